@@ -2,14 +2,26 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
+
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	// Lowest and Next are the offsets of the log's first record and of the
+	// next record appended to it, when the error was returned.
+	Lowest uint64
+	Next   uint64
 }
 
+// OffsetOutOfRangeReason is the reason of the error info detail of
+// ErrOffsetOutOfRange, whose metadata has the offset and the log's lowest
+// and next offsets.
+const OffsetOutOfRangeReason = "OFFSET_OUT_OF_RANGE"
+
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	st := status.New(
 		404,
@@ -22,13 +34,258 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 		Locale:  "en-US",
 		Message: msg,
 	}
-	std, err := st.WithDetails(d)
+	std, err := st.WithDetails(d, &errdetails.ErrorInfo{
+		Reason: OffsetOutOfRangeReason,
+		Domain: "dislog",
+		Metadata: map[string]string{
+			"offset": strconv.FormatUint(e.Offset, 10),
+			"lowest": strconv.FormatUint(e.Lowest, 10),
+			"next":   strconv.FormatUint(e.Next, 10),
+		},
+	})
 	if err != nil {
 		return st
 	}
 	return std
 }
 
+// Truncated returns whether the offset's record was removed from the log,
+// rather than not appended yet.
+func (e ErrOffsetOutOfRange) Truncated() bool {
+	return e.Offset < e.Lowest
+}
+
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrRecordTooLarge is returned when a produced record is larger than the
+// servers accept.
+type ErrRecordTooLarge struct {
+	// Size is the size of the record in bytes.
+	Size uint64
+	// Max is the size of the largest record the servers accept.
+	Max uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d bytes, max %d", e.Size, e.Max),
+	)
+	std, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field: "record",
+			Description: fmt.Sprintf(
+				"The record is %d bytes, larger than the %d bytes allowed",
+				e.Size,
+				e.Max,
+			),
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrMissingRecord is returned when a produce request has no record.
+type ErrMissingRecord struct{}
+
+func (e ErrMissingRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, "missing record")
+	std, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       "record",
+			Description: "The request has no record to produce",
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrMissingRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrSchemaNotFound is returned when no schema has the ID, or the subject has
+// no such version.
+type ErrSchemaNotFound struct {
+	ID      uint32
+	Subject string
+	// Version is the subject's version, its latest when 0.
+	Version uint32
+}
+
+func (e ErrSchemaNotFound) GRPCStatus() *status.Status {
+	name := fmt.Sprintf("%d", e.ID)
+	if e.ID == 0 {
+		name = fmt.Sprintf("%s/%d", e.Subject, e.Version)
+		if e.Version == 0 {
+			name = e.Subject + "/latest"
+		}
+	}
+	st := status.New(codes.NotFound, "schema not found: "+name)
+	std, err := st.WithDetails(&errdetails.ResourceInfo{
+		ResourceType: "schema",
+		ResourceName: name,
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrSchemaNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownServer is returned by the operations on a server that isn't in
+// the cluster.
+type ErrUnknownServer struct {
+	ID string
+}
+
+func (e ErrUnknownServer) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, "unknown server: "+e.ID)
+	std, err := st.WithDetails(&errdetails.ResourceInfo{
+		ResourceType: "server",
+		ResourceName: e.ID,
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownServer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidSchema is returned when a schema being registered doesn't parse.
+type ErrInvalidSchema struct {
+	Reason string
+}
+
+func (e ErrInvalidSchema) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, "invalid schema: "+e.Reason)
+	std, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       "definition",
+			Description: e.Reason,
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrIncompatibleSchema is returned when a schema being registered isn't
+// compatible with the latest version of its subject.
+type ErrIncompatibleSchema struct {
+	Subject       string
+	Compatibility Compatibility
+	Reason        string
+}
+
+func (e ErrIncompatibleSchema) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"schema not %s compatible with %s: %s",
+			e.Compatibility,
+			e.Subject,
+			e.Reason,
+		),
+	)
+	std, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        e.Compatibility.String(),
+			Subject:     e.Subject,
+			Description: e.Reason,
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrIncompatibleSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidRecord is returned when a produced record doesn't have a schema
+// of the log's subject or its value doesn't validate against it.
+type ErrInvalidRecord struct {
+	// Field is the field of the record that's invalid.
+	Field  string
+	Reason string
+}
+
+func (e ErrInvalidRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, "invalid record: "+e.Reason)
+	std, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       e.Field,
+			Description: e.Reason,
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned when a server that isn't the leader is asked to
+// apply a command, which clients retry on the leader.
+type ErrNotLeader struct {
+	// Leader is the address of the leader, empty if the server doesn't
+	// know it.
+	Leader string
+	// Err is Raft's error.
+	Err error
+}
+
+// NotLeaderReason is the reason of the error info detail of ErrNotLeader.
+const NotLeaderReason = "NOT_LEADER"
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	msg := "not the leader"
+	if e.Leader != "" {
+		msg = fmt.Sprintf("not the leader, %s is", e.Leader)
+	}
+	st := status.New(codes.Unavailable, msg)
+	std, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   NotLeaderReason,
+		Domain:   "dislog",
+		Metadata: map[string]string{"leader": e.Leader},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrNotLeader) Unwrap() error {
+	return e.Err
+}
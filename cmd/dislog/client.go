@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/loadbalance"
+)
+
+// client represents the configuration of the client subcommands.
+type client struct {
+	addr    string
+	output  string
+	timeout time.Duration
+	token   string
+	tls     config.TLSConfig
+	picker  loadbalance.Config
+}
+
+// Output formats of the client subcommands.
+const (
+	outputJSON = "json"
+	outputRaw  = "raw"
+)
+
+// clientCommands returns the subcommands that talk to a running cluster.
+func clientCommands() []*cobra.Command {
+	c := &client{}
+	produce := &cobra.Command{
+		Use:   "produce [file...]",
+		Short: "Produce the files, or each line of stdin, as records.",
+		RunE:  c.produce,
+	}
+	consume := &cobra.Command{
+		Use:   "consume",
+		Short: "Consume records from an offset.",
+		RunE:  c.consume,
+	}
+	consume.Flags().Uint64("from", 0, "Offset to consume from.")
+	consume.Flags().Uint64("count",
+		0,
+		"Number of records to consume, 0 consumes to the end of the log.")
+	tail := &cobra.Command{
+		Use:   "tail",
+		Short: "Stream records from an offset as they're produced.",
+		RunE:  c.tail,
+	}
+	tail.Flags().Uint64("from", 0, "Offset to stream from.")
+	servers := &cobra.Command{
+		Use:   "servers",
+		Short: "List the servers of the cluster.",
+		RunE:  c.servers,
+	}
+	cmds := []*cobra.Command{produce, consume, tail, servers}
+	for _, cmd := range cmds {
+		cmd.Flags().String("addr",
+			"127.0.0.1:8400",
+			"RPC address of a server in the cluster.")
+		cmd.Flags().String("output",
+			outputJSON,
+			"Output format, json or raw.")
+		cmd.Flags().Duration("timeout",
+			10*time.Second,
+			"Timeout of each request, tail streams have none.")
+		cmd.Flags().String("token",
+			"",
+			"Bearer token to authenticate with instead of a certificate, "+
+				"which needs TLS.")
+		cmd.Flags().String("strategy",
+			string(loadbalance.RoundRobin),
+			"How requests pick among the servers, round_robin or "+
+				"least_outstanding.")
+		cmd.Flags().String("zone",
+			"",
+			"Zone or region of the client, whose servers are preferred.")
+		cmd.PreRunE = c.setupConfig
+	}
+	return cmds
+}
+
+// setupConfig reads the flags of the subcommand and the TLS flags shared
+// with the agent.
+func (c *client) setupConfig(cmd *cobra.Command, args []string) error {
+	// the usage doesn't help once the flags have been parsed
+	cmd.SilenceUsage = true
+	var err error
+	if c.addr, err = cmd.Flags().GetString("addr"); err != nil {
+		return err
+	}
+	if c.output, err = cmd.Flags().GetString("output"); err != nil {
+		return err
+	}
+	if c.output != outputJSON && c.output != outputRaw {
+		return fmt.Errorf("unknown output format: %s", c.output)
+	}
+	if c.timeout, err = cmd.Flags().GetDuration("timeout"); err != nil {
+		return err
+	}
+	if c.token, err = cmd.Flags().GetString("token"); err != nil {
+		return err
+	}
+	strategy, err := cmd.Flags().GetString("strategy")
+	if err != nil {
+		return err
+	}
+	c.picker.Strategy = loadbalance.Strategy(strategy)
+	if c.picker.Zone, err = cmd.Flags().GetString("zone"); err != nil {
+		return err
+	}
+	c.tls.CertFile = viper.GetString("peer-tls-cert-file")
+	c.tls.KeyFile = viper.GetString("peer-tls-key-file")
+	c.tls.CAFile = viper.GetString("peer-tls-ca-file")
+	return nil
+}
+
+// dial connects to the cluster through the proglog resolver, so produces go
+// to the leader and consumes to the followers.
+func (c *client) dial() (*grpc.ClientConn, error) {
+	var opts []grpc.DialOption
+	if c.tls.CAFile != "" || c.tls.CertFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(c.tls)
+		if err != nil {
+			return nil, err
+		}
+		creds := credentials.NewTLS(tlsConfig)
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if c.token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearer(c.token)))
+	}
+	return grpc.Dial(loadbalance.Target(c.addr, c.picker), opts...)
+}
+
+// bearer authenticates the requests with a bearer token.
+type bearer string
+
+// GetRequestMetadata returns the authorization metadata of the token.
+func (b bearer) GetRequestMetadata(
+	context.Context,
+	...string,
+) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+// RequireTransportSecurity requires TLS, as the token would otherwise be
+// sent in the clear.
+func (bearer) RequireTransportSecurity() bool {
+	return true
+}
+
+// produce produces each file given as an argument as a record, or each line
+// of stdin if there are none, and prints their offsets.
+func (c *client) produce(cmd *cobra.Command, args []string) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	send := func(value []byte) error {
+		ctx, cancel := context.WithTimeout(cmd.Context(), c.timeout)
+		defer cancel()
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value},
+		})
+		if err != nil {
+			return err
+		}
+		return printProduced(cmd.OutOrStdout(), c.output, res)
+	}
+
+	if len(args) == 0 {
+		return readLines(cmd.InOrStdin(), send)
+	}
+	for _, file := range args {
+		value, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err = send(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consume prints the records from the given offset until it has consumed the
+// given number of them or reached the end of the log.
+func (c *client) consume(cmd *cobra.Command, args []string) error {
+	from, err := cmd.Flags().GetUint64("from")
+	if err != nil {
+		return err
+	}
+	count, err := cmd.Flags().GetUint64("count")
+	if err != nil {
+		return err
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	for off := from; count == 0 || off < from+count; off++ {
+		ctx, cancel := context.WithTimeout(cmd.Context(), c.timeout)
+		res, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: off,
+		})
+		cancel()
+		if err != nil {
+			// reaching the end of the log isn't an error unless the
+			// caller asked for more records than there are, while
+			// starting before the log's first record is
+			if count == 0 && isOffsetOutOfRange(err) && !isTruncated(err) {
+				return nil
+			}
+			return err
+		}
+		if err = printRecord(cmd.OutOrStdout(), c.output, res.Record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tail prints the records from the given offset as they're produced until
+// it's interrupted.
+func (c *client) tail(cmd *cobra.Command, args []string) error {
+	from, err := cmd.Flags().GetUint64("from")
+	if err != nil {
+		return err
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	ctx, stop := signal.NotifyContext(
+		cmd.Context(),
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+	defer stop()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset: from,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF || status.Code(err) == codes.Canceled {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = printRecord(cmd.OutOrStdout(), c.output, res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+// servers prints the servers of the cluster.
+func (c *client) servers(cmd *cobra.Command, args []string) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx, cancel := context.WithTimeout(cmd.Context(), c.timeout)
+	defer cancel()
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return err
+	}
+	for _, server := range res.Servers {
+		if err = printServer(cmd.OutOrStdout(), c.output, server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLines calls fn with each line read, without its line ending, which may
+// be \n or \r\n. The last line needn't end in one.
+func readLines(r io.Reader, fn func(line []byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 {
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// printProduced prints the response to a produce as JSON, or its offset if
+// the output is raw.
+func printProduced(w io.Writer, output string, res *api.ProduceResponse) error {
+	if output == outputRaw {
+		_, err := fmt.Fprintln(w, res.Offset)
+		return err
+	}
+	return printJSON(w, res)
+}
+
+// printServer prints the server as JSON, or as a tab separated line of its
+// ID, address, leadership, role and suffrage if the output is raw.
+func printServer(w io.Writer, output string, server *api.Server) error {
+	if output == outputRaw {
+		_, err := fmt.Fprintf(
+			w,
+			"%s\t%s\t%t\t%s\t%s\n",
+			server.Id,
+			server.RpcAddr,
+			server.IsLeader,
+			server.Role,
+			server.Suffrage,
+		)
+		return err
+	}
+	return printJSON(w, server)
+}
+
+// printRecord prints the record as JSON, or its value if the output is raw.
+func printRecord(w io.Writer, output string, record *api.Record) error {
+	if output == outputRaw {
+		_, err := fmt.Fprintf(w, "%s\n", record.Value)
+		return err
+	}
+	return printJSON(w, record)
+}
+
+// printJSON prints the message as a line of JSON.
+func printJSON(w io.Writer, m proto.Message) error {
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// isOffsetOutOfRange checks whether the error is api.ErrOffsetOutOfRange
+// returned by a server.
+func isOffsetOutOfRange(err error) bool {
+	want := api.ErrOffsetOutOfRange{}.GRPCStatus().Code()
+	return status.Code(err) == want
+}
+
+// isTruncated checks whether the error is api.ErrOffsetOutOfRange of an
+// offset whose record was removed from the log, from its error info detail.
+func isTruncated(err error) bool {
+	for _, detail := range status.Convert(err).Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != api.OffsetOutOfRangeReason {
+			continue
+		}
+		offset, err := strconv.ParseUint(info.Metadata["offset"], 10, 64)
+		if err != nil {
+			return false
+		}
+		lowest, err := strconv.ParseUint(info.Metadata["lowest"], 10, 64)
+		if err != nil {
+			return false
+		}
+		return api.ErrOffsetOutOfRange{Offset: offset, Lowest: lowest}.Truncated()
+	}
+	return false
+}
+
+// exitCode maps the error to the exit code of the program: the gRPC status
+// code of errors returned by the cluster, and 1 for any other error.
+func exitCode(err error) int {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return 1
+	}
+	code := grpcErr.GRPCStatus().Code()
+	if isOffsetOutOfRange(err) {
+		code = codes.OutOfRange
+	}
+	if code == codes.OK || code > codes.Unauthenticated {
+		return 1
+	}
+	return int(code)
+}
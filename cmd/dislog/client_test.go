@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+func TestExitCode(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		err  error
+		want int
+	}{
+		"local error":   {errors.New("no such file"), 1},
+		"status error":  {status.Error(codes.NotFound, "not found"), 5},
+		"wrapped error": {fmt.Errorf("consume: %w", status.Error(codes.PermissionDenied, "denied")), 7},
+		"not leader":    {api.ErrNotLeader{Leader: "1"}, 14},
+		"offset out of range": {
+			api.ErrOffsetOutOfRange{Offset: 3},
+			int(codes.OutOfRange),
+		},
+		"offset out of range from the wire": {
+			status.Error(404, "offset out of range: 3"),
+			int(codes.OutOfRange),
+		},
+		"unknown code": {status.Error(codes.Code(99), "unknown"), 1},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, tc.want, exitCode(tc.err))
+		})
+	}
+}
+
+func TestIsTruncated(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		err  error
+		want bool
+	}{
+		"end of the log": {
+			api.ErrOffsetOutOfRange{Offset: 3, Lowest: 0, Next: 3},
+			false,
+		},
+		"empty log": {api.ErrOffsetOutOfRange{}, false},
+		"removed record": {
+			api.ErrOffsetOutOfRange{Offset: 1, Lowest: 2, Next: 3},
+			true,
+		},
+		"removed record from the wire": {
+			status.ErrorProto(api.ErrOffsetOutOfRange{
+				Offset: 1,
+				Lowest: 2,
+				Next:   3,
+			}.GRPCStatus().Proto()),
+			true,
+		},
+		"no details": {status.Error(404, "offset out of range: 1"), false},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, tc.want, isTruncated(tc.err))
+		})
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		in   string
+		want []string
+	}{
+		"empty":               {"", nil},
+		"newlines":            {"a\nb\n", []string{"a", "b"}},
+		"carriage returns":    {"a\r\nb\r\n", []string{"a", "b"}},
+		"no final newline":    {"a\nb", []string{"a", "b"}},
+		"empty lines":         {"a\n\n\r\nb\n", []string{"a", "", "", "b"}},
+		"inner carriage ends": {"a\rb\n", []string{"a\rb"}},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			var got []string
+			err := readLines(strings.NewReader(tc.in), func(line []byte) error {
+				got = append(got, string(line))
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	t.Run("stops at error", func(t *testing.T) {
+		want := errors.New("unavailable")
+		calls := 0
+		err := readLines(strings.NewReader("a\nb\n"), func([]byte) error {
+			calls++
+			return want
+		})
+		require.Equal(t, want, err)
+		require.Equal(t, 1, calls)
+	})
+}
+
+func TestPrint(t *testing.T) {
+	record := &api.Record{Value: []byte("hello"), Offset: 2}
+	server := &api.Server{
+		Id:       "1",
+		RpcAddr:  "127.0.0.1:8400",
+		IsLeader: true,
+		Role:     api.Role_NON_VOTER,
+		Suffrage: "Nonvoter",
+	}
+	for scenario, tc := range map[string]struct {
+		print func(w io.Writer, output string) error
+		raw   string
+		json  []string
+	}{
+		"produced": {
+			print: func(w io.Writer, output string) error {
+				return printProduced(w, output, &api.ProduceResponse{Offset: 2})
+			},
+			raw:  "2\n",
+			json: []string{`"offset":"2"`},
+		},
+		"record": {
+			print: func(w io.Writer, output string) error {
+				return printRecord(w, output, record)
+			},
+			raw:  "hello\n",
+			json: []string{`"value":"aGVsbG8="`, `"offset":"2"`},
+		},
+		"server": {
+			print: func(w io.Writer, output string) error {
+				return printServer(w, output, server)
+			},
+			raw: "1\t127.0.0.1:8400\ttrue\tNON_VOTER\tNonvoter\n",
+			json: []string{
+				`"id":"1"`,
+				`"isLeader":true`,
+				`"role":"NON_VOTER"`,
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			var b bytes.Buffer
+			require.NoError(t, tc.print(&b, outputRaw))
+			require.Equal(t, tc.raw, b.String())
+
+			b.Reset()
+			require.NoError(t, tc.print(&b, outputJSON))
+			out := b.String()
+			require.True(t, strings.HasSuffix(out, "\n"))
+			require.Equal(t, 1, strings.Count(out, "\n"), "one line each")
+			compact := strings.ReplaceAll(out, " ", "")
+			for _, want := range tc.json {
+				require.Contains(t, compact, want)
+			}
+		})
+	}
+}
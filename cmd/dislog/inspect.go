@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/log"
+)
+
+// inspectCommand returns the command that inspects and repairs the segments
+// of a log directory, the log/ or raft/log directory in the data directory of
+// a stopped server.
+func inspectCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Inspect and repair the log of a stopped server.",
+	}
+	segments := &cobra.Command{
+		Use:   "segments DIR",
+		Short: "List the segments of the log.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  inspectSegments,
+	}
+	dump := &cobra.Command{
+		Use:   "dump DIR",
+		Short: "Print the records of the log in an offset range.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  inspectDump,
+	}
+	dump.Flags().Uint64("from", 0, "Offset to print from.")
+	dump.Flags().Uint64("to", math.MaxUint64, "Offset to print up to.")
+	verify := &cobra.Command{
+		Use:   "verify DIR",
+		Short: "Check that every index entry points to a valid store frame.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  inspectVerify,
+	}
+	rebuild := &cobra.Command{
+		Use:   "rebuild-index DIR BASE_OFFSET",
+		Short: "Rebuild the index of a segment from its store.",
+		Args:  cobra.ExactArgs(2),
+		RunE:  inspectRebuildIndex,
+	}
+	for _, c := range []*cobra.Command{segments, dump, verify, rebuild} {
+		c.PreRun = silenceUsage
+	}
+	for _, c := range []*cobra.Command{segments, dump} {
+		c.Flags().String("output",
+			outputJSON,
+			"Output format, json or raw.")
+	}
+	cmd.AddCommand(segments, dump, verify, rebuild)
+	return cmd
+}
+
+// silenceUsage stops printing the usage once the arguments have been parsed,
+// as it doesn't help with the errors of reading the log.
+func silenceUsage(cmd *cobra.Command, args []string) {
+	cmd.SilenceUsage = true
+}
+
+// inspectSegments lists the base and next offsets and the store and index
+// sizes of each segment. Records carry no timestamps, so none are listed.
+func inspectSegments(cmd *cobra.Command, args []string) error {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	segments, err := log.InspectSegments(args[0])
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if output == outputRaw {
+			_, err = fmt.Fprintf(
+				cmd.OutOrStdout(),
+				"%d\t%d\t%d\t%d\n",
+				s.BaseOffset,
+				s.NextOffset,
+				s.StoreBytes,
+				s.IndexBytes,
+			)
+		} else {
+			err = printJSON(cmd.OutOrStdout(), s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectDump prints the records in the offset range.
+func inspectDump(cmd *cobra.Command, args []string) error {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	from, err := cmd.Flags().GetUint64("from")
+	if err != nil {
+		return err
+	}
+	to, err := cmd.Flags().GetUint64("to")
+	if err != nil {
+		return err
+	}
+	return log.ReadRange(args[0], from, to, func(record *api.Record) error {
+		return printRecord(cmd.OutOrStdout(), output, record)
+	})
+}
+
+// inspectVerify prints the corruptions of the log and fails if it found any.
+func inspectVerify(cmd *cobra.Command, args []string) error {
+	corruptions, err := log.Verify(args[0])
+	if err != nil {
+		return err
+	}
+	for _, c := range corruptions {
+		if _, err = fmt.Fprintln(cmd.OutOrStdout(), c); err != nil {
+			return err
+		}
+	}
+	if len(corruptions) != 0 {
+		return fmt.Errorf("found %d corruptions", len(corruptions))
+	}
+	return nil
+}
+
+// inspectRebuildIndex rebuilds the index of the segment from its store.
+func inspectRebuildIndex(cmd *cobra.Command, args []string) error {
+	baseOffset, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	entries, err := log.RebuildIndex(args[0], baseOffset)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(
+		cmd.OutOrStdout(),
+		"rebuilt index of segment %d with %d entries\n",
+		baseOffset,
+		entries,
+	)
+	return err
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"github.com/pouriaamini/proglog/internal/agent"
 	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 )
 
 // main is the entry point of the dislog CLI.
@@ -28,15 +30,22 @@ func main() {
 	if err := setupFlags(cmd); err != nil {
 		log.Fatal(err)
 	}
+	cmd.AddCommand(clientCommands()...)
+	cmd.AddCommand(inspectCommand())
 
 	if err := cmd.Execute(); err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		os.Exit(exitCode(err))
 	}
 }
 
 // cli represents the CLI configuration.
 type cli struct {
 	cfg cfg
+	// serverTLS and peerTLS reload the certificates of the TLS
+	// configurations, nil if they aren't configured.
+	serverTLS *config.TLSReloader
+	peerTLS   *config.TLSReloader
 }
 
 // cfg represents the configuration of the dislog agent.
@@ -67,26 +76,156 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().Int("rpc-port",
 		8400,
 		"Port for RPC clients (and Raft) connections.")
+	cmd.Flags().Int("http-port",
+		8402,
+		"Port for the HTTP server exposing Prometheus metrics and the "+
+			"health probes, 0 disables it.")
+	cmd.Flags().Int("rest-port",
+		8403,
+		"Port for the REST API over the log, using the server's TLS, "+
+			"0 disables it.")
+	cmd.Flags().String("topic",
+		"dislog",
+		"Name of the log, as a topic in the ACL policy and to Kafka clients.")
+	cmd.Flags().Bool("kafka",
+		false,
+		"Serve Kafka clients on the RPC port, in plaintext and "+
+			"unauthenticated, with --kafka-insecure.")
+	cmd.Flags().Bool("kafka-insecure",
+		false,
+		"Accept that Kafka clients connect without TLS or authentication, "+
+			"which --kafka needs.")
+	cmd.Flags().String("kafka-subject",
+		"kafka",
+		"ACL subject Kafka clients are authorized as.")
+	cmd.Flags().Uint64("max-record-bytes",
+		1<<20,
+		"Size of the largest record clients may produce, 0 for no limit.")
+	cmd.Flags().Uint64("max-batch-bytes",
+		4<<20,
+		"Size of the largest batch of records Kafka clients may produce, "+
+			"0 for no limit.")
+	cmd.Flags().Int("max-server-watches",
+		1024,
+		"Most WatchServers streams served at once, 0 for no limit.")
+	cmd.Flags().String("schema-subject",
+		"",
+		"Subject of the registered schemas the records produced must have "+
+			"and validate against, empty to accept any record.")
+	cmd.Flags().Uint64("ready-max-apply-lag",
+		1000,
+		"Committed entries left to apply past which the server isn't ready.")
+	cmd.Flags().Duration("ready-max-last-contact",
+		10*time.Second,
+		"Time without hearing from the leader past which a follower isn't "+
+			"ready.")
+	cmd.Flags().Uint64("ready-min-free-bytes",
+		64<<20,
+		"Free disk space of the data directory below which the server isn't "+
+			"ready.")
+	cmd.Flags().Duration("autopilot-stabilization-time",
+		10*time.Second,
+		"Time a new server must be healthy before it's promoted to a voter.")
+	cmd.Flags().Duration("autopilot-dead-server-timeout",
+		5*time.Minute,
+		"Time a server must be failed before it's removed from the cluster.")
+	cmd.Flags().Int("autopilot-min-quorum",
+		0,
+		"Fewest voters removing the failed servers leaves in the cluster.")
+	cmd.Flags().Float64("trace-sample-ratio",
+		0.01,
+		"Fraction of requests traced, from 0 to 1.")
+	cmd.Flags().String("trace-exporter",
+		tracing.ExporterNone,
+		"Where sampled traces go: none, otlp or file.")
+	cmd.Flags().String("trace-otlp-endpoint",
+		"127.0.0.1:4317",
+		"Address of the collector receiving traces with OTLP over gRPC.")
+	cmd.Flags().String("trace-file",
+		"",
+		"File the file exporter appends traces to, stderr if empty.")
 	cmd.Flags().StringSlice("start-join-addrs",
 		nil,
 		"Serf addresses to join.")
+	cmd.Flags().String("discovery",
+		"serf",
+		"How servers discover each other: serf, static or dns.")
+	cmd.Flags().StringSlice("static-peers",
+		nil,
+		"Servers of the static discovery, as name=rpc_addr.")
+	cmd.Flags().String("dns-name",
+		"",
+		"SRV records, or host with --dns-port, the dns discovery looks up.")
+	cmd.Flags().Int("dns-port",
+		0,
+		"RPC port of the host's addresses, 0 looks up SRV records.")
+	cmd.Flags().String("gossip-keyring-file",
+		"",
+		"Path to a JSON list of base64 keys encrypting the gossip, "+
+			"the first being the primary key.")
+	cmd.Flags().StringSlice("allowed-nodes",
+		nil,
+		"Names of the only nodes that may join the cluster.")
+	cmd.Flags().String("join-token",
+		"",
+		"Token nodes must have to join the cluster.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Int("bootstrap-expect",
+		0,
+		"Number of voters that bootstrap the cluster once they all gossip.")
+	cmd.Flags().Bool("non-voter",
+		false,
+		"Join the cluster as a read replica that doesn't vote.")
+	cmd.Flags().String("zone",
+		"",
+		"Zone or region the server runs in, which clients may prefer.")
 
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
-	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
+	cmd.Flags().String("acl-policy-file",
+		"",
+		"Path to ACL policy, reloaded when it changes or on SIGHUP.")
+	cmd.Flags().String("auth-tokens-file",
+		"",
+		"Path to a CSV file of bearer tokens and their subjects clients may "+
+			"authenticate with, reloaded on SIGHUP.")
+	cmd.Flags().String("auth-jwks-file",
+		"",
+		"Path to the JWKS verifying the bearer JWTs clients may authenticate "+
+			"with, reloaded on SIGHUP.")
+	cmd.Flags().String("auth-jwt-issuer", "", "Issuer JWTs must have.")
+	cmd.Flags().String("auth-jwt-audience", "", "Audience JWTs must have.")
+	cmd.Flags().String("auth-jwt-subject-claim",
+		"sub",
+		"Claim of JWTs holding the subject.")
+	cmd.Flags().Duration("auth-jwt-leeway",
+		time.Minute,
+		"Clock skew allowed checking the times of JWTs.")
+	cmd.Flags().String("quota-file",
+		"",
+		"Path to a CSV file of the rates subjects may produce and consume "+
+			"at, reloaded when it changes or on SIGHUP.")
 
+	// the tls files are reloaded when they change or on SIGHUP
 	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert.")
 	cmd.Flags().String("server-tls-key-file", "", "Path to server tls key.")
 	cmd.Flags().String("server-tls-ca-file",
 		"",
 		"Path to server certificate authority.")
 
-	cmd.Flags().String("peer-tls-cert-file", "", "Path to peer tls cert.")
-	cmd.Flags().String("peer-tls-key-file", "", "Path to peer tls key.")
-	cmd.Flags().String("peer-tls-ca-file",
+	// the peer tls flags are shared with the client subcommands
+	cmd.PersistentFlags().String("peer-tls-cert-file",
+		"",
+		"Path to peer tls cert.")
+	cmd.PersistentFlags().String("peer-tls-key-file",
+		"",
+		"Path to peer tls key.")
+	cmd.PersistentFlags().String("peer-tls-ca-file",
 		"",
 		"Path to peer certificate authority.")
 
+	if err := viper.BindPFlags(cmd.PersistentFlags()); err != nil {
+		return err
+	}
 	return viper.BindPFlags(cmd.Flags())
 }
 
@@ -113,10 +252,51 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.NodeName = viper.GetString("node-name")
 	c.cfg.BindAddr = viper.GetString("bind-addr")
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
+	c.cfg.HTTPPort = viper.GetInt("http-port")
+	c.cfg.RESTPort = viper.GetInt("rest-port")
+	c.cfg.Topic = viper.GetString("topic")
+	c.cfg.Kafka = viper.GetBool("kafka")
+	c.cfg.KafkaInsecure = viper.GetBool("kafka-insecure")
+	c.cfg.KafkaSubject = viper.GetString("kafka-subject")
+	c.cfg.MaxRecordBytes = viper.GetUint64("max-record-bytes")
+	c.cfg.MaxBatchBytes = viper.GetUint64("max-batch-bytes")
+	c.cfg.MaxServerWatches = viper.GetInt("max-server-watches")
+	c.cfg.SchemaSubject = viper.GetString("schema-subject")
+	c.cfg.Health.MaxApplyLag = viper.GetUint64("ready-max-apply-lag")
+	c.cfg.Health.MaxLastContact = viper.GetDuration("ready-max-last-contact")
+	c.cfg.Health.MinFreeBytes = viper.GetUint64("ready-min-free-bytes")
+	c.cfg.Autopilot.ServerStabilizationTime = viper.GetDuration(
+		"autopilot-stabilization-time",
+	)
+	c.cfg.Autopilot.DeadServerTimeout = viper.GetDuration(
+		"autopilot-dead-server-timeout",
+	)
+	c.cfg.Autopilot.MinQuorum = viper.GetInt("autopilot-min-quorum")
+	c.cfg.Tracing.SampleRatio = viper.GetFloat64("trace-sample-ratio")
+	c.cfg.Tracing.Exporter = viper.GetString("trace-exporter")
+	c.cfg.Tracing.OTLPEndpoint = viper.GetString("trace-otlp-endpoint")
+	c.cfg.Tracing.File = viper.GetString("trace-file")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
+	c.cfg.Discovery = viper.GetString("discovery")
+	c.cfg.StaticPeers = viper.GetStringSlice("static-peers")
+	c.cfg.DNSName = viper.GetString("dns-name")
+	c.cfg.DNSPort = viper.GetInt("dns-port")
+	c.cfg.GossipKeyringFile = viper.GetString("gossip-keyring-file")
+	c.cfg.AllowedNodes = viper.GetStringSlice("allowed-nodes")
+	c.cfg.JoinToken = viper.GetString("join-token")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
-	c.cfg.ACLModelFile = viper.GetString("acl-mode-file")
+	c.cfg.BootstrapExpect = viper.GetInt("bootstrap-expect")
+	c.cfg.NonVoter = viper.GetBool("non-voter")
+	c.cfg.Zone = viper.GetString("zone")
+	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
+	c.cfg.TokensFile = viper.GetString("auth-tokens-file")
+	c.cfg.QuotaFile = viper.GetString("quota-file")
+	c.cfg.JWT.JWKSFile = viper.GetString("auth-jwks-file")
+	c.cfg.JWT.Issuer = viper.GetString("auth-jwt-issuer")
+	c.cfg.JWT.Audience = viper.GetString("auth-jwt-audience")
+	c.cfg.JWT.SubjectClaim = viper.GetString("auth-jwt-subject-claim")
+	c.cfg.JWT.Leeway = viper.GetDuration("auth-jwt-leeway")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
 	c.cfg.ServerTLSConfig.KeyFile = viper.GetString("server-tls-key-file")
 	c.cfg.ServerTLSConfig.CAFile = viper.GetString("server-tls-ca-file")
@@ -127,22 +307,20 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	if c.cfg.ServerTLSConfig.CertFile != "" &&
 		c.cfg.ServerTLSConfig.KeyFile != "" {
 		c.cfg.ServerTLSConfig.Server = true
-		c.cfg.Config.ServerTLSConfig, err = config.SetupTLSConfig(
-			c.cfg.ServerTLSConfig,
-		)
+		c.serverTLS, err = config.NewTLSReloader(c.cfg.ServerTLSConfig)
 		if err != nil {
 			return err
 		}
+		c.cfg.Config.ServerTLSConfig = c.serverTLS.TLSConfig()
 	}
 
 	if c.cfg.PeerTLSConfig.CertFile != "" &&
 		c.cfg.PeerTLSConfig.KeyFile != "" {
-		c.cfg.Config.PeerTLSConfig, err = config.SetupTLSConfig(
-			c.cfg.PeerTLSConfig,
-		)
+		c.peerTLS, err = config.NewTLSReloader(c.cfg.PeerTLSConfig)
 		if err != nil {
 			return err
 		}
+		c.cfg.Config.PeerTLSConfig = c.peerTLS.TLSConfig()
 	}
 
 	return nil
@@ -155,8 +333,43 @@ func (c *cli) run(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	reloaders := c.tlsReloaders()
+	for _, r := range reloaders {
+		if err = r.Watch(); err != nil {
+			return err
+		}
+	}
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	<-sigc
-	return agent.Shutdown()
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigc {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// the agent and reloaders keep the current policy and certificates
+		// if the new ones fail to load
+		if err := agent.Reload(); err != nil {
+			log.Printf("failed to reload: %v", err)
+		}
+		for _, r := range reloaders {
+			if err := r.Reload(); err != nil {
+				log.Printf("failed to reload TLS files: %v", err)
+			}
+		}
+	}
+	err = agent.Shutdown()
+	for _, r := range reloaders {
+		r.Close()
+	}
+	return err
+}
+
+// tlsReloaders returns the configured TLS reloaders.
+func (c *cli) tlsReloaders() []*config.TLSReloader {
+	var reloaders []*config.TLSReloader
+	for _, r := range []*config.TLSReloader{c.serverTLS, c.peerTLS} {
+		if r != nil {
+			reloaders = append(reloaders, r)
+		}
+	}
+	return reloaders
 }
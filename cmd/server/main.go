@@ -1,11 +0,0 @@
-package main
-
-import (
-	"github.com/pouriaamini/proglog/internal/server"
-	"log"
-)
-
-func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
-}
@@ -5,24 +5,37 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/hashicorp/raft"
 
 	"github.com/soheilhy/cmux"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	api "github.com/pouriaamini/proglog/api/v1"
 	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/autopilot"
 	"github.com/pouriaamini/proglog/internal/discovery"
+	"github.com/pouriaamini/proglog/internal/kafka"
 	"github.com/pouriaamini/proglog/internal/log"
+	"github.com/pouriaamini/proglog/internal/quota"
 	"github.com/pouriaamini/proglog/internal/server"
+	"github.com/pouriaamini/proglog/internal/tracing"
 )
 
 // Agent is a struct that implements the Proglog agent.
@@ -34,8 +47,19 @@ type Agent struct {
 
 	mux        cmux.CMux
 	log        *log.DistributedLog
+	autopilot  *autopilot.Autopilot
+	authorizer *auth.Authorizer
+	authn      auth.Chain
+	quotas     *quota.Quotas
 	server     *grpc.Server
-	membership *discovery.Membership
+	health     *health.Server
+	membership discovery.Provider
+	http       *http.Server
+	rest       *http.Server
+	kafka      *kafka.Server
+	tracing    func() error
+	// notReady is why the log was last found not ready, empty if it was.
+	notReady string
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -58,12 +82,105 @@ type Config struct {
 	NodeName string
 	// StartJoinAddrs is the initial list of nodes to join.
 	StartJoinAddrs []string
+	// Discovery is the provider discovering the nodes of the cluster:
+	// discovery.ProviderSerf, the default, ProviderStatic or ProviderDNS.
+	Discovery string
+	// StaticPeers are the nodes the static provider joins, as
+	// name=rpc_addr.
+	StaticPeers []string
+	// DNSName and DNSPort are the SRV records, without the port, or the
+	// host, with it, the DNS provider looks the nodes up by.
+	DNSName string
+	DNSPort int
 	// ACLModelFile is the path to the model file for ACL.
 	ACLModelFile string
-	// ACLPolicyFile is the path to the policy file for ACL.
+	// ACLPolicyFile is the path to the policy file for ACL, which is
+	// reloaded when it changes.
 	ACLPolicyFile string
 	// Bootstrap is a flag to bootstrap the Raft cluster.
 	Bootstrap bool
+	// BootstrapExpect, if set, is the number of voters that bootstrap the
+	// cluster together once they all gossip, instead of a single one
+	// bootstrapping it. It needs the Serf discovery provider, and is ignored
+	// by the servers that have Raft state.
+	BootstrapExpect int
+	// NonVoter is a flag to join the cluster as a read replica that gets
+	// the replicated log but doesn't vote in elections or commits.
+	NonVoter bool
+	// GossipKeyringFile is the path to a JSON list of the base64 encoded
+	// keys encrypting the gossip of the members, the first of which is the
+	// primary key. The keys installed and removed through the admin service
+	// are written back to it. Empty leaves the gossip unencrypted.
+	GossipKeyringFile string
+	// AllowedNodes, if set, are the names of the only nodes that may join
+	// the cluster.
+	AllowedNodes []string
+	// JoinToken, if set, is the token nodes must gossip to join the
+	// cluster, which they all need.
+	JoinToken string
+	// Autopilot sets how the leader promotes the new voters once they're
+	// stable and removes the failed servers.
+	Autopilot autopilot.Config
+	// Zone is the zone or region the node runs in, which clients may prefer
+	// the servers of.
+	Zone string
+	// HTTPPort is the port the HTTP server exposing the Prometheus metrics
+	// on /metrics will listen on, 0 disables it.
+	HTTPPort int
+	// RESTPort is the port the REST API over the log will listen on, with
+	// the server's TLS configuration, 0 disables it.
+	RESTPort int
+	// TokensFile is the path to a CSV file of static bearer tokens clients
+	// may authenticate with instead of certificates, each followed by the
+	// subject it authenticates. Empty disables them.
+	TokensFile string
+	// JWT verifies the bearer JWTs clients may authenticate with instead of
+	// certificates. An empty JWKSFile disables them.
+	JWT auth.JWTConfig
+	// QuotaFile is the path to a CSV file of the rates each subject may
+	// produce and consume at, which is reloaded when it changes. Empty
+	// disables quotas.
+	QuotaFile string
+	// Topic is the name of the log, which the ACL policy grants access to
+	// as a topic and Kafka clients know it by.
+	Topic string
+	// Kafka is a flag to serve Kafka clients on the RPC port, in plaintext,
+	// with the log as a topic with a single partition.
+	Kafka bool
+	// KafkaInsecure acknowledges that Kafka clients connect without TLS or
+	// authentication, bypassing the certificates, tokens and JWTs the other
+	// clients need. The agent refuses to serve Kafka clients without it.
+	KafkaInsecure bool
+	// KafkaSubject is the ACL subject Kafka clients are authorized as.
+	KafkaSubject string
+	// MaxRecordBytes is the size of the largest record clients may produce,
+	// and MaxBatchBytes of the largest batch Kafka clients may. Zero doesn't
+	// limit them.
+	MaxRecordBytes uint64
+	MaxBatchBytes  uint64
+	// MaxServerWatches is the most WatchServers streams the server serves
+	// at once, which clients open without authenticating. Zero doesn't limit
+	// them.
+	MaxServerWatches int
+	// SchemaSubject is the subject of the registered schemas the records
+	// produced to the topic must have and validate against. Empty accepts
+	// any record. Kafka records carry their schema IDs in their schema_id
+	// header.
+	SchemaSubject string
+	// Health sets when the server stops being ready to serve the log,
+	// which it reports through the gRPC health service and on /readyz.
+	Health log.HealthConfig
+	// Tracing configures how the spans of requests, the log and Raft are
+	// sampled and exported.
+	Tracing tracing.Config
+}
+
+// Role returns the role the node joins the Raft cluster with.
+func (c Config) Role() api.Role {
+	if c.NonVoter {
+		return api.Role_NON_VOTER
+	}
+	return api.Role_VOTER
 }
 
 // RPCAddr returns the address of the RPC endpoint.
@@ -75,6 +192,16 @@ func (c Config) RPCAddr() (string, error) {
 	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
 }
 
+// RESTAddr returns the address of the agent's REST API, on the host of its
+// bind address.
+func (c Config) RESTAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, c.RESTPort), nil
+}
+
 // New creates a new instance of the agent with the given configuration.
 func New(config Config) (*Agent, error) {
 	a := &Agent{
@@ -83,13 +210,23 @@ func New(config Config) (*Agent, error) {
 	}
 	setup := []func() error{
 		a.setupLogger,
+		a.setupTracing,
 		a.setupMux,
 		a.setupLog,
+		a.setupAutopilot,
+		a.setupHealth,
+		a.setupAuth,
+		a.setupQuotas,
 		a.setupServer,
 		a.setupMembership,
+		a.setupBootstrap,
+		a.setupHTTP,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
+			// shut down what was set up, so the log's data directory
+			// and the agent's ports are released
+			_ = a.Shutdown()
 			return nil, err
 		}
 	}
@@ -107,6 +244,18 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
+// setupTracing applies the sampler and registers the exporter of the
+// agent's tracing configuration.
+func (a *Agent) setupTracing() error {
+	c := a.Config.Tracing
+	if c.NodeName == "" {
+		c.NodeName = a.Config.NodeName
+	}
+	var err error
+	a.tracing, err = tracing.Setup(c)
+	return err
+}
+
 // setupMux sets up the multiplexer for the agent.
 func (a *Agent) setupMux() error {
 	//addr, err := net.ResolveTCPAddr("tcp", a.Config.BindAddr)
@@ -132,6 +281,17 @@ func (a *Agent) setupMux() error {
 // agent's configuration. It also waits for a leader if bootstrap is set to
 // true in the configuration.
 func (a *Agent) setupLog() error {
+	bootstrap := a.Config.Bootstrap || a.Config.BootstrapExpect != 0
+	if bootstrap && a.Config.NonVoter {
+		return fmt.Errorf("a non-voter can't bootstrap the cluster")
+	}
+	if a.Config.Bootstrap && a.Config.BootstrapExpect != 0 {
+		return fmt.Errorf("bootstrap and bootstrap-expect are exclusive")
+	}
+	if a.Config.BootstrapExpect != 0 && a.Config.Discovery != "" &&
+		a.Config.Discovery != discovery.ProviderSerf {
+		return fmt.Errorf("bootstrap-expect needs the serf discovery provider")
+	}
 	raftLn := a.mux.Match(func(reader io.Reader) bool {
 		b := make([]byte, 1)
 		if _, err := reader.Read(b); err != nil {
@@ -166,22 +326,247 @@ func (a *Agent) setupLog() error {
 	return err
 }
 
+// setupAutopilot function sets up the autopilot managing the servers of the
+// log's cluster, which handles the nodes the membership discovers.
+func (a *Agent) setupAutopilot() error {
+	a.autopilot = autopilot.New(a.log, a.Config.Autopilot)
+	return nil
+}
+
+// healthInterval is how often the agent checks the log to update the
+// statuses of its health server.
+const healthInterval = time.Second
+
+// serverWatcher watches the log's servers until the agent shuts down, so the
+// server's graceful stop doesn't wait for the clients' resolvers, which
+// resolve the servers again once their watches end.
+type serverWatcher struct {
+	log       *log.DistributedLog
+	shutdowns <-chan struct{}
+}
+
+func (w *serverWatcher) WatchServers(
+	ctx context.Context,
+	fn func([]*api.Server) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.shutdowns:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return w.log.WatchServers(ctx, fn)
+}
+
+// keyring manages the gossip keys of the agent's membership, which is set up
+// after the server but before the server serves.
+type keyring struct {
+	agent *Agent
+}
+
+// errNoGossip is the error of the keyring of agents whose members don't
+// gossip.
+var errNoGossip = fmt.Errorf("gossip keys need the serf discovery provider")
+
+// serf returns the agent's Serf membership.
+func (k *keyring) serf() (*discovery.Membership, error) {
+	membership, ok := k.agent.membership.(*discovery.Membership)
+	if !ok {
+		return nil, errNoGossip
+	}
+	return membership, nil
+}
+
+func (k *keyring) InstallKey(key string) error {
+	membership, err := k.serf()
+	if err != nil {
+		return err
+	}
+	return membership.InstallKey(key)
+}
+
+func (k *keyring) UseKey(key string) error {
+	membership, err := k.serf()
+	if err != nil {
+		return err
+	}
+	return membership.UseKey(key)
+}
+
+func (k *keyring) RemoveKey(key string) error {
+	membership, err := k.serf()
+	if err != nil {
+		return err
+	}
+	return membership.RemoveKey(key)
+}
+
+func (k *keyring) ListKeys() (map[string]int, map[string]int, int, error) {
+	membership, err := k.serf()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return membership.ListKeys()
+}
+
+// setupHealth function sets up the health server the gRPC server reports
+// through, and keeps its statuses up to date with the state of the log until
+// the agent shuts down. The server and the Admin service are serving as long
+// as Raft runs, while the Log service is only serving when the log is ready.
+func (a *Agent) setupHealth() error {
+	a.health = health.NewServer()
+	a.updateHealth()
+	go func() {
+		ticker := time.NewTicker(healthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.shutdowns:
+				return
+			case <-ticker.C:
+				a.updateHealth()
+			}
+		}
+	}()
+	return nil
+}
+
+// updateHealth sets the statuses of the health server from the state of the
+// log, logging why the log stops being ready.
+func (a *Agent) updateHealth() {
+	liveness := healthpb.HealthCheckResponse_SERVING
+	if err := a.log.Alive(); err != nil {
+		liveness = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	readiness := healthpb.HealthCheckResponse_SERVING
+	var notReady string
+	if err := a.log.Ready(a.Config.Health); err != nil {
+		readiness = healthpb.HealthCheckResponse_NOT_SERVING
+		notReady = err.Error()
+	}
+	if notReady != a.notReady {
+		logger := zap.L().Named("health")
+		if notReady == "" {
+			logger.Info("log is ready")
+		} else {
+			logger.Warn("log isn't ready", zap.String("reason", notReady))
+		}
+		a.notReady = notReady
+	}
+	a.health.SetServingStatus("", liveness)
+	a.health.SetServingStatus(api.Admin_ServiceDesc.ServiceName, liveness)
+	a.health.SetServingStatus(api.Log_ServiceDesc.ServiceName, readiness)
+}
+
+// setupAuth function sets up the authenticators and the authorizer the
+// agent's servers share, reloading the ACL policy whenever its file changes.
+// Clients authenticate with their certificates or, when configured, with
+// static tokens or JWTs.
+func (a *Agent) setupAuth() error {
+	a.authn = auth.Chain{auth.TLS{}}
+	if a.Config.TokensFile != "" {
+		tokens, err := auth.NewTokens(a.Config.TokensFile)
+		if err != nil {
+			return err
+		}
+		a.authn = append(a.authn, tokens)
+	}
+	if a.Config.JWT.JWKSFile != "" {
+		jwt, err := auth.NewJWT(a.Config.JWT)
+		if err != nil {
+			return err
+		}
+		a.authn = append(a.authn, jwt)
+	}
+	var err error
+	a.authorizer, err = auth.New(
+		a.Config.ACLModelFile,
+		a.Config.ACLPolicyFile,
+	)
+	if err != nil {
+		return err
+	}
+	return a.authorizer.Watch()
+}
+
+// setupQuotas function sets up the quotas limiting the rates subjects
+// produce and consume at, reloading them whenever their file changes. As
+// produce requests are served by the leader, its produce quotas apply to the
+// whole cluster, while each server applies consume quotas to the reads it
+// serves.
+func (a *Agent) setupQuotas() error {
+	if a.Config.QuotaFile == "" {
+		return nil
+	}
+	var err error
+	a.quotas, err = quota.New(a.Config.QuotaFile)
+	if err != nil {
+		return err
+	}
+	return a.quotas.Watch()
+}
+
+// clientTLSConfig returns the TLS configuration of the servers clients
+// connect to. Clients authenticating with tokens don't have certificates to
+// present, so the servers only verify the certificates clients give, while
+// Raft keeps requiring them of its peers.
+func (a *Agent) clientTLSConfig() *tls.Config {
+	if a.Config.ServerTLSConfig == nil || len(a.authn) == 1 {
+		return a.Config.ServerTLSConfig
+	}
+	tlsConfig := a.Config.ServerTLSConfig.Clone()
+	if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	// configurations reloading their CAs return one for each client, which
+	// must relax the same way
+	if getConfig := tlsConfig.GetConfigForClient; getConfig != nil {
+		tlsConfig.GetConfigForClient = func(
+			hello *tls.ClientHelloInfo,
+		) (*tls.Config, error) {
+			c, err := getConfig(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			if c.ClientAuth == tls.RequireAndVerifyClientCert {
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return c, nil
+		}
+	}
+	return tlsConfig
+}
+
 // setupServer function sets up the gRPC server for the agent by creating a
 // new instance of gRPC server and initializing it with the agent's
 // configuration.
 func (a *Agent) setupServer() error {
-	authorizer := auth.New(
-		a.Config.ACLModelFile,
-		a.Config.ACLPolicyFile,
-	)
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:        a.log,
+		Topic:            a.Config.Topic,
+		Authorizer:       a.authorizer,
+		Authenticator:    a.authn,
+		GetServerer:      a.log,
+		ServerWatcher:    &serverWatcher{log: a.log, shutdowns: a.shutdowns},
+		Administrator:    a.log,
+		Keyring:          &keyring{agent: a},
+		RESTLocator:      &restLocator{agent: a},
+		Autopilot:        a.autopilot,
+		Schemas:          a.log,
+		SchemaSubject:    a.Config.SchemaSubject,
+		Health:           a.health,
+		MaxRecordBytes:   a.Config.MaxRecordBytes,
+		MaxServerWatches: a.Config.MaxServerWatches,
+	}
+	if a.quotas != nil {
+		serverConfig.Quotas = a.quotas
 	}
 	var opts []grpc.ServerOption
-	if a.Config.ServerTLSConfig != nil {
-		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
+	if tlsConfig := a.clientTLSConfig(); tlsConfig != nil {
+		creds := credentials.NewTLS(tlsConfig)
 		opts = append(opts, grpc.Creds(creds))
 	}
 	var err error
@@ -189,32 +574,350 @@ func (a *Agent) setupServer() error {
 	if err != nil {
 		return err
 	}
+	// Kafka requests are matched before the gRPC server takes the rest of
+	// the connections
+	if err = a.setupKafka(); err != nil {
+		return err
+	}
 	grpcLn := a.mux.Match(cmux.Any())
 	go func() {
 		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
-	return err
+	return a.setupREST(serverConfig)
+}
+
+// setupKafka function sets up the Kafka server for the agent, serving the
+// connections on the RPC port that start with a Kafka request. The offsets
+// committed to it are replicated through the log's Raft.
+func (a *Agent) setupKafka() error {
+	if !a.Config.Kafka {
+		return nil
+	}
+	if !a.Config.KafkaInsecure {
+		return fmt.Errorf(
+			"kafka clients connect without tls or authentication, " +
+				"which needs kafka-insecure",
+		)
+	}
+	zap.L().Named("agent").Warn(
+		"serving kafka clients without tls or authentication",
+		zap.String("subject", a.Config.KafkaSubject),
+	)
+	kafkaConfig := kafka.Config{
+		Topic:          a.Config.Topic,
+		NodeName:       a.Config.NodeName,
+		Log:            a.log,
+		Authorizer:     a.authorizer,
+		Subject:        a.Config.KafkaSubject,
+		MaxRecordBytes: a.Config.MaxRecordBytes,
+		MaxBatchBytes:  a.Config.MaxBatchBytes,
+		SchemaSubject:  a.Config.SchemaSubject,
+	}
+	if a.quotas != nil {
+		kafkaConfig.Quotas = a.quotas
+	}
+	var err error
+	a.kafka, err = kafka.NewServer(kafkaConfig)
+	if err != nil {
+		return err
+	}
+	kafkaLn := a.mux.Match(kafka.Match)
+	go func() {
+		if err := a.kafka.Serve(kafkaLn); err != nil {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// setupREST function sets up the REST API for the agent, serving the same
+// log with the same authorizer and TLS configuration as the gRPC server.
+func (a *Agent) setupREST(serverConfig *server.Config) error {
+	if a.Config.RESTPort == 0 {
+		return nil
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", a.Config.RESTPort))
+	if err != nil {
+		return err
+	}
+	if tlsConfig := a.clientTLSConfig(); tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	// the tails of the log end when the server shuts down, rather than
+	// holding it up
+	ctx, cancel := context.WithCancel(context.Background())
+	a.rest = &http.Server{
+		Handler:     server.NewHTTPHandler(serverConfig),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	a.rest.RegisterOnShutdown(cancel)
+	go func() {
+		if err := a.rest.Serve(ln); err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// restLocator locates the REST APIs of the servers by the rest_addr tags
+// their members gossip. The members that don't gossip are taken to serve
+// their REST APIs on the agent's REST port, on the host of their RPC address.
+type restLocator struct {
+	agent *Agent
+}
+
+func (l *restLocator) RESTAddr(rpcAddr string) (string, bool) {
+	if l.agent.membership != nil {
+		for _, peer := range l.agent.membership.Peers() {
+			if peer.RPCAddr == rpcAddr && peer.Tags != nil {
+				addr, ok := peer.Tags["rest_addr"]
+				return addr, ok
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(rpcAddr)
+	if err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(l.agent.Config.RESTPort)), true
 }
 
 // setupMembership function sets up the membership for the agent by creating
-// a new instance of discovery and initializing it with the agent's
-// configuration.
+// the discovery provider of the agent's configuration, which passes the nodes
+// it discovers to the autopilot, and starts the autopilot.
 func (a *Agent) setupMembership() error {
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
 	}
-	a.membership, err = discovery.New(a.log, discovery.Config{
-		NodeName: a.Config.NodeName,
-		BindAddr: a.Config.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
-		},
+	tags := map[string]string{
+		"rpc_addr": rpcAddr,
+		"role":     a.Config.Role().String(),
+		"zone":     a.Config.Zone,
+	}
+	if a.Config.RESTPort != 0 {
+		restAddr, err := a.Config.RESTAddr()
+		if err != nil {
+			return err
+		}
+		tags["rest_addr"] = restAddr
+	}
+	if a.Config.BootstrapExpect != 0 {
+		tags[expectTag] = strconv.Itoa(a.Config.BootstrapExpect)
+	}
+	hasState, err := a.log.HasState()
+	if err != nil {
+		return err
+	}
+	if hasState {
+		tags[bootstrappedTag] = "true"
+	}
+	a.membership, err = discovery.NewProvider(a.autopilot, discovery.Config{
+		NodeName:       a.Config.NodeName,
+		BindAddr:       a.Config.BindAddr,
+		Tags:           tags,
 		StartJoinAddrs: a.Config.StartJoinAddrs,
+		KeyringFile:    a.Config.GossipKeyringFile,
+		AllowedNodes:   a.Config.AllowedNodes,
+		JoinToken:      a.Config.JoinToken,
+		Provider:       a.Config.Discovery,
+		StaticPeers:    a.Config.StaticPeers,
+		DNSName:        a.Config.DNSName,
+		DNSPort:        a.Config.DNSPort,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	a.autopilot.Start(a.membership)
+	return nil
+}
+
+// Tags the agents gossip to bootstrap the cluster together.
+const (
+	// expectTag is the tag of the number of voters the agent expects to
+	// bootstrap the cluster with.
+	expectTag = "expect"
+	// bootstrappedTag is set once the agent has Raft state, so the agents
+	// expecting voters never bootstrap the cluster it's in again.
+	bootstrappedTag = "bootstrapped"
+)
+
+// bootstrapInterval is how often the agent checks whether it has Raft state
+// or can bootstrap the cluster.
+const bootstrapInterval = time.Second
+
+// setupBootstrap function watches the log until it has Raft state, tagging
+// the agent's member as bootstrapped then. Meanwhile, if the agent expects
+// voters, it bootstraps the cluster once they gossip. Agents whose members
+// don't gossip can't be tagged and don't expect voters.
+func (a *Agent) setupBootstrap() error {
+	membership, ok := a.membership.(*discovery.Membership)
+	if !ok {
+		return nil
+	}
+	logger := zap.L().Named("bootstrap")
+	go func() {
+		ticker := time.NewTicker(bootstrapInterval)
+		defer ticker.Stop()
+		for {
+			done, err := a.bootstrap(membership)
+			if err != nil {
+				logger.Warn("failed to bootstrap", zap.Error(err))
+			}
+			if done {
+				return
+			}
+			select {
+			case <-a.shutdowns:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// bootstrap tags the agent's member as bootstrapped, and returns true, if the
+// log has Raft state. Otherwise, if the agent expects voters and none of the
+// voters gossiping is bootstrapped, it bootstraps the cluster of them once
+// there are as many as expected, all expecting as many, if its name is the
+// lowest, and joins the read replicas. The others get Raft state as the
+// cluster's leader replicates its log to them.
+func (a *Agent) bootstrap(membership *discovery.Membership) (bool, error) {
+	hasState, err := a.log.HasState()
+	if err != nil {
+		return false, err
+	}
+	if hasState {
+		return true, membership.SetTag(bootstrappedTag, "true")
+	}
+	expect := a.Config.BootstrapExpect
+	if expect == 0 {
+		return false, nil
+	}
+	var servers, replicas []*api.Server
+	for _, peer := range membership.Peers() {
+		if !peer.Voter {
+			replicas = append(replicas, &api.Server{
+				Id:      peer.Name,
+				RpcAddr: peer.RPCAddr,
+			})
+			continue
+		}
+		if peer.Tags[bootstrappedTag] != "" {
+			// the voter's in a cluster, whose leader joins the agent
+			return false, nil
+		}
+		if peer.Tags[expectTag] != strconv.Itoa(expect) {
+			return false, fmt.Errorf(
+				"%s expects %q voters rather than %d",
+				peer.Name,
+				peer.Tags[expectTag],
+				expect,
+			)
+		}
+		servers = append(servers, &api.Server{
+			Id:      peer.Name,
+			RpcAddr: peer.RPCAddr,
+		})
+	}
+	if len(servers) < expect {
+		return false, nil
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+	if servers[0].Id != a.Config.NodeName {
+		return false, nil
+	}
+	err = a.log.Bootstrap(servers)
+	if err != nil && !errors.Is(err, log.ErrExistingState) {
+		return false, err
+	}
+	if err == nil {
+		logger := zap.L().Named("bootstrap")
+		logger.Info("bootstrapped the cluster", zap.Int("voters", len(servers)))
+		// the replicas gossiped before there was a leader to join them
+		if err := a.log.WaitForLeader(3 * time.Second); err != nil {
+			logger.Warn("failed to join the replicas", zap.Error(err))
+		}
+		for _, replica := range replicas {
+			if err := a.log.Join(replica.Id, replica.RpcAddr, false); err != nil {
+				logger.Warn(
+					"failed to join the replica",
+					zap.Error(err),
+					zap.String("name", replica.Id),
+				)
+			}
+		}
+	}
+	return true, membership.SetTag(bootstrappedTag, "true")
+}
+
+// setupHTTP function sets up the HTTP server for the agent, exporting the
+// OpenCensus views and metrics of the log, Raft, membership and gRPC server
+// in the Prometheus text format, and serving the liveness probe on /healthz
+// and the readiness probe on /readyz.
+func (a *Agent) setupHTTP() error {
+	if a.Config.HTTPPort == 0 {
+		return nil
+	}
+	logger := zap.L().Named("http")
+	exporter, err := prometheus.NewExporter(prometheus.Options{
+		Namespace: "proglog",
+		OnError: func(err error) {
+			logger.Error("failed to export metrics", zap.Error(err))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	mux.Handle("/healthz", probe(a.log.Alive))
+	mux.Handle("/readyz", probe(func() error {
+		return a.log.Ready(a.Config.Health)
+	}))
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", a.Config.HTTPPort))
+	if err != nil {
+		return err
+	}
+	a.http = &http.Server{Handler: mux}
+	go func() {
+		if err := a.http.Serve(ln); err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// probe returns a handler responding with 200 if the check passes, and with
+// 503 and the check's error otherwise.
+func probe(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// Reload function reloads the ACL policy and quotas, which the agent
+// otherwise reloads when their files change, and the tokens and JWKS clients
+// authenticate with.
+func (a *Agent) Reload() error {
+	if err := a.authorizer.Reload(); err != nil {
+		return err
+	}
+	if a.quotas != nil {
+		if err := a.quotas.Reload(); err != nil {
+			return err
+		}
+	}
+	return a.authn.Reload()
 }
 
 // Shutdown function is responsible for shutting down the agent by closing
@@ -229,12 +932,72 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
 		func() error {
-			a.server.GracefulStop()
+			if a.health != nil {
+				a.health.Shutdown()
+			}
 			return nil
 		},
-		a.log.Close,
+		func() error {
+			if a.http == nil {
+				return nil
+			}
+			return a.http.Shutdown(context.Background())
+		},
+		func() error {
+			if a.rest == nil {
+				return nil
+			}
+			return a.rest.Shutdown(context.Background())
+		},
+		func() error {
+			if a.membership == nil {
+				return nil
+			}
+			return a.membership.Leave()
+		},
+		func() error {
+			if a.autopilot == nil {
+				return nil
+			}
+			return a.autopilot.Close()
+		},
+		func() error {
+			if a.kafka == nil {
+				return nil
+			}
+			return a.kafka.Close()
+		},
+		func() error {
+			if a.server != nil {
+				a.server.GracefulStop()
+			}
+			return nil
+		},
+		func() error {
+			if a.log == nil {
+				return nil
+			}
+			return a.log.Close()
+		},
+		func() error {
+			if a.authorizer == nil {
+				return nil
+			}
+			return a.authorizer.Close()
+		},
+		func() error {
+			if a.quotas == nil {
+				return nil
+			}
+			return a.quotas.Close()
+		},
+		func() error {
+			if a.tracing == nil {
+				return nil
+			}
+			return a.tracing()
+		},
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
@@ -4,24 +4,31 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"github.com/pouriaamini/proglog/internal/loadbalance"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"github.com/twmb/franz-go/pkg/kgo"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
 	api "github.com/pouriaamini/proglog/api/v1"
 	"github.com/pouriaamini/proglog/internal/agent"
 	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/loadbalance"
 )
 
 func TestAgent(t *testing.T) {
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	// the agents reload their certificates as dislog runs them
+	serverTLS, err := config.NewTLSReloader(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
 		CAFile:        config.CAFile,
@@ -29,8 +36,10 @@ func TestAgent(t *testing.T) {
 		ServerAddress: "127.0.0.1",
 	})
 	require.NoError(t, err)
+	defer serverTLS.Close()
+	serverTLSConfig := serverTLS.TLSConfig()
 
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	peerTLS, err := config.NewTLSReloader(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -38,12 +47,21 @@ func TestAgent(t *testing.T) {
 		ServerAddress: "127.0.0.1",
 	})
 	require.NoError(t, err)
+	defer peerTLS.Close()
+	peerTLSConfig := peerTLS.TLSConfig()
+
+	// clients without certificates authenticate with tokens
+	tokensFile := filepath.Join(t.TempDir(), "tokens.csv")
+	err = os.WriteFile(tokensFile, []byte("root-token,root\n"), 0600)
+	require.NoError(t, err)
 
 	var agents []*agent.Agent
 	for i := 0; i < 3; i++ {
-		ports := dynaport.Get(2)
+		ports := dynaport.Get(4)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		rpcPort := ports[1]
+		httpPort := ports[2]
+		restPort := ports[3]
 
 		dataDir, err := os.MkdirTemp("", "agent-test-log")
 		require.NoError(t, err)
@@ -61,12 +79,20 @@ func TestAgent(t *testing.T) {
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
+			HTTPPort:        httpPort,
+			RESTPort:        restPort,
+			Kafka:           true,
+			KafkaInsecure:   true,
+			Topic:           "dislog",
+			KafkaSubject:    "kafka",
 			DataDir:         dataDir,
 			ACLModelFile:    config.ACLModelFile,
 			ACLPolicyFile:   config.ACLPolicyFile,
+			TokensFile:      tokensFile,
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
 			Bootstrap:       i == 0,
+			NonVoter:        i == 2,
 		})
 		require.NoError(t, err)
 
@@ -127,6 +153,284 @@ func TestAgent(t *testing.T) {
 	got := status.Code(err)
 	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
 	require.Equal(t, got, want)
+
+	// the REST API reads the same replicated log
+	restClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: peerTLSConfig},
+	}
+	res, err := restClient.Get(fmt.Sprintf(
+		"https://127.0.0.1:%d/records/%d?encoding=text",
+		agents[1].Config.RESTPort,
+		produceResponse.Offset,
+	))
+	require.NoError(t, err)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.JSONEq(t,
+		fmt.Sprintf(`{"offset":%d,"value":"foo"}`, produceResponse.Offset),
+		string(b),
+	)
+
+	// the followers redirect REST produces to the leader
+	res, err = restClient.Post(
+		fmt.Sprintf(
+			"https://127.0.0.1:%d/records?encoding=text",
+			agents[1].Config.RESTPort,
+		),
+		"application/json",
+		strings.NewReader(`{"value":"baz"}`),
+	)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t,
+		fmt.Sprintf("127.0.0.1:%d", agents[0].Config.RESTPort),
+		res.Request.URL.Host,
+	)
+
+	caTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"https://127.0.0.1:%d/records/%d",
+		agents[0].Config.RESTPort,
+		produceResponse.Offset,
+	), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer root-token")
+	tokenClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: caTLSConfig},
+	}
+	res, err = tokenClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the agents shut down with tails of the log still open
+	events, err := restClient.Get(fmt.Sprintf(
+		"https://127.0.0.1:%d/records/events",
+		agents[0].Config.RESTPort,
+	))
+	require.NoError(t, err)
+	defer events.Body.Close()
+	require.Equal(t, http.StatusOK, events.StatusCode)
+
+	metrics := scrape(t, agents[0])
+	for _, name := range []string{
+		"proglog_log_append_latency_bucket",
+		`proglog_log_segments{log="log",node="0"}`,
+		`proglog_raft_state{node="0"} 2`,
+		"proglog_raft_commit_index",
+		"proglog_raft_applied_index",
+		`proglog_discovery_members{node="0",status="alive"} 3`,
+		"proglog_server_produced_records 1",
+		"proglog_grpc_io_server_completed_rpcs",
+	} {
+		require.Contains(t, metrics, name)
+	}
+
+	// Kafka clients produce to and consume from the same log through any
+	// agent, which sends them to the leader for producing
+	rpcAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	kafkaClient, err := kgo.NewClient(
+		kgo.SeedBrokers(rpcAddr),
+		kgo.DefaultProduceTopic("dislog"),
+		kgo.DisableIdempotentWrite(),
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{
+			"dislog": {0: kgo.NewOffset().AtStart()},
+		}),
+	)
+	require.NoError(t, err)
+	defer kafkaClient.Close()
+	err = kafkaClient.ProduceSync(
+		context.Background(),
+		&kgo.Record{Value: []byte("bar")},
+	).FirstErr()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var values []string
+	for len(values) < 3 {
+		fetches := kafkaClient.PollFetches(ctx)
+		require.NoError(t, ctx.Err())
+		require.Empty(t, fetches.Errors())
+		fetches.EachRecord(func(r *kgo.Record) {
+			values = append(values, string(r.Value))
+		})
+	}
+	require.Equal(t, []string{"foo", "baz", "bar"}, values)
+
+	for _, agent := range agents {
+		require.Equal(t, "ok\n", probe(t, agent, "/readyz"))
+		require.Equal(t, "ok\n", probe(t, agent, "/healthz"))
+	}
+	rpcAddr, err = agents[2].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	healthResponse, err := healthpb.NewHealthClient(conn).Check(
+		context.Background(),
+		&healthpb.HealthCheckRequest{Service: "log.v1.Log"},
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		healthpb.HealthCheckResponse_SERVING,
+		healthResponse.Status,
+	)
+}
+
+func TestAgentBootstrapExpect(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	// the agents start in reverse, so the one bootstrapping the cluster
+	// doesn't find the others as it starts
+	var agents []*agent.Agent
+	for i := 2; i >= 0; i-- {
+		ports := dynaport.Get(2)
+		var startJoinAddrs []string
+		if len(agents) != 0 {
+			startJoinAddrs = []string{agents[0].Config.BindAddr}
+		}
+		a, err := agent.New(agent.Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         t.TempDir(),
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			BootstrapExpect: 3,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	defer func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+		}
+	}()
+
+	var servers []*api.Server
+	require.Eventually(t, func() bool {
+		res, err := client(t, agents[1], peerTLSConfig).GetServers(
+			context.Background(),
+			&api.GetServersRequest{},
+		)
+		if err != nil {
+			return false
+		}
+		servers = res.Servers
+		leader := false
+		for _, server := range servers {
+			leader = leader || server.IsLeader
+		}
+		return len(servers) == 3 && leader
+	}, 10*time.Second, 250*time.Millisecond)
+	for _, server := range servers {
+		require.Equal(t, api.Role_VOTER, server.Role)
+	}
+
+	// the leader's autopilot reports the servers' health
+	rpcAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := api.NewAdminClient(conn)
+	require.Eventually(t, func() bool {
+		res, err := admin.GetServerHealth(
+			context.Background(),
+			&api.GetServerHealthRequest{},
+		)
+		return err == nil && res.Healthy && len(res.Servers) == 3 &&
+			res.FailureTolerance == 1
+	}, 5*time.Second, 250*time.Millisecond)
+}
+
+// probe returns the body of the agent's successful response to the probe.
+func TestAgentSetupFailure(t *testing.T) {
+	ports := dynaport.Get(2)
+	c := agent.Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:       ports[1],
+		DataDir:       t.TempDir(),
+		ACLModelFile:  config.ACLModelFile,
+		ACLPolicyFile: filepath.Join(t.TempDir(), "missing.csv"),
+		Bootstrap:     true,
+	}
+	// the authorizer is set up after the log, which has to release its
+	// data directory and port when it fails
+	_, err := agent.New(c)
+	require.Error(t, err)
+
+	// the agent refuses to serve Kafka clients unless they're accepted as
+	// insecure, after setting up the log too
+	c.ACLPolicyFile = config.ACLPolicyFile
+	c.Kafka = true
+	_, err = agent.New(c)
+	require.ErrorContains(t, err, "kafka-insecure")
+
+	c.KafkaInsecure = true
+	a, err := agent.New(c)
+	require.NoError(t, err)
+	require.NoError(t, a.Shutdown())
+}
+
+func probe(t *testing.T, agent *agent.Agent, path string) string {
+	res, err := http.Get(fmt.Sprintf(
+		"http://127.0.0.1:%d%s",
+		agent.Config.HTTPPort,
+		path,
+	))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// scrape returns the metrics exported by the agent.
+func scrape(t *testing.T, agent *agent.Agent) string {
+	res, err := http.Get(fmt.Sprintf(
+		"http://127.0.0.1:%d/metrics",
+		agent.Config.HTTPPort,
+	))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(b)
 }
 
 func client(
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the client
+	// didn't present the credentials it authenticates.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidToken is returned by an Authenticator when it doesn't
+	// accept the client's token.
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Credentials are what a client presents to authenticate.
+type Credentials struct {
+	// TLS is the state of the client's TLS connection, nil if it isn't
+	// over TLS.
+	TLS *tls.ConnectionState
+	// Token is the bearer token the client sent, empty if it sent none.
+	Token string
+}
+
+// Authenticator authenticates clients by their credentials, returning the
+// subject the ACL policy authorizes them as.
+type Authenticator interface {
+	Authenticate(Credentials) (string, error)
+}
+
+// Reloader is implemented by the authenticators that load their keys or
+// tokens from files, to reload them.
+type Reloader interface {
+	Reload() error
+}
+
+// Chain authenticates clients with the first of its authenticators that
+// finds the credentials it authenticates. It fails with ErrNoCredentials if
+// none of them do, or with the error of the first that rejects the client's
+// credentials if none accepts them.
+type Chain []Authenticator
+
+// Authenticate authenticates the client with the chain's authenticators.
+func (c Chain) Authenticate(creds Credentials) (string, error) {
+	var rejected error
+	for _, a := range c {
+		subject, err := a.Authenticate(creds)
+		if err == nil {
+			return subject, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) && rejected == nil {
+			rejected = err
+		}
+	}
+	if rejected != nil {
+		return "", rejected
+	}
+	return "", ErrNoCredentials
+}
+
+// Reload reloads the chain's authenticators that load from files.
+func (c Chain) Reload() error {
+	for _, a := range c {
+		if r, ok := a.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TLS authenticates clients by their certificates, as the common name of the
+// certificate the server verified.
+type TLS struct{}
+
+// Authenticate returns the common name of the client's verified certificate.
+func (TLS) Authenticate(creds Credentials) (string, error) {
+	if creds.TLS == nil ||
+		len(creds.TLS.VerifiedChains) == 0 ||
+		len(creds.TLS.VerifiedChains[0]) == 0 {
+		return "", ErrNoCredentials
+	}
+	return creds.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+// Tokens authenticates clients by static bearer tokens, loaded from a CSV
+// file of a token and the subject it authenticates on each line. Lines
+// starting with # are comments.
+type Tokens struct {
+	path string
+
+	mu sync.RWMutex
+	// tokens maps the hashes of the tokens to their subjects, so looking a
+	// token up doesn't leak how much of it matched.
+	tokens map[[sha256.Size]byte]string
+}
+
+// NewTokens returns an authenticator of the tokens in the file.
+func NewTokens(path string) (*Tokens, error) {
+	t := &Tokens{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload loads the tokens from the file, keeping the current ones if it
+// fails.
+func (t *Tokens) Reload() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to load tokens: %w", err)
+	}
+	tokens := make(map[[sha256.Size]byte]string, len(records))
+	for _, record := range records {
+		token, subject := record[0], record[1]
+		if token == "" || subject == "" {
+			return fmt.Errorf("failed to load tokens: empty token or subject")
+		}
+		tokens[sha256.Sum256([]byte(token))] = subject
+	}
+	t.mu.Lock()
+	t.tokens = tokens
+	t.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns the subject of the client's token.
+func (t *Tokens) Authenticate(creds Credentials) (string, error) {
+	if creds.Token == "" {
+		return "", ErrNoCredentials
+	}
+	sum := sha256.Sum256([]byte(creds.Token))
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for hash, subject := range t.tokens {
+		if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+			return subject, nil
+		}
+	}
+	return "", ErrInvalidToken
+}
+
+// JWTConfig configures how JWTs are verified.
+type JWTConfig struct {
+	// JWKSFile is the path to the JSON Web Key Set verifying the tokens'
+	// signatures.
+	JWKSFile string
+	// Issuer is the issuer the tokens must have, if set.
+	Issuer string
+	// Audience is an audience the tokens must have, if set.
+	Audience string
+	// SubjectClaim is the claim holding the subject, sub if empty.
+	SubjectClaim string
+	// Leeway is the clock skew allowed checking the tokens' times.
+	Leeway time.Duration
+}
+
+// JWT authenticates clients by bearer JWTs signed by a key of a local JSON
+// Web Key Set. The tokens must expire.
+type JWT struct {
+	config JWTConfig
+
+	mu   sync.RWMutex
+	keys *jose.JSONWebKeySet
+}
+
+// NewJWT returns an authenticator of JWTs signed by the keys of the
+// configured set.
+func NewJWT(config JWTConfig) (*JWT, error) {
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+	j := &JWT{config: config}
+	if err := j.Reload(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Reload loads the key set from its file, keeping the current one if it
+// fails.
+func (j *JWT) Reload() error {
+	b, err := os.ReadFile(j.config.JWKSFile)
+	if err != nil {
+		return err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err = json.Unmarshal(b, keys); err != nil {
+		return fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	for _, key := range keys.Keys {
+		if !key.IsPublic() {
+			return fmt.Errorf(
+				"failed to load JWKS: key %q isn't public",
+				key.KeyID,
+			)
+		}
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// Authenticate verifies the client's token, returning its subject claim.
+func (j *JWT) Authenticate(creds Credentials) (string, error) {
+	if creds.Token == "" {
+		return "", ErrNoCredentials
+	}
+	token, err := jwt.ParseSigned(creds.Token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	j.mu.RLock()
+	keys := j.keys
+	j.mu.RUnlock()
+	var claims jwt.Claims
+	custom := make(map[string]interface{})
+	if err = token.Claims(keys, &claims, &custom); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Expiry == nil {
+		return "", fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	expected := jwt.Expected{Issuer: j.config.Issuer, Time: time.Now()}
+	if j.config.Audience != "" {
+		expected.Audience = jwt.Audience{j.config.Audience}
+	}
+	if err = claims.ValidateWithLeeway(expected, j.config.Leeway); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	subject, _ := custom[j.config.SubjectClaim].(string)
+	if strings.TrimSpace(subject) == "" {
+		return "", fmt.Errorf(
+			"%w: no %s claim",
+			ErrInvalidToken,
+			j.config.SubjectClaim,
+		)
+	}
+	return subject, nil
+}
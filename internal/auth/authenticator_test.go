@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLS(t *testing.T) {
+	_, err := TLS{}.Authenticate(Credentials{})
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	// connections without a verified certificate have no credentials rather
+	// than panicking
+	_, err = TLS{}.Authenticate(Credentials{TLS: &tls.ConnectionState{}})
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	subject, err := TLS{}.Authenticate(Credentials{TLS: &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+}
+
+func TestTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.csv")
+	require.NoError(t, os.WriteFile(
+		path,
+		[]byte("# token,subject\nsecret, producer\n"),
+		0600,
+	))
+	tokens, err := NewTokens(path)
+	require.NoError(t, err)
+
+	subject, err := tokens.Authenticate(Credentials{Token: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, "producer", subject)
+
+	_, err = tokens.Authenticate(Credentials{Token: "guess"})
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = tokens.Authenticate(Credentials{})
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	// reloading revokes the tokens no longer in the file
+	require.NoError(t, os.WriteFile(path, []byte("other,producer\n"), 0600))
+	require.NoError(t, tokens.Reload())
+	_, err = tokens.Authenticate(Credentials{Token: "secret"})
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// a malformed file leaves the current tokens in place
+	require.NoError(t, os.WriteFile(path, []byte("other\n"), 0600))
+	require.Error(t, tokens.Reload())
+	_, err = tokens.Authenticate(Credentials{Token: "other"})
+	require.NoError(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &key.PublicKey,
+		KeyID:     "key",
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0644))
+	authenticator, err := NewJWT(JWTConfig{
+		JWKSFile: path,
+		Issuer:   "issuer",
+		Audience: "dislog",
+	})
+	require.NoError(t, err)
+
+	sign := func(key *ecdsa.PrivateKey, claims jwt.Claims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{
+			Algorithm: jose.ES256,
+			Key:       jose.JSONWebKey{Key: key, KeyID: "key"},
+		}, nil)
+		require.NoError(t, err)
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+	valid := jwt.Claims{
+		Subject:  "producer",
+		Issuer:   "issuer",
+		Audience: jwt.Audience{"dislog"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	subject, err := authenticator.Authenticate(Credentials{
+		Token: sign(key, valid),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "producer", subject)
+
+	for name, token := range map[string]string{
+		"signed by another key": sign(other, valid),
+		"expired": sign(key, func(c jwt.Claims) jwt.Claims {
+			c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			return c
+		}(valid)),
+		"never expiring": sign(key, func(c jwt.Claims) jwt.Claims {
+			c.Expiry = nil
+			return c
+		}(valid)),
+		"of another issuer": sign(key, func(c jwt.Claims) jwt.Claims {
+			c.Issuer = "other"
+			return c
+		}(valid)),
+		"for another audience": sign(key, func(c jwt.Claims) jwt.Claims {
+			c.Audience = jwt.Audience{"other"}
+			return c
+		}(valid)),
+		"not a JWT": "secret",
+	} {
+		_, err := authenticator.Authenticate(Credentials{Token: token})
+		require.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+}
+
+func TestChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.csv")
+	require.NoError(t, os.WriteFile(path, []byte("secret,producer\n"), 0600))
+	tokens, err := NewTokens(path)
+	require.NoError(t, err)
+	chain := Chain{TLS{}, tokens}
+
+	subject, err := chain.Authenticate(Credentials{Token: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, "producer", subject)
+
+	_, err = chain.Authenticate(Credentials{Token: "guess"})
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = chain.Authenticate(Credentials{})
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	require.NoError(t, chain.Reload())
+}
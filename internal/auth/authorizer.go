@@ -3,39 +3,251 @@ package auth
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/casbin/casbin"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Actions of the admin service checked against the ACL policy.
+const (
+	RemoveServerAction       = "remove_server"
+	TransferLeadershipAction = "transfer_leadership"
+	SnapshotAction           = "snapshot"
+	DescribeRaftAction       = "describe_raft"
+	ListSegmentsAction       = "list_segments"
+	ForceRetentionAction     = "force_retention"
+	ManageKeysAction         = "manage_keys"
+)
+
+// Actions of the registry service checked against the ACL policy.
+const (
+	RegisterSchemaAction = "register_schema"
+	ReadSchemaAction     = "read_schema"
+)
+
+// Objects the ACL policy grants actions on. An object in the policy may end
+// with a * to match every object starting with what precedes it, so * alone
+// matches every object and topic:* every topic.
+const (
+	// ClusterObject is the object of the admin actions on the cluster as a
+	// whole.
+	ClusterObject = "cluster"
+	// legacyObject is the object every action was authorized on before
+	// objects named what they act on. Models matching objects exactly can't
+	// match the named objects to a policy's *, so the Authorizer falls back
+	// to it to keep granting what those policies did.
+	legacyObject = "*"
+)
+
+// TopicObject returns the object of the topic, the name the log is produced
+// to and consumed from as.
+func TopicObject(topic string) string {
+	return "topic:" + topic
+}
+
+// GroupObject returns the object of the consumer group.
+func GroupObject(group string) string {
+	return "group:" + group
+}
+
+// SchemaObject returns the object of the subject whose versions of the
+// schema the registry actions act on.
+func SchemaObject(subject string) string {
+	return "schema:" + subject
+}
+
+// ServerObject returns the object of the server with the ID, which the admin
+// actions on a single server act on.
+func ServerObject(id string) string {
+	return "server:" + id
+}
+
+// ErrorReason is the reason of the error info detail of the errors of the
+// denied requests.
+const ErrorReason = "ACL_DENIED"
+
 // New returns a new Authorizer with the given Casbin model and policy.
-func New(model, policy string) *Authorizer {
-	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{
-		enforcer: enforcer,
+func New(model, policy string) (*Authorizer, error) {
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		logger: zap.L().Named("auth"),
+		done:   make(chan struct{}),
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
 	}
+	return a, nil
 }
 
 // Authorizer is an authorization module that uses Casbin to enforce access
-// control.
+// control. It reloads the policy when asked to or, once it watches it, when
+// its file changes, so revoking a client's access takes effect without
+// restarting the server.
 type Authorizer struct {
+	model  string
+	policy string
+	logger *zap.Logger
+
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	// legacy is set once the loaded policy has granted an action only on
+	// the legacy object, so it's logged once per load.
+	legacy bool
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// Reload loads the model and policy into a new enforcer, which replaces the
+// current one once it's fully loaded. If loading fails, the Authorizer keeps
+// enforcing the current policy.
+func (a *Authorizer) Reload() error {
+	for _, path := range []string{a.model, a.policy} {
+		if path == "" {
+			return fmt.Errorf("ACL model and policy files are required")
+		}
+		// Casbin loads a missing policy as an empty one, denying every
+		// request rather than failing
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	enforcer, err := casbin.NewEnforcerSafe(a.model, a.policy)
+	if err != nil {
+		return fmt.Errorf("failed to load ACL: %w", err)
+	}
+	a.mu.Lock()
+	a.enforcer = enforcer
+	a.legacy = false
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policy whenever its file changes until the Authorizer's
+// closed. It watches the file's directory, as editors and Kubernetes config
+// maps replace the file rather than writing to it.
+func (a *Authorizer) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(a.policy)); err != nil {
+		watcher.Close()
+		return err
+	}
+	a.watcher = watcher
+	go a.watch()
+	return nil
+}
+
+func (a *Authorizer) watch() {
+	for {
+		select {
+		case <-a.done:
+			return
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+			a.logger.Error("failed to watch ACL policy", zap.Error(err))
+		case event, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				// the policy may be missing between its replacement's
+				// events, and the last event reloads it
+				a.logger.Warn(
+					"failed to reload ACL policy",
+					zap.String("file", a.policy),
+					zap.Error(err),
+				)
+				continue
+			}
+			a.logger.Debug("reloaded ACL policy", zap.String("file", a.policy))
+		}
+	}
+}
+
+// Close stops watching the policy.
+func (a *Authorizer) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+	select {
+	case <-a.done:
+		return nil
+	default:
+	}
+	close(a.done)
+	return a.watcher.Close()
 }
 
 // Authorize enforces the access control policy for the given subject,
-// object and action.
-// It returns an error if the access is denied, otherwise it returns nil.
+// object and action, falling back to the legacy * object for policies
+// written before objects named what they act on.
+// It returns an error if the access is denied, otherwise it returns nil. The
+// error's status details the denied request with an ErrorInfo.
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
-		msg := fmt.Sprintf(
-			"%s not permitted to %s to %s",
-			subject,
-			action,
-			object,
-		)
-		st := status.New(codes.PermissionDenied, msg)
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
+	if enforcer.Enforce(subject, object, action) {
+		return nil
+	}
+	if enforcer.Enforce(subject, legacyObject, action) {
+		a.warnLegacy(subject, object, action)
+		return nil
+	}
+	msg := fmt.Sprintf(
+		"%q not permitted to %s on %s",
+		subject,
+		action,
+		object,
+	)
+	st := status.New(codes.PermissionDenied, msg)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: ErrorReason,
+		Domain: "dislog",
+		Metadata: map[string]string{
+			"subject": subject,
+			"object":  object,
+			"action":  action,
+		},
+	})
+	if err != nil {
 		return st.Err()
 	}
-	return nil
+	return detailed.Err()
+}
+
+// warnLegacy logs that the policy granted the action only on the legacy
+// object, once per load of the policy, for operators to migrate it.
+func (a *Authorizer) warnLegacy(subject, object, action string) {
+	a.mu.Lock()
+	warned := a.legacy
+	a.legacy = true
+	a.mu.Unlock()
+	if warned {
+		return
+	}
+	a.logger.Warn(
+		"ACL granted an action only on the legacy * object; "+
+			"match objects with keyMatch in the model",
+		zap.String("subject", subject),
+		zap.String("object", object),
+		zap.String("action", action),
+		zap.String("model", a.model),
+	)
 }
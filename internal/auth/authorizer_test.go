@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pouriaamini/proglog/internal/config"
+)
+
+func TestAuthorizer(t *testing.T) {
+	policy := writePolicy(t, `p, root, *, produce
+p, app, topic:orders, produce
+p, app, group:*, consume
+`)
+	authorizer, err := New(config.ACLModelFile, policy)
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Authorize("root", TopicObject("any"), "produce"))
+	require.NoError(t, authorizer.Authorize("app", TopicObject("orders"), "produce"))
+	require.NoError(t, authorizer.Authorize("app", GroupObject("billing"), "consume"))
+
+	err = authorizer.Authorize("app", TopicObject("payments"), "produce")
+	st := status.Convert(err)
+	require.Equal(t, codes.PermissionDenied, st.Code())
+	require.Equal(t,
+		`"app" not permitted to produce on topic:payments`,
+		st.Message(),
+	)
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, ErrorReason, info.Reason)
+	require.Equal(t, map[string]string{
+		"subject": "app",
+		"object":  "topic:payments",
+		"action":  "produce",
+	}, info.Metadata)
+}
+
+func TestAuthorizerReload(t *testing.T) {
+	policy := writePolicy(t, "p, app, topic:orders, produce\n")
+	authorizer, err := New(config.ACLModelFile, policy)
+	require.NoError(t, err)
+	require.NoError(t, authorizer.Watch())
+	defer authorizer.Close()
+	require.NoError(t, authorizer.Authorize("app", TopicObject("orders"), "produce"))
+
+	// replacing the policy revokes the access it no longer grants
+	tmp := policy + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte("p, root, *, produce\n"), 0644))
+	require.NoError(t, os.Rename(tmp, policy))
+	require.Eventually(t, func() bool {
+		return authorizer.Authorize("app", TopicObject("orders"), "produce") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, authorizer.Authorize("root", TopicObject("orders"), "produce"))
+
+	// a policy that fails to load leaves the current one in place
+	require.NoError(t, os.Remove(policy))
+	require.Error(t, authorizer.Reload())
+	require.NoError(t, authorizer.Authorize("root", TopicObject("orders"), "produce"))
+}
+
+func TestAuthorizerLegacyModel(t *testing.T) {
+	// models and policies from before objects named what they act on match
+	// objects exactly, granting actions on * alone
+	model := filepath.Join(t.TempDir(), "model.conf")
+	require.NoError(t, os.WriteFile(model, []byte(`[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`), 0644))
+	policy := writePolicy(t, `p, root, *, produce
+p, root, *, consume
+p, root, *, snapshot
+`)
+	authorizer, err := New(model, policy)
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Authorize("root", TopicObject("dislog"), "produce"))
+	require.NoError(t, authorizer.Authorize("root", GroupObject("billing"), "consume"))
+	require.NoError(t, authorizer.Authorize("root", ClusterObject, "snapshot"))
+	err = authorizer.Authorize("root", ServerObject("1"), "remove_server")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = authorizer.Authorize("nobody", TopicObject("dislog"), "produce")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestNewWithoutFiles(t *testing.T) {
+	_, err := New("", "")
+	require.Error(t, err)
+}
+
+// writePolicy writes the policy to a file in a temporary directory and
+// returns its path.
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0644))
+	return path
+}
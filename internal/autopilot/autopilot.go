@@ -0,0 +1,373 @@
+// Package autopilot manages the servers of the Raft cluster from its leader,
+// promoting the new servers to voters once they're stable and removing the
+// servers that stay failed, and reports their health.
+package autopilot
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/discovery"
+)
+
+// Config sets how the autopilot manages the servers. Zero values take the
+// defaults.
+type Config struct {
+	// ServerStabilizationTime is how long a new server must be healthy
+	// before it's promoted to a voter, 10s by default.
+	ServerStabilizationTime time.Duration
+	// DeadServerTimeout is how long a server must be failed before it's
+	// removed from the cluster, 5m by default.
+	DeadServerTimeout time.Duration
+	// MinQuorum is the fewest voters removing the failed servers leaves in
+	// the cluster.
+	MinQuorum int
+	// LastContactThreshold is how long a healthy server may go without the
+	// leader hearing from it, 500ms by default.
+	LastContactThreshold time.Duration
+	// MaxTrailingLogs is how many entries a healthy server's Raft log may be
+	// behind the leader's, 250 by default.
+	MaxTrailingLogs uint64
+	// Interval is how often the autopilot checks the servers, 1s by
+	// default.
+	Interval time.Duration
+}
+
+// Raft is the Raft cluster the autopilot manages.
+type Raft interface {
+	discovery.Handler
+	// ServerHealth returns how the servers replicate the log, or
+	// raft.ErrNotLeader if the server isn't the leader.
+	ServerHealth() ([]*api.ServerHealth, error)
+	GetServers() ([]*api.Server, error)
+}
+
+// Members are the members of the cluster the autopilot tells the failed
+// servers and the servers wanting to vote by.
+type Members interface {
+	Peers() []discovery.Peer
+}
+
+// Autopilot manages the servers of the Raft cluster when its server is the
+// leader. It's the handler of the members discovered: the voters joining are
+// added as non-voters, promoted once they've been healthy for the
+// stabilization time, and the members failing are removed once they've been
+// failed for the dead server timeout, as long as it leaves the cluster the
+// minimum quorum and removes less than half its voters. Members leaving are
+// removed right away.
+type Autopilot struct {
+	Config
+	raft   Raft
+	logger *zap.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	members Members
+	// stableSince and failedSince map the servers to when they became
+	// healthy and failed, as last seen by the leader.
+	stableSince map[string]time.Time
+	failedSince map[string]time.Time
+
+	done   chan struct{}
+	closed chan struct{}
+}
+
+var (
+	_ discovery.Handler = (*Autopilot)(nil)
+	_ discovery.Failer  = (*Autopilot)(nil)
+	_ discovery.Locator = (*Autopilot)(nil)
+)
+
+// New returns the autopilot of the Raft cluster, which manages its servers
+// once it's started.
+func New(r Raft, config Config) *Autopilot {
+	if config.ServerStabilizationTime == 0 {
+		config.ServerStabilizationTime = 10 * time.Second
+	}
+	if config.DeadServerTimeout == 0 {
+		config.DeadServerTimeout = 5 * time.Minute
+	}
+	if config.LastContactThreshold == 0 {
+		config.LastContactThreshold = 500 * time.Millisecond
+	}
+	if config.MaxTrailingLogs == 0 {
+		config.MaxTrailingLogs = 250
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second
+	}
+	return &Autopilot{
+		Config:      config,
+		raft:        r,
+		logger:      zap.L().Named("autopilot"),
+		now:         time.Now,
+		stableSince: make(map[string]time.Time),
+		failedSince: make(map[string]time.Time),
+		done:        make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Start starts managing the servers, telling the failed ones and the ones
+// wanting to vote by the members, until the autopilot's closed.
+func (a *Autopilot) Start(members Members) {
+	a.mu.Lock()
+	a.members = members
+	a.mu.Unlock()
+	go a.run()
+}
+
+func (a *Autopilot) run() {
+	defer close(a.closed)
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+		if err := a.manage(); err != nil && !errors.Is(err, raft.ErrNotLeader) {
+			a.logger.Error("failed to manage the servers", zap.Error(err))
+		}
+	}
+}
+
+// Close stops managing the servers.
+func (a *Autopilot) Close() error {
+	close(a.done)
+	a.mu.Lock()
+	started := a.members != nil
+	a.mu.Unlock()
+	if started {
+		<-a.closed
+	}
+	return nil
+}
+
+// Join adds the server to the cluster, as a non-voter until it's stable if
+// it wants to vote.
+func (a *Autopilot) Join(id, addr string, voter bool) error {
+	if voter {
+		servers, err := a.raft.GetServers()
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			// the voters stay voters and the non-voters get promoted
+			if server.Id == id && server.RpcAddr == addr {
+				return nil
+			}
+		}
+	}
+	return a.raft.Join(id, addr, false)
+}
+
+// Leave removes the server leaving the cluster.
+func (a *Autopilot) Leave(id string) error {
+	return a.raft.Leave(id)
+}
+
+// Fail leaves the failed server in the cluster, which the autopilot removes
+// once it's been failed for the dead server timeout.
+func (a *Autopilot) Fail(id string) error {
+	return nil
+}
+
+// Locate passes the server's zone to the cluster, if it tracks them.
+func (a *Autopilot) Locate(id, zone string) {
+	if locator, ok := a.raft.(discovery.Locator); ok {
+		locator.Locate(id, zone)
+	}
+}
+
+// ServerHealth returns the health of the servers, or raft.ErrNotLeader if
+// the server isn't the leader.
+func (a *Autopilot) ServerHealth() (*api.GetServerHealthResponse, error) {
+	res, _, err := a.observe()
+	return res, err
+}
+
+// observe returns the health of the servers, updating when they became
+// healthy and failed, and the members wanting to vote.
+func (a *Autopilot) observe() (
+	*api.GetServerHealthResponse,
+	map[string]bool,
+	error,
+) {
+	servers, err := a.raft.ServerHealth()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		// a new leader tells the stable and failed servers anew
+		a.stableSince = make(map[string]time.Time)
+		a.failedSince = make(map[string]time.Time)
+		return nil, nil, err
+	}
+	var alive, voters map[string]bool
+	if a.members != nil {
+		alive = make(map[string]bool)
+		voters = make(map[string]bool)
+		for _, peer := range a.members.Peers() {
+			alive[peer.Name] = true
+			voters[peer.Name] = peer.Voter
+		}
+	}
+	now := a.now()
+	var term uint64
+	for _, server := range servers {
+		if server.IsLeader {
+			term = server.Term
+		}
+	}
+	res := &api.GetServerHealthResponse{Healthy: true, Servers: servers}
+	known := make(map[string]bool, len(servers))
+	healthyVoters, voterCount := 0, 0
+	for _, server := range servers {
+		known[server.Id] = true
+		if alive != nil && !alive[server.Id] && !server.IsLeader {
+			if _, ok := a.failedSince[server.Id]; !ok {
+				a.failedSince[server.Id] = now
+			}
+			server.FailedMs = now.Sub(a.failedSince[server.Id]).Milliseconds()
+		} else {
+			delete(a.failedSince, server.Id)
+		}
+		server.Healthy = a.healthy(server, term)
+		if server.Healthy {
+			if _, ok := a.stableSince[server.Id]; !ok {
+				a.stableSince[server.Id] = now
+			}
+			server.StableMs = now.Sub(a.stableSince[server.Id]).Milliseconds()
+		} else {
+			delete(a.stableSince, server.Id)
+			res.Healthy = false
+		}
+		if server.Voter {
+			voterCount++
+			if server.Healthy {
+				healthyVoters++
+			}
+		}
+	}
+	for id := range a.stableSince {
+		if !known[id] {
+			delete(a.stableSince, id)
+		}
+	}
+	for id := range a.failedSince {
+		if !known[id] {
+			delete(a.failedSince, id)
+		}
+	}
+	if tolerance := healthyVoters - (voterCount/2 + 1); tolerance > 0 {
+		res.FailureTolerance = int32(tolerance)
+	}
+	return res, voters, nil
+}
+
+// healthy returns whether the server is alive, in contact with the leader,
+// in its term and not too far behind it.
+func (a *Autopilot) healthy(server *api.ServerHealth, term uint64) bool {
+	if server.IsLeader {
+		return true
+	}
+	if _, failed := a.failedSince[server.Id]; failed {
+		return false
+	}
+	lastContact := time.Duration(server.LastContactMs) * time.Millisecond
+	return server.LastContactMs >= 0 &&
+		lastContact <= a.LastContactThreshold &&
+		server.Term == term &&
+		server.IndexLag <= a.MaxTrailingLogs
+}
+
+// manage promotes the non-voters wanting to vote that have been healthy for
+// the stabilization time, and removes the servers that have been failed for
+// the dead server timeout, as long as it leaves the minimum quorum and
+// removes less than half the voters.
+func (a *Autopilot) manage() error {
+	res, voters, err := a.observe()
+	if err != nil {
+		return err
+	}
+	stable := a.ServerStabilizationTime.Milliseconds()
+	dead := a.DeadServerTimeout.Milliseconds()
+	var failedVoters, failedNonVoters []*api.ServerHealth
+	voterCount := 0
+	for _, server := range res.Servers {
+		if server.Voter {
+			voterCount++
+		}
+		switch {
+		case !server.Voter && voters[server.Id] && server.Healthy &&
+			server.StableMs >= stable:
+			if err := a.raft.Join(server.Id, server.RpcAddr, true); err != nil {
+				return err
+			}
+			a.logger.Info("promoted server", zap.String("id", server.Id))
+		case server.FailedMs >= dead && server.Voter:
+			failedVoters = append(failedVoters, server)
+		case server.FailedMs >= dead:
+			failedNonVoters = append(failedNonVoters, server)
+		}
+	}
+	for _, server := range failedNonVoters {
+		if err := a.remove(server); err != nil {
+			return err
+		}
+	}
+	if len(failedVoters) == 0 {
+		return nil
+	}
+	// removing half the voters or more would follow a partition rather than
+	// failures, which the removals can't be committed through anyway
+	if len(failedVoters)*2 >= voterCount {
+		a.logger.Warn(
+			"keeping failed servers, they're half the voters or more",
+			zap.Int("failed", len(failedVoters)),
+			zap.Int("voters", voterCount),
+		)
+		return nil
+	}
+	sort.Slice(failedVoters, func(i, j int) bool {
+		return failedVoters[i].FailedMs > failedVoters[j].FailedMs
+	})
+	for _, server := range failedVoters {
+		if voterCount-1 < a.MinQuorum {
+			a.logger.Warn(
+				"keeping failed server for the minimum quorum",
+				zap.String("id", server.Id),
+				zap.Int("min_quorum", a.MinQuorum),
+			)
+			return nil
+		}
+		if err := a.remove(server); err != nil {
+			return err
+		}
+		voterCount--
+	}
+	return nil
+}
+
+// remove removes the failed server from the cluster.
+func (a *Autopilot) remove(server *api.ServerHealth) error {
+	if err := a.raft.Leave(server.Id); err != nil {
+		return err
+	}
+	a.logger.Info(
+		"removed failed server",
+		zap.String("id", server.Id),
+		zap.Duration(
+			"failed",
+			time.Duration(server.FailedMs)*time.Millisecond,
+		),
+	)
+	return nil
+}
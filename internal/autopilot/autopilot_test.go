@@ -0,0 +1,218 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/discovery"
+)
+
+func TestAutopilotPromotesStableServers(t *testing.T) {
+	r := newFakeRaft("0")
+	a, now := setupAutopilot(t, r, Config{})
+	members := &fakeMembers{peers: []discovery.Peer{
+		{Name: "0", Voter: true},
+		{Name: "1", Voter: true},
+		{Name: "2", Voter: false},
+	}}
+	a.members = members
+
+	// the voters join as non-voters
+	require.NoError(t, a.Join("1", "addr-1", true))
+	require.NoError(t, a.Join("2", "addr-2", false))
+	require.False(t, r.servers["1"].Voter)
+	require.False(t, r.servers["2"].Voter)
+
+	require.NoError(t, a.manage())
+	*now = now.Add(5 * time.Second)
+	// lagging servers aren't healthy, so they start over
+	r.servers["1"].IndexLag = 1000
+	require.NoError(t, a.manage())
+	r.servers["1"].IndexLag = 0
+	require.NoError(t, a.manage())
+	*now = now.Add(5 * time.Second)
+	require.NoError(t, a.manage())
+	require.False(t, r.servers["1"].Voter)
+
+	*now = now.Add(5 * time.Second)
+	require.NoError(t, a.manage())
+	require.True(t, r.servers["1"].Voter)
+	require.False(t, r.servers["2"].Voter, "replicas aren't promoted")
+
+	// joining again doesn't demote them
+	require.NoError(t, a.Join("1", "addr-1", true))
+	require.True(t, r.servers["1"].Voter)
+
+	res, err := a.ServerHealth()
+	require.NoError(t, err)
+	require.True(t, res.Healthy)
+	require.Equal(t, int32(0), res.FailureTolerance)
+}
+
+func TestAutopilotRemovesDeadServers(t *testing.T) {
+	r := newFakeRaft("0")
+	r.join("1", true)
+	r.join("2", true)
+	r.join("3", true)
+	r.join("4", true)
+	r.join("5", false)
+	a, now := setupAutopilot(t, r, Config{
+		DeadServerTimeout: time.Minute,
+		MinQuorum:         4,
+	})
+	members := &fakeMembers{}
+	a.members = members
+	members.set("0", "1", "2", "3", "4", "5")
+
+	res, err := a.ServerHealth()
+	require.NoError(t, err)
+	require.True(t, res.Healthy)
+	require.Equal(t, int32(2), res.FailureTolerance)
+
+	// a blip doesn't remove the failed servers
+	require.NoError(t, a.Fail("3"))
+	members.set("0", "1", "2", "4")
+	require.NoError(t, a.manage())
+	*now = now.Add(30 * time.Second)
+	members.set("0", "1", "2", "3", "4")
+	require.NoError(t, a.manage())
+	members.set("0", "1", "2", "4")
+	require.NoError(t, a.manage())
+	*now = now.Add(45 * time.Second)
+	require.NoError(t, a.manage())
+	require.Contains(t, r.servers, "3")
+
+	res, err = a.ServerHealth()
+	require.NoError(t, err)
+	require.False(t, res.Healthy)
+	require.Equal(t, int32(1), res.FailureTolerance)
+
+	// they're removed once they've been failed for the timeout, but for
+	// the minimum quorum
+	members.set("0", "1", "2")
+	require.NoError(t, a.manage())
+	*now = now.Add(time.Minute)
+	require.NoError(t, a.manage())
+	require.NotContains(t, r.servers, "5")
+	require.Len(t, r.servers, 4)
+	require.NotContains(t, r.servers, "3", "the longest failed goes first")
+	require.Contains(t, r.servers, "4")
+}
+
+func TestAutopilotKeepsPartitionedServers(t *testing.T) {
+	r := newFakeRaft("0")
+	r.join("1", true)
+	r.join("2", true)
+	a, now := setupAutopilot(t, r, Config{DeadServerTimeout: time.Minute})
+	members := &fakeMembers{}
+	a.members = members
+	members.set("0", "1")
+	require.NoError(t, a.manage())
+
+	// removing half the voters or more follows a partition
+	members.set("0")
+	require.NoError(t, a.manage())
+	*now = now.Add(2 * time.Minute)
+	require.NoError(t, a.manage())
+	require.Len(t, r.servers, 3)
+
+	// the followers don't manage the servers
+	r.leader = false
+	require.ErrorIs(t, a.manage(), raft.ErrNotLeader)
+	_, err := a.ServerHealth()
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func setupAutopilot(t *testing.T, r *fakeRaft, config Config) (
+	*Autopilot,
+	*time.Time,
+) {
+	t.Helper()
+	a := New(r, config)
+	now := time.Unix(0, 0)
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+// fakeRaft stands in for the cluster, whose servers are all in contact with
+// the leader unless the tests change their health.
+type fakeRaft struct {
+	leader  bool
+	servers map[string]*api.ServerHealth
+}
+
+func newFakeRaft(leader string) *fakeRaft {
+	r := &fakeRaft{leader: true, servers: map[string]*api.ServerHealth{}}
+	r.join(leader, true)
+	r.servers[leader].IsLeader = true
+	return r
+}
+
+func (r *fakeRaft) join(id string, voter bool) {
+	r.servers[id] = &api.ServerHealth{
+		Id:      id,
+		RpcAddr: "addr-" + id,
+		Voter:   voter,
+		Term:    1,
+	}
+}
+
+func (r *fakeRaft) Join(id, addr string, voter bool) error {
+	if server, ok := r.servers[id]; ok {
+		server.Voter = voter
+		return nil
+	}
+	r.join(id, voter)
+	return nil
+}
+
+func (r *fakeRaft) Leave(id string) error {
+	delete(r.servers, id)
+	return nil
+}
+
+func (r *fakeRaft) ServerHealth() ([]*api.ServerHealth, error) {
+	if !r.leader {
+		return nil, raft.ErrNotLeader
+	}
+	var servers []*api.ServerHealth
+	for _, server := range r.servers {
+		servers = append(servers, proto.Clone(server).(*api.ServerHealth))
+	}
+	return servers, nil
+}
+
+func (r *fakeRaft) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for _, server := range r.servers {
+		servers = append(servers, &api.Server{
+			Id:      server.Id,
+			RpcAddr: server.RpcAddr,
+		})
+	}
+	return servers, nil
+}
+
+type fakeMembers struct {
+	peers []discovery.Peer
+}
+
+// set sets the alive members, which all want to vote but 5.
+func (m *fakeMembers) set(names ...string) {
+	m.peers = nil
+	for _, name := range names {
+		m.peers = append(m.peers, discovery.Peer{
+			Name:  name,
+			Voter: name != "5",
+		})
+	}
+}
+
+func (m *fakeMembers) Peers() []discovery.Peer {
+	return m.peers
+}
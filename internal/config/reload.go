@@ -0,0 +1,291 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.uber.org/zap"
+)
+
+// TLSReloader keeps the certificate and CA of a TLS configuration loaded from
+// their files, reloading them when they change, so connections use rotated
+// certificates without restarting. It exports when its certificate expires
+// as a gauge until it's closed.
+type TLSReloader struct {
+	cfg    TLSConfig
+	logger *zap.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	ca   *x509.CertPool
+
+	metrics *metric.Registry
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewTLSReloader loads the files of the TLS configuration.
+func NewTLSReloader(cfg TLSConfig) (*TLSReloader, error) {
+	r := &TLSReloader{
+		cfg:    cfg,
+		logger: zap.L().Named("tls"),
+		done:   make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if err := r.setupMetrics(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate, key and CA from their files. If loading any
+// of them fails, the reloader keeps the current ones.
+func (r *TLSReloader) Reload() error {
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" && r.cfg.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		if c.Leaf == nil {
+			if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		cert = &c
+	}
+	var ca *x509.CertPool
+	if r.cfg.CAFile != "" {
+		b, err := os.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return fmt.Errorf(
+				"failed to parse root certificate: %q",
+				r.cfg.CAFile,
+			)
+		}
+	}
+	r.mu.Lock()
+	r.cert = cert
+	r.ca = ca
+	r.mu.Unlock()
+	return nil
+}
+
+// TLSConfig returns a TLS configuration like SetupTLSConfig's, whose
+// connections use the certificate and CA last loaded.
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{}
+	if r.certificate() != nil {
+		if r.cfg.Server {
+			tlsConfig.GetCertificate = func(
+				*tls.ClientHelloInfo,
+			) (*tls.Certificate, error) {
+				return r.certificate(), nil
+			}
+		} else {
+			tlsConfig.GetClientCertificate = func(
+				*tls.CertificateRequestInfo,
+			) (*tls.Certificate, error) {
+				return r.certificate(), nil
+			}
+		}
+	}
+	if r.pool() == nil {
+		return tlsConfig
+	}
+	tlsConfig.ServerName = r.cfg.ServerAddress
+	if r.cfg.Server {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = r.pool()
+		// servers verify clients with the CAs of the configuration they
+		// return for each client
+		tlsConfig.GetConfigForClient = func(
+			*tls.ClientHelloInfo,
+		) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = r.pool()
+			return c, nil
+		}
+	} else {
+		// clients verify servers with a fixed pool, so they verify them
+		// themselves with the current one instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyServer
+	}
+	return tlsConfig
+}
+
+// verifyServer verifies the server's certificate chain against the current
+// CAs, and that it's for the server's name.
+func (r *TLSReloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	name := cs.ServerName
+	if name == "" {
+		// no name is sent for IP addresses
+		name = r.cfg.ServerAddress
+	}
+	if name == "" {
+		return fmt.Errorf("no server name to verify the certificate for")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         r.pool(),
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (r *TLSReloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *TLSReloader) pool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ca
+}
+
+// NotAfter returns when the certificate expires, the zero time if there's
+// none.
+func (r *TLSReloader) NotAfter() time.Time {
+	cert := r.certificate()
+	if cert == nil {
+		return time.Time{}
+	}
+	return cert.Leaf.NotAfter
+}
+
+// Watch reloads the files whenever they change until the reloader's closed.
+// It watches their directories, as Kubernetes secrets and cert-manager
+// replace the files rather than writing to them.
+func (r *TLSReloader) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]struct{})
+	for _, file := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = struct{}{}
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	r.watcher = watcher
+	go r.watch()
+	return nil
+}
+
+func (r *TLSReloader) watch() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Error("failed to watch TLS files", zap.Error(err))
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				// a certificate may not match its key until both are
+				// replaced, and the last event reloads them
+				r.logger.Warn(
+					"failed to reload TLS files",
+					zap.String("cert", r.cfg.CertFile),
+					zap.Error(err),
+				)
+				continue
+			}
+			r.logger.Debug(
+				"reloaded TLS files",
+				zap.String("cert", r.cfg.CertFile),
+				zap.Time("not_after", r.NotAfter()),
+			)
+		}
+	}
+}
+
+// Close stops watching the files and exporting the certificate's expiry.
+func (r *TLSReloader) Close() error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	close(r.done)
+	metricproducer.GlobalManager().DeleteProducer(r.metrics)
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
+
+// setupMetrics registers a gauge of when the certificate expires, labeled
+// with its file and whether it's a server's or a client's, so alerts fire
+// before a failed rotation lets it expire.
+func (r *TLSReloader) setupMetrics() error {
+	r.metrics = metric.NewRegistry()
+	if r.cfg.CertFile == "" {
+		return nil
+	}
+	usage := "client"
+	if r.cfg.Server {
+		usage = "server"
+	}
+	expiry, err := r.metrics.AddFloat64DerivedGauge(
+		"tls/certificate_expiry_timestamp_seconds",
+		metric.WithDescription("Unix time the certificate expires at"),
+		metric.WithUnit(metricdata.UnitDimensionless),
+		metric.WithLabelKeys("file", "usage"),
+	)
+	if err != nil {
+		return err
+	}
+	err = expiry.UpsertEntry(
+		func() float64 {
+			return float64(r.NotAfter().Unix())
+		},
+		metricdata.NewLabelValue(r.cfg.CertFile),
+		metricdata.NewLabelValue(usage),
+	)
+	if err != nil {
+		return err
+	}
+	metricproducer.GlobalManager().AddProducer(r.metrics)
+	return nil
+}
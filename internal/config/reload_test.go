@@ -0,0 +1,157 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	serverFiles := TLSConfig{
+		CertFile:      filepath.Join(dir, "server.pem"),
+		KeyFile:       filepath.Join(dir, "server-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	}
+	clientFiles := TLSConfig{
+		CertFile:      filepath.Join(dir, "client.pem"),
+		KeyFile:       filepath.Join(dir, "client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+	}
+	writeCerts(t, serverFiles, clientFiles, 1)
+
+	server, err := NewTLSReloader(serverFiles)
+	require.NoError(t, err)
+	defer server.Close()
+	client, err := NewTLSReloader(clientFiles)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, server.Watch())
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig())
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// the handshake verifies the client's certificate
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dial := func() (*x509.Certificate, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), client.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+	cert, err := dial()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), cert.SerialNumber.Int64())
+
+	// rotating the certificates and their CA changes what the server
+	// presents and verifies without restarting it, while the client keeps
+	// trusting the old CA until it reloads
+	notAfter := server.NotAfter()
+	writeCerts(t, serverFiles, clientFiles, 2)
+	require.Eventually(t, func() bool {
+		return server.NotAfter().After(notAfter)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = dial()
+	require.Error(t, err)
+
+	require.NoError(t, client.Reload())
+	cert, err = dial()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), cert.SerialNumber.Int64())
+
+	// files that fail to load leave the current certificates in place
+	require.NoError(t, os.WriteFile(clientFiles.KeyFile, []byte("key"), 0600))
+	require.Error(t, client.Reload())
+	_, err = dial()
+	require.NoError(t, err)
+}
+
+// writeCerts writes a new CA and a server and client certificate it signs,
+// with the serial number, to the files of the configurations. The later the
+// serial, the later the certificates expire.
+func writeCerts(t *testing.T, server, client TLSConfig, serial int64) {
+	t.Helper()
+	notAfter := time.Now().Add(time.Duration(serial) * time.Hour)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err = x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	writePEM(t, server.CAFile, "CERTIFICATE", caDER)
+
+	for _, cfg := range []TLSConfig{server, client} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		usage := x509.ExtKeyUsageClientAuth
+		if cfg.Server {
+			usage = x509.ExtKeyUsageServerAuth
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "root"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		// the key's written first, so the certificate's event reloads a
+		// matching pair
+		writePEM(t, cfg.KeyFile, "EC PRIVATE KEY", keyDER)
+		writePEM(t, cfg.CertFile, "CERTIFICATE", der)
+	}
+}
+
+// writePEM replaces the file with the PEM encoded block, the way secrets are
+// rotated.
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(
+		tmp,
+		pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}),
+		0600,
+	))
+	require.NoError(t, os.Rename(tmp, path))
+}
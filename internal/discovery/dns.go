@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsTimeout bounds each lookup of the members.
+const dnsTimeout = 5 * time.Second
+
+// dns looks the members up by the DNS records of the config's DNSName.
+type dns struct {
+	name     string
+	port     int
+	resolver *net.Resolver
+}
+
+func newDNS(config Config) *dns {
+	d := &dns{
+		name:     config.DNSName,
+		port:     config.DNSPort,
+		resolver: config.Resolver,
+	}
+	if d.resolver == nil {
+		d.resolver = net.DefaultResolver
+	}
+	return d
+}
+
+// lookup looks the members up by their SRV records, or by their A and AAAA
+// records if the port is set.
+func (d *dns) lookup() ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	if d.port == 0 {
+		return d.lookupSRV(ctx)
+	}
+	return d.lookupHost(ctx)
+}
+
+// lookupSRV returns the targets of the SRV records as the members, named by
+// the first labels of the targets, such as dislog-0 for
+// dislog-0.dislog.default.svc.cluster.local.
+func (d *dns) lookupSRV(ctx context.Context) ([]Peer, error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		peers = append(peers, Peer{
+			Name:    firstLabel(target),
+			RPCAddr: net.JoinHostPort(target, strconv.Itoa(int(srv.Port))),
+			Voter:   true,
+		})
+	}
+	return peers, nil
+}
+
+// lookupHost returns the addresses of the host, with the port, as the
+// members, named by the first labels of the names their PTR records point
+// to, or by their addresses if they have none.
+func (d *dns) lookupHost(ctx context.Context) ([]Peer, error) {
+	addrs, err := d.resolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, addr := range addrs {
+		name := addr
+		if names, err := d.resolver.LookupAddr(ctx, addr); err == nil &&
+			len(names) != 0 {
+			name = firstLabel(strings.TrimSuffix(names[0], "."))
+		}
+		peers = append(peers, Peer{
+			Name:    name,
+			RPCAddr: net.JoinHostPort(addr, strconv.Itoa(d.port)),
+			Voter:   true,
+		})
+	}
+	return peers, nil
+}
+
+// firstLabel returns the first label of the domain name.
+func firstLabel(name string) string {
+	if i := strings.Index(name, "."); i != -1 {
+		return name[:i]
+	}
+	return name
+}
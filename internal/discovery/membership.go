@@ -1,11 +1,24 @@
 package discovery
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
-	"net"
 
 	"github.com/hashicorp/serf/serf"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricproducer"
+
+	api "github.com/pouriaamini/proglog/api/v1"
 )
 
 type Membership struct {
@@ -14,6 +27,7 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+	metrics *metric.Registry
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
@@ -25,6 +39,9 @@ func New(handler Handler, config Config) (*Membership, error) {
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
+	if err := c.setupMetrics(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -33,8 +50,47 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// KeyringFile is the path to a JSON list of the base64 encoded keys
+	// encrypting the gossip, the first of which is the primary key. Serf
+	// writes the keys installed and removed at runtime back to it. Empty
+	// leaves the gossip unencrypted.
+	KeyringFile string
+	// AllowedNodes, if set, are the names of the only members passed to the
+	// handler.
+	AllowedNodes []string
+	// JoinToken, if set, is the token members must have in their join_token
+	// tag to be passed to the handler. The member's own tag is set to it.
+	JoinToken string
+	// Provider is the provider NewProvider creates: ProviderSerf, the
+	// default, ProviderStatic or ProviderDNS. The fields above, but the node
+	// name and the rpc_addr tag, only configure the Serf provider.
+	Provider string
+	// StaticPeers are the members of the static provider, as
+	// name=rpc_addr.
+	StaticPeers []string
+	// DNSName is the name the DNS provider looks the members up by. Without
+	// DNSPort, it's the name of SRV records, such as
+	// _rpc._tcp.dislog.default.svc.cluster.local, whose targets are the
+	// members, named by their first labels. With DNSPort, it's a host whose
+	// addresses are the members, named by the first labels of their PTR
+	// records, or by their addresses.
+	DNSName string
+	DNSPort int
+	// Resolver looks the members up for the DNS provider,
+	// net.DefaultResolver by default.
+	Resolver *net.Resolver
+	// RefreshInterval is how often the static and DNS providers join the
+	// members the handler failed to, and the DNS provider looks them up
+	// again, 10s by default.
+	RefreshInterval time.Duration
 }
 
+// joinTokenTag is the tag of the members' join token.
+const joinTokenTag = "join_token"
+
+// ErrRejected is the error of the members that aren't allowed to join.
+var ErrRejected = errors.New("member rejected")
+
 func (m *Membership) setupSerf() (err error) {
 	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
 	if err != nil {
@@ -47,6 +103,21 @@ func (m *Membership) setupSerf() (err error) {
 	m.events = make(chan serf.Event)
 	config.EventCh = m.events
 	config.Tags = m.Tags
+	if m.JoinToken != "" {
+		config.Tags = make(map[string]string, len(m.Tags)+1)
+		for k, v := range m.Tags {
+			config.Tags[k] = v
+		}
+		config.Tags[joinTokenTag] = m.JoinToken
+	}
+	if m.KeyringFile != "" {
+		keyring, err := loadKeyring(m.KeyringFile)
+		if err != nil {
+			return err
+		}
+		config.MemberlistConfig.Keyring = keyring
+		config.KeyringFile = m.KeyringFile
+	}
 	config.NodeName = m.Config.NodeName
 	m.serf, err = serf.Create(config)
 	if err != nil {
@@ -62,45 +133,142 @@ func (m *Membership) setupSerf() (err error) {
 	return nil
 }
 
+// loadKeyring loads the keyring of the keys in the file, the first of which
+// is the primary key.
+func loadKeyring(path string) (*memberlist.Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, fmt.Errorf("keyring file %s: %w", path, err)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("keyring file %s has no keys", path)
+	}
+	keys := make([][]byte, 0, len(encoded))
+	for _, key := range encoded {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("keyring file %s: %w", path, err)
+		}
+		keys = append(keys, b)
+	}
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(name string) error
 }
 
+// Locator is implemented by the handlers that track the zones of the
+// members, from their zone tags, as they join or update their tags.
+type Locator interface {
+	Locate(name, zone string)
+}
+
+// Failer is implemented by the handlers that handle the failed members apart
+// from the members leaving, as they may only be unreachable for a while.
+type Failer interface {
+	Fail(name string) error
+}
+
 func (m *Membership) eventHandler() {
 	for e := range m.events {
 		switch e.EventType() {
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
+					m.locate(member)
 					continue
 				}
 				m.handleJoin(member)
 			}
+		case serf.EventMemberUpdate:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) || m.admit(member) == nil {
+					m.locate(member)
+				}
+			}
 		case serf.EventMemberLeave, serf.EventMemberFailed:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
 					return
 				}
-				m.handleLeave(member)
+				if m.admit(member) != nil {
+					continue
+				}
+				m.handleLeave(e.EventType(), member)
 			}
 		}
 	}
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(
+	if err := m.admit(member); err != nil {
+		recordRejected()
+		m.logger.Warn(
+			"rejected member",
+			zap.Error(err),
+			zap.String("name", member.Name),
+			zap.String("rpc_addr", member.Tags["rpc_addr"]),
+		)
+		return
+	}
+	m.locate(member)
+	err := m.handler.Join(
 		member.Name,
 		member.Tags["rpc_addr"],
-	); err != nil {
+		member.Tags["role"] != api.Role_NON_VOTER.String(),
+	)
+	recordEvent(serf.EventMemberJoin, err)
+	if err != nil {
 		m.logError(err, "failed to join", member)
 	}
 }
 
-func (m *Membership) handleLeave(member serf.Member) {
-	if err := m.handler.Leave(
-		member.Name,
-	); err != nil {
+// admit returns an error wrapping ErrRejected if the member isn't one of the
+// allowed nodes or doesn't have the join token.
+func (m *Membership) admit(member serf.Member) error {
+	if len(m.AllowedNodes) != 0 {
+		allowed := false
+		for _, name := range m.AllowedNodes {
+			if name == member.Name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s isn't allowed", ErrRejected, member.Name)
+		}
+	}
+	if m.JoinToken != "" && subtle.ConstantTimeCompare(
+		[]byte(member.Tags[joinTokenTag]),
+		[]byte(m.JoinToken),
+	) != 1 {
+		return fmt.Errorf("%w: invalid join token", ErrRejected)
+	}
+	return nil
+}
+
+// locate passes the member's zone to the handler, if it tracks them.
+func (m *Membership) locate(member serf.Member) {
+	if locator, ok := m.handler.(Locator); ok {
+		locator.Locate(member.Name, member.Tags["zone"])
+	}
+}
+
+func (m *Membership) handleLeave(event serf.EventType, member serf.Member) {
+	var err error
+	if failer, ok := m.handler.(Failer); ok && event == serf.EventMemberFailed {
+		err = failer.Fail(member.Name)
+	} else {
+		err = m.handler.Leave(member.Name)
+	}
+	recordEvent(event, err)
+	if err != nil {
 		m.logError(err, "failed to leave", member)
 	}
 }
@@ -113,13 +281,84 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// Peers returns the alive members that are admitted, the local one
+// included.
+func (m *Membership) Peers() []Peer {
+	var peers []Peer
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		if !m.isLocal(member) && m.admit(member) != nil {
+			continue
+		}
+		peers = append(peers, Peer{
+			Name:    member.Name,
+			RPCAddr: member.Tags["rpc_addr"],
+			Voter:   member.Tags["role"] != api.Role_NON_VOTER.String(),
+			Tags:    member.Tags,
+		})
+	}
+	return peers
+}
+
+// SetTag sets the local member's tag, which the other members learn as it
+// gossips.
+func (m *Membership) SetTag(key, value string) error {
+	local := m.serf.LocalMember().Tags
+	tags := make(map[string]string, len(local)+1)
+	for k, v := range local {
+		tags[k] = v
+	}
+	tags[key] = value
+	return m.serf.SetTags(tags)
+}
+
+// InstallKey installs the base64 encoded key on the keyring of every member,
+// so they decrypt the gossip encrypted with it.
+func (m *Membership) InstallKey(key string) error {
+	_, err := m.serf.KeyManager().InstallKey(key)
+	return err
+}
+
+// UseKey makes the installed key the primary key of every member, which
+// they encrypt the gossip with.
+func (m *Membership) UseKey(key string) error {
+	_, err := m.serf.KeyManager().UseKey(key)
+	return err
+}
+
+// RemoveKey removes the key from the keyring of every member. The primary
+// key can't be removed.
+func (m *Membership) RemoveKey(key string) error {
+	_, err := m.serf.KeyManager().RemoveKey(key)
+	return err
+}
+
+// ListKeys lists the keys of the members' keyrings and their primary keys,
+// with how many members have each, and how many members there are.
+func (m *Membership) ListKeys() (
+	keys, primaryKeys map[string]int,
+	members int,
+	err error,
+) {
+	res, err := m.serf.KeyManager().ListKeys()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return res.Keys, res.PrimaryKeys, res.NumNodes, nil
+}
+
 func (m *Membership) Leave() error {
+	if m.metrics != nil {
+		metricproducer.GlobalManager().DeleteProducer(m.metrics)
+	}
 	return m.serf.Leave()
 }
 
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
-	if err == raft.ErrNotLeader {
+	if errors.Is(err, raft.ErrNotLeader) {
 		log = m.logger.Debug
 	}
 	log(
@@ -127,5 +366,6 @@ func (m *Membership) logError(err error, msg string, member serf.Member) {
 		zap.Error(err),
 		zap.String("name", member.Name),
 		zap.String("rpc_addr", member.Tags["rpc_addr"]),
+		zap.String("role", member.Tags["role"]),
 	)
 }
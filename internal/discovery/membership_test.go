@@ -1,13 +1,18 @@
 package discovery
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+
+	api "github.com/pouriaamini/proglog/api/v1"
 )
 
 func TestMembership(t *testing.T) {
@@ -21,11 +26,17 @@ func TestMembership(t *testing.T) {
 			0 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
 
+	voters := map[string]string{}
+	for i := 0; i < 2; i++ {
+		join := <-handler.joins
+		voters[join["id"]] = join["voter"]
+	}
+	require.Equal(t, map[string]string{"1": "true", "2": "false"}, voters)
+
 	require.NoError(t, m[2].Leave())
 
 	require.Eventually(t, func() bool {
-		return 2 == len(handler.joins) &&
-			3 == len(m[0].Members()) &&
+		return 3 == len(m[0].Members()) &&
 			serf.StatusLeft == m[0].Members()[2].Status &&
 			1 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
@@ -33,14 +44,110 @@ func TestMembership(t *testing.T) {
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
+func TestMembershipRejectsMembers(t *testing.T) {
+	secure := func(c *Config) {
+		c.AllowedNodes = []string{"0", "1", "2"}
+		c.JoinToken = "secret"
+	}
+	m, handler := setupMemberWith(t, nil, secure)
+	m, _ = setupMemberWith(t, m, secure)
+	// the third member has the token but isn't allowed, the fourth is
+	// allowed but doesn't have it
+	m, _ = setupMemberWith(t, m, func(c *Config) {
+		c.NodeName = "intruder"
+		c.JoinToken = "secret"
+	})
+	m, _ = setupMemberWith(t, m, func(c *Config) {
+		c.NodeName = "2"
+	})
+
+	require.Eventually(t, func() bool {
+		return 4 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+	// the rejected members never reach the handler
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, 1, len(handler.joins))
+	require.Equal(t, "1", (<-handler.joins)["id"])
+	require.ErrorIs(t, m[0].admit(m[2].serf.LocalMember()), ErrRejected)
+	require.ErrorIs(t, m[0].admit(m[3].serf.LocalMember()), ErrRejected)
+}
+
+func TestMembershipEncryptsGossip(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyring := func(name string, keys ...string) string {
+		path := filepath.Join(dir, name)
+		b, err := json.Marshal(keys)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0600))
+		return path
+	}
+	key := "T9jncgl9mbLus+baTTa7q7nPSUrXwbDi2dhbtqir37s="
+	newKey := "HvY8ubRZMgafUOWvrOadwOckVa1wN3QWAo46FVKbVN8="
+	keyrings := []string{
+		writeKeyring("0.json", key),
+		writeKeyring("1.json", key),
+	}
+	m, h := setupMemberWith(t, nil, func(c *Config) {
+		c.KeyringFile = keyrings[0]
+	})
+	m, _ = setupMemberWith(t, m, func(c *Config) {
+		c.KeyringFile = keyrings[1]
+	})
+	require.Eventually(t, func() bool {
+		return 1 == len(h.joins) && 2 == len(m[0].Members())
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// members without the key can't join
+	_, err := New(&handler{}, Config{
+		NodeName:       "2",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		KeyringFile:    writeKeyring("2.json", newKey),
+		StartJoinAddrs: []string{m[0].BindAddr},
+	})
+	require.Error(t, err)
+
+	// rotating the key changes every member's keyring and keyring file
+	require.NoError(t, m[1].InstallKey(newKey))
+	require.NoError(t, m[1].UseKey(newKey))
+	require.NoError(t, m[1].RemoveKey(key))
+	keys, primaryKeys, members, err := m[0].ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{newKey: 2}, keys)
+	require.Equal(t, map[string]int{newKey: 2}, primaryKeys)
+	require.Equal(t, 2, members)
+	for _, path := range keyrings {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(b), newKey)
+		require.NotContains(t, string(b), key)
+	}
+}
+
 func setupMember(t *testing.T, members []*Membership) (
 	[]*Membership, *handler,
+) {
+	return setupMemberWith(t, members, func(*Config) {})
+}
+
+// setupMemberWith sets up a member joining the first of the members, with
+// the config configure changes.
+func setupMemberWith(
+	t *testing.T,
+	members []*Membership,
+	configure func(*Config),
+) (
+	[]*Membership, *handler,
 ) {
 	id := len(members)
 	ports := dynaport.Get(1)
 	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+	role := api.Role_VOTER
+	if id == 2 {
+		role = api.Role_NON_VOTER
+	}
 	tags := map[string]string{
 		"rpc_addr": addr,
+		"role":     role.String(),
 	}
 	c := Config{
 		NodeName: fmt.Sprintf("%d", id),
@@ -56,6 +163,7 @@ func setupMember(t *testing.T, members []*Membership) (
 			members[0].BindAddr,
 		}
 	}
+	configure(&c)
 	m, err := New(h, c)
 	require.NoError(t, err)
 	members = append(members, m)
@@ -67,11 +175,12 @@ type handler struct {
 	leaves chan string
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
 	if h.joins != nil {
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": fmt.Sprintf("%t", voter),
 		}
 	}
 	return nil
@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/hashicorp/serf/serf"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	memberEvents = stats.Int64(
+		"discovery/member_events",
+		"Number of Serf member events handled",
+		stats.UnitDimensionless,
+	)
+	handlerErrors = stats.Int64(
+		"discovery/handler_errors",
+		"Number of member events the handler failed to apply",
+		stats.UnitDimensionless,
+	)
+	rejectedMembers = stats.Int64(
+		"discovery/rejected_members",
+		"Number of members rejected for their name or join token",
+		stats.UnitDimensionless,
+	)
+	eventKey = tag.MustNewKey("event")
+)
+
+// Views are the views of the membership's measures, registered by New.
+var Views = []*view.View{
+	{
+		Name:        memberEvents.Name(),
+		Description: memberEvents.Description(),
+		Measure:     memberEvents,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{eventKey},
+	},
+	{
+		Name:        handlerErrors.Name(),
+		Description: handlerErrors.Description(),
+		Measure:     handlerErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{eventKey},
+	},
+	{
+		Name:        rejectedMembers.Name(),
+		Description: rejectedMembers.Description(),
+		Measure:     rejectedMembers,
+		Aggregation: view.Count(),
+	},
+}
+
+// memberStatuses are the statuses the members gauge counts members in.
+var memberStatuses = []serf.MemberStatus{
+	serf.StatusAlive,
+	serf.StatusLeaving,
+	serf.StatusLeft,
+	serf.StatusFailed,
+}
+
+// setupMetrics registers a gauge counting the members Serf knows of by
+// status, labeled with the node's name. Leave removes it.
+func (m *Membership) setupMetrics() error {
+	if err := view.Register(Views...); err != nil {
+		return err
+	}
+	r := metric.NewRegistry()
+	members, err := r.AddInt64DerivedGauge(
+		"discovery/members",
+		metric.WithDescription("Number of cluster members by status"),
+		metric.WithConstLabel(map[metricdata.LabelKey]metricdata.LabelValue{
+			{Key: "node"}: metricdata.NewLabelValue(m.Config.NodeName),
+		}),
+		metric.WithLabelKeys("status"),
+	)
+	if err != nil {
+		return err
+	}
+	for _, status := range memberStatuses {
+		status := status
+		err = members.UpsertEntry(func() int64 {
+			var n int64
+			for _, member := range m.serf.Members() {
+				if member.Status == status {
+					n++
+				}
+			}
+			return n
+		}, metricdata.NewLabelValue(status.String()))
+		if err != nil {
+			return err
+		}
+	}
+	metricproducer.GlobalManager().AddProducer(r)
+	m.metrics = r
+	return nil
+}
+
+// recordEvent counts the member event, and the handler's failure to apply it
+// if err isn't nil.
+func recordEvent(event serf.EventType, err error) {
+	ctx, _ := tag.New(
+		context.Background(),
+		tag.Upsert(eventKey, event.String()),
+	)
+	stats.Record(ctx, memberEvents.M(1))
+	if err != nil {
+		stats.Record(ctx, handlerErrors.M(1))
+	}
+}
+
+// recordRejected counts a member rejected before it reached the handler.
+func recordRejected() {
+	stats.Record(context.Background(), rejectedMembers.M(1))
+}
@@ -0,0 +1,223 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// Providers of the members of the cluster.
+const (
+	// ProviderSerf discovers the members gossiping with Serf.
+	ProviderSerf = "serf"
+	// ProviderStatic discovers the members of a fixed list.
+	ProviderStatic = "static"
+	// ProviderDNS discovers the members by looking up their DNS records.
+	ProviderDNS = "dns"
+)
+
+// Provider discovers the members of the cluster and passes them to its
+// handler as they join and leave.
+type Provider interface {
+	// Peers returns the members the provider knows of, the local member
+	// included when it knows of it.
+	Peers() []Peer
+	// Leave stops discovering the members, and leaves the cluster if the
+	// provider's members gossip.
+	Leave() error
+}
+
+// Peer is a member of the cluster a provider discovered.
+type Peer struct {
+	Name    string
+	RPCAddr string
+	Voter   bool
+	// Tags are the tags the member gossips, nil if the provider's members
+	// don't gossip.
+	Tags map[string]string
+}
+
+var _ Provider = (*Membership)(nil)
+
+// NewProvider creates the provider of the config's Provider, passing the
+// members it discovers to the handler.
+func NewProvider(handler Handler, config Config) (Provider, error) {
+	switch config.Provider {
+	case "", ProviderSerf:
+		m, err := New(handler, config)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case ProviderStatic:
+		peers, err := parseStaticPeers(config.StaticPeers)
+		if err != nil {
+			return nil, err
+		}
+		return newPoller(handler, config, ProviderStatic, func() ([]Peer, error) {
+			return peers, nil
+		}), nil
+	case ProviderDNS:
+		if config.DNSName == "" {
+			return nil, fmt.Errorf("the dns provider needs a name to look up")
+		}
+		return newPoller(handler, config, ProviderDNS, newDNS(config).lookup), nil
+	}
+	return nil, fmt.Errorf("unknown discovery provider: %s", config.Provider)
+}
+
+// parseStaticPeers parses the peers from their name=rpc_addr.
+func parseStaticPeers(peers []string) ([]Peer, error) {
+	var parsed []Peer
+	for _, peer := range peers {
+		name, addr, ok := strings.Cut(peer, "=")
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("static peer %q isn't name=rpc_addr", peer)
+		}
+		parsed = append(parsed, Peer{Name: name, RPCAddr: addr, Voter: true})
+	}
+	return parsed, nil
+}
+
+// defaultRefreshInterval is how often the pollers look the members up again,
+// unless they're configured otherwise.
+const defaultRefreshInterval = 10 * time.Second
+
+// poller is a provider looking the members up every RefreshInterval. It
+// joins the members it finds, again until the handler joins them, and fails
+// the joined members a successful lookup no longer finds, as a lookup may
+// miss a member that's only restarting or unreachable. Handlers that aren't
+// Failers leave them instead.
+type poller struct {
+	Config
+	handler Handler
+	lookup  func() ([]Peer, error)
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	peers  []Peer
+	joined map[string]Peer
+
+	done   chan struct{}
+	closed chan struct{}
+}
+
+func newPoller(
+	handler Handler,
+	config Config,
+	name string,
+	lookup func() ([]Peer, error),
+) *poller {
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultRefreshInterval
+	}
+	p := &poller{
+		Config:  config,
+		handler: handler,
+		lookup:  lookup,
+		logger:  zap.L().Named(name),
+		joined:  make(map[string]Peer),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *poller) run() {
+	defer close(p.closed)
+	ticker := time.NewTicker(p.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		p.refresh()
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh looks the members up and passes the changes to the handler.
+func (p *poller) refresh() {
+	peers, err := p.lookup()
+	if err != nil {
+		p.logger.Error("failed to look up members", zap.Error(err))
+		return
+	}
+	p.mu.Lock()
+	p.peers = peers
+	p.mu.Unlock()
+	found := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		found[peer.Name] = true
+		if p.isLocal(peer) {
+			continue
+		}
+		if joined, ok := p.joined[peer.Name]; ok && joined.RPCAddr == peer.RPCAddr &&
+			joined.Voter == peer.Voter {
+			continue
+		}
+		if err := p.handler.Join(peer.Name, peer.RPCAddr, peer.Voter); err != nil {
+			p.logError(err, "failed to join", peer)
+			continue
+		}
+		p.joined[peer.Name] = peer
+	}
+	for name, peer := range p.joined {
+		if found[name] {
+			continue
+		}
+		// the member joins again if a later lookup finds it
+		var err error
+		if failer, ok := p.handler.(Failer); ok {
+			err = failer.Fail(name)
+		} else {
+			err = p.handler.Leave(name)
+		}
+		if err != nil {
+			p.logError(err, "failed to leave", peer)
+			continue
+		}
+		delete(p.joined, name)
+	}
+}
+
+// isLocal returns whether the peer is the local member, by its name or its
+// RPC address.
+func (p *poller) isLocal(peer Peer) bool {
+	return peer.Name == p.NodeName ||
+		(p.Tags["rpc_addr"] != "" && peer.RPCAddr == p.Tags["rpc_addr"])
+}
+
+func (p *poller) logError(err error, msg string, peer Peer) {
+	log := p.logger.Error
+	if errors.Is(err, raft.ErrNotLeader) {
+		log = p.logger.Debug
+	}
+	log(
+		msg,
+		zap.Error(err),
+		zap.String("name", peer.Name),
+		zap.String("rpc_addr", peer.RPCAddr),
+	)
+}
+
+// Peers returns the members of the last successful lookup.
+func (p *poller) Peers() []Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Peer(nil), p.peers...)
+}
+
+// Leave stops looking the members up.
+func (p *poller) Leave() error {
+	close(p.done)
+	<-p.closed
+	return nil
+}
@@ -0,0 +1,300 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestStaticProvider(t *testing.T) {
+	h := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	p, err := NewProvider(h, Config{
+		NodeName: "0",
+		Provider: ProviderStatic,
+		StaticPeers: []string{
+			"0=127.0.0.1:8400",
+			"1=127.0.0.1:8410",
+			"2=127.0.0.1:8420",
+		},
+	})
+	require.NoError(t, err)
+	defer p.Leave()
+
+	// the local member isn't joined
+	joins := map[string]string{}
+	for i := 0; i < 2; i++ {
+		join := <-h.joins
+		joins[join["id"]] = join["addr"]
+	}
+	require.Equal(t, map[string]string{
+		"1": "127.0.0.1:8410",
+		"2": "127.0.0.1:8420",
+	}, joins)
+	require.Len(t, p.Peers(), 3)
+
+	_, err = NewProvider(h, Config{
+		Provider:    ProviderStatic,
+		StaticPeers: []string{"127.0.0.1:8400"},
+	})
+	require.Error(t, err)
+}
+
+func TestDNSProviderSRV(t *testing.T) {
+	dns := newDNSServer(t)
+	dns.set("_rpc._tcp.dislog.default.svc.cluster.local.", []dnsRecord{
+		{target: "dislog-0.dislog.default.svc.cluster.local.", port: 8400},
+		{target: "dislog-1.dislog.default.svc.cluster.local.", port: 8400},
+		{target: "dislog-2.dislog.default.svc.cluster.local.", port: 8400},
+	})
+	h := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	p, err := NewProvider(h, Config{
+		NodeName:        "dislog-0",
+		Provider:        ProviderDNS,
+		DNSName:         "_rpc._tcp.dislog.default.svc.cluster.local",
+		Resolver:        dns.resolver(),
+		RefreshInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer p.Leave()
+
+	joins := map[string]string{}
+	for i := 0; i < 2; i++ {
+		join := <-h.joins
+		joins[join["id"]] = join["addr"]
+	}
+	require.Equal(t, map[string]string{
+		"dislog-1": "dislog-1.dislog.default.svc.cluster.local:8400",
+		"dislog-2": "dislog-2.dislog.default.svc.cluster.local:8400",
+	}, joins)
+
+	// the members that are no longer found leave
+	dns.set("_rpc._tcp.dislog.default.svc.cluster.local.", []dnsRecord{
+		{target: "dislog-0.dislog.default.svc.cluster.local.", port: 8400},
+		{target: "dislog-1.dislog.default.svc.cluster.local.", port: 8400},
+	})
+	select {
+	case id := <-h.leaves:
+		require.Equal(t, "dislog-2", id)
+	case <-time.After(time.Second):
+		t.Fatal("dislog-2 didn't leave")
+	}
+	require.Empty(t, h.joins)
+}
+
+func TestDNSProviderFails(t *testing.T) {
+	dns := newDNSServer(t)
+	records := []dnsRecord{
+		{target: "dislog-0.dislog.default.svc.cluster.local.", port: 8400},
+		{target: "dislog-1.dislog.default.svc.cluster.local.", port: 8400},
+	}
+	dns.set("_rpc._tcp.dislog.default.svc.cluster.local.", records)
+	h := &failer{
+		handler: handler{
+			joins:  make(chan map[string]string, 3),
+			leaves: make(chan string, 3),
+		},
+		fails: make(chan string, 3),
+	}
+	p, err := NewProvider(h, Config{
+		NodeName:        "dislog-0",
+		Provider:        ProviderDNS,
+		DNSName:         "_rpc._tcp.dislog.default.svc.cluster.local",
+		Resolver:        dns.resolver(),
+		RefreshInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer p.Leave()
+	require.Equal(t, "dislog-1", (<-h.joins)["id"])
+
+	// a lookup missing a member fails it rather than removing it, for the
+	// autopilot to remove it only if it stays failed
+	dns.set("_rpc._tcp.dislog.default.svc.cluster.local.", records[:1])
+	select {
+	case id := <-h.fails:
+		require.Equal(t, "dislog-1", id)
+	case <-time.After(time.Second):
+		t.Fatal("dislog-1 didn't fail")
+	}
+	require.Empty(t, h.leaves)
+
+	// and it joins again once it's found again
+	dns.set("_rpc._tcp.dislog.default.svc.cluster.local.", records)
+	select {
+	case join := <-h.joins:
+		require.Equal(t, "dislog-1", join["id"])
+	case <-time.After(time.Second):
+		t.Fatal("dislog-1 didn't join again")
+	}
+	require.Empty(t, h.leaves)
+}
+
+// failer is a handler that's a Failer too.
+type failer struct {
+	handler
+	fails chan string
+}
+
+func (f *failer) Fail(id string) error {
+	f.fails <- id
+	return nil
+}
+
+func TestDNSProviderHost(t *testing.T) {
+	dns := newDNSServer(t)
+	dns.set("dislog.default.svc.cluster.local.", []dnsRecord{
+		{ip: "10.0.0.1"},
+		{ip: "10.0.0.2"},
+	})
+	dns.set("1.0.0.10.in-addr.arpa.", []dnsRecord{
+		{target: "dislog-0.dislog.default.svc.cluster.local."},
+	})
+	dns.set("2.0.0.10.in-addr.arpa.", []dnsRecord{
+		{target: "dislog-1.dislog.default.svc.cluster.local."},
+	})
+	h := &handler{
+		joins:  make(chan map[string]string, 3),
+		leaves: make(chan string, 3),
+	}
+	p, err := NewProvider(h, Config{
+		NodeName: "dislog-0",
+		Provider: ProviderDNS,
+		DNSName:  "dislog.default.svc.cluster.local",
+		DNSPort:  8400,
+		Resolver: dns.resolver(),
+	})
+	require.NoError(t, err)
+	defer p.Leave()
+
+	join := <-h.joins
+	require.Equal(t, "dislog-1", join["id"])
+	require.Equal(t, "10.0.0.2:8400", join["addr"])
+	require.Eventually(t, func() bool {
+		return len(p.Peers()) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+// dnsRecord is an SRV or PTR record pointing to the target, or an A record
+// of the IP.
+type dnsRecord struct {
+	target string
+	port   uint16
+	ip     string
+}
+
+// dnsServer stands in for a DNS server, answering the queries of the names
+// it's set the records of over UDP.
+type dnsServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]dnsRecord
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &dnsServer{conn: conn, records: map[string][]dnsRecord{}}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *dnsServer) set(name string, records []dnsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = records
+}
+
+// resolver returns a resolver querying the server.
+func (s *dnsServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) == 0 {
+			continue
+		}
+		answer := s.answer(req)
+		res, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		_, _ = s.conn.WriteTo(res, addr)
+	}
+}
+
+func (s *dnsServer) answer(req dnsmessage.Message) dnsmessage.Message {
+	q := req.Questions[0]
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            req.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: req.Questions,
+	}
+	s.mu.Lock()
+	records, ok := s.records[strings.ToLower(q.Name.String())]
+	s.mu.Unlock()
+	if !ok {
+		res.RCode = dnsmessage.RCodeNameError
+		return res
+	}
+	for _, r := range records {
+		header := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: dnsmessage.ClassINET,
+		}
+		switch {
+		case q.Type == dnsmessage.TypeSRV && r.port != 0:
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: header,
+				Body: &dnsmessage.SRVResource{
+					Target: dnsmessage.MustNewName(r.target),
+					Port:   r.port,
+				},
+			})
+		case q.Type == dnsmessage.TypePTR && r.target != "":
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: header,
+				Body: &dnsmessage.PTRResource{
+					PTR: dnsmessage.MustNewName(r.target),
+				},
+			})
+		case q.Type == dnsmessage.TypeA && r.ip != "":
+			a := dnsmessage.AResource{}
+			copy(a.A[:], net.ParseIP(r.ip).To4())
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: header,
+				Body:   &a,
+			})
+		}
+	}
+	return res
+}
@@ -0,0 +1,573 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/quota"
+)
+
+// fetchPollInterval is how often a fetch waiting for records checks for
+// them.
+var fetchPollInterval = 100 * time.Millisecond
+
+// versionRange is the range of versions of a request the server supports.
+type versionRange struct {
+	min, max int16
+}
+
+// apiVersions are the requests the server supports and their versions. The
+// minimum produce and fetch versions are the first with record batches, and
+// the maximum versions are the last before topic IDs and batched groups.
+var apiVersions = map[int16]versionRange{
+	int16(kmsg.Produce):         {min: 3, max: 9},
+	int16(kmsg.Fetch):           {min: 4, max: 12},
+	int16(kmsg.ListOffsets):     {min: 1, max: 7},
+	int16(kmsg.Metadata):        {min: 0, max: 9},
+	int16(kmsg.OffsetCommit):    {min: 0, max: 8},
+	int16(kmsg.OffsetFetch):     {min: 0, max: 7},
+	int16(kmsg.FindCoordinator): {min: 0, max: 3},
+	int16(kmsg.ApiVersions):     {min: 0, max: 3},
+}
+
+// supportedAPIs returns the requests the server supports and their
+// versions, ordered by key.
+func supportedAPIs() []kmsg.ApiVersionsResponseApiKey {
+	var keys []kmsg.ApiVersionsResponseApiKey
+	for key := int16(0); key <= int16(kmsg.ApiVersions); key++ {
+		versions, ok := apiVersions[key]
+		if !ok {
+			continue
+		}
+		k := kmsg.NewApiVersionsResponseApiKey()
+		k.ApiKey = key
+		k.MinVersion = versions.min
+		k.MaxVersion = versions.max
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *Server) apiVersions(
+	req *kmsg.ApiVersionsRequest,
+) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+	res.ApiKeys = supportedAPIs()
+	return res
+}
+
+// broker describes a server as a Kafka broker.
+type broker struct {
+	id   int32
+	host string
+	port int32
+}
+
+// cluster returns the servers of the cluster as brokers, and the broker
+// leading the partition or nil if there's no known leader.
+func (s *Server) cluster() ([]broker, *broker, error) {
+	servers, err := s.Log.GetServers()
+	if err != nil {
+		return nil, nil, err
+	}
+	var brokers []broker
+	leader := -1
+	for _, server := range servers {
+		host, port, err := net.SplitHostPort(server.RpcAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, err := strconv.ParseInt(port, 10, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		brokers = append(brokers, broker{
+			id:   brokerID(server.Id),
+			host: host,
+			port: int32(p),
+		})
+		if server.IsLeader {
+			leader = len(brokers) - 1
+		}
+	}
+	if leader == -1 {
+		return brokers, nil, nil
+	}
+	return brokers, &brokers[leader], nil
+}
+
+func (s *Server) metadata(req *kmsg.MetadataRequest) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.MetadataResponse)
+	brokers, leader, err := s.cluster()
+	if err != nil {
+		s.logger.Error("failed to get servers", zap.Error(err))
+	}
+	res.ControllerID = -1
+	if leader != nil {
+		res.ControllerID = leader.id
+	}
+	replicas := make([]int32, 0, len(brokers))
+	for _, b := range brokers {
+		rb := kmsg.NewMetadataResponseBroker()
+		rb.NodeID = b.id
+		rb.Host = b.host
+		rb.Port = b.port
+		res.Brokers = append(res.Brokers, rb)
+		replicas = append(replicas, b.id)
+	}
+
+	topics := []string{s.Topic}
+	if req.Topics != nil {
+		topics = nil
+		for _, t := range req.Topics {
+			if t.Topic != nil {
+				topics = append(topics, *t.Topic)
+			}
+		}
+	}
+	for _, name := range topics {
+		name := name
+		t := kmsg.NewMetadataResponseTopic()
+		t.Topic = &name
+		if name != s.Topic {
+			t.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			res.Topics = append(res.Topics, t)
+			continue
+		}
+		p := kmsg.NewMetadataResponseTopicPartition()
+		p.Partition = 0
+		p.Leader = -1
+		// clients skip validating leader epochs they're not given
+		p.LeaderEpoch = -1
+		if leader != nil {
+			p.Leader = leader.id
+		} else {
+			p.ErrorCode = kerr.LeaderNotAvailable.Code
+		}
+		p.Replicas = replicas
+		p.ISR = replicas
+		t.Partitions = append(t.Partitions, p)
+		res.Topics = append(res.Topics, t)
+	}
+	return res
+}
+
+func (s *Server) produce(
+	ctx context.Context,
+	req *kmsg.ProduceRequest,
+) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.ProduceResponse)
+	authErr := s.authorize(auth.TopicObject(s.Topic), produceAction)
+	var throttle time.Duration
+	for _, t := range req.Topics {
+		rt := kmsg.NewProduceResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewProduceResponseTopicPartition()
+			rp.Partition = p.Partition
+			rp.LogAppendTime = -1
+			switch {
+			case t.Topic != s.Topic || p.Partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			case authErr != nil:
+				rp.ErrorCode = kerr.TopicAuthorizationFailed.Code
+			default:
+				var waited time.Duration
+				rp.BaseOffset, waited, rp.ErrorCode = s.append(ctx, p.Records)
+				rp.LogStartOffset = s.logStartOffset()
+				throttle += waited
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	res.ThrottleMillis = throttleMillis(throttle)
+	if req.Acks == 0 {
+		// clients don't wait for responses to requests without acks
+		return nil
+	}
+	return res
+}
+
+// append appends the batches' records to the log together, at contiguous
+// offsets, returning the offset of the first one and how long the produce
+// quota delayed them. With a schema subject, the records must carry the ID of
+// one of its schemas in their schema_id header and validate against it.
+func (s *Server) append(
+	ctx context.Context,
+	b []byte,
+) (int64, time.Duration, int16) {
+	records, err := readBatches(b)
+	if err != nil {
+		var kerrErr *kerr.Error
+		if errors.As(err, &kerrErr) {
+			return -1, 0, kerrErr.Code
+		}
+		return -1, 0, kerr.CorruptMessage.Code
+	}
+	// the quota takes the records as large as the log stores them, like the
+	// gRPC server's, while the batch limit is of their values
+	var size, bytes int64
+	for _, record := range records {
+		// records are as large as the log stores them, like the gRPC
+		// server's
+		if s.MaxRecordBytes != 0 &&
+			uint64(proto.Size(record)) > s.MaxRecordBytes {
+			return -1, 0, kerr.MessageTooLarge.Code
+		}
+		if s.SchemaSubject != "" {
+			err := s.Log.ValidateRecord(s.SchemaSubject, record)
+			if err != nil {
+				s.logger.Info("rejected invalid record", zap.Error(err))
+				return -1, 0, kerr.InvalidRecord.Code
+			}
+		}
+		size += int64(len(record.Value))
+		bytes += int64(proto.Size(record))
+	}
+	if s.MaxBatchBytes != 0 && uint64(size) > s.MaxBatchBytes {
+		return -1, 0, kerr.RecordListTooLarge.Code
+	}
+	waited, err := s.waitQuota(ctx, func(q Quotas) time.Duration {
+		return q.Produce(s.Subject, int64(len(records)), bytes)
+	})
+	if err != nil {
+		return -1, waited, kerr.RequestTimedOut.Code
+	}
+	if len(records) == 0 {
+		_, next := s.bounds()
+		return next, waited, 0
+	}
+	base, err := s.Log.AppendBatchContext(ctx, records)
+	if err != nil {
+		if errors.Is(err, raft.ErrNotLeader) ||
+			errors.Is(err, raft.ErrLeadershipLost) {
+			return -1, waited, kerr.NotLeaderForPartition.Code
+		}
+		s.logger.Error("failed to append records", zap.Error(err))
+		return -1, waited, kerr.UnknownServerError.Code
+	}
+	return int64(base), waited, 0
+}
+
+// bounds returns the lowest offset in the log and the offset the next
+// record's appended at, the log's high watermark.
+func (s *Server) bounds() (lowest, next int64) {
+	segments := s.Log.Segments()
+	if len(segments) == 0 {
+		return 0, 0
+	}
+	return int64(segments[0].BaseOffset),
+		int64(segments[len(segments)-1].NextOffset)
+}
+
+func (s *Server) logStartOffset() int64 {
+	lowest, _ := s.bounds()
+	return lowest
+}
+
+func (s *Server) fetch(
+	ctx context.Context,
+	req *kmsg.FetchRequest,
+) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.FetchResponse)
+	authErr := s.authorize(auth.TopicObject(s.Topic), consumeAction)
+	wait := time.Duration(req.MaxWaitMillis) * time.Millisecond
+	deadline := time.Now().Add(wait)
+	for {
+		res.Topics = nil
+		var fetched int
+		var bytes int64
+		var failed bool
+		for _, t := range req.Topics {
+			rt := kmsg.NewFetchResponseTopic()
+			rt.Topic = t.Topic
+			for _, p := range t.Partitions {
+				rp := kmsg.NewFetchResponseTopicPartition()
+				rp.Partition = p.Partition
+				switch {
+				case t.Topic != s.Topic || p.Partition != 0:
+					rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+				case authErr != nil:
+					rp.ErrorCode = kerr.TopicAuthorizationFailed.Code
+				default:
+					n, size := s.fetchPartition(ctx, p, req.MaxBytes, &rp)
+					fetched += n
+					bytes += size
+				}
+				failed = failed || rp.ErrorCode != 0
+				rt.Partitions = append(rt.Partitions, rp)
+			}
+			res.Topics = append(res.Topics, rt)
+		}
+		if fetched != 0 {
+			// the response goes out once the consume quota allows it,
+			// telling the client how long it was held back
+			waited, _ := s.waitQuota(ctx, func(q Quotas) time.Duration {
+				return q.Consume(s.Subject, bytes)
+			})
+			res.ThrottleMillis = throttleMillis(waited)
+			return res
+		}
+		// wait for records until the request's deadline, like a broker
+		// waiting for its minimum bytes
+		if failed || !time.Now().Before(deadline) {
+			return res
+		}
+		select {
+		case <-ctx.Done():
+			return res
+		case <-time.After(fetchPollInterval):
+		}
+	}
+}
+
+// fetchPartition reads the partition's records from the fetch offset into
+// the response, at most maxBytes of them but at least one, and returns how
+// many it read and their size as the log stores them.
+func (s *Server) fetchPartition(
+	ctx context.Context,
+	p kmsg.FetchRequestTopicPartition,
+	maxBytes int32,
+	rp *kmsg.FetchResponseTopicPartition,
+) (int, int64) {
+	lowest, next := s.bounds()
+	rp.HighWatermark = next
+	rp.LastStableOffset = next
+	rp.LogStartOffset = lowest
+	if p.FetchOffset < lowest || p.FetchOffset > next {
+		rp.ErrorCode = kerr.OffsetOutOfRange.Code
+		return 0, 0
+	}
+	limit := int(p.PartitionMaxBytes)
+	if maxBytes > 0 && int(maxBytes) < limit {
+		limit = int(maxBytes)
+	}
+	var records []*api.Record
+	var size int
+	var bytes int64
+	for off := p.FetchOffset; off < next; off++ {
+		record, err := s.Log.ReadContext(ctx, uint64(off))
+		if err != nil {
+			if len(records) == 0 {
+				s.logger.Error("failed to read record", zap.Error(err))
+				rp.ErrorCode = kerr.UnknownServerError.Code
+			}
+			break
+		}
+		if len(records) != 0 && size+len(record.Value) > limit {
+			break
+		}
+		records = append(records, record)
+		size += len(record.Value)
+		bytes += int64(proto.Size(record))
+	}
+	if len(records) != 0 {
+		rp.RecordBatches = appendBatch(nil, records)
+	}
+	return len(records), bytes
+}
+
+func (s *Server) listOffsets(req *kmsg.ListOffsetsRequest) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+	authErr := s.authorize(auth.TopicObject(s.Topic), consumeAction)
+	lowest, next := s.bounds()
+	for _, t := range req.Topics {
+		rt := kmsg.NewListOffsetsResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewListOffsetsResponseTopicPartition()
+			rp.Partition = p.Partition
+			rp.Timestamp = -1
+			rp.LeaderEpoch = -1
+			switch {
+			case t.Topic != s.Topic || p.Partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			case authErr != nil:
+				rp.ErrorCode = kerr.TopicAuthorizationFailed.Code
+			case p.Timestamp == -1:
+				rp.Offset = next
+			case p.Timestamp == -2:
+				rp.Offset = lowest
+			default:
+				// records don't keep timestamps to look them up by
+				rp.ErrorCode = kerr.UnsupportedForMessageFormat.Code
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// findCoordinator finds the Raft leader for every group, which commits the
+// groups' offsets through Raft.
+func (s *Server) findCoordinator(
+	req *kmsg.FindCoordinatorRequest,
+) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.FindCoordinatorResponse)
+	res.NodeID = -1
+	_, leader, err := s.cluster()
+	switch {
+	case req.CoordinatorType != 0:
+		res.ErrorCode = kerr.InvalidRequest.Code
+	case err != nil || leader == nil:
+		res.ErrorCode = kerr.CoordinatorNotAvailable.Code
+	default:
+		res.NodeID = leader.id
+		res.Host = leader.host
+		res.Port = leader.port
+	}
+	return res
+}
+
+// coordinatorErr returns the error code of the group's request sent to the
+// server, which is only the coordinator while it leads.
+func (s *Server) coordinatorErr(group string) int16 {
+	_, leader, err := s.cluster()
+	if err != nil || leader == nil {
+		return kerr.CoordinatorNotAvailable.Code
+	}
+	if leader.id != brokerID(s.NodeName) {
+		return kerr.NotCoordinator.Code
+	}
+	if s.authorize(auth.GroupObject(group), consumeAction) != nil {
+		return kerr.GroupAuthorizationFailed.Code
+	}
+	return 0
+}
+
+func (s *Server) offsetCommit(
+	ctx context.Context,
+	req *kmsg.OffsetCommitRequest,
+) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+	errCode := s.coordinatorErr(req.Group)
+	var commits []*api.GroupOffset
+	for _, t := range req.Topics {
+		rt := kmsg.NewOffsetCommitResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewOffsetCommitResponseTopicPartition()
+			rp.Partition = p.Partition
+			switch {
+			case errCode != 0:
+				rp.ErrorCode = errCode
+			case t.Topic != s.Topic || p.Partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			default:
+				commit := &api.GroupOffset{
+					Group:  req.Group,
+					Offset: p.Offset,
+				}
+				if p.Metadata != nil {
+					commit.Metadata = *p.Metadata
+				}
+				commits = append(commits, commit)
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	if len(commits) != 0 {
+		err := s.Log.CommitOffset(ctx, commits[len(commits)-1])
+		if err != nil {
+			errCode := kerr.UnknownServerError.Code
+			if errors.Is(err, raft.ErrNotLeader) ||
+				errors.Is(err, raft.ErrLeadershipLost) {
+				errCode = kerr.NotCoordinator.Code
+			} else {
+				s.logger.Error("failed to commit offset", zap.Error(err))
+			}
+			for i := range res.Topics {
+				for j := range res.Topics[i].Partitions {
+					p := &res.Topics[i].Partitions[j]
+					if p.ErrorCode == 0 {
+						p.ErrorCode = errCode
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+func (s *Server) offsetFetch(req *kmsg.OffsetFetchRequest) kmsg.Response {
+	res := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+	errCode := s.coordinatorErr(req.Group)
+	if req.GetVersion() >= 2 {
+		res.ErrorCode = errCode
+	}
+	topics := req.Topics
+	if topics == nil {
+		// all the topics the group committed offsets for
+		if _, ok := s.Log.GroupOffset(req.Group); ok {
+			t := kmsg.NewOffsetFetchRequestTopic()
+			t.Topic = s.Topic
+			t.Partitions = []int32{0}
+			topics = append(topics, t)
+		}
+	}
+	for _, t := range topics {
+		rt := kmsg.NewOffsetFetchResponseTopic()
+		rt.Topic = t.Topic
+		for _, partition := range t.Partitions {
+			rp := kmsg.NewOffsetFetchResponseTopicPartition()
+			rp.Partition = partition
+			rp.Offset = -1
+			rp.LeaderEpoch = -1
+			switch {
+			case errCode != 0:
+				rp.ErrorCode = errCode
+			case t.Topic != s.Topic || partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			default:
+				if commit, ok := s.Log.GroupOffset(req.Group); ok {
+					metadata := commit.Metadata
+					rp.Offset = commit.Offset
+					rp.Metadata = &metadata
+				}
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// authorize authorizes the action on the object for Kafka clients.
+// waitQuota waits until take, taking from the quotas, returns zero, and
+// returns how long it waited. Brokers throttle clients over their quotas by
+// holding back their responses, as the connection's requests are served in
+// order, and tell them how long they were throttled.
+func (s *Server) waitQuota(
+	ctx context.Context,
+	take func(Quotas) time.Duration,
+) (time.Duration, error) {
+	if s.Quotas == nil {
+		return 0, nil
+	}
+	return quota.Wait(ctx, func() time.Duration {
+		return take(s.Quotas)
+	})
+}
+
+// throttleMillis returns the throttle time of a response in milliseconds.
+func throttleMillis(d time.Duration) int32 {
+	return int32(d / time.Millisecond)
+}
+
+func (s *Server) authorize(object, action string) error {
+	return s.Authorizer.Authorize(s.Subject, object, action)
+}
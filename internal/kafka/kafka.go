@@ -0,0 +1,390 @@
+// Package kafka serves a subset of the Kafka protocol over the distributed
+// log, so Kafka clients can produce to and consume from it. The log is a
+// topic with a single partition whose offsets are the log's, and every
+// server is a broker whose partition leader is the Raft leader.
+//
+// The supported requests are ApiVersions, Metadata, Produce, Fetch,
+// ListOffsets, FindCoordinator, OffsetCommit and OffsetFetch. Records keep
+// only their values and the schema IDs of their schema_id headers, batches
+// may be uncompressed or compressed with gzip, and the offsets groups commit
+// are replicated through Raft, whose leader coordinates every group. Clients
+// over their quotas are throttled by holding back their responses, as
+// brokers do.
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// maxRequestBytes bounds the size of a request. It keeps the first byte of a
+// request's size zero, which tells Kafka requests apart from the other
+// protocols sharing the port.
+const maxRequestBytes = 1<<24 - 1
+
+// Config describes the configuration for the Kafka server.
+type Config struct {
+	// Topic is the name clients know the log by.
+	Topic string
+	// NodeName is the Raft server ID of this server.
+	NodeName string
+	// Log is the log clients produce to and consume from.
+	Log Log
+	// Authorizer authorizes the requests as Subject.
+	Authorizer Authorizer
+	// Subject is the ACL subject Kafka clients are authorized as, as they
+	// connect without TLS or authentication. Anyone who reaches the server
+	// gets its permissions.
+	Subject string
+	// Quotas limit the rates Subject produces and consumes at, if set.
+	Quotas Quotas
+	// MaxRecordBytes is the size of the largest record clients may produce,
+	// as the log stores it, and MaxBatchBytes of the values of a produce
+	// request's batches for a partition. Zero doesn't limit them.
+	MaxRecordBytes uint64
+	MaxBatchBytes  uint64
+	// SchemaSubject is the subject of the schemas the log's records must
+	// have, if set. Kafka records carry their schema IDs in their schema_id
+	// header, and the server rejects those without one or whose values don't
+	// validate against it.
+	SchemaSubject string
+}
+
+// Log is the log Kafka clients produce to and consume from. The context
+// carries the span of the request.
+type Log interface {
+	// AppendBatchContext appends the records together, at contiguous
+	// offsets, and returns the offset of the first one.
+	AppendBatchContext(context.Context, []*api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
+	Segments() []*api.Segment
+	GetServers() ([]*api.Server, error)
+	// CommitOffset commits the group's offset, replicating it to the
+	// servers that may coordinate the group next.
+	CommitOffset(context.Context, *api.GroupOffset) error
+	// GroupOffset returns the offset the group last committed, if it has.
+	GroupOffset(group string) (*api.GroupOffset, bool)
+	// ValidateRecord checks the record has a schema of the subject and its
+	// value validates against it.
+	ValidateRecord(subject string, record *api.Record) error
+}
+
+// Authorizer is an interface for authorizing.
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+// Quotas limit the rates subjects produce and consume at. Each method takes
+// from the subject's quota, returning zero if it may go ahead, or how long
+// it must wait until it may without taking anything.
+type Quotas interface {
+	Produce(subject string, records, bytes int64) time.Duration
+	Consume(subject string, bytes int64) time.Duration
+}
+
+const (
+	produceAction = "produce"
+	consumeAction = "consume"
+)
+
+// Server serves Kafka clients.
+type Server struct {
+	Config
+
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	closed bool
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer creates a Kafka server with the configuration.
+func NewServer(config Config) (*Server, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		Config: config,
+		logger: zap.L().Named("kafka"),
+		conns:  make(map[net.Conn]struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if config.SchemaSubject != "" {
+		s.logger.Info(
+			"kafka records must carry the id of a schema of the subject "+
+				"in their "+SchemaIDHeader+" header",
+			zap.String("subject", config.SchemaSubject),
+		)
+	}
+	return s, nil
+}
+
+// Match returns whether the connection starts with a Kafka request, for
+// cmux to send the connection to the Kafka server.
+func Match(r io.Reader) bool {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return false
+	}
+	size := binary.BigEndian.Uint32(b[0:4])
+	key := int16(binary.BigEndian.Uint16(b[4:6]))
+	version := int16(binary.BigEndian.Uint16(b[6:8]))
+	if size < 8 || size > maxRequestBytes || key < 0 || version < 0 {
+		return false
+	}
+	req := kmsg.RequestForKey(key)
+	if req == nil {
+		return false
+	}
+	// clients send ApiVersions at the latest version they know, which may be
+	// newer than the server's, to learn the versions it supports
+	return kmsg.Key(key) == kmsg.ApiVersions || version <= req.MaxVersion()
+}
+
+// Serve accepts connections on the listener and serves their requests
+// until the server's closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes the open ones.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// serveConn serves the connection's requests one at a time, as Kafka
+// clients expect responses in the order of their requests.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		b, err := readRequest(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("failed to read request", zap.Error(err))
+			}
+			return
+		}
+		res, err := s.handle(b)
+		if err != nil {
+			s.logger.Warn(
+				"closing connection",
+				zap.Error(err),
+				zap.String("client", conn.RemoteAddr().String()),
+			)
+			return
+		}
+		if res == nil {
+			continue
+		}
+		if _, err = conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+// readRequest reads the next request's header and body.
+func readRequest(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(b)
+	if size > maxRequestBytes {
+		return nil, fmt.Errorf("request of %d bytes is too large", size)
+	}
+	b = make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// handle parses the request, serves it and returns its response with its
+// size, or nil if the request has no response. An error closes the
+// connection, as Kafka brokers do with requests they can't parse.
+func (s *Server) handle(b []byte) ([]byte, error) {
+	if len(b) < 10 {
+		return nil, fmt.Errorf("truncated request header")
+	}
+	key := int16(binary.BigEndian.Uint16(b[0:2]))
+	version := int16(binary.BigEndian.Uint16(b[2:4]))
+	correlationID := int32(binary.BigEndian.Uint32(b[4:8]))
+	// skip the nullable client ID
+	clientIDLen := int(int16(binary.BigEndian.Uint16(b[8:10])))
+	b = b[10:]
+	if clientIDLen > 0 {
+		if len(b) < clientIDLen {
+			return nil, fmt.Errorf("truncated request header")
+		}
+		b = b[clientIDLen:]
+	}
+
+	req := kmsg.RequestForKey(key)
+	versions, ok := apiVersions[key]
+	if req == nil || !ok {
+		return nil, fmt.Errorf("unsupported request key %d", key)
+	}
+	if version < versions.min || version > versions.max {
+		if kmsg.Key(key) != kmsg.ApiVersions {
+			return nil, fmt.Errorf(
+				"unsupported version %d of request key %d",
+				version,
+				key,
+			)
+		}
+		// clients retry with a version they find in the response, which
+		// is always readable as version 0
+		res := kmsg.NewPtrApiVersionsResponse()
+		res.ErrorCode = kerr.UnsupportedVersion.Code
+		res.ApiKeys = supportedAPIs()
+		return frame(correlationID, res, false), nil
+	}
+	req.SetVersion(version)
+	if req.IsFlexible() {
+		var err error
+		if b, err = skipTags(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.ReadFrom(b); err != nil {
+		return nil, fmt.Errorf("invalid request key %d: %w", key, err)
+	}
+
+	res := s.serve(req)
+	if res == nil {
+		return nil, nil
+	}
+	res.SetVersion(version)
+	// the ApiVersions response header stays the same in every version for
+	// clients to read it before they know the broker's versions
+	flexible := res.IsFlexible() && kmsg.Key(key) != kmsg.ApiVersions
+	return frame(correlationID, res, flexible), nil
+}
+
+// serve serves the request, returning its response or nil if it has none.
+func (s *Server) serve(req kmsg.Request) kmsg.Response {
+	ctx := s.ctx
+	switch req := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		return s.apiVersions(req)
+	case *kmsg.MetadataRequest:
+		return s.metadata(req)
+	case *kmsg.ProduceRequest:
+		return s.produce(ctx, req)
+	case *kmsg.FetchRequest:
+		return s.fetch(ctx, req)
+	case *kmsg.ListOffsetsRequest:
+		return s.listOffsets(req)
+	case *kmsg.FindCoordinatorRequest:
+		return s.findCoordinator(req)
+	case *kmsg.OffsetCommitRequest:
+		return s.offsetCommit(ctx, req)
+	case *kmsg.OffsetFetchRequest:
+		return s.offsetFetch(req)
+	}
+	return nil
+}
+
+// frame returns the response with its size and header.
+func frame(correlationID int32, res kmsg.Response, flexible bool) []byte {
+	b := make([]byte, 8, 64)
+	binary.BigEndian.PutUint32(b[4:8], uint32(correlationID))
+	if flexible {
+		// no tagged fields
+		b = append(b, 0)
+	}
+	b = res.AppendTo(b)
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-4))
+	return b
+}
+
+// skipTags skips the tagged fields of a flexible request header.
+func skipTags(b []byte) ([]byte, error) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 {
+		return nil, fmt.Errorf("invalid tagged fields")
+	}
+	b = b[read:]
+	for i := uint64(0); i < n; i++ {
+		if _, read = binary.Uvarint(b); read <= 0 {
+			return nil, fmt.Errorf("invalid tagged fields")
+		}
+		b = b[read:]
+		size, read := binary.Uvarint(b)
+		if read <= 0 || uint64(len(b)-read) < size {
+			return nil, fmt.Errorf("invalid tagged fields")
+		}
+		b = b[read+int(size):]
+	}
+	return b, nil
+}
+
+// brokerID returns the Kafka broker ID of the Raft server with the ID.
+func brokerID(id string) int32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int32(h.Sum32() & 0x7fffffff)
+}
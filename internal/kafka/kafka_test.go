@@ -0,0 +1,492 @@
+package kafka_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/agent"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/kafka"
+)
+
+const topic = "dislog"
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		a *agent.Agent,
+	){
+		"produce and consume records":          testProduceConsume,
+		"gzip compressed batches":              testGzip,
+		"unsupported compression fails":        testUnsupportedCompression,
+		"offsets committed and fetched":        testOffsets,
+		"unknown topic fails":                  testUnknownTopic,
+		"api versions from an unknown version": testAPIVersions,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			a := setupAgent(t)
+			fn(t, a)
+		})
+	}
+}
+
+func TestServerUnauthorized(t *testing.T) {
+	a := setupAgent(t, func(c *agent.Config) {
+		c.KafkaSubject = "nobody"
+	})
+
+	client := newClient(t, a)
+	err := client.ProduceSync(
+		context.Background(),
+		&kgo.Record{Value: []byte("hello world")},
+	).FirstErr()
+	require.ErrorIs(t, err, kerr.TopicAuthorizationFailed)
+}
+
+func TestServerQuotas(t *testing.T) {
+	// the kafka subject may produce 2 records a second
+	quotaFile := filepath.Join(t.TempDir(), "quotas.csv")
+	require.NoError(t, os.WriteFile(quotaFile, []byte("kafka,0,2,0\n"), 0600))
+	a := setupAgent(t, func(c *agent.Config) {
+		c.QuotaFile = quotaFile
+	})
+
+	throttles := make(chan time.Duration, 3)
+	client := newClient(t, a, kgo.WithHooks(throttleHook(throttles)))
+	for i := 0; i < 3; i++ {
+		err := client.ProduceSync(
+			context.Background(),
+			&kgo.Record{Value: []byte("hello world")},
+		).FirstErr()
+		require.NoError(t, err)
+	}
+	// the third record's response was held back until the quota allowed
+	// it, and tells the client how long
+	select {
+	case throttle := <-throttles:
+		require.GreaterOrEqual(t, throttle, 100*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("the client wasn't throttled")
+	}
+}
+
+func TestServerMaxRecordBytes(t *testing.T) {
+	a := setupAgent(t, func(c *agent.Config) {
+		c.MaxRecordBytes = 16
+		c.MaxBatchBytes = 32
+	})
+
+	client := newClient(t, a)
+	ctx := context.Background()
+	err := client.ProduceSync(
+		ctx,
+		&kgo.Record{Value: bytes.Repeat([]byte("a"), 32)},
+	).FirstErr()
+	require.ErrorIs(t, err, kerr.MessageTooLarge)
+
+	// records within the limit fail together when their batch isn't, which
+	// flushing them at once makes a single one
+	batcher := newClient(t, a, kgo.ManualFlushing())
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		batcher.Produce(
+			ctx,
+			&kgo.Record{Value: []byte("hello world")},
+			func(_ *kgo.Record, err error) { results <- err },
+		)
+	}
+	require.NoError(t, batcher.Flush(ctx))
+	for i := 0; i < 3; i++ {
+		require.ErrorIs(t, <-results, kerr.RecordListTooLarge)
+	}
+	require.Equal(t, int64(0), endOffset(t, client))
+}
+
+func TestServerSchemaSubject(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	a := setupAgent(t, func(c *agent.Config) {
+		c.ServerTLSConfig = serverTLSConfig
+		c.SchemaSubject = "users"
+	})
+	ctx := context.Background()
+
+	// Kafka clients share the port with the gRPC clients registering the
+	// schemas
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	addr, err := a.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	registered, err := api.NewRegistryClient(conn).RegisterSchema(
+		ctx,
+		&api.RegisterSchemaRequest{
+			Subject:    "users",
+			Definition: []byte(`{"type": "object", "required": ["name"]}`),
+		},
+	)
+	require.NoError(t, err)
+	schemaID := []byte(strconv.Itoa(int(registered.Schema.Id)))
+
+	// records carry their schema IDs in their headers, and must validate
+	// against their schemas
+	client := newClient(t, a)
+	for _, record := range []*kgo.Record{
+		{Value: []byte(`{"name": "pouria"}`)},
+		{
+			Value: []byte(`{}`),
+			Headers: []kgo.RecordHeader{
+				{Key: kafka.SchemaIDHeader, Value: schemaID},
+			},
+		},
+		{
+			Value: []byte(`{"name": "pouria"}`),
+			Headers: []kgo.RecordHeader{
+				{Key: kafka.SchemaIDHeader, Value: []byte("users")},
+			},
+		},
+	} {
+		err = client.ProduceSync(ctx, record).FirstErr()
+		require.ErrorIs(t, err, kerr.InvalidRecord)
+	}
+	err = client.ProduceSync(ctx, &kgo.Record{
+		Value: []byte(`{"name": "pouria"}`),
+		Headers: []kgo.RecordHeader{
+			{Key: kafka.SchemaIDHeader, Value: schemaID},
+		},
+	}).FirstErr()
+	require.NoError(t, err)
+
+	// and consumers get them back
+	consumer := newClient(t, a, kgo.ConsumePartitions(
+		map[string]map[int32]kgo.Offset{
+			topic: {0: kgo.NewOffset().AtStart()},
+		},
+	))
+	consumed := poll(t, consumer, 1)
+	require.Equal(t, []kgo.RecordHeader{
+		{Key: kafka.SchemaIDHeader, Value: schemaID},
+	}, consumed[0].Headers)
+}
+
+// throttleHook sends the throttles brokers tell the client of.
+type throttleHook chan<- time.Duration
+
+func (h throttleHook) OnBrokerThrottle(
+	_ kgo.BrokerMetadata,
+	throttle time.Duration,
+	_ bool,
+) {
+	if throttle > 0 {
+		h <- throttle
+	}
+}
+
+// setupAgent starts an in-process agent serving Kafka clients, which shuts
+// down when the test ends.
+func setupAgent(t *testing.T, fns ...func(*agent.Config)) *agent.Agent {
+	t.Helper()
+	ports := dynaport.Get(2)
+	cfg := agent.Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:       ports[1],
+		DataDir:       t.TempDir(),
+		Kafka:         true,
+		KafkaInsecure: true,
+		Topic:         topic,
+		KafkaSubject:  "kafka",
+		ACLModelFile:  config.ACLModelFile,
+		ACLPolicyFile: config.ACLPolicyFile,
+		Bootstrap:     true,
+	}
+	for _, fn := range fns {
+		fn(&cfg)
+	}
+	a, err := agent.New(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Shutdown())
+	})
+	return a
+}
+
+func newClient(t *testing.T, a *agent.Agent, opts ...kgo.Opt) *kgo.Client {
+	t.Helper()
+	addr, err := a.Config.RPCAddr()
+	require.NoError(t, err)
+	client, err := kgo.NewClient(append([]kgo.Opt{
+		kgo.SeedBrokers(addr),
+		kgo.DefaultProduceTopic(topic),
+		kgo.DisableIdempotentWrite(),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.RequestRetries(2),
+		kgo.RecordRetries(2),
+	}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	return client
+}
+
+func testProduceConsume(t *testing.T, a *agent.Agent) {
+	ctx := context.Background()
+	producer := newClient(t, a)
+	values := []string{"first", "second", "third"}
+	var records []*kgo.Record
+	for _, value := range values {
+		records = append(records, &kgo.Record{Value: []byte(value)})
+	}
+	results := producer.ProduceSync(ctx, records...)
+	require.NoError(t, results.FirstErr())
+	for i, result := range results {
+		require.Equal(t, int64(i), result.Record.Offset)
+	}
+	require.Equal(t, int64(3), endOffset(t, producer))
+
+	consumer := newClient(t, a, kgo.ConsumePartitions(
+		map[string]map[int32]kgo.Offset{
+			topic: {0: kgo.NewOffset().At(1)},
+		},
+	))
+	consumed := poll(t, consumer, 2)
+	require.Equal(t, []byte("second"), consumed[0].Value)
+	require.Equal(t, int64(1), consumed[0].Offset)
+	require.Equal(t, []byte("third"), consumed[1].Value)
+	require.Equal(t, int64(2), consumed[1].Offset)
+
+	// the consumer waits for records appended after it caught up
+	err := producer.ProduceSync(
+		ctx,
+		&kgo.Record{Value: []byte("fourth")},
+	).FirstErr()
+	require.NoError(t, err)
+	consumed = poll(t, consumer, 1)
+	require.Equal(t, []byte("fourth"), consumed[0].Value)
+	require.Equal(t, int64(3), consumed[0].Offset)
+}
+
+func testGzip(t *testing.T, a *agent.Agent) {
+	producer := newClient(
+		t,
+		a,
+		kgo.ProducerBatchCompression(kgo.GzipCompression()),
+	)
+	value := bytes.Repeat([]byte("hello world"), 100)
+	err := producer.ProduceSync(
+		context.Background(),
+		&kgo.Record{Value: value},
+	).FirstErr()
+	require.NoError(t, err)
+
+	consumer := newClient(t, a, kgo.ConsumePartitions(
+		map[string]map[int32]kgo.Offset{
+			topic: {0: kgo.NewOffset().AtStart()},
+		},
+	))
+	consumed := poll(t, consumer, 1)
+	require.Equal(t, value, consumed[0].Value)
+}
+
+func testUnsupportedCompression(t *testing.T, a *agent.Agent) {
+	producer := newClient(
+		t,
+		a,
+		kgo.ProducerBatchCompression(kgo.SnappyCompression()),
+	)
+	// producers send batches uncompressed when compressing doesn't shrink
+	// them
+	err := producer.ProduceSync(
+		context.Background(),
+		&kgo.Record{Value: bytes.Repeat([]byte("hello world"), 100)},
+	).FirstErr()
+	require.ErrorIs(t, err, kerr.UnsupportedCompressionType)
+	require.Equal(t, int64(0), endOffset(t, producer))
+}
+
+func testOffsets(t *testing.T, a *agent.Agent) {
+	ctx := context.Background()
+	client := newClient(t, a)
+
+	commit := kmsg.NewPtrOffsetCommitRequest()
+	commit.Group = "group"
+	commit.Generation = -1
+	ct := kmsg.NewOffsetCommitRequestTopic()
+	ct.Topic = topic
+	cp := kmsg.NewOffsetCommitRequestTopicPartition()
+	cp.Partition = 0
+	cp.Offset = 42
+	ct.Partitions = append(ct.Partitions, cp)
+	commit.Topics = append(commit.Topics, ct)
+	commitRes, err := commit.RequestWith(ctx, client)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		int16(0),
+		commitRes.Topics[0].Partitions[0].ErrorCode,
+	)
+
+	fetch := kmsg.NewPtrOffsetFetchRequest()
+	fetch.Group = "group"
+	ft := kmsg.NewOffsetFetchRequestTopic()
+	ft.Topic = topic
+	ft.Partitions = []int32{0}
+	fetch.Topics = append(fetch.Topics, ft)
+	fetchRes, err := fetch.RequestWith(ctx, client)
+	require.NoError(t, err)
+	require.Equal(t, int16(0), fetchRes.ErrorCode)
+	require.Equal(t, int64(42), fetchRes.Topics[0].Partitions[0].Offset)
+
+	// groups without commits have no offset
+	other := kmsg.NewPtrOffsetFetchRequest()
+	other.Group = "other"
+	other.Topics = fetch.Topics
+	otherRes, err := other.RequestWith(ctx, client)
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), otherRes.Topics[0].Partitions[0].Offset)
+
+	// the offsets are in the replicated log, so they outlive the server
+	client.Close()
+	require.NoError(t, a.Shutdown())
+	// serf keeps listening after leaving, so the restarted server gossips
+	// on another port
+	cfg := a.Config
+	cfg.BindAddr = fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	restarted, err := agent.New(cfg)
+	require.NoError(t, err)
+	defer restarted.Shutdown()
+	client = newClient(t, restarted)
+	fetchRes, err = fetch.RequestWith(ctx, client)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), fetchRes.Topics[0].Partitions[0].Offset)
+}
+
+func testUnknownTopic(t *testing.T, a *agent.Agent) {
+	client := newClient(t, a)
+
+	metadata := kmsg.NewPtrMetadataRequest()
+	mt := kmsg.NewMetadataRequestTopic()
+	mt.Topic = kmsg.StringPtr("unknown")
+	metadata.Topics = append(metadata.Topics, mt)
+	res, err := metadata.RequestWith(context.Background(), client)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		kerr.UnknownTopicOrPartition.Code,
+		res.Topics[0].ErrorCode,
+	)
+}
+
+func testAPIVersions(t *testing.T, a *agent.Agent) {
+	addr, err := a.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := kmsg.NewPtrApiVersionsRequest()
+	req.SetVersion(req.MaxVersion() + 1)
+	b := make([]byte, 4, 64)
+	b = append(b, 0, byte(kmsg.ApiVersions))
+	b = append(b, 0, byte(req.GetVersion()))
+	b = append(b, 0, 0, 0, 7) // correlation ID
+	b = append(b, 0xff, 0xff) // null client ID
+	b[3] = byte(len(b) - 4)
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+
+	size := make([]byte, 4)
+	_, err = io.ReadFull(conn, size)
+	require.NoError(t, err)
+	res := make([]byte, binary.BigEndian.Uint32(size))
+	_, err = io.ReadFull(conn, res)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 7}, res[:4])
+	versions := kmsg.NewPtrApiVersionsResponse()
+	require.NoError(t, versions.ReadFrom(res[4:]))
+	require.Equal(t, kerr.UnsupportedVersion.Code, versions.ErrorCode)
+	// the response lists the versions the client may retry with
+	keys := map[int16]bool{}
+	for _, key := range versions.ApiKeys {
+		keys[key.ApiKey] = true
+	}
+	for _, key := range []kmsg.Key{
+		kmsg.ApiVersions,
+		kmsg.Metadata,
+		kmsg.Produce,
+		kmsg.Fetch,
+		kmsg.ListOffsets,
+		kmsg.FindCoordinator,
+		kmsg.OffsetCommit,
+		kmsg.OffsetFetch,
+	} {
+		require.True(t, keys[int16(key)], key.Name())
+	}
+}
+
+// endOffset returns the offset the next record's appended at.
+func endOffset(t *testing.T, client *kgo.Client) int64 {
+	t.Helper()
+	req := kmsg.NewPtrListOffsetsRequest()
+	req.ReplicaID = -1
+	rt := kmsg.NewListOffsetsRequestTopic()
+	rt.Topic = topic
+	rp := kmsg.NewListOffsetsRequestTopicPartition()
+	rp.Partition = 0
+	rp.Timestamp = -1
+	rt.Partitions = append(rt.Partitions, rp)
+	req.Topics = append(req.Topics, rt)
+	res, err := req.RequestWith(context.Background(), client)
+	require.NoError(t, err)
+	p := res.Topics[0].Partitions[0]
+	require.Equal(t, int16(0), p.ErrorCode)
+	return p.Offset
+}
+
+// poll polls the consumer until it's consumed n records.
+func poll(t *testing.T, consumer *kgo.Client, n int) []*kgo.Record {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := consumer.PollFetches(ctx)
+		require.NoError(t, ctx.Err())
+		require.Empty(t, fetches.Errors())
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
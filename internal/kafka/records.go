@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+const (
+	// batchHeaderBytes is the size of a record batch up to and including its
+	// length.
+	batchHeaderBytes = 12
+	// batchCRCOffset is where a record batch's CRC starts, which covers
+	// everything after it.
+	batchCRCOffset = 17
+	// batchLengthBytes is the size of a record batch's fields that follow
+	// its length, without its records.
+	batchLengthBytes = 49
+	// batchMagic is the version of the record batch format.
+	batchMagic = 2
+)
+
+// Compression codecs in the attributes of a record batch.
+const (
+	compressionMask = 0x07
+	compressionNone = 0
+	compressionGzip = 1
+)
+
+// SchemaIDHeader is the header of the records carrying the decimal ID of the
+// registered schema their values have, which Kafka records have no field for.
+const SchemaIDHeader = "schema_id"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// readBatches returns the records in the record batches, with their values
+// and the schema IDs of their headers. It returns a *kerr.Error if the
+// batches are invalid or use a compression the server doesn't support.
+func readBatches(b []byte) ([]*api.Record, error) {
+	var records []*api.Record
+	for len(b) != 0 {
+		if len(b) < batchHeaderBytes {
+			return nil, kerr.CorruptMessage
+		}
+		size := batchHeaderBytes + int(int32(binary.BigEndian.Uint32(b[8:12])))
+		if size < batchHeaderBytes+batchLengthBytes || size > len(b) {
+			return nil, kerr.CorruptMessage
+		}
+		var batch kmsg.RecordBatch
+		if err := batch.ReadFrom(b[:size]); err != nil {
+			return nil, kerr.CorruptMessage
+		}
+		if batch.Magic != batchMagic {
+			return nil, kerr.UnsupportedForMessageFormat
+		}
+		crc := crc32.Checksum(b[batchCRCOffset+4:size], crc32c)
+		if int32(crc) != batch.CRC {
+			return nil, kerr.CorruptMessage
+		}
+		raw, err := decompress(batch)
+		if err != nil {
+			return nil, err
+		}
+		for i := int32(0); i < batch.NumRecords; i++ {
+			length, read := binary.Varint(raw)
+			if read <= 0 || length < 0 || int64(len(raw)-read) < length {
+				return nil, kerr.CorruptMessage
+			}
+			var record kmsg.Record
+			if err := record.ReadFrom(raw[:read+int(length)]); err != nil {
+				return nil, kerr.CorruptMessage
+			}
+			schemaID, err := readSchemaID(record.Headers)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, &api.Record{
+				Value:    record.Value,
+				SchemaId: schemaID,
+			})
+			raw = raw[read+int(length):]
+		}
+		b = b[size:]
+	}
+	return records, nil
+}
+
+// readSchemaID returns the schema ID of the record's headers, zero if it has
+// none.
+func readSchemaID(headers []kmsg.Header) (uint32, error) {
+	for _, header := range headers {
+		if header.Key != SchemaIDHeader {
+			continue
+		}
+		id, err := strconv.ParseUint(string(header.Value), 10, 32)
+		if err != nil {
+			return 0, kerr.InvalidRecord
+		}
+		return uint32(id), nil
+	}
+	return 0, nil
+}
+
+// decompress returns the batch's records, decompressed.
+func decompress(batch kmsg.RecordBatch) ([]byte, error) {
+	switch batch.Attributes & compressionMask {
+	case compressionNone:
+		return batch.Records, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(batch.Records))
+		if err != nil {
+			return nil, kerr.CorruptMessage
+		}
+		defer r.Close()
+		records, err := io.ReadAll(io.LimitReader(r, maxRequestBytes+1))
+		if err != nil || len(records) > maxRequestBytes {
+			return nil, kerr.CorruptMessage
+		}
+		return records, nil
+	default:
+		return nil, kerr.UnsupportedCompressionType
+	}
+}
+
+// appendBatch appends an uncompressed record batch of the records, which
+// must have consecutive offsets, to dst. The records have no timestamps, as
+// the log doesn't keep them, and the schema IDs of those that have them in
+// their headers.
+func appendBatch(dst []byte, records []*api.Record) []byte {
+	var b []byte
+	for i, r := range records {
+		record := kmsg.NewRecord()
+		record.OffsetDelta = int32(i)
+		record.Value = r.Value
+		if r.SchemaId != 0 {
+			record.Headers = append(record.Headers, kmsg.Header{
+				Key:   SchemaIDHeader,
+				Value: []byte(strconv.FormatUint(uint64(r.SchemaId), 10)),
+			})
+		}
+		// the length is of everything that follows it
+		record.Length = int32(len(record.AppendTo(nil)) - 1)
+		b = record.AppendTo(b)
+	}
+	batch := kmsg.NewRecordBatch()
+	batch.FirstOffset = int64(records[0].Offset)
+	batch.Length = int32(batchLengthBytes + len(b))
+	batch.PartitionLeaderEpoch = -1
+	batch.Magic = batchMagic
+	batch.LastOffsetDelta = int32(len(records) - 1)
+	batch.FirstTimestamp = -1
+	batch.MaxTimestamp = -1
+	batch.ProducerID = -1
+	batch.ProducerEpoch = -1
+	batch.FirstSequence = -1
+	batch.NumRecords = int32(len(records))
+	batch.Records = b
+	start := len(dst)
+	dst = batch.AppendTo(dst)
+	crc := crc32.Checksum(dst[start+batchCRCOffset+4:], crc32c)
+	binary.BigEndian.PutUint32(dst[start+batchCRCOffset:], crc)
+	return dst
+}
@@ -1,14 +1,111 @@
 package loadbalance
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/pouriaamini/proglog/api/v1"
 )
 
+// Strategy is how the picker picks among the servers that may serve a
+// request.
+type Strategy string
+
+const (
+	// RoundRobin picks the servers in turn.
+	RoundRobin Strategy = "round_robin"
+	// LeastOutstanding picks the server with the fewest requests in flight.
+	LeastOutstanding Strategy = "least_outstanding"
+)
+
+// StickyKey is the metadata key that pins reads to a follower, such as a
+// consumer's ConsumeStream, so the stream opens again on the server it read
+// from for as long as that server is ready. The reads with the same value go
+// to the same follower.
+const StickyKey = "proglog-sticky"
+
+// Config is the proglog balancer's config in the service config, such as
+// {"loadBalancingConfig":[{"proglog":{"strategy":"least_outstanding"}}]}.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	// Strategy is how the picker picks among the servers, RoundRobin by
+	// default.
+	Strategy Strategy `json:"strategy,omitempty"`
+	// Zone is the zone the client runs in. The picker prefers the servers
+	// in it, and picks among the others when none of them may serve the
+	// request.
+	Zone string `json:"zone,omitempty"`
+}
+
+// route is where the picker routes a method's requests.
+type route int
+
+const (
+	// toLeader routes the requests to the leader, which applies the writes.
+	toLeader route = iota
+	// toFollower routes the requests to the followers, preferring the
+	// non-voters, or to the leader while there are none.
+	toFollower
+	// toAny routes the requests to any server.
+	toAny
+)
+
+// routes classifies the methods by their service and method names, without
+// the package, so the API versions route alike. The methods that aren't in
+// it are routed to any server.
+var routes = map[string]route{
+	"Log/Produce":               toLeader,
+	"Log/ProduceStream":         toLeader,
+	"Log/Consume":               toFollower,
+	"Log/ConsumeStream":         toFollower,
+	"Log/GetServers":            toAny,
+	"Log/WatchServers":          toAny,
+	"Registry/RegisterSchema":   toLeader,
+	"Registry/GetSchema":        toFollower,
+	"Registry/SetCompatibility": toLeader,
+	"Registry/GetCompatibility": toFollower,
+	"Admin/RemoveServer":        toLeader,
+	"Admin/TransferLeadership":  toLeader,
+	"Admin/Snapshot":            toLeader,
+	"Admin/DescribeRaft":        toLeader,
+	"Admin/ListSegments":        toLeader,
+	"Admin/ForceRetention":      toLeader,
+	"Admin/InstallGossipKey":    toLeader,
+	"Admin/UseGossipKey":        toLeader,
+	"Admin/RemoveGossipKey":     toLeader,
+	"Admin/ListGossipKeys":      toLeader,
+	"Admin/GetServerHealth":     toLeader,
+}
+
+// routeOf returns the route of the full method name, such as
+// /log.v1.Log/Produce.
+func routeOf(fullMethodName string) route {
+	name := fullMethodName
+	if i := strings.LastIndex(name, "."); i != -1 {
+		name = name[i+1:]
+	}
+	if r, ok := routes[name]; ok {
+		return r
+	}
+	return toAny
+}
+
+// server is a ready subconnection and the attributes of its server.
+type server struct {
+	subConn balancer.SubConn
+	addr    string
+	zone    string
+}
+
 var _ base.PickerBuilder = (*Picker)(nil)
 
 // Picker is a struct that implements the balancer.Picker interface.
@@ -16,72 +113,265 @@ var _ base.PickerBuilder = (*Picker)(nil)
 type Picker struct {
 	// A mutex to synchronize access to the picker's internal state.
 	mu sync.RWMutex
+	// The configuration of the pickers it builds
+	config Config
 	// The leader subconnection
-	leader balancer.SubConn
+	leader *server
 	// The list of follower subconnections
-	followers []balancer.SubConn
-	// The index of the current follower for the next "Consume" request.
+	followers []*server
+	// The list of non-voter subconnections, a subset of the followers
+	nonVoters []*server
+	// The list of all the subconnections
+	servers []*server
+	// The index of the current server for the next request picked in turn.
 	current uint64
+	// The requests in flight of each subconnection, which the pickers it
+	// builds share so they're still counted once a picker is replaced.
+	outstanding *sync.Map
 }
 
 // Build creates a new Picker based on the given buildInfo and returns it.
-// Implements the base.PickerBuilder interface.
+// Implements the base.PickerBuilder interface. Each client connection's
+// balancer has a picker builder of its own, so connections don't share
+// their subconnections and a leader that's no longer ready isn't picked.
 func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	var followers []balancer.SubConn
+	if p.outstanding == nil {
+		p.outstanding = &sync.Map{}
+	}
+	picker := &Picker{
+		config:      p.config,
+		outstanding: p.outstanding,
+	}
 	for sc, scInfo := range buildInfo.ReadySCs {
+		srv := &server{subConn: sc, addr: scInfo.Address.Addr}
+		srv.zone, _ = scInfo.Address.Attributes.Value("zone").(string)
+		picker.servers = append(picker.servers, srv)
 		isLeader := scInfo.
 			Address.
 			Attributes.
 			Value("is_leader").(bool)
 		if isLeader {
-			p.leader = sc
+			picker.leader = srv
 			continue
 		}
-		followers = append(followers, sc)
+		picker.followers = append(picker.followers, srv)
+		role, _ := scInfo.Address.Attributes.Value("role").(api.Role)
+		if role == api.Role_NON_VOTER {
+			picker.nonVoters = append(picker.nonVoters, srv)
+		}
 	}
-	p.followers = followers
-	return p
+	return picker
+}
+
+// Configure sets the configuration of the pickers built from now on.
+func (p *Picker) Configure(config Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
 }
 
 var _ balancer.Picker = (*Picker)(nil)
 
 // Pick picks a subconnection using the leader-follower algorithm.
-// The leader subconnection is chosen for requests containing "Produce" in
-// the full method name.
-// The next available follower subconnection is chosen for requests
-// containing "Consume" in the full method name.
+// The methods that write, and the admin ones, are routed to the leader,
+// the ones that read to the followers, preferring the non-voters so reads
+// don't slow down the servers taking part in commits, and the others, such
+// as GetServers, to any server.
+// Among the servers a request may go to, those in the configured zone are
+// preferred. A read whose metadata has StickyKey goes to the same follower
+// every time; the other requests are picked by the configured strategy.
 // An error is returned if no subconnections are available.
 func (p *Picker) Pick(info balancer.PickInfo) (
 	balancer.PickResult, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") ||
-		len(p.followers) == 0 {
-		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
-		result.SubConn = p.nextFollower()
+	route := routeOf(info.FullMethodName)
+	var candidates []*server
+	switch {
+	case route == toAny:
+		candidates = p.servers
+	case route == toLeader || len(p.followers) == 0:
+		if p.leader != nil {
+			candidates = []*server{p.leader}
+		}
+	case len(p.nonVoters) != 0:
+		candidates = p.nonVoters
+	default:
+		candidates = p.followers
 	}
-	if result.SubConn == nil {
+	candidates = p.local(candidates)
+	if len(candidates) == 0 {
 		return result, balancer.ErrNoSubConnAvailable
 	}
+	var srv *server
+	if key := stickyKey(info); key != "" && route == toFollower {
+		srv = sticky(candidates, key)
+	} else if p.config.Strategy == LeastOutstanding {
+		srv = p.leastOutstanding(candidates)
+	} else {
+		srv = p.next(candidates)
+	}
+	result.SubConn = srv.subConn
+	result.Done = p.track(srv.subConn)
 	return result, nil
 }
 
-// nextFollower returns the next follower subconnection based on the index of
-// the current
-func (p *Picker) nextFollower() balancer.SubConn {
+// local returns the servers in the configured zone, or all of them if none
+// is.
+func (p *Picker) local(servers []*server) []*server {
+	if p.config.Zone == "" {
+		return servers
+	}
+	var local []*server
+	for _, srv := range servers {
+		if srv.zone == p.config.Zone {
+			local = append(local, srv)
+		}
+	}
+	if len(local) == 0 {
+		return servers
+	}
+	return local
+}
+
+// next returns the next server of the given list based on the index
+// of the current
+func (p *Picker) next(servers []*server) *server {
 	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
+	len := uint64(len(servers))
 	idx := int(cur % len)
-	return p.followers[idx]
+	return servers[idx]
+}
+
+// leastOutstanding returns the server of the list with the fewest requests
+// in flight. The ties are broken in turn.
+func (p *Picker) leastOutstanding(servers []*server) *server {
+	start := int(atomic.AddUint64(&p.current, uint64(1)) % uint64(len(servers)))
+	var least *server
+	var leastCount int64
+	for i := range servers {
+		srv := servers[(start+i)%len(servers)]
+		count := atomic.LoadInt64(p.counter(srv.subConn))
+		if least == nil || count < leastCount {
+			least, leastCount = srv, count
+		}
+	}
+	return least
+}
+
+// track counts a request in flight on the subconnection, and returns the
+// function that counts it done.
+func (p *Picker) track(sc balancer.SubConn) func(balancer.DoneInfo) {
+	counter := p.counter(sc)
+	atomic.AddInt64(counter, 1)
+	return func(balancer.DoneInfo) {
+		atomic.AddInt64(counter, -1)
+	}
+}
+
+// counter returns the counter of the requests in flight on the
+// subconnection.
+func (p *Picker) counter(sc balancer.SubConn) *int64 {
+	counter, _ := p.outstanding.LoadOrStore(sc, new(int64))
+	return counter.(*int64)
+}
+
+// stickyKey returns the value of StickyKey in the request's metadata.
+func stickyKey(info balancer.PickInfo) string {
+	if info.Ctx == nil {
+		return ""
+	}
+	md, _ := metadata.FromOutgoingContext(info.Ctx)
+	if values := md.Get(StickyKey); len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// sticky returns the server the key hashes to, highest of the hashes of the
+// key and each server's address, so a key moves only when its server goes.
+func sticky(servers []*server, key string) *server {
+	var picked *server
+	var max uint64
+	for _, srv := range servers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(srv.addr))
+		if sum := h.Sum64(); picked == nil || sum > max {
+			picked, max = srv, sum
+		}
+	}
+	return picked
+}
+
+// builder builds the proglog balancers. Each has a picker builder of its
+// own, which the configuration from the service config is set on.
+type builder struct{}
+
+var (
+	_ balancer.Builder      = builder{}
+	_ balancer.ConfigParser = builder{}
+)
+
+// Build builds the balancer of a client connection.
+func (builder) Build(
+	cc balancer.ClientConn,
+	opts balancer.BuildOptions,
+) balancer.Balancer {
+	picker := &Picker{}
+	return &configBalancer{
+		Balancer: base.NewBalancerBuilder(
+			Name,
+			picker,
+			base.Config{},
+		).Build(cc, opts),
+		picker: picker,
+	}
+}
+
+// Name returns the name of the proglog balancer.
+func (builder) Name() string {
+	return Name
+}
+
+// ParseConfig parses the proglog balancer's config in the service config.
+func (builder) ParseConfig(
+	js json.RawMessage,
+) (serviceconfig.LoadBalancingConfig, error) {
+	config := &Config{}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, err
+	}
+	switch config.Strategy {
+	case "", RoundRobin, LeastOutstanding:
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", config.Strategy)
+	}
+	return config, nil
+}
+
+// configBalancer is a base balancer that configures its picker builder with
+// the config of the client connection's states.
+type configBalancer struct {
+	balancer.Balancer
+	picker *Picker
+}
+
+// UpdateClientConnState configures the pickers built from now on, and
+// updates the subconnections.
+func (b *configBalancer) UpdateClientConnState(
+	s balancer.ClientConnState,
+) error {
+	if config, ok := s.BalancerConfig.(*Config); ok {
+		b.picker.Configure(*config)
+	}
+	return b.Balancer.UpdateClientConnState(s)
 }
 
-// init registers the Picker builder with the grpc balancer module.
+// init registers the proglog balancer with the grpc balancer module.
 func init() {
-	balancer.Register(
-		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
-	)
+	balancer.Register(builder{})
 }
@@ -1,11 +1,15 @@
 package loadbalance_test
 
 import (
+	"context"
+	"fmt"
+	api "github.com/pouriaamini/proglog/api/v1"
 	"github.com/pouriaamini/proglog/internal/loadbalance"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
 	"testing"
 )
@@ -37,36 +41,167 @@ func TestPickerProducesToLeader(t *testing.T) {
 	}
 }
 
+func TestPickerRoutesSchemas(t *testing.T) {
+	picker, subConns := setupTest()
+	pick, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.vX.Registry/RegisterSchema",
+	})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+	pick, err = picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.vX.Registry/GetSchema",
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, subConns[0], pick.SubConn)
+}
+
 func TestPickerConsumesFromFollowers(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
 		FullMethodName: "/log.vX.Log/Consume",
 	}
+	var picks []balancer.SubConn
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Contains(t, subConns[1:3], pick.SubConn)
+		// the followers are picked in turn
+		if i > 0 {
+			require.NotEqual(t, picks[i-1], pick.SubConn)
+		}
+		picks = append(picks, pick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromNonVoters(t *testing.T) {
+	picker, subConns := setupTest(api.Role_NON_VOTER)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Consume",
+	}
 	for i := 0; i < 5; i++ {
 		pick, err := picker.Pick(info)
 		require.NoError(t, err)
-		require.Equal(t, subConns[i%2+1], pick.SubConn)
+		require.Equal(t, subConns[3], pick.SubConn)
+	}
+}
+
+func TestPickerRoutesByMethod(t *testing.T) {
+	picker, subConns := setupTest()
+	for _, method := range []string{
+		"/log.vX.Admin/RemoveServer",
+		"/log.vX.Admin/DescribeRaft",
+		"/log.vX.Log/ProduceStream",
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], pick.SubConn, method)
+	}
+	// any server may serve the servers, the leader too
+	picked := map[balancer.SubConn]bool{}
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.vX.Log/GetServers",
+		})
+		require.NoError(t, err)
+		picked[pick.SubConn] = true
+	}
+	require.Len(t, picked, 3)
+}
+
+func TestPickerLeastOutstanding(t *testing.T) {
+	picker, subConns := setupTestConfig(loadbalance.Config{
+		Strategy: loadbalance.LeastOutstanding,
+	})
+	info := balancer.PickInfo{FullMethodName: "/log.vX.Log/ConsumeStream"}
+	first, err := picker.Pick(info)
+	require.NoError(t, err)
+	// the other follower has no requests in flight
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotEqual(t, first.SubConn, pick.SubConn)
+		pick.Done(balancer.DoneInfo{})
+	}
+	first.Done(balancer.DoneInfo{})
+	require.Contains(t, subConns[1:], first.SubConn)
+}
+
+func TestPickerPrefersZone(t *testing.T) {
+	picker, subConns := setupTestConfig(loadbalance.Config{Zone: "zone-2"})
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.vX.Log/Consume",
+		})
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
 	}
+	// the leader's the only one to produce to, whatever its zone
+	pick, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.vX.Log/Produce",
+	})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
 }
 
-func setupTest() (*loadbalance.Picker, []*subConn) {
+func TestPickerSticksToFollower(t *testing.T) {
+	picker, _ := setupTest(api.Role_NON_VOTER, api.Role_NON_VOTER)
+	picked := map[string]balancer.SubConn{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("consumer-%d", i%5)
+		pick, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.vX.Log/ConsumeStream",
+			Ctx: metadata.AppendToOutgoingContext(
+				context.Background(),
+				loadbalance.StickyKey,
+				key,
+			),
+		})
+		require.NoError(t, err)
+		if sc, ok := picked[key]; ok {
+			require.Equal(t, sc, pick.SubConn)
+		}
+		picked[key] = pick.SubConn
+	}
+}
+
+// setupTest builds a picker over a leader, two followers and a server for
+// each of the given extra roles.
+func setupTest(roles ...api.Role) (*loadbalance.Picker, []*subConn) {
+	return setupTestConfig(loadbalance.Config{}, roles...)
+}
+
+// setupTestConfig builds a picker with the config over a leader, two
+// followers and a server for each of the given extra roles. The ith server
+// is in the zone zone-i.
+func setupTestConfig(config loadbalance.Config, roles ...api.Role) (
+	*loadbalance.Picker,
+	[]*subConn,
+) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
 		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
 	}
-	for i := 0; i < 3; i++ {
+	roles = append(
+		[]api.Role{api.Role_VOTER, api.Role_VOTER, api.Role_VOTER},
+		roles...,
+	)
+	for i, role := range roles {
 		sc := &subConn{}
 		addr := resolver.Address{
-			Attributes: attributes.New("is_leader", i == 0),
+			Addr: fmt.Sprintf("127.0.0.1:%d", 8400+i),
+			Attributes: attributes.New("is_leader", i == 0).
+				WithValue("role", role).
+				WithValue("zone", fmt.Sprintf("zone-%d", i)),
 		}
 		// 0th sub conn is the leader
 		sc.UpdateAddresses([]resolver.Address{addr})
 		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
 		subConns = append(subConns, sc)
 	}
-	picker := &loadbalance.Picker{}
-	picker.Build(buildInfo)
-	return picker, subConns
+	builder := &loadbalance.Picker{}
+	builder.Configure(config)
+	picker := builder.Build(buildInfo)
+	return picker.(*loadbalance.Picker), subConns
 }
 
 // subConn implements balancer.SubConn.
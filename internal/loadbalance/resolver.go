@@ -5,8 +5,11 @@ package loadbalance
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -19,7 +22,11 @@ import (
 
 // Resolver implements the resolver.Resolver interface.
 // It resolves the service endpoint addresses and their attributes (
-// isLeader, for example) using the get_servers RPC of a proglog server.
+// isLeader, for example) using the get_servers RPC of a proglog server, and
+// updates them as the watch_servers RPC streams their changes, so clients
+// follow leader elections as they happen.
+// The query of the target sets the balancer's config in the service config,
+// such as proglog:///localhost:8400?strategy=least_outstanding&zone=eu-west-1a.
 type Resolver struct {
 	// A mutex to synchronize access to the resolver's internal state
 	mu sync.Mutex
@@ -31,41 +38,84 @@ type Resolver struct {
 	serviceConfig *serviceconfig.ParseResult
 	// A logger instance
 	logger *zap.Logger
+	// Cancels the watch, which closes done once it returns
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
+// pollInterval is how often the resolver resolves the servers while it can't
+// watch them, such as when the server doesn't serve watch_servers.
+const pollInterval = 5 * time.Second
+
 var _ resolver.Builder = (*Resolver)(nil)
 
 // Build builds and returns a new Resolver struct for the given target,
-// clientConn, and resolver.BuildOptions.
+// clientConn, and resolver.BuildOptions. Each client connection gets a
+// resolver of its own, so a process may open several.
 func (r *Resolver) Build(
 	target resolver.Target,
 	cc resolver.ClientConn,
 	opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.logger = zap.L().Named("resolver")
-	r.clientConn = cc
+	res := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+	}
 	var dialOpts []grpc.DialOption
 	if opts.DialCreds != nil {
 		dialOpts = append(
 			dialOpts,
 			grpc.WithTransportCredentials(opts.DialCreds),
 		)
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	query := target.URL.Query()
+	config, err := json.Marshal(Config{
+		Strategy: Strategy(query.Get("strategy")),
+		Zone:     query.Get("zone"),
+	})
+	if err != nil {
+		return nil, err
 	}
-	r.serviceConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	res.serviceConfig = res.clientConn.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":%s}]}`, Name, config),
 	)
-	var err error
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	if res.serviceConfig.Err != nil {
+		return nil, res.serviceConfig.Err
+	}
+	res.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	return r, nil
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	res.cancel = cancel
+	res.done = make(chan struct{})
+	go res.watch(ctx)
+	return res, nil
 }
 
 // Name is the name of the proglog load balancing mechanism.
 const Name = "proglog"
 
+// Target returns the target of the cluster of the server at the address,
+// which the proglog resolver resolves and its balancer picks by the config.
+func Target(addr string, config Config) string {
+	query := url.Values{}
+	if config.Strategy != "" {
+		query.Set("strategy", string(config.Strategy))
+	}
+	if config.Zone != "" {
+		query.Set("zone", config.Zone)
+	}
+	target := fmt.Sprintf("%s:///%s", Name, addr)
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
 // Scheme returns the name of the load balancing scheme.
 func (r *Resolver) Scheme() string {
 	return Name
@@ -94,13 +144,57 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 		)
 		return
 	}
+	r.update(res.Servers)
+}
+
+// watch updates the clientConn with the servers the watch_servers RPC
+// streams as they change. While it can't watch them, it resolves them every
+// pollInterval and tries again.
+func (r *Resolver) watch(ctx context.Context) {
+	defer close(r.done)
+	client := api.NewLogClient(r.resolverConn)
+	for {
+		stream, err := client.WatchServers(ctx, &api.WatchServersRequest{})
+		for err == nil {
+			var res *api.WatchServersResponse
+			if res, err = stream.Recv(); err == nil {
+				r.mu.Lock()
+				r.update(res.Servers)
+				r.mu.Unlock()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Debug(
+			"failed to watch servers",
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+// update updates the clientConn with the addresses of the servers and their
+// attributes. The caller holds mu.
+func (r *Resolver) update(servers []*api.Server) {
 	var addrs []resolver.Address
-	for _, server := range res.Servers {
+	for _, server := range servers {
 		addrs = append(addrs, resolver.Address{
 			Addr: server.RpcAddr,
 			Attributes: attributes.New(
 				"is_leader",
 				server.IsLeader,
+			).WithValue(
+				"role",
+				server.Role,
+			).WithValue(
+				"zone",
+				server.Zone,
 			),
 		})
 	}
@@ -110,8 +204,11 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 	})
 }
 
-// Close closes the connection to the proglog server.
+// Close stops watching the servers and closes the connection to the proglog
+// server.
 func (r *Resolver) Close() {
+	r.cancel()
+	<-r.done
 	if err := r.resolverConn.Close(); err != nil {
 		r.logger.Error(
 			"failed to close conn",
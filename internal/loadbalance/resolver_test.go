@@ -1,8 +1,11 @@
 package loadbalance_test
 
 import (
+	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -51,8 +54,7 @@ func TestResolver(t *testing.T) {
 	opts := resolver.BuildOptions{
 		DialCreds: clientCreds,
 	}
-	r := &loadbalance.Resolver{}
-	_, err = r.Build(
+	r, err := (&loadbalance.Resolver{}).Build(
 		resolver.Target{
 			Endpoint: l.Addr().String(),
 		},
@@ -60,20 +62,70 @@ func TestResolver(t *testing.T) {
 		opts,
 	)
 	require.NoError(t, err)
+	defer r.Close()
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
-			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
+			Addr: "localhost:9001",
+			Attributes: attributes.New("is_leader", true).
+				WithValue("role", api.Role_VOTER).
+				WithValue("zone", "zone-a"),
 		}, {
-			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Addr: "localhost:9002",
+			Attributes: attributes.New("is_leader", false).
+				WithValue("role", api.Role_VOTER).
+				WithValue("zone", ""),
+		}, {
+			Addr: "localhost:9003",
+			Attributes: attributes.New("is_leader", false).
+				WithValue("role", api.Role_NON_VOTER).
+				WithValue("zone", ""),
 		}},
+		ServiceConfig: &serviceconfig.ParseResult{},
 	}
-	require.Equal(t, wantState, conn.state)
+	require.Equal(t, wantState, conn.State())
 
-	conn.state.Addresses = nil
+	conn.UpdateState(resolver.State{})
 	r.ResolveNow(resolver.ResolveNowOptions{})
-	require.Equal(t, wantState, conn.state)
+	require.Equal(t, wantState, conn.State())
+}
+
+func TestResolverWatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	watcher := &watchServers{changes: make(chan []*api.Server)}
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer:   &getServers{},
+		ServerWatcher: watcher,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	r, err := (&loadbalance.Resolver{}).Build(
+		resolver.Target{Endpoint: l.Addr().String()},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Len(t, conn.State().Addresses, 3)
+
+	// the resolver updates the addresses as soon as the leader changes,
+	// without gRPC asking it to resolve them
+	watcher.changes <- []*api.Server{{
+		Id:      "follower",
+		RpcAddr: "localhost:9001",
+	}, {
+		Id:       "leader",
+		RpcAddr:  "localhost:9002",
+		IsLeader: true,
+	}}
+	require.Eventually(t, func() bool {
+		addrs := conn.State().Addresses
+		return len(addrs) == 2 &&
+			addrs[1].Attributes.Value("is_leader") == true
+	}, time.Second, 10*time.Millisecond)
 }
 
 type getServers struct{}
@@ -83,19 +135,55 @@ func (s *getServers) GetServers() ([]*api.Server, error) {
 		Id:       "leader",
 		RpcAddr:  "localhost:9001",
 		IsLeader: true,
+		Zone:     "zone-a",
 	}, {
 		Id:      "follower",
 		RpcAddr: "localhost:9002",
+	}, {
+		Id:      "replica",
+		RpcAddr: "localhost:9003",
+		Role:    api.Role_NON_VOTER,
 	}}, nil
 }
 
+// watchServers streams the servers sent to changes.
+type watchServers struct {
+	changes chan []*api.Server
+}
+
+func (w *watchServers) WatchServers(
+	ctx context.Context,
+	fn func([]*api.Server) error,
+) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case servers := <-w.changes:
+			if err := fn(servers); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 type clientConn struct {
 	resolver.ClientConn
+	mu    sync.Mutex
 	state resolver.State
 }
 
-func (c *clientConn) UpdateState(state resolver.State) {
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
+	return nil
+}
+
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
 }
 
 func (c *clientConn) ReportError(err error) {}
@@ -107,5 +195,5 @@ func (c *clientConn) NewServiceConfig(config string) {}
 func (c *clientConn) ParseServiceConfig(
 	config string,
 ) *serviceconfig.ParseResult {
-	return nil
+	return &serviceconfig.ParseResult{}
 }
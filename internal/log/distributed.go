@@ -2,44 +2,92 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/schema"
 )
 
 type DistributedLog struct {
-	config  Config
-	log     *Log
-	raftLog *logStore
-	raft    *raft.Raft
+	config      Config
+	lock        *DirLock
+	log         *Log
+	raftLog     *logStore
+	stableStore *raftboltdb.BoltStore
+	snapshots   raft.SnapshotStore
+	transport   *contactTransport
+	raft        *raft.Raft
+	fsm         *fsm
+	metrics     *metric.Registry
+	// zones maps the IDs of the servers to the zones they run in.
+	zones sync.Map
 }
 
+// NewDistributedLog creates the log and the Raft instance replicating it in
+// the data directory. It holds the data directory's lock until it's closed,
+// and returns an error wrapping ErrLocked if another agent uses the directory.
 func NewDistributedLog(dataDir string, config Config) (
 	*DistributedLog,
 	error,
 ) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := LockDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("data directory in use: %w", err)
+	}
 	l := &DistributedLog{
 		config: config,
+		lock:   lock,
 	}
 	if err := l.setupLog(dataDir); err != nil {
+		_ = lock.Unlock()
 		return nil, err
 	}
 	if err := l.setupRaft(dataDir); err != nil {
+		l.closeStores()
+		_ = lock.Unlock()
+		return nil, err
+	}
+	if err := l.setupMetrics(); err != nil {
+		_ = l.Close()
 		return nil, err
 	}
 	return l, nil
 }
 
+// closeStores closes whatever stores setupRaft opened before it failed.
+func (l *DistributedLog) closeStores() {
+	if l.stableStore != nil {
+		_ = l.stableStore.Close()
+	}
+	if l.raftLog != nil {
+		_ = l.raftLog.Log.Close()
+	}
+	_ = l.log.Close()
+}
+
 func (l *DistributedLog) setupLog(dataDir string) error {
 	logDir := filepath.Join(dataDir, "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -53,7 +101,11 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	var err error
 
-	fsm := &fsm{log: l.log}
+	l.fsm = &fsm{
+		log:     l.log,
+		schemas: schema.NewRegistry(),
+		offsets: newGroupOffsets(),
+	}
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -66,7 +118,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		return err
 	}
 
-	stableStore, err := raftboltdb.NewBoltStore(
+	l.stableStore, err = raftboltdb.NewBoltStore(
 		filepath.Join(dataDir, "raft", "stable"),
 	)
 	if err != nil {
@@ -82,15 +134,21 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	l.snapshots = snapshotStore
 
+	if l.config.Raft.BindAddr != "" {
+		l.config.Raft.StreamLayer.advertise = advertiseAddr(
+			l.config.Raft.BindAddr,
+		)
+	}
 	maxPool := 5
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
+	l.transport = newContactTransport(raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
-	)
+	))
 
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID
@@ -109,20 +167,16 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 
 	l.raft, err = raft.NewRaft(
 		config,
-		fsm,
+		l.fsm,
 		l.raftLog,
-		stableStore,
+		l.stableStore,
 		snapshotStore,
-		transport,
+		l.transport,
 	)
 	if err != nil {
 		return err
 	}
-	hasState, err := raft.HasExistingState(
-		l.raftLog,
-		stableStore,
-		snapshotStore,
-	)
+	hasState, err := l.HasState()
 	if err != nil {
 		return err
 	}
@@ -138,8 +192,63 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	return err
 }
 
+// ErrExistingState is the error of bootstrapping a server that has Raft state,
+// which it only has once it bootstrapped or joined a cluster.
+var ErrExistingState = errors.New("raft has existing state")
+
+// HasState returns whether the server has Raft state: a log, a term or a
+// snapshot.
+func (l *DistributedLog) HasState() (bool, error) {
+	return raft.HasExistingState(l.raftLog, l.stableStore, l.snapshots)
+}
+
+// Bootstrap bootstraps a cluster of the servers, which all vote and must
+// include the local one. It returns ErrExistingState if the server has Raft
+// state, so an existing cluster is never bootstrapped again.
+func (l *DistributedLog) Bootstrap(servers []*api.Server) error {
+	hasState, err := l.HasState()
+	if err != nil {
+		return err
+	}
+	if hasState {
+		return ErrExistingState
+	}
+	var config raft.Configuration
+	local := false
+	for _, server := range servers {
+		if raft.ServerID(server.Id) == l.config.Raft.LocalID {
+			local = true
+		}
+		config.Servers = append(config.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(server.Id),
+			Address:  raft.ServerAddress(server.RpcAddr),
+		})
+	}
+	if !local {
+		return fmt.Errorf("bootstrap servers don't include %s", l.config.Raft.LocalID)
+	}
+	err = l.raft.BootstrapCluster(config).Error()
+	if errors.Is(err, raft.ErrCantBootstrap) {
+		return ErrExistingState
+	}
+	return err
+}
+
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext appends the record through Raft. The span of the context, if
+// it has one, travels with the command, so the leader's and followers' spans
+// applying it join the request's trace.
+func (l *DistributedLog) AppendContext(
+	ctx context.Context,
+	record *api.Record,
+) (uint64, error) {
+	defer recordLatency(appendLatency, time.Now())
 	res, err := l.apply(
+		ctx,
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
 	)
@@ -149,28 +258,61 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
-func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+// AppendBatchContext appends the records through Raft as a single command,
+// so they're appended together at contiguous offsets, and returns the offset
+// of the first one.
+func (l *DistributedLog) AppendBatchContext(
+	ctx context.Context,
+	records []*api.Record,
+) (uint64, error) {
+	defer recordLatency(appendLatency, time.Now())
+	res, err := l.apply(
+		ctx,
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+func (l *DistributedLog) apply(
+	ctx context.Context,
+	reqType RequestType,
+	req proto.Message,
+) (
 	interface{},
 	error,
 ) {
-	var buf bytes.Buffer
-	_, err := buf.Write([]byte{byte(reqType)})
+	_, span := startSpan(ctx, "log.apply")
+	defer span.End()
+	b, err := proto.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	b, err := proto.Marshal(req)
-	if err != nil {
+	if span != nil {
+		b = protowire.AppendTag(b, traceContextField, protowire.BytesType)
+		b = protowire.AppendBytes(b, propagation.Binary(span.SpanContext()))
+	}
+	var buf bytes.Buffer
+	if err = buf.WriteByte(byte(reqType)); err != nil {
 		return nil, err
 	}
-	_, err = buf.Write(b)
-	if err != nil {
+	if _, err = buf.Write(b); err != nil {
 		return nil, err
 	}
 	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	if err := future.Error(); err != nil {
+		span.SetStatus(trace.Status{
+			Code:    trace.StatusCodeUnavailable,
+			Message: err.Error(),
+		})
+		// clients retry the commands on the leader
+		return nil, l.notLeader(err)
 	}
+	span.AddAttributes(trace.Int64Attribute("raft.index", int64(future.Index())))
 	res := future.Response()
 	if err, ok := res.(error); ok {
 		return nil, err
@@ -179,10 +321,23 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 }
 
 func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return l.log.Read(offset)
+	return l.ReadContext(context.Background(), offset)
+}
+
+// ReadContext reads the record from the local log, tracing the read as a
+// child of the context's span, if it has one.
+func (l *DistributedLog) ReadContext(
+	ctx context.Context,
+	offset uint64,
+) (*api.Record, error) {
+	defer recordLatency(readLatency, time.Now())
+	return l.log.ReadContext(ctx, offset)
 }
 
-func (l *DistributedLog) Join(id, addr string) error {
+// Join adds the server to the cluster. Voters take part in elections and
+// commits, while non-voters only receive the replicated log so they can serve
+// reads without changing the quorum size.
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
@@ -192,6 +347,14 @@ func (l *DistributedLog) Join(id, addr string) error {
 	for _, srv := range configFuture.Configuration().Servers {
 		if srv.ID == serverID || srv.Address == serverAddr {
 			if srv.ID == serverID && srv.Address == serverAddr {
+				if voter && srv.Suffrage == raft.Nonvoter {
+					// server has joined as a non-voter, promote it
+					break
+				}
+				if !voter && srv.Suffrage != raft.Nonvoter {
+					// server has joined as a voter, demote it
+					return l.raft.DemoteVoter(serverID, 0, 0).Error()
+				}
 				// server has already joined
 				return nil
 			}
@@ -202,16 +365,154 @@ func (l *DistributedLog) Join(id, addr string) error {
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
-	if err := addFuture.Error(); err != nil {
+	addFuture := l.raft.AddVoter
+	if !voter {
+		addFuture = l.raft.AddNonvoter
+	}
+	if err := addFuture(serverID, serverAddr, 0, 0).Error(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Locate records the zone the server runs in, which GetServers reports so
+// clients may prefer the servers near them.
+func (l *DistributedLog) Locate(id, zone string) {
+	l.zones.Store(id, zone)
+}
+
 func (l *DistributedLog) Leave(id string) error {
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	return l.notLeader(removeFuture.Error())
+}
+
+// notLeader returns api.ErrNotLeader, with the leader the server knows of,
+// if the error is Raft's for a server that isn't or stopped being the
+// leader, and the error otherwise.
+func (l *DistributedLog) notLeader(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) ||
+		errors.Is(err, raft.ErrLeadershipLost) {
+		return api.ErrNotLeader{
+			Leader: string(l.raft.Leader()),
+			Err:    err,
+		}
+	}
+	return err
+}
+
+// TransferLeadership hands the leadership over to the server with the given
+// ID, or to the most up to date server if the ID is empty.
+func (l *DistributedLog) TransferLeadership(id string) error {
+	if id == "" {
+		return l.notLeader(l.raft.LeadershipTransfer().Error())
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			return l.notLeader(l.raft.LeadershipTransferToServer(
+				srv.ID,
+				srv.Address,
+			).Error())
+		}
+	}
+	return api.ErrUnknownServer{ID: id}
+}
+
+// Snapshot takes a snapshot of the log so Raft can compact its own log, and
+// returns the snapshot's metadata.
+func (l *DistributedLog) Snapshot() (*api.SnapshotResponse, error) {
+	future := l.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return nil, l.notLeader(err)
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{
+		Id:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+		Size:  meta.Size,
+	}, nil
+}
+
+// Stats returns the Raft stats of the server.
+func (l *DistributedLog) Stats() map[string]string {
+	return l.raft.Stats()
+}
+
+// Segments describes the segments of the server's log.
+func (l *DistributedLog) Segments() []*api.Segment {
+	return l.log.Segments()
+}
+
+// ForceRetention removes the records before the given offset from the log of
+// every server and returns the lowest offset left in the log.
+func (l *DistributedLog) ForceRetention(lowest uint64) (uint64, error) {
+	res, err := l.apply(
+		context.Background(),
+		RetentionRequestType,
+		&api.ForceRetentionRequest{LowestOffset: lowest},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ForceRetentionResponse).LowestOffset, nil
+}
+
+// RegisterSchema registers the schema through Raft, so every server's
+// registry has it under the same ID.
+func (l *DistributedLog) RegisterSchema(
+	ctx context.Context,
+	req *api.RegisterSchemaRequest,
+) (*api.Schema, error) {
+	res, err := l.apply(ctx, SchemaRequestType, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.RegisterSchemaResponse).Schema, nil
+}
+
+// SetCompatibility sets the compatibility the subject's new versions are
+// checked with through Raft, so every server checks them alike.
+func (l *DistributedLog) SetCompatibility(
+	ctx context.Context,
+	req *api.SetCompatibilityRequest,
+) (api.Compatibility, error) {
+	res, err := l.apply(ctx, CompatibilityRequestType, req)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.SetCompatibilityResponse).Compatibility, nil
+}
+
+// GetCompatibility returns the compatibility the subject's new versions are
+// checked with, NONE if it has none set.
+func (l *DistributedLog) GetCompatibility(subject string) api.Compatibility {
+	compatibility, _ := l.fsm.schemas.Compatibility(subject)
+	return compatibility
+}
+
+// GetSchema returns the schema with the request's ID, or else the request's
+// version of its subject, from the server's registry.
+func (l *DistributedLog) GetSchema(req *api.GetSchemaRequest) (*api.Schema, error) {
+	if req.Id != 0 {
+		return l.fsm.schemas.Get(req.Id)
+	}
+	return l.fsm.schemas.Version(req.Subject, req.Version)
+}
+
+// ValidateRecord checks the record has a schema of the subject and its value
+// validates against it.
+func (l *DistributedLog) ValidateRecord(subject string, record *api.Record) error {
+	return l.fsm.schemas.Validate(subject, record)
 }
 
 func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
@@ -231,6 +532,9 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 }
 
 func (l *DistributedLog) Close() error {
+	if l.metrics != nil {
+		metricproducer.GlobalManager().DeleteProducer(l.metrics)
+	}
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
@@ -238,7 +542,13 @@ func (l *DistributedLog) Close() error {
 	if err := l.raftLog.Log.Close(); err != nil {
 		return err
 	}
-	return l.log.Close()
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.log.Close(); err != nil {
+		return err
+	}
+	return l.lock.Unlock()
 }
 
 func (l *DistributedLog) GetServers() ([]*api.Server, error) {
@@ -248,77 +558,413 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	}
 	var servers []*api.Server
 	for _, server := range future.Configuration().Servers {
+		role := api.Role_VOTER
+		if server.Suffrage == raft.Nonvoter {
+			role = api.Role_NON_VOTER
+		}
+		zone, _ := l.zones.Load(string(server.ID))
+		zoneName, _ := zone.(string)
 		servers = append(servers, &api.Server{
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
 			IsLeader: l.raft.Leader() == server.Address,
+			Role:     role,
+			Suffrage: server.Suffrage.String(),
+			Zone:     zoneName,
 		})
 	}
 	return servers, nil
 }
 
+// watchInterval is how often WatchServers checks for the changes Raft doesn't
+// observe, such as a follower applying a change of the configuration.
+const watchInterval = time.Second
+
+// WatchServers calls fn with the servers, and again whenever they or the
+// leader change, until the context is done or fn fails. Leadership changes
+// and the leader's changes of its peers are observed from Raft as they
+// happen, and the others within watchInterval.
+func (l *DistributedLog) WatchServers(
+	ctx context.Context,
+	fn func([]*api.Server) error,
+) error {
+	// the servers are read again after each observation, so the ones the
+	// watch is too busy to take are dropped
+	observations := make(chan raft.Observation, 1)
+	observer := raft.NewObserver(
+		observations,
+		false,
+		func(o *raft.Observation) bool {
+			switch o.Data.(type) {
+			case raft.LeaderObservation, raft.PeerObservation:
+				return true
+			}
+			return false
+		},
+	)
+	l.raft.RegisterObserver(observer)
+	defer l.raft.DeregisterObserver(observer)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	var last []*api.Server
+	for sent := false; ; {
+		servers, err := l.GetServers()
+		if err != nil {
+			return err
+		}
+		if !sent || !equalServers(last, servers) {
+			if err = fn(servers); err != nil {
+				return err
+			}
+			last, sent = servers, true
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-observations:
+		case <-ticker.C:
+		}
+	}
+}
+
+// equalServers returns whether the lists have the same servers in the same
+// order.
+func equalServers(a, b []*api.Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	log     *Log
+	schemas *schema.Registry
+	offsets *groupOffsets
+	// restoring is 1 while the fsm restores a snapshot.
+	restoring int32
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType    RequestType = 0
+	RetentionRequestType RequestType = 1
+	SchemaRequestType    RequestType = 2
+	// AppendBatchRequestType appends the records of a batch together, so
+	// the servers must all know it before a batch is appended.
+	AppendBatchRequestType RequestType = 3
+	// OffsetCommitRequestType commits the offset of a Kafka consumer group.
+	OffsetCommitRequestType RequestType = 4
+	// CompatibilityRequestType sets the compatibility of a schema subject.
+	CompatibilityRequestType RequestType = 5
 )
 
+// traceContextField is the field number the span context of the request
+// applying a command is appended to its request with, well above the fields
+// of the requests. Servers that don't know it keep it as an unknown field
+// and ignore it, so the span contexts don't break rolling upgrades.
+const traceContextField protowire.Number = 1000
+
 func (f *fsm) Apply(record *raft.Log) interface{} {
+	defer recordLatency(applyLatency, time.Now())
 	buf := record.Data
+	if len(buf) == 0 {
+		return fmt.Errorf("empty command at index %d", record.Index)
+	}
 	reqType := RequestType(buf[0])
+	buf = buf[1:]
+	var req proto.Message
 	switch reqType {
 	case AppendRequestType:
-		return f.applyAppend(buf[1:])
+		req = &api.ProduceRequest{}
+	case RetentionRequestType:
+		req = &api.ForceRetentionRequest{}
+	case SchemaRequestType:
+		req = &api.RegisterSchemaRequest{}
+	case AppendBatchRequestType:
+		req = &api.ProduceBatchRequest{}
+	case OffsetCommitRequestType:
+		req = &api.GroupOffset{}
+	case CompatibilityRequestType:
+		req = &api.SetCompatibilityRequest{}
+	default:
+		return nil
+	}
+	if err := proto.Unmarshal(buf, req); err != nil {
+		return err
+	}
+	sc, _ := traceContext(req)
+	ctx := context.Background()
+	if parent, ok := propagation.FromBinary(sc); ok {
+		var span *trace.Span
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, "fsm.apply", parent)
+		span.AddAttributes(
+			trace.Int64Attribute("raft.index", int64(record.Index)),
+			trace.Int64Attribute("raft.term", int64(record.Term)),
+		)
+		defer span.End()
+	}
+	switch req := req.(type) {
+	case *api.ProduceRequest:
+		return f.applyAppend(ctx, req)
+	case *api.ForceRetentionRequest:
+		return f.applyRetention(req)
+	case *api.RegisterSchemaRequest:
+		return f.applySchema(req)
+	case *api.ProduceBatchRequest:
+		return f.applyAppendBatch(ctx, req)
+	case *api.GroupOffset:
+		return f.applyOffsetCommit(req)
+	case *api.SetCompatibilityRequest:
+		return f.applyCompatibility(req)
 	}
 	return nil
 }
 
-func (f *fsm) applyAppend(b []byte) interface{} {
-	var req api.ProduceRequest
-	err := proto.Unmarshal(b, &req)
+// traceContext removes the span context appended to the request from its
+// unknown fields, and returns it.
+func traceContext(req proto.Message) ([]byte, bool) {
+	m := req.ProtoReflect()
+	unknown := m.GetUnknown()
+	var sc, rest []byte
+	found := false
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return nil, false
+		}
+		size := protowire.ConsumeFieldValue(num, typ, unknown[n:])
+		if size < 0 {
+			return nil, false
+		}
+		if num == traceContextField && typ == protowire.BytesType {
+			sc, _ = protowire.ConsumeBytes(unknown[n:])
+			found = true
+		} else {
+			rest = append(rest, unknown[:n+size]...)
+		}
+		unknown = unknown[n+size:]
+	}
+	if found {
+		m.SetUnknown(rest)
+	}
+	return sc, found
+}
+
+func (f *fsm) applyAppend(
+	ctx context.Context,
+	req *api.ProduceRequest,
+) interface{} {
+	offset, err := f.log.AppendContext(ctx, req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+// applyAppendBatch appends the batch's records, which no other command comes
+// between, and returns the offset of the first one.
+func (f *fsm) applyAppendBatch(
+	ctx context.Context,
+	req *api.ProduceBatchRequest,
+) interface{} {
+	var base uint64
+	for i, record := range req.Records {
+		offset, err := f.log.AppendContext(ctx, record)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			base = offset
+		}
+	}
+	return &api.ProduceResponse{Offset: base}
+}
+
+func (f *fsm) applyRetention(req *api.ForceRetentionRequest) interface{} {
+	if req.LowestOffset > 0 {
+		if err := f.log.Truncate(req.LowestOffset - 1); err != nil {
+			return err
+		}
+	}
+	lowest, err := f.log.LowestOffset()
 	if err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+	return &api.ForceRetentionResponse{LowestOffset: lowest}
+}
+
+func (f *fsm) applySchema(req *api.RegisterSchemaRequest) interface{} {
+	s, err := f.schemas.Register(req)
 	if err != nil {
 		return err
 	}
-	return &api.ProduceResponse{Offset: offset}
+	return &api.RegisterSchemaResponse{Schema: s}
+}
+
+func (f *fsm) applyCompatibility(req *api.SetCompatibilityRequest) interface{} {
+	if err := f.schemas.SetCompatibility(req.Subject, req.Compatibility); err != nil {
+		return err
+	}
+	return &api.SetCompatibilityResponse{Compatibility: req.Compatibility}
 }
 
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	return &snapshot{
+		reader:          r,
+		schemas:         f.schemas.Schemas(),
+		compatibilities: f.schemas.Compatibilities(),
+		offsets:         f.offsets.list(),
+	}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
+// The markers start the sections of the snapshots holding schemas, subjects'
+// compatibilities and group offsets, which precede the records. No record's length can be one, so
+// snapshots of only records, as the servers wrote before they had schemas,
+// still restore.
+var (
+	schemasMarker         = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	offsetsMarker         = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}
+	compatibilitiesMarker = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfd}
+)
+
 type snapshot struct {
-	reader io.Reader
+	reader          io.Reader
+	schemas         []*api.Schema
+	compatibilities []*api.SetCompatibilityRequest
+	offsets         []*api.GroupOffset
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	defer recordLatency(snapshotLatency, time.Now())
+	_, span := trace.StartSpan(context.Background(), "snapshot.persist")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("raft.snapshot", sink.ID()))
+	schemas := make([]proto.Message, len(s.schemas))
+	for i, schema := range s.schemas {
+		schemas[i] = schema
+	}
+	compatibilities := make([]proto.Message, len(s.compatibilities))
+	for i, compatibility := range s.compatibilities {
+		compatibilities[i] = compatibility
+	}
+	offsets := make([]proto.Message, len(s.offsets))
+	for i, offset := range s.offsets {
+		offsets[i] = offset
+	}
+	err := persistSection(sink, schemasMarker, schemas)
+	if err == nil {
+		err = persistSection(sink, compatibilitiesMarker, compatibilities)
+	}
+	if err == nil {
+		err = persistSection(sink, offsetsMarker, offsets)
+	}
+	if err == nil {
+		var n int64
+		n, err = io.Copy(sink, s.reader)
+		span.AddAttributes(trace.Int64Attribute("bytes", n))
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{
+			Code:    trace.StatusCodeInternal,
+			Message: err.Error(),
+		})
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
 
+// persistSection writes the marker, the number of messages and the
+// messages, each preceded by its length, if there are any.
+func persistSection(w io.Writer, marker []byte, messages []proto.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Write(marker)
+	if err := binary.Write(&buf, enc, uint64(len(messages))); err != nil {
+		return err
+	}
+	for _, m := range messages {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err = binary.Write(&buf, enc, uint64(len(b))); err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
 func (s *snapshot) Release() {}
 
 func (f *fsm) Restore(r io.ReadCloser) error {
+	defer recordLatency(restoreLatency, time.Now())
+	atomic.StoreInt32(&f.restoring, 1)
+	defer atomic.StoreInt32(&f.restoring, 0)
+	// the records aren't traced one by one, a snapshot holds the whole log
+	_, span := trace.StartSpan(context.Background(), "snapshot.restore")
+	defer span.End()
 	b := make([]byte, lenWidth)
+	_, err := io.ReadFull(r, b)
+	var schemas []*api.Schema
+	var compatibilities []*api.SetCompatibilityRequest
+	var offsets []*api.GroupOffset
+	for err == nil {
+		var newMessage func() proto.Message
+		switch {
+		case bytes.Equal(b, schemasMarker):
+			newMessage = func() proto.Message {
+				schema := &api.Schema{}
+				schemas = append(schemas, schema)
+				return schema
+			}
+		case bytes.Equal(b, compatibilitiesMarker):
+			newMessage = func() proto.Message {
+				compatibility := &api.SetCompatibilityRequest{}
+				compatibilities = append(compatibilities, compatibility)
+				return compatibility
+			}
+		case bytes.Equal(b, offsetsMarker):
+			newMessage = func() proto.Message {
+				offset := &api.GroupOffset{}
+				offsets = append(offsets, offset)
+				return offset
+			}
+		}
+		if newMessage == nil {
+			break
+		}
+		if err = restoreSection(r, newMessage); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(r, b)
+	}
+	if err := f.schemas.Restore(schemas, compatibilities); err != nil {
+		return err
+	}
+	f.offsets.restore(offsets)
 	var buf bytes.Buffer
 	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
+		if i > 0 {
+			_, err = io.ReadFull(r, b)
+		}
 		if err == io.EOF {
+			span.AddAttributes(trace.Int64Attribute("records", int64(i)))
 			break
 		} else if err != nil {
 			return err
@@ -345,6 +991,29 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 	return nil
 }
 
+// restoreSection reads the messages following the marker of a snapshot's
+// section into the messages newMessage returns.
+func restoreSection(r io.Reader, newMessage func() proto.Message) error {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	n := enc.Uint64(b)
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		buf := make([]byte, enc.Uint64(b))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(buf, newMessage()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var _ raft.LogStore = (*logStore)(nil)
 
 type logStore struct {
@@ -405,6 +1074,7 @@ var _ raft.StreamLayer = (*StreamLayer)(nil)
 
 type StreamLayer struct {
 	ln              net.Listener
+	advertise       net.Addr
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
 }
@@ -466,6 +1136,25 @@ func (s *StreamLayer) Close() error {
 	return s.ln.Close()
 }
 
+// Addr returns the address the other servers reach this server on. Raft
+// hands it to the followers as the leader's address, so it has to match the
+// address the server joined the cluster with rather than the listener's,
+// which may be bound to every interface.
 func (s *StreamLayer) Addr() net.Addr {
+	if s.advertise != nil {
+		return s.advertise
+	}
 	return s.ln.Addr()
 }
+
+// advertiseAddr is the net.Addr of the address a server advertises to its
+// peers.
+type advertiseAddr string
+
+func (a advertiseAddr) Network() string {
+	return "tcp"
+}
+
+func (a advertiseAddr) String() string {
+	return string(a)
+}
@@ -1,10 +1,14 @@
 package log_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/pouriaamini/proglog/internal/log"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"go.opencensus.io/trace"
 )
 
 func TestMultipleNodes(t *testing.T) {
@@ -50,7 +55,7 @@ func TestMultipleNodes(t *testing.T) {
 
 		if i != 0 {
 			err = logs[0].Join(
-				fmt.Sprintf("%d", i), ln.Addr().String(),
+				fmt.Sprintf("%d", i), ln.Addr().String(), true,
 			)
 			require.NoError(t, err)
 		} else {
@@ -118,3 +123,511 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestNonVoter(t *testing.T) {
+	logs := setupLogs(t, true, false)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := logs[1].Read(off)
+		return err == nil && reflect.DeepEqual([]byte("first"), got.Value)
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	require.True(t, servers[0].IsLeader)
+	require.Equal(t, api.Role_VOTER, servers[0].Role)
+	require.Equal(t, raft.Voter.String(), servers[0].Suffrage)
+	require.False(t, servers[1].IsLeader)
+	require.Equal(t, api.Role_NON_VOTER, servers[1].Role)
+	require.Equal(t, raft.Nonvoter.String(), servers[1].Suffrage)
+	require.Empty(t, servers[1].Zone)
+
+	// the servers report the zones membership locates them in
+	logs[0].Locate("1", "zone-b")
+	servers, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, "zone-b", servers[1].Zone)
+
+	// promoting the non-voter makes it a voter
+	err = logs[0].Join("1", servers[1].RpcAddr, true)
+	require.NoError(t, err)
+	servers, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, api.Role_VOTER, servers[1].Role)
+}
+
+func TestAdmin(t *testing.T) {
+	logs := setupLogs(t, true, true)
+
+	for i := 0; i < 3; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "Leader", logs[0].Stats()["state"])
+	segments := logs[0].Segments()
+	require.Equal(t, 1, len(segments))
+	require.Equal(t, uint64(3), segments[0].NextOffset)
+
+	snapshot, err := logs[0].Snapshot()
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshot.Id)
+	require.NotZero(t, snapshot.Index)
+
+	// records of 200 bytes fill a segment every few records, which are
+	// removed once all their records are below the lowest offset
+	for i := 0; i < 20; i++ {
+		_, err := logs[0].Append(&api.Record{Value: make([]byte, 200)})
+		require.NoError(t, err)
+	}
+	lowest, err := logs[0].ForceRetention(12)
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	require.LessOrEqual(t, lowest, uint64(12))
+	_, err = logs[0].Read(lowest - 1)
+	var outOfRange api.ErrOffsetOutOfRange
+	require.ErrorAs(t, err, &outOfRange)
+	require.True(t, outOfRange.Truncated())
+	_, err = logs[0].Read(12)
+	require.NoError(t, err)
+
+	err = logs[1].TransferLeadership("0")
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+	err = logs[0].TransferLeadership("2")
+	require.ErrorAs(t, err, &api.ErrUnknownServer{})
+
+	err = logs[0].TransferLeadership("1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return logs[1].Stats()["state"] == "Leader"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestWatchServers(t *testing.T) {
+	logs := setupLogs(t, true, true)
+	require.Eventually(t, func() bool {
+		servers, err := logs[1].GetServers()
+		return err == nil && len(servers) == 2 && servers[0].IsLeader
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []*api.Server)
+	watched := make(chan error)
+	go func() {
+		watched <- logs[1].WatchServers(ctx, func(servers []*api.Server) error {
+			updates <- servers
+			return nil
+		})
+	}()
+	// leader returns the ID of the leader of the next update, which is
+	// empty while there's none
+	leader := func() string {
+		select {
+		case servers := <-updates:
+			for _, server := range servers {
+				if server.IsLeader {
+					return server.Id
+				}
+			}
+			return ""
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("no update")
+			return ""
+		}
+	}
+	require.Equal(t, "0", leader())
+
+	// the follower observes the new leader without waiting to poll
+	require.NoError(t, logs[0].TransferLeadership("1"))
+	for id := leader(); id != "1"; id = leader() {
+	}
+
+	cancel()
+	require.NoError(t, <-watched)
+}
+
+func TestAppendBatch(t *testing.T) {
+	logs := setupLogs(t, true, true)
+
+	_, err := logs[0].Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	values := []string{"second", "third", "fourth"}
+	var records []*api.Record
+	for _, value := range values {
+		records = append(records, &api.Record{Value: []byte(value)})
+	}
+	base, err := logs[0].AppendBatchContext(context.Background(), records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+
+	// the batch is a single command, appended at contiguous offsets on
+	// every server
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			for i, value := range values {
+				record, err := l.Read(base + uint64(i))
+				if err != nil || string(record.Value) != value {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	_, err = logs[1].AppendBatchContext(context.Background(), records)
+	var notLeader api.ErrNotLeader
+	require.ErrorAs(t, err, &notLeader)
+}
+
+func TestGroupOffsets(t *testing.T) {
+	logs := setupLogs(t, true, true)
+
+	err := logs[0].CommitOffset(context.Background(), &api.GroupOffset{
+		Group:    "group",
+		Offset:   42,
+		Metadata: "meta",
+	})
+	require.NoError(t, err)
+	// the followers know the offset should they come to lead
+	require.Eventually(t, func() bool {
+		offset, ok := logs[1].GroupOffset("group")
+		return ok && offset.Offset == 42 && offset.Metadata == "meta"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, ok := logs[1].GroupOffset("other")
+	require.False(t, ok)
+
+	err = logs[1].CommitOffset(context.Background(), &api.GroupOffset{
+		Group: "group",
+	})
+	var notLeader api.ErrNotLeader
+	require.ErrorAs(t, err, &notLeader)
+}
+
+func TestTracePropagation(t *testing.T) {
+	logs := setupLogs(t, true, true)
+
+	exporter := &spanRecorder{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	ctx, span := trace.StartSpan(
+		context.Background(),
+		"produce",
+		trace.WithSampler(trace.AlwaysSample()),
+	)
+	_, err := logs[0].AppendContext(ctx, &api.Record{Value: []byte("traced")})
+	require.NoError(t, err)
+	span.End()
+	// appends without a span don't start traces
+	_, err = logs[0].Append(&api.Record{Value: []byte("untraced")})
+	require.NoError(t, err)
+
+	// the leader and the follower apply the command in the request's trace
+	require.Eventually(t, func() bool {
+		return exporter.count("fsm.apply") == 2
+	}, time.Second, 50*time.Millisecond)
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	names := map[string]int{}
+	for _, s := range exporter.spans {
+		require.Equal(t, span.SpanContext().TraceID, s.TraceID)
+		names[s.Name]++
+	}
+	require.Equal(t, map[string]int{
+		"produce":      1,
+		"log.apply":    1,
+		"fsm.apply":    2,
+		"log.append":   2,
+		"store.append": 2,
+	}, names)
+}
+
+// spanRecorder records the spans exported to it.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, s := range r.spans {
+		if s.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReady(t *testing.T) {
+	logs := setupLogs(t, true, true)
+
+	require.NoError(t, logs[0].Alive())
+	require.NoError(t, logs[0].Ready(log.HealthConfig{
+		MaxApplyLag:    10,
+		MaxLastContact: time.Second,
+		MinFreeBytes:   1,
+	}))
+	require.Eventually(t, func() bool {
+		return logs[1].Ready(log.HealthConfig{
+			MaxLastContact: time.Second,
+		}) == nil
+	}, time.Second, 50*time.Millisecond)
+
+	err := logs[0].Ready(log.HealthConfig{MinFreeBytes: math.MaxUint64})
+	require.True(t, errors.Is(err, log.ErrDiskFull))
+
+	// a follower without a leader isn't ready but is still alive
+	require.NoError(t, logs[0].Close())
+	require.Eventually(t, func() bool {
+		return errors.Is(logs[1].Ready(log.HealthConfig{}), log.ErrNoLeader)
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, logs[1].Alive())
+	require.True(t, errors.Is(logs[0].Ready(log.HealthConfig{}), log.ErrShutdown))
+}
+
+func TestSchemas(t *testing.T) {
+	logs := setupLogs(t, true, true)
+	ctx := context.Background()
+
+	schema, err := logs[0].RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Type:       api.SchemaType_JSON_SCHEMA,
+		Definition: []byte(`{"type": "object", "required": ["name"]}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), schema.Id)
+	_, err = logs[0].RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Definition: []byte(`{"type": `),
+	})
+	require.Error(t, err)
+
+	// followers get the schema and validate records with it
+	require.Eventually(t, func() bool {
+		_, err := logs[1].GetSchema(&api.GetSchemaRequest{Id: 1})
+		return err == nil
+	}, time.Second, 50*time.Millisecond)
+	got, err := logs[1].GetSchema(&api.GetSchemaRequest{Subject: "users"})
+	require.NoError(t, err)
+	require.Equal(t, schema.Id, got.Id)
+	require.NoError(t, logs[1].ValidateRecord("users", &api.Record{
+		SchemaId: 1,
+		Value:    []byte(`{"name": "pouria"}`),
+	}))
+	require.Error(t, logs[1].ValidateRecord("users", &api.Record{
+		SchemaId: 1,
+		Value:    []byte(`{}`),
+	}))
+	_, err = logs[1].RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Definition: []byte(`{}`),
+	})
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func TestSchemasSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	l, err := log.NewDistributedLog(dataDir, logConfig(ln, 0, true))
+	require.NoError(t, err)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	_, err = l.RegisterSchema(context.Background(), &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Definition: []byte(`{"type": "object"}`),
+	})
+	require.NoError(t, err)
+	_, err = l.SetCompatibility(
+		context.Background(),
+		&api.SetCompatibilityRequest{
+			Subject:       "users",
+			Compatibility: api.Compatibility_FULL,
+		},
+	)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+	err = l.CommitOffset(context.Background(), &api.GroupOffset{
+		Group:  "group",
+		Offset: 1,
+	})
+	require.NoError(t, err)
+	_, err = l.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// the restarted server restores the schema, the subject's compatibility,
+	// the group's offset and the records from the snapshot, rather than
+	// applying the commands before it again
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	l, err = log.NewDistributedLog(dataDir, logConfig(ln, 0, true))
+	require.NoError(t, err)
+	defer l.Close()
+	schema, err := l.GetSchema(&api.GetSchemaRequest{Subject: "users"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), schema.Id)
+	require.Equal(t, api.Compatibility_FULL, l.GetCompatibility("users"))
+	offset, ok := l.GroupOffset("group")
+	require.True(t, ok)
+	require.Equal(t, int64(1), offset.Offset)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record"), record.Value)
+}
+
+func TestBootstrap(t *testing.T) {
+	var logs []*log.DistributedLog
+	var servers []*api.Server
+	ports := dynaport.Get(3)
+	for i := 0; i < 3; i++ {
+		dataDir := t.TempDir()
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+		l, err := log.NewDistributedLog(dataDir, logConfig(ln, i, false))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+		logs = append(logs, l)
+		servers = append(servers, &api.Server{
+			Id:      fmt.Sprintf("%d", i),
+			RpcAddr: ln.Addr().String(),
+		})
+	}
+
+	err := logs[0].Bootstrap(servers[1:])
+	require.Error(t, err)
+	require.NoError(t, logs[0].Bootstrap(servers))
+	require.NoError(t, logs[0].WaitForLeader(3*time.Second))
+	_, err = logs[0].Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+
+	// every server has joined the cluster, so none bootstraps another
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			hasState, err := l.HasState()
+			return err == nil && hasState
+		}, 3*time.Second, 50*time.Millisecond)
+		require.ErrorIs(t, l.Bootstrap(servers), log.ErrExistingState)
+	}
+	got, err := logs[1].GetServers()
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	for _, server := range got {
+		require.Equal(t, api.Role_VOTER, server.Role)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	logs := setupLogs(t, true, true, false)
+	_, err := logs[0].Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		servers, err := logs[0].ServerHealth()
+		if err != nil || len(servers) != 3 {
+			return false
+		}
+		for _, server := range servers {
+			if server.LastContactMs < 0 || server.IndexLag != 0 {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+	servers, err := logs[0].ServerHealth()
+	require.NoError(t, err)
+	for _, server := range servers {
+		require.Equal(t, server.Id == "0", server.IsLeader)
+		require.Equal(t, server.Id != "2", server.Voter)
+		require.Equal(t, servers[0].Term, server.Term)
+		require.Less(t, server.LastContactMs, int64(1000))
+	}
+
+	// the followers don't hear from the others
+	_, err = logs[1].ServerHealth()
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func TestDataDirLock(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	lock, err := log.LockDir(dataDir)
+	require.NoError(t, err)
+	_, err = log.NewDistributedLog(dataDir, log.Config{})
+	require.True(t, errors.Is(err, log.ErrLocked))
+	require.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+	require.NoError(t, lock.Unlock())
+}
+
+// setupLogs starts a cluster with a server for each of the given suffrages,
+// bootstrapped by the first one.
+func setupLogs(t *testing.T, voters ...bool) []*log.DistributedLog {
+	t.Helper()
+	var logs []*log.DistributedLog
+	ports := dynaport.Get(len(voters))
+
+	for i, voter := range voters {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = os.RemoveAll(dataDir)
+		})
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		l, err := log.NewDistributedLog(dataDir, logConfig(ln, i, i == 0))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(), voter,
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+// logConfig returns the config of the server with the ID and listener.
+func logConfig(ln net.Listener, id int, bootstrap bool) log.Config {
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = bootstrap
+	return config
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/schema"
+)
+
+func TestFSMApplyTraceContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	f := &fsm{log: log, schemas: schema.NewRegistry()}
+
+	exporter := &fsmSpans{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	_, span := trace.StartSpan(
+		context.Background(),
+		"produce",
+		trace.WithSampler(trace.AlwaysSample()),
+	)
+	span.End()
+	sc := propagation.Binary(span.SpanContext())
+
+	req, err := proto.Marshal(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+	traced := protowire.AppendTag(req, traceContextField, protowire.BytesType)
+	traced = protowire.AppendBytes(traced, sc)
+
+	// servers that don't know the span context field ignore it
+	var old api.ProduceRequest
+	require.NoError(t, proto.Unmarshal(traced, &old))
+	require.Equal(t, []byte("hello"), old.Record.Value)
+
+	for i, data := range [][]byte{
+		append([]byte{byte(AppendRequestType)}, req...),
+		append([]byte{byte(AppendRequestType)}, traced...),
+	} {
+		res := f.Apply(&raft.Log{Index: uint64(i + 1), Data: data})
+		require.Equal(t, uint64(i), res.(*api.ProduceResponse).Offset)
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), record.Value)
+		require.Empty(t, record.ProtoReflect().GetUnknown())
+	}
+	// the traced command joins the request's trace
+	exporter.mu.Lock()
+	var applied int
+	for _, s := range exporter.spans {
+		if s.Name == "fsm.apply" {
+			require.Equal(t, span.SpanContext().TraceID, s.TraceID)
+			applied++
+		}
+	}
+	exporter.mu.Unlock()
+	require.Equal(t, 1, applied)
+
+	// truncated commands fail rather than panic
+	for _, data := range [][]byte{
+		nil,
+		{byte(AppendRequestType), 0x0a, 16, 1, 2},
+	} {
+		res := f.Apply(&raft.Log{Index: 3, Data: data})
+		_, ok := res.(error)
+		require.True(t, ok)
+	}
+}
+
+// fsmSpans records the spans exported to it.
+type fsmSpans struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *fsmSpans) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
@@ -0,0 +1,90 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Errors Ready wraps to describe why a server isn't ready to serve the log.
+var (
+	ErrShutdown  = errors.New("raft is shut down")
+	ErrNoLeader  = errors.New("no known leader")
+	ErrRestoring = errors.New("restoring a snapshot")
+	ErrLagging   = errors.New("lagging behind the leader")
+	ErrDiskFull  = errors.New("disk full")
+)
+
+// HealthConfig sets when a server stops being ready to serve the log. Zero
+// values disable their check.
+type HealthConfig struct {
+	// MaxApplyLag is the number of committed entries the server may have
+	// left to apply to its log.
+	MaxApplyLag uint64
+	// MaxLastContact is how long a follower may go without hearing from the
+	// leader.
+	MaxLastContact time.Duration
+	// MinFreeBytes is the free space the data directory's disk must have
+	// for appends to succeed. It isn't checked on the platforms diskFree
+	// can't measure the free space of.
+	MinFreeBytes uint64
+}
+
+// Alive returns ErrShutdown once Raft has shut down, and nil otherwise. A
+// server that's alive may not be ready to serve the log.
+func (l *DistributedLog) Alive() error {
+	if l.raft.State() == raft.Shutdown {
+		return ErrShutdown
+	}
+	return nil
+}
+
+// Ready returns nil if the server can serve the log, or an error wrapping
+// one of ErrShutdown, ErrNoLeader, ErrRestoring, ErrLagging or ErrDiskFull
+// describing why it can't.
+func (l *DistributedLog) Ready(c HealthConfig) error {
+	if err := l.Alive(); err != nil {
+		return err
+	}
+	if l.raft.Leader() == "" {
+		return ErrNoLeader
+	}
+	if atomic.LoadInt32(&l.fsm.restoring) == 1 {
+		return ErrRestoring
+	}
+	stats := l.raft.Stats()
+	if c.MaxApplyLag != 0 {
+		commit, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+		applied, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+		if commit > applied && commit-applied > c.MaxApplyLag {
+			return fmt.Errorf(
+				"%w: %d committed entries left to apply",
+				ErrLagging,
+				commit-applied,
+			)
+		}
+	}
+	if c.MaxLastContact != 0 && l.raft.State() != raft.Leader {
+		if since := time.Since(l.raft.LastContact()); since > c.MaxLastContact {
+			return fmt.Errorf(
+				"%w: last contact %s ago",
+				ErrLagging,
+				since.Round(time.Millisecond),
+			)
+		}
+	}
+	if c.MinFreeBytes != 0 {
+		free, err := diskFree(l.log.Dir)
+		if err != nil {
+			return err
+		}
+		if free < c.MinFreeBytes {
+			return fmt.Errorf("%w: %d bytes free", ErrDiskFull, free)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build darwin || dragonfly || freebsd || linux
+
+package log
+
+import "syscall"
+
+// diskFree returns the bytes available to the process on the disk holding
+// the directory.
+func diskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,17 @@
+package log
+
+import "golang.org/x/sys/windows"
+
+// diskFree returns the bytes available to the process on the disk holding
+// the directory.
+func diskFree(dir string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err = windows.GetDiskFreeSpaceEx(name, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
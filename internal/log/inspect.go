@@ -0,0 +1,376 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// The functions in this file read and repair the segments of a log directory
+// straight from their files, without opening the log, so they can be used on
+// the data of a stopped server. Each takes the directory's lock while it runs,
+// so they return an error wrapping ErrLocked rather than reading or repairing
+// the log of a running server.
+
+// Corruption describes an index entry, or a part of a store, that doesn't
+// match the records written to the segment.
+type Corruption struct {
+	// BaseOffset is the base offset of the corrupted segment.
+	BaseOffset uint64
+	// Entry is the index entry pointing to the corrupted frame, relative to
+	// the base offset.
+	Entry uint64
+	// Reason describes what's wrong with the entry.
+	Reason string
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf(
+		"segment %d, entry %d: %s",
+		c.BaseOffset,
+		c.Entry,
+		c.Reason,
+	)
+}
+
+// InspectSegments describes the segments of the directory. The next offsets
+// are derived from the number of entries in each index, as an agent would on
+// startup.
+func InspectSegments(dir string) ([]*api.Segment, error) {
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []*api.Segment
+	for _, baseOffset := range baseOffsets {
+		s, err := openSegmentFiles(dir, baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, &api.Segment{
+			BaseOffset: baseOffset,
+			NextOffset: baseOffset + s.entries(),
+			StoreBytes: s.storeSize,
+			IndexBytes: uint64(len(s.index)),
+		})
+		if err = s.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// ReadRange calls fn with each record of the directory's log from the from
+// offset up to and including the to offset, following the indexes like Read.
+func ReadRange(
+	dir string,
+	from, to uint64,
+	fn func(*api.Record) error,
+) error {
+	lock, err := LockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return err
+	}
+	for _, baseOffset := range baseOffsets {
+		if baseOffset > to {
+			break
+		}
+		if err = readSegmentRange(dir, baseOffset, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegmentRange calls fn with the records of the segment in the range.
+func readSegmentRange(
+	dir string,
+	baseOffset, from, to uint64,
+	fn func(*api.Record) error,
+) error {
+	s, err := openSegmentFiles(dir, baseOffset)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for i := uint64(0); i < s.entries(); i++ {
+		off := baseOffset + i
+		if off < from {
+			continue
+		}
+		if off > to {
+			break
+		}
+		_, pos := s.entry(i)
+		record, err := s.record(pos)
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", off, err)
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks that every index entry of the directory's segments points to
+// a store frame holding the record with the entry's offset, and that every
+// frame of the stores is indexed. It returns the corruptions it found.
+func Verify(dir string) ([]Corruption, error) {
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	var corruptions []Corruption
+	for _, baseOffset := range baseOffsets {
+		s, err := openSegmentFiles(dir, baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		corruptions = append(corruptions, s.verify()...)
+		if err = s.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return corruptions, nil
+}
+
+// RebuildIndex rewrites the index of the segment with the given base offset
+// from the frames of its store, and returns the number of entries written. A
+// partially written frame at the end of the store is cut off, otherwise the
+// records appended after it couldn't be indexed again.
+func RebuildIndex(dir string, baseOffset uint64) (uint64, error) {
+	lock, err := LockDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	s, err := openSegmentFiles(dir, baseOffset)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	var index []byte
+	entry := make([]byte, entWidth)
+	end, err := s.frames(func(n, pos uint64) error {
+		enc.PutUint32(entry[:offWidth], uint32(n))
+		enc.PutUint64(entry[offWidth:], pos)
+		index = append(index, entry...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if end < s.storeSize {
+		if err = s.store.Truncate(int64(end)); err != nil {
+			return 0, err
+		}
+	}
+	indexPath := s.indexPath(dir)
+	tmp := indexPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, index, 0644); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp, indexPath); err != nil {
+		return 0, err
+	}
+	return uint64(len(index)) / entWidth, nil
+}
+
+// segmentFiles is a segment's index and store read from disk, without the
+// memory map and the buffered writes of an open segment.
+type segmentFiles struct {
+	baseOffset uint64
+	index      []byte
+	store      *os.File
+	storeSize  uint64
+}
+
+// openSegmentFiles reads the index of the segment with the given base offset
+// and opens its store. A missing index is read as an empty one.
+func openSegmentFiles(dir string, baseOffset uint64) (*segmentFiles, error) {
+	s := &segmentFiles{baseOffset: baseOffset}
+	var err error
+	s.index, err = ioutil.ReadFile(s.indexPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.store, err = os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)),
+		os.O_RDWR,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.store.Stat()
+	if err != nil {
+		_ = s.store.Close()
+		return nil, err
+	}
+	s.storeSize = uint64(fi.Size())
+	return s, nil
+}
+
+// indexPath returns the path of the segment's index file.
+func (s *segmentFiles) indexPath(dir string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", s.baseOffset, indexExt))
+}
+
+// entries returns the number of entries in the index.
+func (s *segmentFiles) entries() uint64 {
+	return uint64(len(s.index)) / entWidth
+}
+
+// entry returns the relative offset and store position of the nth entry.
+func (s *segmentFiles) entry(n uint64) (uint32, uint64) {
+	pos := n * entWidth
+	return enc.Uint32(s.index[pos : pos+offWidth]),
+		enc.Uint64(s.index[pos+offWidth : pos+entWidth])
+}
+
+// frame returns the data of the store frame at the given position, checking
+// that the frame lies within the store.
+func (s *segmentFiles) frame(pos uint64) ([]byte, error) {
+	if pos+lenWidth > s.storeSize {
+		return nil, fmt.Errorf(
+			"position %d is past the end of the store (%d bytes)",
+			pos,
+			s.storeSize,
+		)
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+		return nil, err
+	}
+	n := enc.Uint64(size)
+	if n > s.storeSize-pos-lenWidth {
+		return nil, fmt.Errorf(
+			"frame at position %d of %d bytes overruns the store",
+			pos,
+			n,
+		)
+	}
+	b := make([]byte, n)
+	if _, err := s.store.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// record returns the record in the store frame at the given position.
+func (s *segmentFiles) record(pos uint64) (*api.Record, error) {
+	b, err := s.frame(pos)
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(b, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// frames calls fn with the number and position of each complete frame of
+// the store, in order, and returns the position the complete frames end at.
+func (s *segmentFiles) frames(fn func(n, pos uint64) error) (uint64, error) {
+	var n, pos uint64
+	for pos < s.storeSize {
+		b, err := s.frame(pos)
+		if err != nil {
+			// the rest of the store is a partially written frame
+			break
+		}
+		if err = fn(n, pos); err != nil {
+			return pos, err
+		}
+		n++
+		pos += lenWidth + uint64(len(b))
+	}
+	return pos, nil
+}
+
+// verify returns the corruptions of the segment.
+func (s *segmentFiles) verify() []Corruption {
+	var corruptions []Corruption
+	corrupt := func(n uint64, format string, a ...interface{}) {
+		corruptions = append(corruptions, Corruption{
+			BaseOffset: s.baseOffset,
+			Entry:      n,
+			Reason:     fmt.Sprintf(format, a...),
+		})
+	}
+	if uint64(len(s.index))%entWidth != 0 {
+		corrupt(
+			s.entries(),
+			"index size %d isn't a multiple of the entry width",
+			len(s.index),
+		)
+	}
+	for n := uint64(0); n < s.entries(); n++ {
+		off, pos := s.entry(n)
+		if uint64(off) != n {
+			corrupt(n, "entry has relative offset %d", off)
+			continue
+		}
+		record, err := s.record(pos)
+		if err != nil {
+			corrupt(n, "%v", err)
+			continue
+		}
+		if record.Offset != s.baseOffset+n {
+			corrupt(
+				n,
+				"frame at position %d holds offset %d",
+				pos,
+				record.Offset,
+			)
+		}
+	}
+	var frames uint64
+	end, _ := s.frames(func(n, pos uint64) error {
+		frames++
+		return nil
+	})
+	if frames > s.entries() {
+		corrupt(
+			s.entries(),
+			"store has %d frames but the index has %d entries",
+			frames,
+			s.entries(),
+		)
+	}
+	if end < s.storeSize {
+		corrupt(
+			frames,
+			"store ends with a partial frame at position %d",
+			end,
+		)
+	}
+	return corruptions
+}
+
+// Close closes the segment's store.
+func (s *segmentFiles) Close() error {
+	return s.store.Close()
+}
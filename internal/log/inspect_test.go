@@ -0,0 +1,97 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	want := log.Segments()
+
+	// the log of a running server can't be read or repaired
+	_, err = InspectSegments(dir)
+	require.True(t, errors.Is(err, ErrLocked))
+	err = ReadRange(dir, 0, 2, func(*api.Record) error { return nil })
+	require.True(t, errors.Is(err, ErrLocked))
+	_, err = Verify(dir)
+	require.True(t, errors.Is(err, ErrLocked))
+	_, err = RebuildIndex(dir, 0)
+	require.True(t, errors.Is(err, ErrLocked))
+	require.NoError(t, log.Close())
+
+	segments, err := InspectSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, len(want), len(segments))
+	for i := range want {
+		require.Equal(t, want[i].BaseOffset, segments[i].BaseOffset)
+		require.Equal(t, want[i].NextOffset, segments[i].NextOffset)
+		require.Equal(t, want[i].StoreBytes, segments[i].StoreBytes)
+		require.Equal(t, want[i].IndexBytes, segments[i].IndexBytes)
+	}
+
+	var offsets []uint64
+	err = ReadRange(dir, 1, 2, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, offsets)
+
+	corruptions, err := Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, corruptions)
+
+	// a server that crashed leaves its active index padded with zeros and
+	// may leave a partially written frame in its store
+	indexPath := path.Join(dir, "2.index")
+	require.NoError(t, os.Truncate(indexPath, int64(entWidth*4)))
+	storePath := path.Join(dir, "2.store")
+	f, err := os.OpenFile(storePath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 64, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	corruptions, err = Verify(dir)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(corruptions))
+	for _, c := range corruptions {
+		require.Equal(t, uint64(2), c.BaseOffset)
+	}
+
+	entries, err := RebuildIndex(dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), entries)
+	corruptions, err = Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, corruptions)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.NoError(t, log.Close())
+}
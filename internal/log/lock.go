@@ -0,0 +1,67 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is the name of the file locked in a directory by the process
+// using the directory.
+const lockFileName = ".lock"
+
+// ErrLocked is returned when another process holds the lock of a directory.
+var ErrLocked = errors.New("directory is locked by another process")
+
+// DirLock is an exclusive lock on a directory. It's an OS lock on a file in
+// the directory, flock on unix and LockFileEx on Windows, so the kernel
+// releases it if the process dies without unlocking.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir takes the lock of the directory without waiting for it, and writes
+// the process ID to the lock file. It returns an error wrapping ErrLocked,
+// naming the holder's process ID, if another process, or another open of the
+// lock file in this one, holds it.
+func LockDir(dir string) (*DirLock, error) {
+	name := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		_ = f.Close()
+		if errors.Is(err, ErrLocked) {
+			b, _ := ioutil.ReadFile(name)
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+			}
+			return nil, fmt.Errorf("%s: %w (pid %d)", dir, ErrLocked, pid)
+		}
+		return nil, err
+	}
+	if err = f.Truncate(0); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &DirLock{file: f}, nil
+}
+
+// Unlock releases the lock of the directory.
+func (l *DirLock) Unlock() error {
+	if err := unlockFile(l.file); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,27 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	lock, err := LockDir(dir)
+	require.NoError(t, err)
+
+	_, err = LockDir(dir)
+	require.True(t, errors.Is(err, ErrLocked))
+
+	require.NoError(t, lock.Unlock())
+	lock, err = LockDir(dir)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
@@ -3,6 +3,7 @@
 package log
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -12,6 +13,8 @@ import (
 	"strings"
 	"sync"
 
+	"go.opencensus.io/trace"
+
 	api "github.com/pouriaamini/proglog/api/v1"
 )
 
@@ -25,6 +28,7 @@ type Log struct {
 	mu            sync.RWMutex
 	Dir           string
 	Config        Config
+	lock          *DirLock
 	activeSegment *segment
 	segments      []*segment
 }
@@ -35,7 +39,10 @@ type Log struct {
 // default values of 1024 will be used.
 // It also initializes the log by reading existing segment files from the
 // directory and setting up new segments as needed.
-// The function returns an error if there was a problem setting up the log.
+// The log holds the directory's lock until it's closed, so two processes
+// can't map the same index files.
+// The function returns an error if there was a problem setting up the log,
+// wrapping ErrLocked if another process uses the directory.
 func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
@@ -43,11 +50,20 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		lock:   lock,
 	}
-	return l, l.setup()
+	if err = l.setup(); err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+	return l, nil
 }
 
 // setup initializes the log by loading all existing segments from the log directory
@@ -55,36 +71,50 @@ func NewLog(dir string, c Config) (*Log, error) {
 // and sorts them before loading segments. It also sets up the active segment and the
 // segments slice.
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	baseOffsets, err := segmentBaseOffsets(l.Dir)
 	if err != nil {
 		return err
 	}
+	for _, baseOffset := range baseOffsets {
+		if err = l.newSegment(baseOffset); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil {
+		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentBaseOffsets returns the sorted base offsets of the segments in the
+// directory, read from the names of their store files. Other files, like the
+// directory's lock file, are skipped.
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		if path.Ext(file.Name()) != storeExt {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
-	}
-	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
-			return err
-		}
-	}
-	return nil
+	return baseOffsets, nil
 }
 
 // Append appends a new record to the active segment of the log. If the active
@@ -93,6 +123,17 @@ func (l *Log) setup() error {
 //
 // Append returns the offset of the appended record and an error if any.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext is Append tracing the append as a child of the context's
+// span, if it has one.
+func (l *Log) AppendContext(
+	ctx context.Context,
+	record *api.Record,
+) (uint64, error) {
+	ctx, span := startSpan(ctx, "log.append")
+	defer span.End()
 	highestOffset, err := l.HighestOffset()
 	if err != nil {
 		return 0, err
@@ -105,10 +146,11 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+	off, err := l.activeSegment.Append(ctx, record)
 	if err != nil {
 		return 0, err
 	}
+	span.AddAttributes(trace.Int64Attribute("offset", int64(off)))
 	return off, err
 }
 
@@ -116,6 +158,15 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 // searches for the segment that contains the record with the given offset and
 // returns an error if the offset is out of range or the segment is not found.
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// ReadContext is Read tracing the read as a child of the context's span, if
+// it has one.
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	ctx, span := startSpan(ctx, "log.read")
+	defer span.End()
+	span.AddAttributes(trace.Int64Attribute("offset", int64(off)))
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	var s *segment
@@ -126,12 +177,17 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		}
 	}
 	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+		return nil, api.ErrOffsetOutOfRange{
+			Offset: off,
+			Lowest: l.segments[0].baseOffset,
+			Next:   l.segments[len(l.segments)-1].nextOffset,
+		}
 	}
-	return s.Read(off)
+	return s.Read(ctx, off)
 }
 
-// Close closes all segments in the log and releases all associated resources.
+// Close closes all segments in the log, releases all associated resources
+// and the directory's lock.
 // It returns an error if any of the segments fail to close.
 func (l *Log) Close() error {
 	l.mu.Lock()
@@ -141,7 +197,7 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	return l.lock.Unlock()
 }
 
 // Remove closes and removes all segments in the log and deletes the log directory
@@ -154,14 +210,20 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
-// Reset removes the log directory and its contents and sets up a new log with
-// the initial segment offset specified in the log configuration. It returns an
-// error if any error occurs while removing the directory or setting up the new
-// log.
+// Reset removes all segments in the log and sets up a new log with the
+// initial segment offset specified in the log configuration, keeping the
+// directory's lock. It returns an error if any error occurs while removing the
+// segments or setting up the new log.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
-		return err
+	l.mu.Lock()
+	for _, segment := range l.segments {
+		if err := segment.Remove(); err != nil {
+			l.mu.Unlock()
+			return err
+		}
 	}
+	l.segments = nil
+	l.mu.Unlock()
 	return l.setup()
 }
 
@@ -186,14 +248,15 @@ func (l *Log) HighestOffset() (uint64, error) {
 }
 
 // Truncate removes all segments in the log whose next offset is less than or
-// equal to the specified lowest offset. It returns an error if any of the segments
-// fail to remove.
+// equal to the specified lowest offset. The active segment is never removed so
+// the log can keep accepting appends. It returns an error if any of the
+// segments fail to remove.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -205,6 +268,24 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// Segments returns the base and next offsets and the store and index sizes of
+// each segment in the log, ordered by offset. It is safe to call this method
+// concurrently with other log methods.
+func (l *Log) Segments() []*api.Segment {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	segments := make([]*api.Segment, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = &api.Segment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.Size(),
+			IndexBytes: s.index.size,
+		}
+	}
+	return segments
+}
+
 // Reader returns a reader that reads all records in the log. It is safe to call
 // this method concurrently with other log methods.
 func (l *Log) Reader() io.Reader {
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"errors"
+
 	api "github.com/pouriaamini/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -18,6 +20,9 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"segments":                          testSegments,
+		"lock directory":                    testLock,
+		"reset":                             testReset,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -49,6 +54,7 @@ func testOutOfRangeErr(t *testing.T, log *Log) {
 	require.Nil(t, read)
 	apiErr := err.(api.ErrOffsetOutOfRange)
 	require.Equal(t, uint64(1), apiErr.Offset)
+	require.False(t, apiErr.Truncated())
 }
 
 func testInitExisting(t *testing.T, o *Log) {
@@ -103,5 +109,64 @@ func testTruncate(t *testing.T, log *Log) {
 	err := log.Truncate(1)
 	require.NoError(t, err)
 	_, err = log.Read(0)
-	require.Error(t, err)
+	apiErr := err.(api.ErrOffsetOutOfRange)
+	require.True(t, apiErr.Truncated())
+	require.Equal(t, uint64(2), apiErr.Lowest)
+	require.Equal(t, uint64(3), apiErr.Next)
+}
+
+func testSegments(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	segments := log.Segments()
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(2), segments[0].NextOffset)
+	require.Equal(t, 2*entWidth, segments[0].IndexBytes)
+	require.Equal(t, uint64(2), segments[1].BaseOffset)
+	require.Equal(t, uint64(3), segments[1].NextOffset)
+	require.Equal(t, entWidth, segments[1].IndexBytes)
+	require.Greater(t, segments[0].StoreBytes, segments[1].StoreBytes)
+
+	// the active segment is kept even when every record is truncated
+	err := log.Truncate(10)
+	require.NoError(t, err)
+	segments = log.Segments()
+	require.Equal(t, 1, len(segments))
+	require.Equal(t, uint64(2), segments[0].BaseOffset)
+}
+
+func testLock(t *testing.T, log *Log) {
+	_, err := NewLog(log.Dir, log.Config)
+	require.True(t, errors.Is(err, ErrLocked))
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.NoError(t, n.Close())
+}
+
+func testReset(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	log.Config.Segment.InitialOffset = 10
+	require.NoError(t, log.Reset())
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	// the log keeps the directory's lock across resets
+	_, err = NewLog(log.Dir, log.Config)
+	require.True(t, errors.Is(err, ErrLocked))
 }
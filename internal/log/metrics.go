@@ -0,0 +1,184 @@
+package log
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+// Measures recorded by the distributed log.
+var (
+	appendLatency = stats.Float64(
+		"log/append_latency",
+		"Latency of appending a record through Raft",
+		stats.UnitMilliseconds,
+	)
+	readLatency = stats.Float64(
+		"log/read_latency",
+		"Latency of reading a record",
+		stats.UnitMilliseconds,
+	)
+	applyLatency = stats.Float64(
+		"raft/fsm_apply_latency",
+		"Latency of applying a committed command to the log",
+		stats.UnitMilliseconds,
+	)
+	snapshotLatency = stats.Float64(
+		"raft/snapshot_persist_latency",
+		"Latency of persisting a snapshot of the log",
+		stats.UnitMilliseconds,
+	)
+	restoreLatency = stats.Float64(
+		"raft/snapshot_restore_latency",
+		"Latency of restoring the log from a snapshot",
+		stats.UnitMilliseconds,
+	)
+)
+
+// latencyDistribution buckets latencies in milliseconds.
+var latencyDistribution = view.Distribution(
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000,
+	10000,
+)
+
+// Views are the views of the distributed log's measures, registered by
+// NewDistributedLog.
+var Views = []*view.View{
+	latencyView(appendLatency),
+	latencyView(readLatency),
+	latencyView(applyLatency),
+	latencyView(snapshotLatency),
+	latencyView(restoreLatency),
+}
+
+func latencyView(m *stats.Float64Measure) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		Measure:     m,
+		Aggregation: latencyDistribution,
+	}
+}
+
+// recordLatency records the time since start in the measure.
+func recordLatency(m *stats.Float64Measure, start time.Time) {
+	ms := float64(time.Since(start)) / float64(time.Millisecond)
+	stats.Record(context.Background(), m.M(ms))
+}
+
+// setupMetrics registers gauges reading the state of the logs and Raft when
+// they're exported, labeled with the server's ID. Close removes them.
+func (l *DistributedLog) setupMetrics() error {
+	if err := view.Register(Views...); err != nil {
+		return err
+	}
+	r := metric.NewRegistry()
+	node := metric.WithConstLabel(map[metricdata.LabelKey]metricdata.LabelValue{
+		{Key: "node"}: metricdata.NewLabelValue(string(l.config.Raft.LocalID)),
+	})
+	logKey := metric.WithLabelKeys("log")
+
+	logGauges := []struct {
+		name, description string
+		unit              metricdata.Unit
+		fn                func(*Log) int64
+	}{
+		{"log/segments", "Number of segments", metricdata.UnitDimensionless,
+			func(log *Log) int64 {
+				return int64(len(log.Segments()))
+			}},
+		{"log/store_bytes", "Size of the segments' stores", metricdata.UnitBytes,
+			func(log *Log) int64 {
+				var n uint64
+				for _, s := range log.Segments() {
+					n += s.StoreBytes
+				}
+				return int64(n)
+			}},
+		{"log/index_bytes", "Size of the segments' indexes", metricdata.UnitBytes,
+			func(log *Log) int64 {
+				var n uint64
+				for _, s := range log.Segments() {
+					n += s.IndexBytes
+				}
+				return int64(n)
+			}},
+	}
+	for _, g := range logGauges {
+		gauge, err := r.AddInt64DerivedGauge(
+			g.name,
+			metric.WithDescription(g.description),
+			metric.WithUnit(g.unit),
+			node,
+			logKey,
+		)
+		if err != nil {
+			return err
+		}
+		fn := g.fn
+		for name, log := range map[string]*Log{
+			"log":  l.log,
+			"raft": l.raftLog.Log,
+		} {
+			log := log
+			err = gauge.UpsertEntry(
+				func() int64 { return fn(log) },
+				metricdata.NewLabelValue(name),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	raftGauges := []struct {
+		name, description string
+		fn                func() int64
+	}{
+		{"raft/state",
+			"State of the server: 0 follower, 1 candidate, 2 leader, 3 shutdown",
+			func() int64 { return int64(l.raft.State()) }},
+		{"raft/term", "Current term", l.raftStat("term")},
+		{"raft/commit_index", "Index of the latest committed entry",
+			l.raftStat("commit_index")},
+		{"raft/applied_index", "Index of the latest entry applied to the log",
+			l.raftStat("applied_index")},
+		{"raft/last_log_index", "Index of the latest entry in the Raft log",
+			l.raftStat("last_log_index")},
+		{"raft/last_snapshot_index", "Index of the latest snapshot",
+			l.raftStat("last_snapshot_index")},
+		{"raft/fsm_pending", "Number of committed entries waiting to be applied",
+			l.raftStat("fsm_pending")},
+	}
+	for _, g := range raftGauges {
+		gauge, err := r.AddInt64DerivedGauge(
+			g.name,
+			metric.WithDescription(g.description),
+			node,
+		)
+		if err != nil {
+			return err
+		}
+		if err = gauge.UpsertEntry(g.fn); err != nil {
+			return err
+		}
+	}
+
+	metricproducer.GlobalManager().AddProducer(r)
+	l.metrics = r
+	return nil
+}
+
+// raftStat returns a function reading the numeric Raft stat.
+func (l *DistributedLog) raftStat(key string) func() int64 {
+	return func() int64 {
+		n, _ := strconv.ParseInt(l.raft.Stats()[key], 10, 64)
+		return n
+	}
+}
@@ -0,0 +1,84 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// groupOffsets are the offsets the Kafka consumer groups committed, as of
+// the commands the fsm applied.
+type groupOffsets struct {
+	mu      sync.RWMutex
+	offsets map[string]*api.GroupOffset
+}
+
+func newGroupOffsets() *groupOffsets {
+	return &groupOffsets{offsets: make(map[string]*api.GroupOffset)}
+}
+
+func (g *groupOffsets) commit(offset *api.GroupOffset) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offsets[offset.Group] = proto.Clone(offset).(*api.GroupOffset)
+}
+
+func (g *groupOffsets) get(group string) (*api.GroupOffset, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	offset, ok := g.offsets[group]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(offset).(*api.GroupOffset), true
+}
+
+// list returns the offsets sorted by their groups, so snapshots of the same
+// offsets are the same.
+func (g *groupOffsets) list() []*api.GroupOffset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	offsets := make([]*api.GroupOffset, 0, len(g.offsets))
+	for _, offset := range g.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i].Group < offsets[j].Group
+	})
+	return offsets
+}
+
+// restore replaces the offsets with the snapshot's.
+func (g *groupOffsets) restore(offsets []*api.GroupOffset) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offsets = make(map[string]*api.GroupOffset, len(offsets))
+	for _, offset := range offsets {
+		g.offsets[offset.Group] = offset
+	}
+}
+
+// CommitOffset commits the offset of the Kafka consumer group through Raft,
+// so every server knows it if it comes to lead.
+func (l *DistributedLog) CommitOffset(
+	ctx context.Context,
+	offset *api.GroupOffset,
+) error {
+	_, err := l.apply(ctx, OffsetCommitRequestType, offset)
+	return err
+}
+
+// GroupOffset returns the offset the Kafka consumer group last committed, as
+// far as the server has applied the commits, if it committed one.
+func (l *DistributedLog) GroupOffset(group string) (*api.GroupOffset, bool) {
+	return l.fsm.offsets.get(group)
+}
+
+func (f *fsm) applyOffsetCommit(offset *api.GroupOffset) interface{} {
+	f.offsets.commit(offset)
+	return offset
+}
@@ -0,0 +1,115 @@
+package log
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// contact is what the leader last heard from a server replicating its log.
+type contact struct {
+	time      time.Time
+	term      uint64
+	lastIndex uint64
+}
+
+// contactTransport is a Raft transport recording the leader's last contact
+// with each server from their responses to its AppendEntries requests, which
+// include the heartbeats it keeps sending them.
+type contactTransport struct {
+	raft.Transport
+
+	mu       sync.Mutex
+	contacts map[raft.ServerID]contact
+}
+
+func newContactTransport(transport raft.Transport) *contactTransport {
+	return &contactTransport{
+		Transport: transport,
+		contacts:  make(map[raft.ServerID]contact),
+	}
+}
+
+func (t *contactTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.contacts[id] = contact{
+		time:      time.Now(),
+		term:      resp.Term,
+		lastIndex: resp.LastLog,
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+// Close closes the transport it wraps, which Raft only does through the
+// transports that can be closed.
+func (t *contactTransport) Close() error {
+	if closer, ok := t.Transport.(raft.WithClose); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (t *contactTransport) contact(id raft.ServerID) (contact, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.contacts[id]
+	return c, ok
+}
+
+// ServerHealth returns how each server of the cluster replicates the log, as
+// last heard by the leader: how long ago, in which term and how far behind
+// the leader's Raft log. It returns raft.ErrNotLeader on the followers, which
+// don't hear from the others. The servers the leader has yet to hear from
+// have a last contact of -1.
+func (l *DistributedLog) ServerHealth() ([]*api.ServerHealth, error) {
+	if l.raft.State() != raft.Leader {
+		return nil, raft.ErrNotLeader
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	term, err := strconv.ParseUint(l.raft.Stats()["term"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	lastIndex := l.raft.LastIndex()
+	var servers []*api.ServerHealth
+	for _, server := range future.Configuration().Servers {
+		health := &api.ServerHealth{
+			Id:      string(server.ID),
+			RpcAddr: string(server.Address),
+			Voter:   server.Suffrage == raft.Voter,
+		}
+		if server.ID == l.config.Raft.LocalID {
+			health.IsLeader = true
+			health.Term = term
+			health.LastIndex = lastIndex
+		} else if c, ok := l.transport.contact(server.ID); ok {
+			health.LastContactMs = now.Sub(c.time).Milliseconds()
+			health.Term = c.term
+			health.LastIndex = c.lastIndex
+		} else {
+			health.LastContactMs = -1
+		}
+		if lastIndex > health.LastIndex {
+			health.IndexLag = lastIndex - health.LastIndex
+		}
+		servers = append(servers, health)
+	}
+	return servers, nil
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -10,6 +11,13 @@ import (
 	api "github.com/pouriaamini/proglog/api/v1"
 )
 
+const (
+	// storeExt is the extension of a segment's store file.
+	storeExt = ".store"
+	// indexExt is the extension of a segment's index file.
+	indexExt = ".index"
+)
+
 // A Segment represents a single storage unit in the log.
 // It contains a set of message records, a corresponding index, and metadata
 // such as the base offset and file sizes.
@@ -35,7 +43,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	}
 	var err error
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
@@ -46,7 +54,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
@@ -69,14 +77,17 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 // segment file. If the active segment is too large or too old,
 // it closes the segment and creates a new one.
 // It returns the offset and position of the record in the log.
-func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+func (s *segment) Append(
+	ctx context.Context,
+	record *api.Record,
+) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
+	_, pos, err := s.store.Append(ctx, p)
 	if err != nil {
 		return 0, err
 	}
@@ -95,12 +106,12 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 // it reads the last entry. The returned `out` is the offset of the log entry in
 // the store, and `pos` is the position of the log entry in the segment. If the
 // requested entry is not found, an `io.EOF` error is returned.
-func (s *segment) Read(off uint64) (*api.Record, error) {
+func (s *segment) Read(ctx context.Context, off uint64) (*api.Record, error) {
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	p, err := s.store.Read(ctx, pos)
 	if err != nil {
 		return nil, err
 	}
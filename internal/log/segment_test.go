@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	api "github.com/pouriaamini/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -21,14 +22,14 @@ func TestSegment(t *testing.T) {
 	require.Equal(t, uint64(16), s.nextOffset, s.nextOffset)
 	require.False(t, s.IsMaxed())
 	for i := uint64(0); i < 3; i++ {
-		off, err := s.Append(want)
+		off, err := s.Append(context.Background(), want)
 		require.NoError(t, err)
 		require.Equal(t, 16+i, off)
-		got, err := s.Read(off)
+		got, err := s.Read(context.Background(), off)
 		require.NoError(t, err)
 		require.Equal(t, want.Value, got.Value)
 	}
-	_, err = s.Append(want)
+	_, err = s.Append(context.Background(), want)
 	require.Equal(t, io.EOF, err)
 	// maxed index
 	require.True(t, s.IsMaxed())
@@ -2,9 +2,12 @@ package log
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"os"
 	"sync"
+
+	"go.opencensus.io/trace"
 )
 
 var (
@@ -56,7 +59,14 @@ func newStore(f *os.File) (*store, error) {
 // It takes a byte slice p as an argument and returns the  number of bytes
 // written to the file, the position of the appended data within the file,
 // and any errors encountered during the write operation.
-func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+func (s *store) Append(ctx context.Context, p []byte) (
+	n uint64,
+	pos uint64,
+	err error,
+) {
+	_, span := startSpan(ctx, "store.append")
+	defer span.End()
+	span.AddAttributes(trace.Int64Attribute("bytes", int64(len(p))))
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
@@ -77,7 +87,9 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 //
 // It takes the position within the file as an argument and returns the byte
 // slice and any errors encountered during the read operation.
-func (s *store) Read(pos uint64) ([]byte, error) {
+func (s *store) Read(ctx context.Context, pos uint64) ([]byte, error) {
+	_, span := startSpan(ctx, "store.read")
+	defer span.End()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
@@ -109,6 +121,14 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Size is a method of the store type that returns the number of bytes
+// appended to the log file, including the ones still buffered.
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
 // Close is a method of the store type that closes the log file and releases
 // any associated resources.
 //
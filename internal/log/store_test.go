@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -31,7 +32,7 @@ func TestStoreAppendRead(t *testing.T) {
 func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
-		n, pos, err := s.Append(write)
+		n, pos, err := s.Append(context.Background(), write)
 		require.NoError(t, err)
 		require.Equal(t, pos+n, width*i)
 	}
@@ -41,7 +42,7 @@ func testRead(t *testing.T, s *store) {
 	t.Helper()
 	var pos uint64
 	for i := uint64(1); i < 4; i++ {
-		read, err := s.Read(pos)
+		read, err := s.Read(context.Background(), pos)
 		require.NoError(t, err)
 		require.Equal(t, write, read)
 		pos += width
@@ -73,7 +74,7 @@ func TestStoreClose(t *testing.T) {
 	defer os.Remove(f.Name())
 	s, err := newStore(f)
 	require.NoError(t, err)
-	_, _, err = s.Append(write)
+	_, _, err = s.Append(context.Background(), write)
 	require.NoError(t, err)
 	f, beforeSize, err := openFile(f.Name())
 	require.NoError(t, err)
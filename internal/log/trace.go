@@ -0,0 +1,18 @@
+package log
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+)
+
+// startSpan starts a span for the operation as a child of the context's
+// span. It returns a nil span, whose methods do nothing, if the context has
+// none, so appends to the Raft log and reads outside of a request don't start
+// traces of their own.
+func startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	if trace.FromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return trace.StartSpan(ctx, name)
+}
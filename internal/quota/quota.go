@@ -0,0 +1,375 @@
+// Package quota limits the rates subjects produce and consume at.
+package quota
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// DefaultSubject is the subject whose limits apply to the subjects without
+// their own.
+const DefaultSubject = "*"
+
+// Limits are the rates a subject may produce and consume at, per second. A
+// zero limit doesn't limit its rate.
+type Limits struct {
+	ProduceBytes   float64
+	ProduceRecords float64
+	ConsumeBytes   float64
+}
+
+// Quotas limit the rates subjects produce and consume at with token buckets,
+// loaded from a CSV file with a subject and its produce bytes, produce
+// records and consume bytes per second on each line. Empty or zero limits
+// don't limit their rates, and the limits of the * subject apply to the
+// subjects without their own. Lines starting with # are comments.
+//
+// Each bucket holds a second of its rate. A request waits until its buckets
+// hold what it takes, or are full if it takes more than they hold, so
+// records larger than a second of the rate still get through, leaving the
+// buckets in debt until they refill. Buckets that have refilled are the same
+// as new ones, so they're dropped, keeping only those of active subjects.
+type Quotas struct {
+	path   string
+	logger *zap.Logger
+	now    func() time.Time
+
+	mu        sync.Mutex
+	limits    map[string]Limits
+	buckets   map[string]*buckets
+	lastSweep time.Time
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// buckets are the token buckets of a subject.
+type buckets struct {
+	produceBytes   bucket
+	produceRecords bucket
+	consumeBytes   bucket
+}
+
+// New returns the quotas of the file.
+func New(path string) (*Quotas, error) {
+	q := &Quotas{
+		path:    path,
+		logger:  zap.L().Named("quota"),
+		now:     time.Now,
+		buckets: make(map[string]*buckets),
+		done:    make(chan struct{}),
+	}
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Reload loads the limits from the file, keeping the current ones if it
+// fails. The subjects keep the tokens they have, up to their new limits.
+func (q *Quotas) Reload() error {
+	f, err := os.Open(q.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 4
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to load quotas: %w", err)
+	}
+	limits := make(map[string]Limits, len(records))
+	for _, record := range records {
+		subject := record[0]
+		if subject == "" {
+			return fmt.Errorf("failed to load quotas: empty subject")
+		}
+		var rates [3]float64
+		for i, field := range record[1:] {
+			if rates[i], err = parseRate(field); err != nil {
+				return fmt.Errorf(
+					"failed to load quotas of %q: %w",
+					subject,
+					err,
+				)
+			}
+		}
+		limits[subject] = Limits{
+			ProduceBytes:   rates[0],
+			ProduceRecords: rates[1],
+			ConsumeBytes:   rates[2],
+		}
+	}
+	q.mu.Lock()
+	q.limits = limits
+	q.mu.Unlock()
+	return nil
+}
+
+// parseRate parses a limit of the file, zero if it's empty.
+func parseRate(field string) (float64, error) {
+	field = strings.TrimSpace(field)
+	if field == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf("invalid rate %q", field)
+	}
+	return rate, nil
+}
+
+// limitsOf returns the limits of the subject.
+func (q *Quotas) limitsOf(subject string) Limits {
+	if limits, ok := q.limits[subject]; ok {
+		return limits
+	}
+	return q.limits[DefaultSubject]
+}
+
+// Produce takes the records and their bytes from the subject's produce
+// buckets, returning zero if it may produce them. Otherwise it takes nothing
+// and returns how long the subject must wait until it may.
+func (q *Quotas) Produce(subject string, records, bytes int64) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limits := q.limitsOf(subject)
+	if limits.ProduceBytes == 0 && limits.ProduceRecords == 0 {
+		return 0
+	}
+	b := q.bucketsOf(subject)
+	now := q.now()
+	wait := maxDuration(
+		b.produceBytes.wait(limits.ProduceBytes, bytes, now),
+		b.produceRecords.wait(limits.ProduceRecords, records, now),
+	)
+	if wait > 0 {
+		return wait
+	}
+	b.produceBytes.take(limits.ProduceBytes, bytes)
+	b.produceRecords.take(limits.ProduceRecords, records)
+	return 0
+}
+
+// Consume takes the bytes from the subject's consume bucket, returning zero
+// if it may consume them. Otherwise it takes nothing and returns how long the
+// subject must wait until it may.
+func (q *Quotas) Consume(subject string, bytes int64) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limits := q.limitsOf(subject)
+	if limits.ConsumeBytes == 0 {
+		return 0
+	}
+	b := q.bucketsOf(subject)
+	wait := b.consumeBytes.wait(limits.ConsumeBytes, bytes, q.now())
+	if wait > 0 {
+		return wait
+	}
+	b.consumeBytes.take(limits.ConsumeBytes, bytes)
+	return 0
+}
+
+// Consumed takes the bytes the subject has already consumed from its consume
+// bucket, even if it goes into debt, for reads whose size is only known once
+// they're done. Consume with zero bytes tells whether the subject may read
+// before then.
+func (q *Quotas) Consumed(subject string, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limits := q.limitsOf(subject)
+	if limits.ConsumeBytes == 0 {
+		return
+	}
+	b := q.bucketsOf(subject)
+	b.consumeBytes.wait(limits.ConsumeBytes, bytes, q.now())
+	b.consumeBytes.take(limits.ConsumeBytes, bytes)
+}
+
+// Wait calls take, which takes from quotas, until it returns zero, waiting
+// for as long as it returns in between. It returns how long it waited, or the
+// context's error if it's done first. Streams wait rather than fail, as their
+// clients can't retry a single message.
+func Wait(
+	ctx context.Context,
+	take func() time.Duration,
+) (time.Duration, error) {
+	var waited time.Duration
+	for {
+		wait := take()
+		if wait == 0 {
+			return waited, nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, ctx.Err()
+		case <-timer.C:
+		}
+		waited += wait
+	}
+}
+
+func (q *Quotas) bucketsOf(subject string) *buckets {
+	q.sweep()
+	b, ok := q.buckets[subject]
+	if !ok {
+		b = &buckets{}
+		q.buckets[subject] = b
+	}
+	return b
+}
+
+// sweepInterval is how often the buckets that have refilled are dropped.
+const sweepInterval = time.Minute
+
+// sweep drops the buckets that have refilled since they were last taken
+// from, at most once every sweepInterval.
+func (q *Quotas) sweep() {
+	now := q.now()
+	if now.Sub(q.lastSweep) < sweepInterval {
+		return
+	}
+	q.lastSweep = now
+	for subject, b := range q.buckets {
+		limits := q.limitsOf(subject)
+		if b.produceBytes.full(limits.ProduceBytes, now) &&
+			b.produceRecords.full(limits.ProduceRecords, now) &&
+			b.consumeBytes.full(limits.ConsumeBytes, now) {
+			delete(q.buckets, subject)
+		}
+	}
+}
+
+// Watch reloads the limits whenever their file changes until the quotas are
+// closed. It watches the file's directory, as editors and Kubernetes config
+// maps replace the file rather than writing to it.
+func (q *Quotas) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(q.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	q.watcher = watcher
+	go q.watch()
+	return nil
+}
+
+func (q *Quotas) watch() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case err, ok := <-q.watcher.Errors:
+			if !ok {
+				return
+			}
+			q.logger.Error("failed to watch quotas", zap.Error(err))
+		case event, ok := <-q.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := q.Reload(); err != nil {
+				// the file may be missing between its replacement's
+				// events, and the last event reloads it
+				q.logger.Warn(
+					"failed to reload quotas",
+					zap.String("file", q.path),
+					zap.Error(err),
+				)
+				continue
+			}
+			q.logger.Debug("reloaded quotas", zap.String("file", q.path))
+		}
+	}
+}
+
+// Close stops watching the limits' file.
+func (q *Quotas) Close() error {
+	if q.watcher == nil {
+		return nil
+	}
+	select {
+	case <-q.done:
+		return nil
+	default:
+	}
+	close(q.done)
+	return q.watcher.Close()
+}
+
+// bucket is a token bucket refilling at its rate up to a second of it. Its
+// tokens go negative when a request takes more than it can hold.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills the bucket at the rate, returning how long until it holds the
+// n tokens, or is full if it can't hold them. It returns zero if it already
+// does or the rate is unlimited.
+func (b *bucket) wait(rate float64, n int64, now time.Time) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		// new buckets start full
+		b.tokens = rate
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(rate, b.tokens+rate*elapsed.Seconds())
+	}
+	b.last = now
+	need := math.Min(float64(n), rate)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration(math.Ceil((need - b.tokens) / rate * float64(time.Second)))
+}
+
+// full returns whether the bucket would be full at the rate by now, as a new
+// one is.
+func (b *bucket) full(rate float64, now time.Time) bool {
+	if rate == 0 || b.last.IsZero() {
+		return true
+	}
+	return b.tokens+rate*now.Sub(b.last).Seconds() >= rate
+}
+
+// take takes the tokens from the bucket, unless its rate is unlimited.
+func (b *bucket) take(rate float64, n int64) {
+	if rate == 0 {
+		return
+	}
+	b.tokens -= float64(n)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	path := writeQuotas(t, `# subject, produce bytes, produce records, consume bytes
+producer, 100, 2,
+*, , , 10
+`)
+	quotas, err := New(path)
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	quotas.now = func() time.Time { return now }
+
+	// buckets start full and wait for what's taken to refill
+	require.Zero(t, quotas.Produce("producer", 1, 60))
+	requireWait(t, 200*time.Millisecond, quotas.Produce("producer", 1, 60))
+	now = now.Add(200 * time.Millisecond)
+	require.Zero(t, quotas.Produce("producer", 1, 60))
+	// the request waits for the bucket that's shortest of what it takes:
+	// 0.4 of a record refilled at 2 a second
+	requireWait(t, 300*time.Millisecond, quotas.Produce("producer", 1, 1))
+
+	// a request larger than the bucket waits for it to be full, then leaves
+	// it in debt
+	now = now.Add(time.Second)
+	require.Zero(t, quotas.Produce("producer", 1, 250))
+	requireWait(t, 1510*time.Millisecond, quotas.Produce("producer", 1, 1))
+
+	// subjects without limits of their own get the default ones
+	require.Zero(t, quotas.Produce("other", 1000, 1<<20))
+	require.Zero(t, quotas.Consume("other", 20))
+	requireWait(t, 1100*time.Millisecond, quotas.Consume("other", 1))
+	require.Zero(t, quotas.Consume("producer", 1<<20))
+
+	// reloading changes the limits, keeping the tokens
+	require.NoError(t, os.WriteFile(path, []byte("producer, , 1, \n"), 0644))
+	require.NoError(t, quotas.Reload())
+	require.Zero(t, quotas.Produce("producer", 1, 1<<20))
+	requireWait(t, time.Second, quotas.Produce("producer", 1, 1))
+
+	// a malformed file leaves the current limits in place
+	require.NoError(t, os.WriteFile(path, []byte("producer, -1, , \n"), 0644))
+	require.Error(t, quotas.Reload())
+	require.NoError(t, os.WriteFile(path, []byte("producer, 1\n"), 0644))
+	require.Error(t, quotas.Reload())
+	requireWait(t, time.Second, quotas.Produce("producer", 1, 1))
+}
+
+func TestQuotasConsumed(t *testing.T) {
+	quotas, err := New(writeQuotas(t, "*, , , 10\n"))
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	quotas.now = func() time.Time { return now }
+
+	// reads are taken once done, going into debt, and the next waits for
+	// the bucket to refill from it
+	require.Zero(t, quotas.Consume("consumer", 0))
+	quotas.Consumed("consumer", 25)
+	requireWait(t, 1500*time.Millisecond, quotas.Consume("consumer", 0))
+	now = now.Add(1500 * time.Millisecond)
+	require.Zero(t, quotas.Consume("consumer", 0))
+}
+
+func TestQuotasSweep(t *testing.T) {
+	quotas, err := New(writeQuotas(t, "*, , 1, 10\n"))
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	quotas.now = func() time.Time { return now }
+
+	require.Zero(t, quotas.Produce("idle", 1, 1))
+	quotas.Consumed("indebted", 1000)
+	require.Len(t, quotas.buckets, 2)
+
+	// buckets that have refilled are dropped, and those still refilling
+	// kept with their debt
+	now = now.Add(sweepInterval)
+	require.Zero(t, quotas.Produce("active", 1, 1))
+	require.Len(t, quotas.buckets, 2)
+	require.Contains(t, quotas.buckets, "indebted")
+	require.NotZero(t, quotas.Consume("indebted", 0))
+}
+
+func TestWait(t *testing.T) {
+	var calls int
+	waited, err := Wait(context.Background(), func() time.Duration {
+		calls++
+		if calls < 3 {
+			return time.Millisecond
+		}
+		return 0
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Millisecond, waited)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Wait(ctx, func() time.Duration { return time.Hour })
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestNewWithoutFile(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "quotas.csv"))
+	require.Error(t, err)
+}
+
+// requireWait asserts the wait is the one wanted, give or take the rounding
+// of the rates' arithmetic.
+func requireWait(t *testing.T, want, wait time.Duration) {
+	t.Helper()
+	require.InDelta(t, want, wait, float64(time.Microsecond))
+}
+
+// writeQuotas writes the quotas to a file in a temporary directory and
+// returns its path.
+func writeQuotas(t *testing.T, quotas string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotas.csv")
+	require.NoError(t, os.WriteFile(path, []byte(quotas), 0644))
+	return path
+}
@@ -0,0 +1,279 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// checkCompatibility checks the next version of a subject's schema is
+// compatible with its latest one: backward compatible schemas read the
+// values written with the latest one, and forward compatible ones write
+// values the latest one reads.
+func checkCompatibility(
+	compatibility api.Compatibility,
+	latest, next *compiled,
+) error {
+	if compatibility == api.Compatibility_NONE {
+		return nil
+	}
+	if latest.Type != next.Type {
+		return fmt.Errorf("type changed from %s to %s", latest.Type, next.Type)
+	}
+	if compatibility == api.Compatibility_BACKWARD ||
+		compatibility == api.Compatibility_FULL {
+		if err := reads(next, latest); err != nil {
+			return fmt.Errorf("reading values of version %d: %w", latest.Version, err)
+		}
+	}
+	if compatibility == api.Compatibility_FORWARD ||
+		compatibility == api.Compatibility_FULL {
+		if err := reads(latest, next); err != nil {
+			return fmt.Errorf("version %d reading values: %w", latest.Version, err)
+		}
+	}
+	return nil
+}
+
+// reads checks the reader schema reads the values written with the writer
+// schema.
+func reads(reader, writer *compiled) error {
+	if reader.message != nil {
+		return readsMessage(
+			reader.message,
+			writer.message,
+			map[[2]protoreflect.FullName]bool{},
+		)
+	}
+	return readsJSON(reader.document, writer.document, "$")
+}
+
+// readsMessage checks the reader message decodes the writer's: the fields
+// they share have the same wire type and cardinality, and the writer sets the
+// fields the reader requires. Fields only the writer has are left unknown.
+func readsMessage(
+	reader, writer protoreflect.MessageDescriptor,
+	seen map[[2]protoreflect.FullName]bool,
+) error {
+	key := [2]protoreflect.FullName{reader.FullName(), writer.FullName()}
+	if seen[key] {
+		return nil
+	}
+	seen[key] = true
+	fields := reader.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		rf := fields.Get(i)
+		wf := writer.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Errorf("required field %s missing", rf.FullName())
+			}
+			continue
+		}
+		if rf.Cardinality() == protoreflect.Required &&
+			wf.Cardinality() != protoreflect.Required {
+			return fmt.Errorf("required field %s is optional", rf.FullName())
+		}
+		if rf.IsList() != wf.IsList() || rf.IsMap() != wf.IsMap() {
+			return fmt.Errorf("field %s changed cardinality", rf.FullName())
+		}
+		if rf.IsMap() {
+			if err := readsField(
+				rf.MapKey(),
+				wf.MapKey(),
+				seen,
+			); err != nil {
+				return err
+			}
+			rf, wf = rf.MapValue(), wf.MapValue()
+		}
+		if err := readsField(rf, wf, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readsField checks the reader field decodes the writer's.
+func readsField(
+	reader, writer protoreflect.FieldDescriptor,
+	seen map[[2]protoreflect.FullName]bool,
+) error {
+	if wireKind(reader.Kind()) != wireKind(writer.Kind()) {
+		return fmt.Errorf(
+			"field %s changed type from %s to %s",
+			reader.FullName(),
+			writer.Kind(),
+			reader.Kind(),
+		)
+	}
+	if reader.Message() != nil {
+		return readsMessage(reader.Message(), writer.Message(), seen)
+	}
+	return nil
+}
+
+// wireKind groups the kinds of fields whose values decode as each other's.
+func wireKind(k protoreflect.Kind) protoreflect.Kind {
+	switch k {
+	case protoreflect.Int32Kind,
+		protoreflect.Uint32Kind,
+		protoreflect.Int64Kind,
+		protoreflect.Uint64Kind,
+		protoreflect.BoolKind,
+		protoreflect.EnumKind:
+		return protoreflect.Int64Kind
+	case protoreflect.Sint32Kind:
+		return protoreflect.Sint64Kind
+	case protoreflect.Sfixed32Kind:
+		return protoreflect.Fixed32Kind
+	case protoreflect.Sfixed64Kind:
+		return protoreflect.Fixed64Kind
+	case protoreflect.StringKind:
+		return protoreflect.BytesKind
+	}
+	return k
+}
+
+// readsJSON checks the reader JSON Schema accepts the values the writer's
+// accepts, as far as their types, enums, required properties, properties,
+// additional properties and items tell. Other keywords aren't checked.
+func readsJSON(reader, writer interface{}, path string) error {
+	if accepts(reader) || writer == false {
+		return nil
+	}
+	r, ok := reader.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s no longer accepts any value", path)
+	}
+	w, _ := writer.(map[string]interface{})
+	if rt := jsonTypes(r); rt != nil {
+		wt := jsonTypes(w)
+		if wt == nil {
+			return fmt.Errorf("%s no longer accepts any type", path)
+		}
+		for t := range wt {
+			if !rt[t] && !(t == "integer" && rt["number"]) {
+				return fmt.Errorf("%s no longer accepts %s", path, t)
+			}
+		}
+	}
+	if re, ok := r["enum"].([]interface{}); ok {
+		we, ok := w["enum"].([]interface{})
+		if !ok {
+			return fmt.Errorf("%s became an enum", path)
+		}
+		for _, v := range we {
+			if !contains(re, v) {
+				return fmt.Errorf("%s no longer accepts %v", path, v)
+			}
+		}
+	}
+	required, _ := w["required"].([]interface{})
+	if rr, ok := r["required"].([]interface{}); ok {
+		for _, p := range rr {
+			if !contains(required, p) {
+				return fmt.Errorf("%s requires %v", path, p)
+			}
+		}
+	}
+	rp, _ := r["properties"].(map[string]interface{})
+	wp, _ := w["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(wp) {
+		ws := wp[name]
+		rs, ok := rp[name]
+		if !ok {
+			rs = additional(r)
+		}
+		if err := readsJSON(rs, ws, path+"."+name); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(rp) {
+		rs := rp[name]
+		if _, ok := wp[name]; ok {
+			continue
+		}
+		// the writer may set the property to anything it accepts as an
+		// additional one
+		if err := readsJSON(rs, additional(w), path+"."+name); err != nil {
+			return err
+		}
+	}
+	if ri, ok := r["items"]; ok {
+		wi, ok := w["items"]
+		if !ok {
+			wi = true
+		}
+		if err := readsJSON(ri, wi, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accepts returns whether the JSON Schema accepts every value.
+func accepts(s interface{}) bool {
+	switch s := s.(type) {
+	case bool:
+		return s
+	case map[string]interface{}:
+		return len(s) == 0
+	}
+	return false
+}
+
+// additional returns the JSON Schema of the object schema's additional
+// properties, which accepts every value unless it's set.
+func additional(s map[string]interface{}) interface{} {
+	if a, ok := s["additionalProperties"]; ok {
+		return a
+	}
+	return true
+}
+
+// jsonTypes returns the set of the JSON Schema's types, nil if it doesn't
+// restrict them.
+func jsonTypes(s map[string]interface{}) map[string]bool {
+	var types []interface{}
+	switch t := s["type"].(type) {
+	case string:
+		types = []interface{}{t}
+	case []interface{}:
+		types = t
+	default:
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, t := range types {
+		if t, ok := t.(string); ok {
+			set[t] = true
+		}
+	}
+	return set
+}
+
+// sortedKeys returns the keys of the properties in order, so the errors of
+// the schemas with several incompatible ones are the same each time.
+func sortedKeys(properties map[string]interface{}) []string {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contains returns whether the decoded JSON values contain the value.
+func contains(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if reflect.DeepEqual(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// compiled is a schema parsed to validate values and check the compatibility
+// of its subject's next versions.
+type compiled struct {
+	*api.Schema
+	// document and validator are the decoded JSON Schema and its compiled
+	// validator, for JSON Schema schemas.
+	document  interface{}
+	validator *jsonschema.Schema
+	// message is the descriptor of the message, for protobuf schemas.
+	message protoreflect.MessageDescriptor
+}
+
+// compile parses the schema, returning an ErrInvalidSchema if it's invalid.
+func compile(s *api.Schema) (*compiled, error) {
+	c := &compiled{Schema: s}
+	var err error
+	switch s.Type {
+	case api.SchemaType_JSON_SCHEMA:
+		err = c.compileJSON()
+	case api.SchemaType_PROTOBUF:
+		err = c.compileProtobuf()
+	default:
+		err = fmt.Errorf("unknown type %d", s.Type)
+	}
+	if err != nil {
+		return nil, api.ErrInvalidSchema{Reason: err.Error()}
+	}
+	return c, nil
+}
+
+// schemaURL is the URL the JSON Schema documents are compiled as.
+const schemaURL = "mem:///schema.json"
+
+func (c *compiled) compileJSON() error {
+	if c.Message != "" {
+		return errors.New("JSON Schema schemas have no message")
+	}
+	document, err := decodeJSON(c.Definition)
+	if err != nil {
+		return err
+	}
+	compiler := jsonschema.NewCompiler()
+	// the documents are registered by clients, so they mustn't read the
+	// servers' files or make them fetch others
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("references to %s aren't supported", url)
+	}
+	err = compiler.AddResource(schemaURL, bytes.NewReader(c.Definition))
+	if err != nil {
+		return err
+	}
+	c.validator, err = compiler.Compile(schemaURL)
+	if err != nil {
+		return err
+	}
+	c.document = document
+	return nil
+}
+
+func (c *compiled) compileProtobuf() error {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(c.Definition, &set); err != nil {
+		return fmt.Errorf("decoding file descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return err
+	}
+	if c.Message == "" {
+		return errors.New("missing message name")
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(c.Message))
+	if err != nil {
+		return fmt.Errorf("message %s: %w", c.Message, err)
+	}
+	message, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return fmt.Errorf("%s isn't a message", c.Message)
+	}
+	c.message = message
+	return nil
+}
+
+// validate checks the value is encoded as the schema describes.
+func (c *compiled) validate(value []byte) error {
+	if c.message != nil {
+		return validateProtobuf(c.message, value)
+	}
+	v, err := decodeJSON(value)
+	if err != nil {
+		return err
+	}
+	return c.validator.Validate(v)
+}
+
+// decodeJSON decodes a single JSON value, keeping the precision of its
+// numbers.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+// validateProtobuf checks the value decodes as the message, with its
+// required fields and without fields the message doesn't have.
+func validateProtobuf(desc protoreflect.MessageDescriptor, value []byte) error {
+	m := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(value, m); err != nil {
+		return err
+	}
+	return checkUnknown(m)
+}
+
+// checkUnknown fails if the message or the messages in it have unknown
+// fields, as values of other messages decode to.
+func checkUnknown(m protoreflect.Message) error {
+	if len(m.GetUnknown()) > 0 {
+		return fmt.Errorf("unknown fields in %s", m.Descriptor().FullName())
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				err = checkUnknown(v.Message())
+				return err == nil
+			})
+		case fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len() && err == nil; i++ {
+				err = checkUnknown(v.List().Get(i).Message())
+			}
+		default:
+			err = checkUnknown(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
@@ -0,0 +1,266 @@
+// Package schema keeps the registry of the schemas records' values are
+// encoded with, and validates the values against them.
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// Registry holds the versions of the subjects' schemas and the compatibility
+// each new version of a subject is checked with. Schemas get IDs in the order
+// they're registered, so registries registering the same schemas in the same
+// order, as the servers applying them through Raft do, agree on them.
+type Registry struct {
+	mu            sync.RWMutex
+	schemas       []*compiled
+	subjects      map[string][]*compiled
+	compatibility map[string]api.Compatibility
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		subjects:      make(map[string][]*compiled),
+		compatibility: make(map[string]api.Compatibility),
+	}
+}
+
+// SetCompatibility sets the compatibility the subject's new versions are
+// checked with.
+func (r *Registry) SetCompatibility(
+	subject string,
+	compatibility api.Compatibility,
+) error {
+	if subject == "" {
+		return api.ErrInvalidSchema{Reason: "missing subject"}
+	}
+	if _, ok := api.Compatibility_name[int32(compatibility)]; !ok {
+		return api.ErrInvalidSchema{
+			Reason: fmt.Sprintf("unknown compatibility %d", compatibility),
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compatibility[subject] = compatibility
+	return nil
+}
+
+// Compatibility returns the compatibility the subject's new versions are
+// checked with, and whether it was set. Subjects without one are checked as
+// each registration asks.
+func (r *Registry) Compatibility(subject string) (api.Compatibility, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	compatibility, ok := r.compatibility[subject]
+	return compatibility, ok
+}
+
+// Compatibilities returns the compatibilities set, ordered by their subjects.
+func (r *Registry) Compatibilities() []*api.SetCompatibilityRequest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	compatibilities := make(
+		[]*api.SetCompatibilityRequest,
+		0,
+		len(r.compatibility),
+	)
+	for subject, compatibility := range r.compatibility {
+		compatibilities = append(
+			compatibilities,
+			&api.SetCompatibilityRequest{
+				Subject:       subject,
+				Compatibility: compatibility,
+			},
+		)
+	}
+	sort.Slice(compatibilities, func(i, j int) bool {
+		return compatibilities[i].Subject < compatibilities[j].Subject
+	})
+	return compatibilities
+}
+
+// Register registers the schema as the next version of its subject, after
+// checking it's compatible with the subject's latest version. It's checked
+// with the subject's compatibility if it's set, which the request may only
+// repeat, or else as the request asks, as the registrations before subjects
+// had their own did. If the subject already has a version with the same
+// definition, it returns that one instead.
+func (r *Registry) Register(req *api.RegisterSchemaRequest) (*api.Schema, error) {
+	if req.Subject == "" {
+		return nil, api.ErrInvalidSchema{Reason: "missing subject"}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	compatibility := req.Compatibility
+	if set, ok := r.compatibility[req.Subject]; ok {
+		if compatibility != api.Compatibility_NONE && compatibility != set {
+			return nil, api.ErrInvalidSchema{Reason: fmt.Sprintf(
+				"subject %s has compatibility %s, not %s",
+				req.Subject,
+				set,
+				compatibility,
+			)}
+		}
+		compatibility = set
+	}
+	versions := r.subjects[req.Subject]
+	for _, v := range versions {
+		if v.Type == req.Type &&
+			v.Message == req.Message &&
+			bytes.Equal(v.Definition, req.Definition) {
+			return v.Schema, nil
+		}
+	}
+	c, err := compile(&api.Schema{
+		Id:            uint32(len(r.schemas) + 1),
+		Subject:       req.Subject,
+		Version:       uint32(len(versions) + 1),
+		Type:          req.Type,
+		Definition:    req.Definition,
+		Message:       req.Message,
+		Compatibility: compatibility,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if err := checkCompatibility(compatibility, latest, c); err != nil {
+			return nil, api.ErrIncompatibleSchema{
+				Subject:       req.Subject,
+				Compatibility: compatibility,
+				Reason:        err.Error(),
+			}
+		}
+	}
+	r.add(c)
+	return c.Schema, nil
+}
+
+// add adds the compiled schema, whose ID and version are the next ones.
+func (r *Registry) add(c *compiled) {
+	r.schemas = append(r.schemas, c)
+	r.subjects[c.Subject] = append(r.subjects[c.Subject], c)
+}
+
+// Get returns the schema with the ID.
+func (r *Registry) Get(id uint32) (*api.Schema, error) {
+	c, err := r.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Schema, nil
+}
+
+func (r *Registry) get(id uint32) (*compiled, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if id == 0 || int(id) > len(r.schemas) {
+		return nil, api.ErrSchemaNotFound{ID: id}
+	}
+	return r.schemas[id-1], nil
+}
+
+// Version returns the version of the subject's schema, its latest if the
+// version is 0.
+func (r *Registry) Version(subject string, version uint32) (*api.Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions := r.subjects[subject]
+	if version == 0 {
+		version = uint32(len(versions))
+	}
+	if version == 0 || int(version) > len(versions) {
+		return nil, api.ErrSchemaNotFound{Subject: subject, Version: version}
+	}
+	return versions[version-1].Schema, nil
+}
+
+// Validate checks the record has a schema of the subject and its value
+// validates against it.
+func (r *Registry) Validate(subject string, record *api.Record) error {
+	if record.SchemaId == 0 {
+		return api.ErrInvalidRecord{
+			Field:  "record.schema_id",
+			Reason: fmt.Sprintf("missing schema id of subject %s", subject),
+		}
+	}
+	c, err := r.get(record.SchemaId)
+	if err != nil {
+		return api.ErrInvalidRecord{
+			Field:  "record.schema_id",
+			Reason: fmt.Sprintf("schema %d not found", record.SchemaId),
+		}
+	}
+	if c.Subject != subject {
+		return api.ErrInvalidRecord{
+			Field: "record.schema_id",
+			Reason: fmt.Sprintf(
+				"schema %d is of subject %s, not %s",
+				c.Id,
+				c.Subject,
+				subject,
+			),
+		}
+	}
+	if err := c.validate(record.Value); err != nil {
+		return api.ErrInvalidRecord{
+			Field:  "record.value",
+			Reason: fmt.Sprintf("not valid for schema %d: %v", c.Id, err),
+		}
+	}
+	return nil
+}
+
+// Schemas returns the registered schemas ordered by their IDs.
+func (r *Registry) Schemas() []*api.Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemas := make([]*api.Schema, 0, len(r.schemas))
+	for _, c := range r.schemas {
+		schemas = append(schemas, c.Schema)
+	}
+	return schemas
+}
+
+// Restore replaces the registry's schemas and compatibilities with the given
+// ones, the schemas ordered by their IDs, as a snapshot of another registry
+// returned them.
+func (r *Registry) Restore(
+	schemas []*api.Schema,
+	compatibilities []*api.SetCompatibilityRequest,
+) error {
+	restored := NewRegistry()
+	for _, c := range compatibilities {
+		restored.compatibility[c.Subject] = c.Compatibility
+	}
+	for _, s := range schemas {
+		if s.Id != uint32(len(restored.schemas)+1) ||
+			s.Version != uint32(len(restored.subjects[s.Subject])+1) {
+			return fmt.Errorf(
+				"schema %d is out of order: %s version %d",
+				s.Id,
+				s.Subject,
+				s.Version,
+			)
+		}
+		c, err := compile(proto.Clone(s).(*api.Schema))
+		if err != nil {
+			return err
+		}
+		restored.add(c)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas = restored.schemas
+	r.subjects = restored.subjects
+	r.compatibility = restored.compatibility
+	return nil
+}
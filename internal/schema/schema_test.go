@@ -0,0 +1,317 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+const userSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"age": {"type": "integer"}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	register := func(
+		definition string,
+		compatibility api.Compatibility,
+	) (*api.Schema, error) {
+		return r.Register(&api.RegisterSchemaRequest{
+			Subject:       "users",
+			Type:          api.SchemaType_JSON_SCHEMA,
+			Definition:    []byte(definition),
+			Compatibility: compatibility,
+		})
+	}
+
+	s, err := register(userSchema, api.Compatibility_BACKWARD)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), s.Id)
+	require.Equal(t, uint32(1), s.Version)
+
+	// registering the same definition returns its version
+	s, err = register(userSchema, api.Compatibility_BACKWARD)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), s.Id)
+
+	// adding an optional property is backward compatible, making it
+	// required isn't
+	_, err = register(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"},
+			"email": {"type": "string"}
+		},
+		"required": ["name", "email"]
+	}`, api.Compatibility_BACKWARD)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, err.Error(), "$ requires email")
+	s, err = register(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "number"},
+			"email": {"type": "string"}
+		},
+		"required": ["name"]
+	}`, api.Compatibility_BACKWARD)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), s.Id)
+	require.Equal(t, uint32(2), s.Version)
+
+	// version 2 writes ages a version taking integers doesn't read
+	_, err = register(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer"}
+		}
+	}`, api.Compatibility_FULL)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, err.Error(), "$.age no longer accepts number")
+	s, err = register(`{"type": "array"}`, api.Compatibility_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), s.Version)
+
+	_, err = register(`{"type": 1}`, api.Compatibility_NONE)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = register(
+		`{"$ref": "file:///etc/passwd"}`,
+		api.Compatibility_NONE,
+	)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	latest, err := r.Version("users", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), latest.Id)
+	s, err = r.Version("users", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), s.Id)
+	_, err = r.Version("users", 4)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = r.Get(4)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// a restored registry has the same schemas and compatibilities
+	require.NoError(t, r.SetCompatibility("users", api.Compatibility_FULL))
+	restored := NewRegistry()
+	require.NoError(t, restored.Restore(r.Schemas(), r.Compatibilities()))
+	s, err = restored.Get(2)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(s, r.Schemas()[1]))
+	compatibility, ok := restored.Compatibility("users")
+	require.True(t, ok)
+	require.Equal(t, api.Compatibility_FULL, compatibility)
+	require.Error(t, restored.Restore(r.Schemas()[1:], nil))
+}
+
+func TestSubjectCompatibility(t *testing.T) {
+	r := NewRegistry()
+	register := func(
+		definition string,
+		compatibility api.Compatibility,
+	) (*api.Schema, error) {
+		return r.Register(&api.RegisterSchemaRequest{
+			Subject:       "users",
+			Type:          api.SchemaType_JSON_SCHEMA,
+			Definition:    []byte(definition),
+			Compatibility: compatibility,
+		})
+	}
+	_, ok := r.Compatibility("users")
+	require.False(t, ok)
+	require.NoError(t, r.SetCompatibility("users", api.Compatibility_BACKWARD))
+	compatibility, ok := r.Compatibility("users")
+	require.True(t, ok)
+	require.Equal(t, api.Compatibility_BACKWARD, compatibility)
+
+	s, err := register(userSchema, api.Compatibility_NONE)
+	require.NoError(t, err)
+	require.Equal(t, api.Compatibility_BACKWARD, s.Compatibility)
+
+	// every new version is checked with the subject's compatibility, even
+	// when the registration doesn't ask for it
+	_, err = register(`{
+		"type": "object",
+		"properties": {"name": {"type": "string"}},
+		"required": ["name", "email"]
+	}`, api.Compatibility_NONE)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// registrations may only ask for the subject's compatibility
+	_, err = register(`{"type": "object"}`, api.Compatibility_FORWARD)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// setting it to NONE lets any version register
+	require.NoError(t, r.SetCompatibility("users", api.Compatibility_NONE))
+	s, err = register(`{"type": "array"}`, api.Compatibility_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), s.Version)
+
+	require.Error(t, r.SetCompatibility("", api.Compatibility_FULL))
+	require.Error(t, r.SetCompatibility("users", api.Compatibility(42)))
+}
+
+func TestValidate(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.Register(&api.RegisterSchemaRequest{
+		Subject:    "users",
+		Type:       api.SchemaType_JSON_SCHEMA,
+		Definition: []byte(userSchema),
+	})
+	require.NoError(t, err)
+	_, err = r.Register(&api.RegisterSchemaRequest{
+		Subject:    "records",
+		Type:       api.SchemaType_PROTOBUF,
+		Definition: recordDescriptor(t),
+		Message:    "log.v1.Record",
+	})
+	require.NoError(t, err)
+	record, err := proto.Marshal(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		subject string
+		record  *api.Record
+		field   string
+	}{
+		"valid json": {
+			subject: "users",
+			record: &api.Record{
+				SchemaId: 1,
+				Value:    []byte(`{"name": "pouria", "age": 30}`),
+			},
+		},
+		"valid protobuf": {
+			subject: "records",
+			record:  &api.Record{SchemaId: 2, Value: record},
+		},
+		"missing schema": {
+			subject: "users",
+			record:  &api.Record{Value: []byte(`{"name": "pouria"}`)},
+			field:   "record.schema_id",
+		},
+		"unknown schema": {
+			subject: "users",
+			record:  &api.Record{SchemaId: 3, Value: []byte(`{}`)},
+			field:   "record.schema_id",
+		},
+		"other subject": {
+			subject: "records",
+			record:  &api.Record{SchemaId: 1, Value: []byte(`{}`)},
+			field:   "record.schema_id",
+		},
+		"missing property": {
+			subject: "users",
+			record:  &api.Record{SchemaId: 1, Value: []byte(`{"age": 30}`)},
+			field:   "record.value",
+		},
+		"not json": {
+			subject: "users",
+			record:  &api.Record{SchemaId: 1, Value: []byte(`{"name"`)},
+			field:   "record.value",
+		},
+		"unknown fields": {
+			subject: "records",
+			record: &api.Record{
+				SchemaId: 2,
+				Value:    []byte{0x50, 0x01},
+			},
+			field: "record.value",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := r.Validate(test.subject, test.record)
+			if test.field == "" {
+				require.NoError(t, err)
+				return
+			}
+			var invalid api.ErrInvalidRecord
+			require.ErrorAs(t, err, &invalid)
+			require.Equal(t, test.field, invalid.Field)
+		})
+	}
+}
+
+func TestProtobufCompatibility(t *testing.T) {
+	r := NewRegistry()
+	register := func(
+		definition []byte,
+		compatibility api.Compatibility,
+	) error {
+		_, err := r.Register(&api.RegisterSchemaRequest{
+			Subject:       "records",
+			Type:          api.SchemaType_PROTOBUF,
+			Definition:    definition,
+			Message:       "log.v1.Record",
+			Compatibility: compatibility,
+		})
+		return err
+	}
+	require.NoError(t, register(recordDescriptor(t), api.Compatibility_FULL))
+
+	// dropping a field and changing another's type to one of the same wire
+	// type is compatible
+	require.NoError(t, register(recordDescriptor(t, func(
+		m *descriptorpb.DescriptorProto,
+	) {
+		m.Field = m.Field[:len(m.Field)-1]
+		m.Field[1].Type = descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+	}), api.Compatibility_FULL))
+
+	err := register(recordDescriptor(t, func(m *descriptorpb.DescriptorProto) {
+		m.Field[0].Type = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum()
+	}), api.Compatibility_BACKWARD)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, err.Error(), "field log.v1.Record.value changed type")
+
+	err = register(recordDescriptor(t, func(m *descriptorpb.DescriptorProto) {
+		m.Field[2].Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	}), api.Compatibility_FORWARD)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	err = register([]byte("not a descriptor"), api.Compatibility_NONE)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// recordDescriptor returns the file descriptor set of the Record message,
+// changed by the given functions.
+func recordDescriptor(
+	t *testing.T,
+	fns ...func(*descriptorpb.DescriptorProto),
+) []byte {
+	t.Helper()
+	file := protodesc.ToFileDescriptorProto(
+		(&api.Record{}).ProtoReflect().Descriptor().ParentFile(),
+	)
+	// the record doesn't need the file's services and other messages
+	file.Service = nil
+	for _, m := range file.MessageType {
+		if m.GetName() == "Record" {
+			file.MessageType = []*descriptorpb.DescriptorProto{m}
+			break
+		}
+	}
+	for _, fn := range fns {
+		fn(file.MessageType[0])
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{file},
+	})
+	require.NoError(t, err)
+	return b
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+)
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// Administrator is an interface for operating the cluster.
+type Administrator interface {
+	Leave(id string) error
+	TransferLeadership(id string) error
+	Snapshot() (*api.SnapshotResponse, error)
+	Stats() map[string]string
+	Segments() []*api.Segment
+	ForceRetention(lowest uint64) (uint64, error)
+}
+
+// Keyring manages the keys encrypting the gossip of the cluster's members.
+type Keyring interface {
+	InstallKey(key string) error
+	UseKey(key string) error
+	RemoveKey(key string) error
+	ListKeys() (keys, primaryKeys map[string]int, members int, err error)
+}
+
+// Autopilot reports the health of the cluster's servers.
+type Autopilot interface {
+	ServerHealth() (*api.GetServerHealthResponse, error)
+}
+
+// adminServer implements the api.AdminServer interface using gRPC.
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+// newAdminServer creates a new admin server with the specified configuration.
+func newAdminServer(config *Config) (srv *adminServer, err error) {
+	srv = &adminServer{
+		Config: config,
+	}
+	return srv, nil
+}
+
+// RemoveServer removes a server from the cluster.
+func (s *adminServer) RemoveServer(
+	ctx context.Context, req *api.RemoveServerRequest,
+) (*api.RemoveServerResponse, error) {
+	if err := s.authorize(
+		ctx,
+		auth.ServerObject(req.Id),
+		auth.RemoveServerAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.Administrator.Leave(req.Id); err != nil {
+		return nil, adminError(err)
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+// TransferLeadership transfers the leadership to the chosen server.
+func (s *adminServer) TransferLeadership(
+	ctx context.Context, req *api.TransferLeadershipRequest,
+) (*api.TransferLeadershipResponse, error) {
+	if err := s.authorize(
+		ctx,
+		auth.ServerObject(req.Id),
+		auth.TransferLeadershipAction,
+	); err != nil {
+		return nil, err
+	}
+	if err := s.Administrator.TransferLeadership(req.Id); err != nil {
+		return nil, adminError(err)
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+// Snapshot triggers a snapshot of the log.
+func (s *adminServer) Snapshot(
+	ctx context.Context, req *api.SnapshotRequest,
+) (*api.SnapshotResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.SnapshotAction); err != nil {
+		return nil, err
+	}
+	res, err := s.Administrator.Snapshot()
+	if err != nil {
+		return nil, adminError(err)
+	}
+	return res, nil
+}
+
+// DescribeRaft returns the Raft stats of the server.
+func (s *adminServer) DescribeRaft(
+	ctx context.Context, req *api.DescribeRaftRequest,
+) (*api.DescribeRaftResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.DescribeRaftAction); err != nil {
+		return nil, err
+	}
+	return &api.DescribeRaftResponse{
+		Stats: s.Administrator.Stats(),
+	}, nil
+}
+
+// ListSegments lists the segments of the server's log.
+func (s *adminServer) ListSegments(
+	ctx context.Context, req *api.ListSegmentsRequest,
+) (*api.ListSegmentsResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.ListSegmentsAction); err != nil {
+		return nil, err
+	}
+	return &api.ListSegmentsResponse{
+		Segments: s.Administrator.Segments(),
+	}, nil
+}
+
+// ForceRetention removes the records before the given offset from the log.
+func (s *adminServer) ForceRetention(
+	ctx context.Context, req *api.ForceRetentionRequest,
+) (*api.ForceRetentionResponse, error) {
+	if err := s.authorize(
+		ctx,
+		auth.ClusterObject,
+		auth.ForceRetentionAction,
+	); err != nil {
+		return nil, err
+	}
+	lowest, err := s.Administrator.ForceRetention(req.LowestOffset)
+	if err != nil {
+		return nil, adminError(err)
+	}
+	return &api.ForceRetentionResponse{LowestOffset: lowest}, nil
+}
+
+// InstallGossipKey installs the key on the keyring of every member.
+func (s *adminServer) InstallGossipKey(
+	ctx context.Context, req *api.GossipKeyRequest,
+) (*api.GossipKeyResponse, error) {
+	return s.manageKey(ctx, req, Keyring.InstallKey)
+}
+
+// UseGossipKey makes the installed key the primary key of every member.
+func (s *adminServer) UseGossipKey(
+	ctx context.Context, req *api.GossipKeyRequest,
+) (*api.GossipKeyResponse, error) {
+	return s.manageKey(ctx, req, Keyring.UseKey)
+}
+
+// RemoveGossipKey removes the key from the keyring of every member.
+func (s *adminServer) RemoveGossipKey(
+	ctx context.Context, req *api.GossipKeyRequest,
+) (*api.GossipKeyResponse, error) {
+	return s.manageKey(ctx, req, Keyring.RemoveKey)
+}
+
+// ListGossipKeys lists the keys of the members' keyrings.
+func (s *adminServer) ListGossipKeys(
+	ctx context.Context, req *api.ListGossipKeysRequest,
+) (*api.ListGossipKeysResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.ManageKeysAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, errNoKeyring
+	}
+	keys, primaryKeys, members, err := s.Keyring.ListKeys()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	res := &api.ListGossipKeysResponse{
+		Keys:        make(map[string]int32, len(keys)),
+		PrimaryKeys: make(map[string]int32, len(primaryKeys)),
+		NumMembers:  int32(members),
+	}
+	for key, n := range keys {
+		res.Keys[key] = int32(n)
+	}
+	for key, n := range primaryKeys {
+		res.PrimaryKeys[key] = int32(n)
+	}
+	return res, nil
+}
+
+// errNoKeyring is the error of the gossip key calls of servers without a
+// keyring.
+var errNoKeyring = status.Error(
+	codes.Unimplemented,
+	"gossip keys aren't managed",
+)
+
+// manageKey authorizes the subject of the context to manage the keys and
+// changes the keyrings of the members with the key.
+func (s *adminServer) manageKey(
+	ctx context.Context,
+	req *api.GossipKeyRequest,
+	change func(Keyring, string) error,
+) (*api.GossipKeyResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.ManageKeysAction); err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, errNoKeyring
+	}
+	// the members that failed to change their keyrings are in the message
+	if err := change(s.Keyring, req.Key); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &api.GossipKeyResponse{}, nil
+}
+
+// GetServerHealth reports the health of the servers, as seen by the leader.
+func (s *adminServer) GetServerHealth(
+	ctx context.Context, req *api.GetServerHealthRequest,
+) (*api.GetServerHealthResponse, error) {
+	if err := s.authorize(ctx, auth.ClusterObject, auth.DescribeRaftAction); err != nil {
+		return nil, err
+	}
+	if s.Autopilot == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"server health isn't reported",
+		)
+	}
+	// only the leader hears from every server
+	res, err := s.Autopilot.ServerHealth()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return res, nil
+}
+
+// adminError returns the error of the cluster operation with the gRPC code
+// of its cause. Errors with a status, such as api.ErrNotLeader, keep it.
+func adminError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var notLeader api.ErrNotLeader
+	if errors.As(err, &notLeader) {
+		return notLeader
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, raft.ErrNothingNewToSnapshot):
+		code = codes.FailedPrecondition
+	case errors.Is(err, raft.ErrLeadershipTransferInProgress),
+		errors.Is(err, raft.ErrRaftShutdown),
+		errors.Is(err, raft.ErrEnqueueTimeout):
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+// authorize authorizes the subject of the context to perform the action on
+// the object.
+func (s *adminServer) authorize(
+	ctx context.Context,
+	object, action string,
+) error {
+	return s.Authorizer.Authorize(subject(ctx), object, action)
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+)
+
+func TestAdmin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	newClient := func(crtPath, keyPath string) api.AdminClient {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: crtPath,
+			KeyFile:  keyPath,
+			CAFile:   config.CAFile,
+			Server:   false,
+		})
+		require.NoError(t, err)
+		tlsCreds := credentials.NewTLS(tlsConfig)
+		conn, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(tlsCreds),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewAdminClient(conn)
+	}
+	rootClient := newClient(
+		config.RootClientCertFile,
+		config.RootClientKeyFile,
+	)
+	nobodyClient := newClient(
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	admin := &administrator{}
+	server, err := NewGRPCServer(&Config{
+		Authorizer:    authorizer,
+		Administrator: admin,
+		Autopilot:     autopilot{},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	ctx := context.Background()
+
+	_, err = rootClient.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.NoError(t, err)
+	require.Equal(t, "1", admin.left)
+
+	_, err = rootClient.TransferLeadership(
+		ctx,
+		&api.TransferLeadershipRequest{Id: "2"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "2", admin.leader)
+
+	snapshot, err := rootClient.Snapshot(ctx, &api.SnapshotRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), snapshot.Index)
+
+	stats, err := rootClient.DescribeRaft(ctx, &api.DescribeRaftRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "Leader", stats.Stats["state"])
+
+	segments, err := rootClient.ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments.Segments))
+	require.Equal(t, uint64(4), segments.Segments[0].NextOffset)
+
+	retention, err := rootClient.ForceRetention(
+		ctx,
+		&api.ForceRetentionRequest{LowestOffset: 2},
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), retention.LowestOffset)
+
+	health, err := rootClient.GetServerHealth(
+		ctx,
+		&api.GetServerHealthRequest{},
+	)
+	require.NoError(t, err)
+	require.True(t, health.Healthy)
+	require.Equal(t, "0", health.Servers[0].Id)
+
+	_, err = nobodyClient.GetServerHealth(ctx, &api.GetServerHealthRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	// the errors of the operations have the codes of their causes
+	admin.err = api.ErrNotLeader{Leader: "127.0.0.1:8400", Err: raft.ErrNotLeader}
+	_, err = rootClient.TransferLeadership(
+		ctx,
+		&api.TransferLeadershipRequest{Id: "2"},
+	)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	admin.err = api.ErrUnknownServer{ID: "3"}
+	_, err = rootClient.TransferLeadership(
+		ctx,
+		&api.TransferLeadershipRequest{Id: "3"},
+	)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	admin.err = raft.ErrNothingNewToSnapshot
+	_, err = rootClient.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	admin.err = nil
+
+	_, err = nobodyClient.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.ForceRetention(
+		ctx,
+		&api.ForceRetentionRequest{LowestOffset: 3},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, "1", admin.left)
+}
+
+func TestAdminGossipKeys(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	newClient := func(crtPath, keyPath string) api.AdminClient {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: crtPath,
+			KeyFile:  keyPath,
+			CAFile:   config.CAFile,
+			Server:   false,
+		})
+		require.NoError(t, err)
+		conn, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewAdminClient(conn)
+	}
+	rootClient := newClient(
+		config.RootClientCertFile,
+		config.RootClientKeyFile,
+	)
+	nobodyClient := newClient(
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	keys := &keyring{keys: map[string]int{}}
+	server, err := NewGRPCServer(&Config{
+		Authorizer:    authorizer,
+		Administrator: &administrator{},
+		Keyring:       keys,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	ctx := context.Background()
+	key := "T9jncgl9mbLus+baTTa7q7nPSUrXwbDi2dhbtqir37s="
+	_, err = rootClient.InstallGossipKey(ctx, &api.GossipKeyRequest{Key: key})
+	require.NoError(t, err)
+	_, err = rootClient.UseGossipKey(ctx, &api.GossipKeyRequest{Key: key})
+	require.NoError(t, err)
+	list, err := rootClient.ListGossipKeys(ctx, &api.ListGossipKeysRequest{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{key: 3}, list.Keys)
+	require.Equal(t, map[string]int32{key: 3}, list.PrimaryKeys)
+	require.Equal(t, int32(3), list.NumMembers)
+
+	// the members failing to change their keyrings fail the call
+	_, err = rootClient.RemoveGossipKey(ctx, &api.GossipKeyRequest{Key: key})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = rootClient.InstallGossipKey(
+		ctx,
+		&api.GossipKeyRequest{Key: "not a key"},
+	)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobodyClient.ListGossipKeys(ctx, &api.ListGossipKeysRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// administrator implements Administrator by recording the operations, which
+// fail with err if it's set.
+type administrator struct {
+	left   string
+	leader string
+	err    error
+}
+
+func (a *administrator) Leave(id string) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.left = id
+	return nil
+}
+
+func (a *administrator) TransferLeadership(id string) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.leader = id
+	return nil
+}
+
+func (a *administrator) Snapshot() (*api.SnapshotResponse, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &api.SnapshotResponse{Index: 3}, nil
+}
+
+func (a *administrator) Stats() map[string]string {
+	return map[string]string{"state": "Leader"}
+}
+
+func (a *administrator) Segments() []*api.Segment {
+	return []*api.Segment{{BaseOffset: 0, NextOffset: 4}}
+}
+
+func (a *administrator) ForceRetention(lowest uint64) (uint64, error) {
+	return lowest, nil
+}
+
+// autopilot implements Autopilot for a healthy server.
+type autopilot struct{}
+
+func (autopilot) ServerHealth() (*api.GetServerHealthResponse, error) {
+	return &api.GetServerHealthResponse{
+		Healthy: true,
+		Servers: []*api.ServerHealth{{Id: "0", IsLeader: true, Healthy: true}},
+	}, nil
+}
+
+// keyring implements Keyring for three members, which can't remove their
+// primary key.
+type keyring struct {
+	keys    map[string]int
+	primary string
+}
+
+func (k *keyring) InstallKey(key string) error {
+	k.keys[key] = 3
+	return nil
+}
+
+func (k *keyring) UseKey(key string) error {
+	k.primary = key
+	return nil
+}
+
+func (k *keyring) RemoveKey(key string) error {
+	if key == k.primary {
+		return fmt.Errorf("3/3 nodes reported failure")
+	}
+	delete(k.keys, key)
+	return nil
+}
+
+func (k *keyring) ListKeys() (map[string]int, map[string]int, int, error) {
+	return k.keys, map[string]int{k.primary: 3}, 3, nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/log"
+)
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	tokensFile := filepath.Join(t.TempDir(), "tokens.csv")
+	require.NoError(t, os.WriteFile(
+		tokensFile,
+		[]byte("# producers\nroot-token,root\nnobody-token,nobody\n"),
+		0600,
+	))
+	tokens, err := auth.NewTokens(tokensFile)
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	// clients with tokens have no certificates to present
+	serverTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	server, err := NewGRPCServer(&Config{
+		CommitLog:     clog,
+		Authorizer:    authorizer,
+		Authenticator: auth.Chain{auth.TLS{}, tokens},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	dial := func(
+		tlsConfig config.TLSConfig,
+		token string,
+	) *grpc.ClientConn {
+		tlsConfig.CAFile = config.CAFile
+		clientTLSConfig, err := config.SetupTLSConfig(tlsConfig)
+		require.NoError(t, err)
+		opts := []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)),
+		}
+		if token != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(bearer(token)))
+		}
+		conn, err := grpc.Dial(l.Addr().String(), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	produce := func(conn *grpc.ClientConn) error {
+		_, err := api.NewLogClient(conn).Produce(
+			context.Background(),
+			&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}},
+		)
+		return err
+	}
+
+	// a token authenticates clients without certificates
+	err = produce(dial(config.TLSConfig{}, "root-token"))
+	require.NoError(t, err)
+
+	// the token's subject is authorized like a certificate's
+	err = produce(dial(config.TLSConfig{}, "nobody-token"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	err = produce(dial(config.TLSConfig{}, "wrong-token"))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "invalid token")
+
+	anonymous := dial(config.TLSConfig{}, "")
+	err = produce(anonymous)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// certificates still authenticate clients
+	err = produce(dial(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+	}, ""))
+	require.NoError(t, err)
+
+	// the health service doesn't need credentials
+	_, err = healthpb.NewHealthClient(anonymous).Check(
+		context.Background(),
+		&healthpb.HealthCheckRequest{},
+	)
+	require.NoError(t, err)
+}
+
+// bearer authenticates the requests with a bearer token.
+type bearer string
+
+func (b bearer) GetRequestMetadata(
+	context.Context,
+	...string,
+) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (bearer) RequireTransportSecurity() bool {
+	return true
+}
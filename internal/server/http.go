@@ -1,97 +1,527 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
-	"github.com/gorilla/mux"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/plugin/ochttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// Encodings of record values in the JSON of the HTTP API, chosen with the
+// encoding query parameter.
+const (
+	// EncodingBase64 encodes values as base64 strings. It's the default as
+	// it holds any value.
+	EncodingBase64 = "base64"
+	// EncodingJSON embeds values as JSON, so they must be valid JSON.
+	EncodingJSON = "json"
+	// EncodingText encodes values as strings, so they must be UTF-8.
+	EncodingText = "text"
+)
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+const (
+	// defaultRangeLimit is the number of records a range query returns if
+	// it doesn't set a limit.
+	defaultRangeLimit = 100
+	// maxRangeLimit is the most records a range query returns.
+	maxRangeLimit = 1000
+)
 
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
-	}
+// NewHTTPHandler returns the REST API over the config's commit log, which
+// authorizes requests with the config's authorizer and the common name of
+// the client's verified certificate, like the gRPC server. Its routes are:
+//
+//	POST /records             appends {"value": ...} and returns its offset,
+//	                          or redirects to the leader's REST API with a
+//	                          307 if the server's a follower
+//	GET  /records/{offset}    reads the record at the offset
+//	GET  /records?from=&to=&limit=
+//	                          reads the records from offset from up to, but
+//	                          excluding, offset to, at most limit of them
+//	GET  /records/events?from=
+//	                          tails the log from the offset as Server-Sent
+//	                          Events, resuming after the Last-Event-ID
+//	GET  /records/ws?from=    tails the log from the offset over a WebSocket
+//
+// Values are encoded as set by the encoding query parameter: base64, json or
+// text. Errors respond with the HTTP status matching their gRPC code and a
+// body of {"code": ..., "message": ...}.
+func NewHTTPHandler(config *Config) http.Handler {
+	s := &httpServer{Config: config}
+	r := mux.NewRouter()
+	r.HandleFunc("/records", s.handleProduce).Methods(http.MethodPost)
+	r.HandleFunc("/records/events", s.handleEvents).Methods(http.MethodGet)
+	r.HandleFunc("/records/ws", s.handleSocket).Methods(http.MethodGet)
+	r.HandleFunc("/records/{offset:[0-9]+}", s.handleConsume).
+		Methods(http.MethodGet)
+	r.HandleFunc("/records", s.handleConsumeRange).Methods(http.MethodGet)
+	return &ochttp.Handler{Handler: r}
 }
 
+// httpServer serves the HTTP API.
 type httpServer struct {
-	Log *Log
+	*Config
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{
-		Log: NewLog(),
-	}
+// httpRecord is the JSON representation of a record.
+type httpRecord struct {
+	Offset   uint64          `json:"offset"`
+	Value    json.RawMessage `json:"value"`
+	SchemaID uint32          `json:"schema_id,omitempty"`
 }
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
+// httpProduceRequest is the body of a produce request.
+type httpProduceRequest struct {
+	Value    json.RawMessage `json:"value"`
+	SchemaID uint32          `json:"schema_id,omitempty"`
 }
 
-type ProduceResponse struct {
+// httpProduceResponse is the body of a produce response.
+type httpProduceResponse struct {
 	Offset uint64 `json:"offset"`
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+// httpRangeResponse is the body of a range query's response. Next is the
+// offset to continue reading from.
+type httpRangeResponse struct {
+	Records []httpRecord `json:"records"`
+	Next    uint64       `json:"next"`
 }
 
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+// httpError is the body of an error response.
+type httpError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Lowest and Next are the log's lowest and next offsets, for the
+	// offsets outside its range.
+	Lowest *uint64 `json:"lowest,omitempty"`
+	Next   *uint64 `json:"next,omitempty"`
 }
 
+// handleProduce appends the request's record to the commit log.
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-
-	err := json.NewDecoder(r.Body).Decode(&req)
+	encoding, err := valueEncoding(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-
-	off, err := s.Log.Append(req.Record)
+	subject, err := s.authorize(r, produceAction)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
+	var req httpProduceRequest
+	body := http.MaxBytesReader(
+		w,
+		r.Body,
+		maxRequestBytes(s.MaxRecordBytes),
+	)
+	if err = json.NewDecoder(body).Decode(&req); err != nil {
+		writeError(w, status.Errorf(
+			codes.InvalidArgument,
+			"invalid request body: %v",
+			err,
+		))
+		return
+	}
+	value, err := decodeValue(encoding, req.Value)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	record := &api.Record{Value: value, SchemaId: req.SchemaID}
+	if err = validateRecord(record, s.MaxRecordBytes); err != nil {
+		writeError(w, err)
 		return
 	}
+	if err = validateSchema(s.Config, record); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = s.takeProduce(r.Context(), subject, record); err != nil {
+		writeError(w, err)
+		return
+	}
+	offset, err := s.CommitLog.AppendContext(r.Context(), record)
+	if err != nil {
+		if location, ok := s.leaderLocation(r, err); ok {
+			http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/records/%d", offset))
+	writeJSON(w, http.StatusCreated, httpProduceResponse{Offset: offset})
 }
 
-func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var req ConsumeRequest
+// leaderLocation returns the URL of the request on the leader's REST API, if
+// the error is api.ErrNotLeader naming a leader the locator knows the REST
+// API of.
+func (s *httpServer) leaderLocation(r *http.Request, err error) (string, bool) {
+	var notLeader api.ErrNotLeader
+	if s.RESTLocator == nil ||
+		!errors.As(err, &notLeader) ||
+		notLeader.Leader == "" {
+		return "", false
+	}
+	addr, ok := s.RESTLocator.RESTAddr(notLeader.Leader)
+	if !ok {
+		return "", false
+	}
+	location := url.URL{
+		Scheme:   "http",
+		Host:     addr,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if r.TLS != nil {
+		location.Scheme = "https"
+	}
+	return location.String(), true
+}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+// handleConsume reads the record at the route's offset.
+func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
+	encoding, err := valueEncoding(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "invalid offset"))
 		return
 	}
-
+	subject, err := s.authorize(r, consumeAction)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	record, err := s.CommitLog.ReadContext(r.Context(), offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	if err = s.takeConsume(r.Context(), subject, record); err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := encodeRecord(encoding, record)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
 
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+// handleConsumeRange reads the records in the query's range, stopping early
+// at the end of the log. It fails if the range starts before the log's first
+// record, so clients following Next don't get stuck on removed records.
+func (s *httpServer) handleConsumeRange(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	encoding, err := valueEncoding(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	from, err := uintParam(query.Get("from"), 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	to, err := uintParam(query.Get("to"), ^uint64(0))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, err := uintParam(query.Get("limit"), defaultRangeLimit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if limit == 0 || limit > maxRangeLimit {
+		writeError(w, status.Errorf(
+			codes.InvalidArgument,
+			"limit must be between 1 and %d",
+			maxRangeLimit,
+		))
+		return
+	}
+	subject, err := s.authorize(r, consumeAction)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	res := httpRangeResponse{Records: []httpRecord{}, Next: from}
+	for off := from; off < to && uint64(len(res.Records)) < limit; off++ {
+		record, err := s.CommitLog.ReadContext(r.Context(), off)
+		var outOfRange api.ErrOffsetOutOfRange
+		if errors.As(err, &outOfRange) && !outOfRange.Truncated() {
+			break
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err = s.takeConsume(r.Context(), subject, record); err != nil {
+			// the records read so far go out, and Next tells the client
+			// where to continue once its quota allows
+			if len(res.Records) != 0 {
+				break
+			}
+			writeError(w, err)
+			return
+		}
+		encoded, err := encodeRecord(encoding, record)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res.Records = append(res.Records, encoded)
+		res.Next = off + 1
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// authorize authenticates the request's client, from its verified
+// certificate or the bearer token of its Authorization header, and
+// authorizes it for the action, returning its subject.
+func (s *httpServer) authorize(r *http.Request, action string) (string, error) {
+	authenticator := s.Authenticator
+	if authenticator == nil {
+		authenticator = auth.TLS{}
+	}
+	creds := auth.Credentials{TLS: r.TLS}
+	if token, ok := bearerToken(r.Header.Get("Authorization")); ok {
+		creds.Token = token
+	}
+	subject, err := authenticator.Authenticate(creds)
+	if err != nil {
+		return "", status.New(
+			codes.Unauthenticated,
+			fmt.Sprintf("failed to authenticate: %v", err),
+		).Err()
+	}
+	err = s.Authorizer.Authorize(subject, auth.TopicObject(s.Topic), action)
+	if err != nil {
+		return "", err
+	}
+	return subject, nil
+}
+
+// takeProduce takes the record from the subject's produce quota, failing
+// with ResourceExhausted if the subject has exceeded it.
+func (s *httpServer) takeProduce(
+	ctx context.Context,
+	subject string,
+	record *api.Record,
+) error {
+	if s.Quotas == nil {
+		return nil
+	}
+	wait := s.Quotas.Produce(subject, 1, int64(proto.Size(record)))
+	if wait > 0 {
+		return quotaExceeded(ctx, subject, produceAction, wait)
+	}
+	return nil
+}
+
+// takeConsume takes the record from the subject's consume quota, as large as
+// the log stores it like the gRPC server's, failing with ResourceExhausted if
+// the subject has exceeded it.
+func (s *httpServer) takeConsume(
+	ctx context.Context,
+	subject string,
+	record *api.Record,
+) error {
+	if s.Quotas == nil {
+		return nil
+	}
+	if wait := s.Quotas.Consume(subject, int64(proto.Size(record))); wait > 0 {
+		return quotaExceeded(ctx, subject, consumeAction, wait)
+	}
+	return nil
+}
+
+// encodeRecord returns the record with its value in the encoding.
+func encodeRecord(encoding string, record *api.Record) (httpRecord, error) {
+	value, err := encodeValue(encoding, record.Value)
+	if err != nil {
+		return httpRecord{}, err
+	}
+	return httpRecord{
+		Offset:   record.Offset,
+		Value:    value,
+		SchemaID: record.SchemaId,
+	}, nil
+}
+
+// valueEncoding returns the request's value encoding, base64 if it doesn't
+// set one.
+func valueEncoding(r *http.Request) (string, error) {
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "":
+		return EncodingBase64, nil
+	case EncodingBase64, EncodingJSON, EncodingText:
+		return encoding, nil
+	default:
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"unknown encoding: %s",
+			encoding,
+		)
+	}
+}
+
+// decodeValue decodes the JSON of a value in the encoding.
+func decodeValue(encoding string, raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing value")
+	}
+	var value []byte
+	var err error
+	switch encoding {
+	case EncodingBase64:
+		err = json.Unmarshal(raw, &value)
+	case EncodingText:
+		var text string
+		err = json.Unmarshal(raw, &text)
+		value = []byte(text)
+	case EncodingJSON:
+		value = raw
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"value isn't %s: %v",
+			encoding,
+			err,
+		)
+	}
+	return value, nil
+}
+
+// encodeValue encodes the value to JSON in the encoding, failing if the
+// encoding can't represent it.
+func encodeValue(encoding string, value []byte) (json.RawMessage, error) {
+	switch encoding {
+	case EncodingJSON:
+		if !json.Valid(value) {
+			return nil, status.Error(
+				codes.FailedPrecondition,
+				"value isn't json, read it as base64",
+			)
+		}
+		return value, nil
+	case EncodingText:
+		if !utf8.Valid(value) {
+			return nil, status.Error(
+				codes.FailedPrecondition,
+				"value isn't utf-8 text, read it as base64",
+			)
+		}
+		return json.Marshal(string(value))
+	default:
+		return json.Marshal(base64.StdEncoding.EncodeToString(value))
+	}
+}
+
+// uintParam parses the query parameter, returning the default if it's empty.
+func uintParam(param string, def uint64) (uint64, error) {
+	if param == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"invalid query parameter: %s",
+			param,
+		)
+	}
+	return v, nil
+}
+
+// writeJSON responds with the status and the value as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the HTTP status matching the error's gRPC code.
+func writeError(w http.ResponseWriter, err error) {
+	code, body := errorBody(err)
+	if code == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if delay := retryDelay(err); delay > 0 {
+		seconds := int64((delay + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	writeJSON(w, httpStatus(code), body)
+}
+
+// errorBody returns the gRPC code of the error and the body of its response.
+func errorBody(err error) (codes.Code, httpError) {
+	code := status.Code(err)
+	body := httpError{Message: status.Convert(err).Message()}
+	var outOfRange api.ErrOffsetOutOfRange
+	if errors.As(err, &outOfRange) {
+		code = codes.NotFound
+		body.Lowest = &outOfRange.Lowest
+		body.Next = &outOfRange.Next
+	}
+	body.Code = code.String()
+	return code, body
+}
+
+// httpStatus returns the HTTP status matching the gRPC code.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/log"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// segments of three records, so retention can remove the first
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 3 * 12
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(NewHTTPHandler(&Config{
+		CommitLog:      clog,
+		Authorizer:     authorizer,
+		MaxRecordBytes: 16,
+	}))
+	srv.TLS = serverTLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(crtPath, keyPath string) *http.Client {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      crtPath,
+			KeyFile:       keyPath,
+			CAFile:        config.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+	rootClient := newClient(
+		config.RootClientCertFile,
+		config.RootClientKeyFile,
+	)
+	nobodyClient := newClient(
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	)
+
+	do := func(
+		client *http.Client,
+		method, path, body string,
+		wantStatus int,
+	) map[string]interface{} {
+		req, err := http.NewRequest(
+			method,
+			srv.URL+path,
+			bytes.NewBufferString(body),
+		)
+		require.NoError(t, err)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, wantStatus, res.StatusCode)
+		var got map[string]interface{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+		return got
+	}
+
+	// "hello" in base64
+	got := do(rootClient, "POST", "/records", `{"value":"aGVsbG8="}`, 201)
+	require.Equal(t, float64(0), got["offset"])
+	got = do(rootClient, "POST", "/records?encoding=json",
+		`{"value":{"n":1}}`, 201)
+	require.Equal(t, float64(1), got["offset"])
+	got = do(rootClient, "POST", "/records?encoding=text",
+		`{"value":"world"}`, 201)
+	require.Equal(t, float64(2), got["offset"])
+
+	got = do(rootClient, "GET", "/records/0", "", 200)
+	require.Equal(t, "aGVsbG8=", got["value"])
+	got = do(rootClient, "GET", "/records/0?encoding=text", "", 200)
+	require.Equal(t, "hello", got["value"])
+	got = do(rootClient, "GET", "/records/1?encoding=json", "", 200)
+	require.Equal(t, map[string]interface{}{"n": float64(1)}, got["value"])
+	got = do(rootClient, "GET", "/records/0?encoding=json", "", 412)
+	require.Equal(t, "FailedPrecondition", got["code"])
+
+	got = do(rootClient, "GET", "/records?from=1&limit=5&encoding=text",
+		"", 200)
+	require.Equal(t, float64(3), got["next"])
+	records := got["records"].([]interface{})
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "world", records[1].(map[string]interface{})["value"])
+	got = do(rootClient, "GET", "/records?from=0&to=1", "", 200)
+	require.Equal(t, 1, len(got["records"].([]interface{})))
+	require.Equal(t, float64(1), got["next"])
+
+	got = do(rootClient, "GET", "/records/3", "", 404)
+	require.Equal(t, "NotFound", got["code"])
+	require.Equal(t, float64(3), got["next"])
+	got = do(rootClient, "GET", "/records?limit=0", "", 400)
+	require.Equal(t, "InvalidArgument", got["code"])
+	got = do(rootClient, "POST", "/records", `{"value":"%"}`, 400)
+	require.Equal(t, "InvalidArgument", got["code"])
+	got = do(rootClient, "POST", "/records?encoding=xml", `{}`, 400)
+	require.Equal(t, "InvalidArgument", got["code"])
+	got = do(rootClient, "POST", "/records?encoding=text",
+		`{"value":"a value over sixteen bytes"}`, 400)
+	require.Equal(t, "record too large: 28 bytes, max 16", got["message"])
+
+	// ranges from removed records fail with the lowest offset, rather than
+	// returning empty pages forever, while those from the end are empty
+	got = do(rootClient, "POST", "/records", `{"value":"aGVsbG8="}`, 201)
+	require.Equal(t, float64(3), got["offset"])
+	require.NoError(t, clog.Truncate(2))
+	got = do(rootClient, "GET", "/records?from=0", "", 404)
+	require.Equal(t, "NotFound", got["code"])
+	require.Equal(t, float64(3), got["lowest"])
+	got = do(rootClient, "GET", "/records?from=3", "", 200)
+	require.Equal(t, 1, len(got["records"].([]interface{})))
+	got = do(rootClient, "GET", "/records?from=4", "", 200)
+	require.Equal(t, 0, len(got["records"].([]interface{})))
+	require.Equal(t, float64(4), got["next"])
+
+	got = do(nobodyClient, "POST", "/records", `{"value":"aGVsbG8="}`, 403)
+	require.Equal(t, "PermissionDenied", got["code"])
+	got = do(nobodyClient, "GET", fmt.Sprintf("/records/%d", 0), "", 403)
+	require.Equal(t, "PermissionDenied", got["code"])
+}
+
+func TestHTTPProduceOnFollower(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-follower-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	leader := httptest.NewServer(NewHTTPHandler(&Config{
+		CommitLog:     clog,
+		Authorizer:    authorizer,
+		Authenticator: rootAuthenticator{},
+	}))
+	defer leader.Close()
+	leaderURL, err := url.Parse(leader.URL)
+	require.NoError(t, err)
+	locator := restLocator{"leader:8400": leaderURL.Host}
+	newFollower := func(leader string) *httptest.Server {
+		return httptest.NewServer(NewHTTPHandler(&Config{
+			CommitLog:     &followerLog{CommitLog: clog, leader: leader},
+			Authorizer:    authorizer,
+			Authenticator: rootAuthenticator{},
+			RESTLocator:   locator,
+		}))
+	}
+
+	// the follower redirects to the leader, whose client sends the
+	// request again
+	follower := newFollower("leader:8400")
+	defer follower.Close()
+	res, err := http.Post(
+		follower.URL+"/records?encoding=text",
+		"application/json",
+		bytes.NewBufferString(`{"value":"hello"}`),
+	)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, leaderURL.Host, res.Request.URL.Host)
+	record, err := clog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), record.Value)
+
+	// without a known leader the produce fails
+	unknown := newFollower("elsewhere:8400")
+	defer unknown.Close()
+	res, err = http.Post(
+		unknown.URL+"/records",
+		"application/json",
+		bytes.NewBufferString(`{"value":"aGVsbG8="}`),
+	)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+// followerLog is the log of a follower, which fails appends as the leader
+// isn't it.
+type followerLog struct {
+	CommitLog
+	leader string
+}
+
+func (l *followerLog) AppendContext(
+	context.Context,
+	*api.Record,
+) (uint64, error) {
+	return 0, api.ErrNotLeader{Leader: l.leader}
+}
+
+// rootAuthenticator authenticates every client as root.
+type rootAuthenticator struct{}
+
+func (rootAuthenticator) Authenticate(auth.Credentials) (string, error) {
+	return "root", nil
+}
+
+// restLocator maps the RPC addresses of the servers to their REST APIs.
+type restLocator map[string]string
+
+func (l restLocator) RESTAddr(rpcAddr string) (string, bool) {
+	addr, ok := l[rpcAddr]
+	return addr, ok
+}
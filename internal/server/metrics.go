@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+var (
+	producedRecords = stats.Int64(
+		"server/produced_records",
+		"Number of records received in produce requests",
+		stats.UnitDimensionless,
+	)
+	producedBytes = stats.Int64(
+		"server/produced_bytes",
+		"Size of the records received in produce requests",
+		stats.UnitBytes,
+	)
+	consumedRecords = stats.Int64(
+		"server/consumed_records",
+		"Number of records sent in consume responses",
+		stats.UnitDimensionless,
+	)
+	consumedBytes = stats.Int64(
+		"server/consumed_bytes",
+		"Size of the records sent in consume responses",
+		stats.UnitBytes,
+	)
+	throttledRequests = stats.Int64(
+		"server/throttled_requests",
+		"Number of requests failed or delayed for exceeding quotas",
+		stats.UnitDimensionless,
+	)
+)
+
+// Views are the views of the server's measures, registered with the
+// OpenCensus gRPC views by NewGRPCServer.
+var Views = []*view.View{
+	{
+		Name:        producedRecords.Name(),
+		Description: producedRecords.Description(),
+		Measure:     producedRecords,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        producedBytes.Name(),
+		Description: producedBytes.Description(),
+		Measure:     producedBytes,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        consumedRecords.Name(),
+		Description: consumedRecords.Description(),
+		Measure:     consumedRecords,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        consumedBytes.Name(),
+		Description: consumedBytes.Description(),
+		Measure:     consumedBytes,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        throttledRequests.Name(),
+		Description: throttledRequests.Description(),
+		Measure:     throttledRequests,
+		Aggregation: view.Count(),
+	},
+}
+
+// recordMessage records the records carried by a produce request or a
+// consume response.
+func recordMessage(ctx context.Context, m interface{}) {
+	switch m := m.(type) {
+	case *api.ProduceRequest:
+		stats.Record(ctx,
+			producedRecords.M(1),
+			producedBytes.M(int64(proto.Size(m.Record))),
+		)
+	case *api.ConsumeResponse:
+		stats.Record(ctx,
+			consumedRecords.M(1),
+			consumedBytes.M(int64(proto.Size(m.Record))),
+		)
+	}
+}
+
+// metricsUnaryInterceptor records the records produced and consumed by unary
+// calls.
+func metricsUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	recordMessage(ctx, req)
+	res, err := handler(ctx, req)
+	if err == nil {
+		recordMessage(ctx, res)
+	}
+	return res, err
+}
+
+// metricsStreamInterceptor records the records produced and consumed by
+// streams as their messages are received and sent.
+func metricsStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &metricsServerStream{ServerStream: stream})
+}
+
+// metricsServerStream records the messages of the stream it wraps.
+type metricsServerStream struct {
+	grpc.ServerStream
+}
+
+func (s *metricsServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		recordMessage(s.Context(), m)
+	}
+	return err
+}
+
+func (s *metricsServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		recordMessage(s.Context(), m)
+	}
+	return err
+}
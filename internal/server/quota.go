@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/quota"
+)
+
+// Quotas limit the rates subjects produce and consume at. Produce and Consume
+// take from the subject's quota, returning zero if it may go ahead, or how
+// long it must wait until it may without taking anything. Consumed takes the
+// bytes of a read already done, even if it exceeds the quota.
+type Quotas interface {
+	Produce(subject string, records, bytes int64) time.Duration
+	Consume(subject string, bytes int64) time.Duration
+	Consumed(subject string, bytes int64)
+}
+
+// takeMessage takes the records carried by a produce request or a consume
+// response from the subject's quota, returning how long the subject must
+// wait if it has exceeded it.
+func takeMessage(quotas Quotas, subject string, m interface{}) time.Duration {
+	switch m := m.(type) {
+	case *api.ProduceRequest:
+		return quotas.Produce(subject, 1, int64(proto.Size(m.Record)))
+	case *api.ConsumeResponse:
+		return quotas.Consume(subject, int64(proto.Size(m.Record)))
+	}
+	return 0
+}
+
+// authorizeMessage authorizes the subject to produce or consume the records
+// of the request, so the subjects that may not don't take from their quotas.
+func authorizeMessage(config *Config, subject string, m interface{}) error {
+	var action string
+	switch m.(type) {
+	case *api.ProduceRequest:
+		action = produceAction
+	case *api.ConsumeRequest:
+		action = consumeAction
+	default:
+		return nil
+	}
+	return config.Authorizer.Authorize(
+		subject,
+		auth.TopicObject(config.Topic),
+		action,
+	)
+}
+
+// quotaUnaryInterceptor authorizes the produce and consume calls, then fails
+// those of the subjects that have exceeded their quotas with
+// ResourceExhausted, before they're handled.
+func quotaUnaryInterceptor(config *Config) grpc.UnaryServerInterceptor {
+	quotas := config.Quotas
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := authorizeMessage(config, subject(ctx), req); err != nil {
+			return nil, err
+		}
+		if _, ok := req.(*api.ConsumeRequest); ok {
+			return consumeUnary(ctx, quotas, req, handler)
+		}
+		if wait := takeMessage(quotas, subject(ctx), req); wait > 0 {
+			return nil, quotaExceeded(ctx, subject(ctx), produceAction, wait)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// consumeUnary reads the record if the subject's consume quota isn't in debt,
+// then takes the record's bytes, which are only known once it's read. A read
+// may take the quota into debt, failing the subject's reads until it refills,
+// rather than being read and failed.
+func consumeUnary(
+	ctx context.Context,
+	quotas Quotas,
+	req interface{},
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if wait := quotas.Consume(subject(ctx), 0); wait > 0 {
+		return nil, quotaExceeded(ctx, subject(ctx), consumeAction, wait)
+	}
+	res, err := handler(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	if res, ok := res.(*api.ConsumeResponse); ok {
+		quotas.Consumed(subject(ctx), int64(proto.Size(res.Record)))
+	}
+	return res, nil
+}
+
+// quotaStreamInterceptor delays the records produced and consumed by the
+// streams of the subjects that have exceeded their quotas, until their quotas
+// allow them. The records produced are authorized before they wait.
+func quotaStreamInterceptor(config *Config) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &quotaServerStream{
+			ServerStream: stream,
+			config:       config,
+			quotas:       config.Quotas,
+		})
+	}
+}
+
+// quotaServerStream delays the messages of the stream it wraps by the
+// subject's quotas.
+type quotaServerStream struct {
+	grpc.ServerStream
+	config *Config
+	quotas Quotas
+}
+
+func (s *quotaServerStream) SendMsg(m interface{}) error {
+	if err := s.wait(m); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *quotaServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	err := authorizeMessage(s.config, subject(s.Context()), m)
+	if err != nil {
+		return err
+	}
+	return s.wait(m)
+}
+
+func (s *quotaServerStream) wait(m interface{}) error {
+	ctx := s.Context()
+	waited, err := quota.Wait(ctx, func() time.Duration {
+		return takeMessage(s.quotas, subject(ctx), m)
+	})
+	if waited > 0 {
+		stats.Record(ctx, throttledRequests.M(1))
+	}
+	return err
+}
+
+// quotaExceeded returns the error of a request of the subject exceeding its
+// quota for the action. Its status details how long to wait before retrying
+// with a RetryInfo, and the exceeded quota with a QuotaFailure.
+func quotaExceeded(
+	ctx context.Context,
+	subject, action string,
+	wait time.Duration,
+) error {
+	stats.Record(ctx, throttledRequests.M(1))
+	msg := fmt.Sprintf(
+		"%q exceeded its %s quota, retry in %s",
+		subject,
+		action,
+		wait,
+	)
+	st := status.New(codes.ResourceExhausted, msg)
+	detailed, err := st.WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)},
+		&errdetails.QuotaFailure{
+			Violations: []*errdetails.QuotaFailure_Violation{{
+				Subject:     subject,
+				Description: action + " rate exceeded",
+			}},
+		},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// retryDelay returns the delay of the RetryInfo detail of the error's status,
+// zero if it has none.
+func retryDelay(err error) time.Duration {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return 0
+}
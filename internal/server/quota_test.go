@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/log"
+	"github.com/pouriaamini/proglog/internal/quota"
+)
+
+func TestQuotas(t *testing.T) {
+	// root may produce a record and consume a byte a second, as may nobody
+	path := writeQuotas(t, "root, , 1, 1\n*, , 1, 1\n")
+	quotas, err := quota.New(path)
+	require.NoError(t, err)
+	client, nobodyClient, _, teardown := setupTest(t, func(c *Config) {
+		c.Quotas = quotas
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		return err
+	}
+	// subjects that may not produce don't take from their quotas
+	for i := 0; i < 2; i++ {
+		_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+
+	require.NoError(t, produce())
+	err = produce()
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 2)
+	retry, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.InDelta(t,
+		time.Second,
+		retry.RetryDelay.AsDuration(),
+		float64(100*time.Millisecond),
+	)
+	failure, ok := st.Details()[1].(*errdetails.QuotaFailure)
+	require.True(t, ok)
+	require.Equal(t, "root", failure.Violations[0].Subject)
+
+	// a read goes over the consume quota, failing the next before it reads,
+	// so even reads past the end fail with the quota
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 100})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// streams are delayed rather than failed: at 20 records a second, 25
+	// records take over a second from the emptied bucket
+	require.NoError(t, os.WriteFile(path, []byte("root, , 20, \n"), 0644))
+	require.NoError(t, quotas.Reload())
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		}))
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestHTTPQuotas(t *testing.T) {
+	quotas, err := quota.New(writeQuotas(t, "*, , 1, \n"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(NewHTTPHandler(&Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+		Quotas:     quotas,
+	}))
+	srv.TLS = serverTLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	produce := func() *http.Response {
+		res, err := client.Post(
+			srv.URL+"/records",
+			"application/json",
+			bytes.NewBufferString(`{"value":"aGVsbG8="}`),
+		)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	require.Equal(t, http.StatusCreated, produce().StatusCode)
+	res := produce()
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Retry-After"))
+}
+
+// writeQuotas writes the quotas to a file in a temporary directory and
+// returns its path.
+func writeQuotas(t *testing.T, quotas string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotas.csv")
+	require.NoError(t, os.WriteFile(path, []byte(quotas), 0644))
+	return path
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+)
+
+var _ api.RegistryServer = (*registryServer)(nil)
+
+// Schemas registers the schemas of the records' values and validates the
+// records against them.
+type Schemas interface {
+	RegisterSchema(context.Context, *api.RegisterSchemaRequest) (*api.Schema, error)
+	GetSchema(*api.GetSchemaRequest) (*api.Schema, error)
+	SetCompatibility(context.Context, *api.SetCompatibilityRequest) (api.Compatibility, error)
+	GetCompatibility(subject string) api.Compatibility
+	ValidateRecord(subject string, record *api.Record) error
+}
+
+// registryServer implements the api.RegistryServer interface using gRPC.
+type registryServer struct {
+	api.UnimplementedRegistryServer
+	*Config
+}
+
+// newRegistryServer creates a new registry server with the specified
+// configuration.
+func newRegistryServer(config *Config) (srv *registryServer, err error) {
+	srv = &registryServer{
+		Config: config,
+	}
+	return srv, nil
+}
+
+// RegisterSchema registers the schema as the next version of its subject.
+func (s *registryServer) RegisterSchema(
+	ctx context.Context, req *api.RegisterSchemaRequest,
+) (*api.RegisterSchemaResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		auth.SchemaObject(req.Subject),
+		auth.RegisterSchemaAction,
+	); err != nil {
+		return nil, err
+	}
+	schema, err := s.Schemas.RegisterSchema(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RegisterSchemaResponse{Schema: schema}, nil
+}
+
+// GetSchema gets the schema with the ID, or the version of the subject.
+func (s *registryServer) GetSchema(
+	ctx context.Context, req *api.GetSchemaRequest,
+) (*api.GetSchemaResponse, error) {
+	if req.Id == 0 {
+		if err := s.authorizeRead(ctx, req.Subject); err != nil {
+			return nil, err
+		}
+	}
+	schema, err := s.Schemas.GetSchema(req)
+	if err != nil {
+		return nil, err
+	}
+	// the subject of the schema with the ID is known once it's found
+	if req.Id != 0 {
+		if err := s.authorizeRead(ctx, schema.Subject); err != nil {
+			return nil, err
+		}
+	}
+	return &api.GetSchemaResponse{Schema: schema}, nil
+}
+
+// SetCompatibility sets the compatibility the subject's new versions are
+// checked with, which registering them allows setting.
+func (s *registryServer) SetCompatibility(
+	ctx context.Context, req *api.SetCompatibilityRequest,
+) (*api.SetCompatibilityResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		auth.SchemaObject(req.Subject),
+		auth.RegisterSchemaAction,
+	); err != nil {
+		return nil, err
+	}
+	compatibility, err := s.Schemas.SetCompatibility(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &api.SetCompatibilityResponse{Compatibility: compatibility}, nil
+}
+
+// GetCompatibility gets the compatibility the subject's new versions are
+// checked with.
+func (s *registryServer) GetCompatibility(
+	ctx context.Context, req *api.GetCompatibilityRequest,
+) (*api.GetCompatibilityResponse, error) {
+	if err := s.authorizeRead(ctx, req.Subject); err != nil {
+		return nil, err
+	}
+	return &api.GetCompatibilityResponse{
+		Compatibility: s.Schemas.GetCompatibility(req.Subject),
+	}, nil
+}
+
+// authorizeRead authorizes the subject of the context to read the schemas
+// of the schema subject.
+func (s *registryServer) authorizeRead(ctx context.Context, subj string) error {
+	return s.Authorizer.Authorize(
+		subject(ctx),
+		auth.SchemaObject(subj),
+		auth.ReadSchemaAction,
+	)
+}
+
+// validateSchema checks the record has a schema of the config's schema
+// subject and validates against it, if the config has one.
+func validateSchema(config *Config, record *api.Record) error {
+	if config.SchemaSubject == "" {
+		return nil
+	}
+	return config.Schemas.ValidateRecord(config.SchemaSubject, record)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/log"
+	"github.com/pouriaamini/proglog/internal/schema"
+)
+
+func TestRegistry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	newConn := func(crtPath, keyPath string) *grpc.ClientConn {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: crtPath,
+			KeyFile:  keyPath,
+			CAFile:   config.CAFile,
+			Server:   false,
+		})
+		require.NoError(t, err)
+		conn, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	rootConn := newConn(config.RootClientCertFile, config.RootClientKeyFile)
+	registry := api.NewRegistryClient(rootConn)
+	client := api.NewLogClient(rootConn)
+	nobody := api.NewRegistryClient(newConn(
+		config.NobodyClientCertFile,
+		config.NobodyClientKeyFile,
+	))
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	server, err := NewGRPCServer(&Config{
+		CommitLog:     clog,
+		Authorizer:    authorizer,
+		Schemas:       schemas{schema.NewRegistry()},
+		SchemaSubject: "users",
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	defer server.Stop()
+
+	ctx := context.Background()
+
+	registered, err := registry.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Type:       api.SchemaType_JSON_SCHEMA,
+		Definition: []byte(`{"type": "object", "required": ["name"]}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), registered.Schema.Id)
+
+	got, err := registry.GetSchema(ctx, &api.GetSchemaRequest{Id: 1})
+	require.NoError(t, err)
+	require.Equal(t, "users", got.Schema.Subject)
+	_, err = registry.GetSchema(ctx, &api.GetSchemaRequest{
+		Subject: "users",
+		Version: 2,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = registry.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Definition: []byte(`{}`),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = registry.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:       "users",
+		Definition:    []byte(`{"type": "array"}`),
+		Compatibility: api.Compatibility_BACKWARD,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the subject's compatibility checks every new version
+	set, err := registry.SetCompatibility(ctx, &api.SetCompatibilityRequest{
+		Subject:       "users",
+		Compatibility: api.Compatibility_BACKWARD,
+	})
+	require.NoError(t, err)
+	require.Equal(t, api.Compatibility_BACKWARD, set.Compatibility)
+	compatibility, err := registry.GetCompatibility(ctx, &api.GetCompatibilityRequest{
+		Subject: "users",
+	})
+	require.NoError(t, err)
+	require.Equal(t, api.Compatibility_BACKWARD, compatibility.Compatibility)
+	_, err = registry.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Definition: []byte(`{"type": "array"}`),
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = registry.SetCompatibility(ctx, &api.SetCompatibilityRequest{
+		Compatibility: api.Compatibility_FULL,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = nobody.SetCompatibility(ctx, &api.SetCompatibilityRequest{
+		Subject: "users",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.GetSchema(ctx, &api.GetSchemaRequest{Id: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.RegisterSchema(ctx, &api.RegisterSchemaRequest{
+		Subject:    "users",
+		Definition: []byte(`{}`),
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the log takes only the records with valid values of the subject's
+	// schemas
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{SchemaId: 1, Value: []byte(`{"name": "pouria"}`)},
+	})
+	require.NoError(t, err)
+	for _, record := range []*api.Record{
+		{Value: []byte(`{"name": "pouria"}`)},
+		{SchemaId: 1, Value: []byte(`{}`)},
+	} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		st := status.Convert(err)
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Len(t, st.Details(), 1)
+		_, ok := st.Details()[0].(*errdetails.BadRequest)
+		require.True(t, ok)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), consume.Record.SchemaId)
+}
+
+// schemas implements Schemas with a registry, as a single server would
+// after applying the registrations.
+type schemas struct {
+	*schema.Registry
+}
+
+func (s schemas) RegisterSchema(
+	_ context.Context,
+	req *api.RegisterSchemaRequest,
+) (*api.Schema, error) {
+	return s.Register(req)
+}
+
+func (s schemas) GetSchema(req *api.GetSchemaRequest) (*api.Schema, error) {
+	if req.Id != 0 {
+		return s.Get(req.Id)
+	}
+	return s.Version(req.Subject, req.Version)
+}
+
+func (s schemas) SetCompatibility(
+	_ context.Context,
+	req *api.SetCompatibilityRequest,
+) (api.Compatibility, error) {
+	return req.Compatibility, s.Registry.SetCompatibility(
+		req.Subject,
+		req.Compatibility,
+	)
+}
+
+func (s schemas) GetCompatibility(subject string) api.Compatibility {
+	compatibility, _ := s.Compatibility(subject)
+	return compatibility
+}
+
+func (s schemas) ValidateRecord(subject string, record *api.Record) error {
+	return s.Validate(subject, record)
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -14,7 +17,6 @@ import (
 
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
-	"go.opencensus.io/trace"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -23,6 +25,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
@@ -31,16 +34,58 @@ import (
 type Config struct {
 	// CommitLog is the commit log to be used by the server.
 	CommitLog CommitLog
+	// Topic is the name of the log, whose topic object the ACL policy
+	// grants producing to and consuming from.
+	Topic string
 	// Authorizer is the authorizer to be used by the server.
 	Authorizer Authorizer
+	// Authenticator authenticates the clients as the subjects they're
+	// authorized as. If it's nil, clients are authenticated by their
+	// verified certificates.
+	Authenticator Authenticator
+	// Quotas limit the rates subjects produce and consume at, if set.
+	Quotas Quotas
+	// MaxRecordBytes is the size of the largest record clients may produce,
+	// which doesn't limit it if it's 0.
+	MaxRecordBytes uint64
+	// Schemas registers the schemas of the records' values for the registry
+	// service, which is only registered when it's set.
+	Schemas Schemas
+	// SchemaSubject is the subject of the schemas the records produced to
+	// the topic must have, and their values validate against, if it's set.
+	SchemaSubject string
+	// RESTLocator locates the leader's REST API, which the REST produces a
+	// follower receives are redirected to. If it's nil, or doesn't know the
+	// leader's, they fail with Unavailable.
+	RESTLocator RESTLocator
 	// GetServerer is the server getter to be used by the server.
 	GetServerer GetServerer
+	// ServerWatcher watches the servers for WatchServers, which fails with
+	// Unimplemented if it's nil.
+	ServerWatcher ServerWatcher
+	// MaxServerWatches is the most WatchServers streams served at once, as
+	// clients open them without authenticating. The ones past it fail with
+	// ResourceExhausted, and resolvers poll GetServers instead. Zero doesn't
+	// limit them.
+	MaxServerWatches int
+	// Administrator operates the cluster for the admin service, which is
+	// only registered when it's set.
+	Administrator Administrator
+	// Keyring manages the gossip keys of the cluster for the admin service.
+	// If it's nil, the gossip key calls fail with Unimplemented.
+	Keyring Keyring
+	// Autopilot reports the health of the servers for the admin service. If
+	// it's nil, GetServerHealth fails with Unimplemented.
+	Autopilot Autopilot
+	// Health is the health server reporting the status of the server and
+	// its services. If it's nil, the server reports itself as serving
+	// regardless of the state of the log.
+	Health *health.Server
 }
 
 const (
-	objectWildcard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	produceAction = "produce"
+	consumeAction = "consume"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -50,9 +95,19 @@ var _ api.LogServer = (*grpcServer)(nil)
 //
 // The server is configured with logging, tracing, and authentication middleware.
 // The logging middleware uses zap to log incoming requests and outgoing responses.
-// The tracing middleware uses OpenCensus to trace incoming requests and outgoing responses.
-// The authentication middleware uses the Authorizer interface provided in the Config
-// to authenticate incoming requests.
+// The tracing middleware uses OpenCensus to trace incoming requests and outgoing responses,
+// sampled and exported as configured by the caller with the tracing package.
+// The metrics middleware uses OpenCensus to count the records produced and consumed.
+// The authentication middleware uses the Authenticator provided in the Config to
+// authenticate incoming requests, failing them with Unauthenticated if it can't.
+// The validation middleware fails malformed requests and records larger than the
+// Config's MaxRecordBytes with InvalidArgument, before they reach the log.
+// The registry service, if the Config has Schemas, registers the schemas of the
+// records, and the server rejects the records produced without a valid one of
+// the Config's SchemaSubject, if it's set.
+// The quota middleware, if the Config has Quotas, fails the produce and consume
+// calls of subjects over their quotas with ResourceExhausted and delays their
+// streams.
 //
 // If an error occurs during server registration or initialization, it is returned along
 // with a nil server.
@@ -69,28 +124,59 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 		),
 	}
 
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 	err := view.Register(ocgrpc.DefaultServerViews...)
 	if err != nil {
 		return nil, err
 	}
+	if err = view.Register(Views...); err != nil {
+		return nil, err
+	}
 
-	opts = append(opts, grpc.StreamInterceptor(
-		grpc_middleware.ChainStreamServer(
-			grpc_ctxtags.StreamServerInterceptor(),
-			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+	authenticator := config.Authenticator
+	if authenticator == nil {
+		authenticator = auth.TLS{}
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(authenticate(authenticator)),
+		validateStreamInterceptor(config.MaxRecordBytes),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
 		grpc_ctxtags.UnaryServerInterceptor(),
 		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)),
+		grpc_auth.UnaryServerInterceptor(authenticate(authenticator)),
+		validateUnaryInterceptor(config.MaxRecordBytes),
+	}
+	// quotas apply to the valid requests of authenticated subjects, before
+	// the metrics count the records they let through
+	if config.Quotas != nil {
+		streamInterceptors = append(
+			streamInterceptors,
+			quotaStreamInterceptor(config),
+		)
+		unaryInterceptors = append(
+			unaryInterceptors,
+			quotaUnaryInterceptor(config),
+		)
+	}
+	opts = append(opts,
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
+			append(streamInterceptors, metricsStreamInterceptor)...,
+		)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			append(unaryInterceptors, metricsUnaryInterceptor)...,
+		)),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		grpc.MaxRecvMsgSize(int(maxRequestBytes(config.MaxRecordBytes))),
 	)
 	gsrv := grpc.NewServer(opts...)
 
-	hsrv := health.NewServer()
-	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	hsrv := config.Health
+	if hsrv == nil {
+		hsrv = health.NewServer()
+		hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
 	healthpb.RegisterHealthServer(gsrv, hsrv)
 
 	srv, err := newgrpcServer(config)
@@ -98,6 +184,22 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+
+	if config.Schemas != nil {
+		rsrv, err := newRegistryServer(config)
+		if err != nil {
+			return nil, err
+		}
+		api.RegisterRegistryServer(gsrv, rsrv)
+	}
+
+	if config.Administrator != nil {
+		asrv, err := newAdminServer(config)
+		if err != nil {
+			return nil, err
+		}
+		api.RegisterAdminServer(gsrv, asrv)
+	}
 	return gsrv, nil
 }
 
@@ -105,6 +207,9 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// watches holds a token for each WatchServers stream served, if they're
+	// limited.
+	watches chan struct{}
 }
 
 // GetServers gets all the servers.
@@ -124,10 +229,53 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
-// CommitLog is an interface for committing logs.
+// WatchServers streams the servers, and again whenever they or the leader
+// change, so clients follow leadership changes as they happen.
+func (s *grpcServer) WatchServers(
+	req *api.WatchServersRequest,
+	stream api.Log_WatchServersServer,
+) error {
+	if s.ServerWatcher == nil {
+		return status.Error(codes.Unimplemented, "servers aren't watched")
+	}
+	if s.watches != nil {
+		select {
+		case s.watches <- struct{}{}:
+			defer func() { <-s.watches }()
+		default:
+			return status.Error(
+				codes.ResourceExhausted,
+				"too many watches of the servers, poll them instead",
+			)
+		}
+	}
+	return s.ServerWatcher.WatchServers(
+		stream.Context(),
+		func(servers []*api.Server) error {
+			return stream.Send(&api.WatchServersResponse{Servers: servers})
+		},
+	)
+}
+
+// ServerWatcher is an interface for watching servers.
+type ServerWatcher interface {
+	// WatchServers calls fn with the servers, and again whenever they or
+	// the leader change, until the context is done or fn fails.
+	WatchServers(ctx context.Context, fn func([]*api.Server) error) error
+}
+
+// RESTLocator locates the REST APIs of the servers.
+type RESTLocator interface {
+	// RESTAddr returns the address of the REST API of the server with the
+	// RPC address, if it knows it.
+	RESTAddr(rpcAddr string) (string, bool)
+}
+
+// CommitLog is an interface for committing logs. The context carries the
+// span of the request, so the log traces its work as part of it.
 type CommitLog interface {
-	Append(*api.Record) (uint64, error)
-	Read(uint64) (*api.Record, error)
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
 }
 
 // Authorizer is an interface for authorizing.
@@ -135,11 +283,19 @@ type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// Authenticator is an interface for authenticating.
+type Authenticator interface {
+	Authenticate(auth.Credentials) (string, error)
+}
+
 // newgrpcServer creates a new gRPC server with the specified configuration.
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		Config: config,
 	}
+	if config.MaxServerWatches > 0 {
+		srv.watches = make(chan struct{}, config.MaxServerWatches)
+	}
 	return srv, nil
 }
 
@@ -147,12 +303,15 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
-		objectWildcard,
+		auth.TopicObject(s.Topic),
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := validateSchema(s.Config, req.Record); err != nil {
+		return nil, err
+	}
+	offset, err := s.CommitLog.AppendContext(ctx, req.Record)
 	if err != nil {
 		return nil, err
 	}
@@ -163,12 +322,12 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
-		objectWildcard,
+		auth.TopicObject(s.Topic),
 		consumeAction,
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	record, err := s.CommitLog.ReadContext(ctx, req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -192,7 +351,9 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
-// ConsumeStream retrieves records from the commit log.
+// ConsumeStream retrieves records from the commit log, waiting for the ones
+// not appended yet. It fails with ErrOffsetOutOfRange once it reaches an
+// offset retention removed, which the stream would never get.
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
 	for {
 		select {
@@ -200,9 +361,12 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			return nil
 		default:
 			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
+			switch err := err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				if err.Truncated() {
+					return err
+				}
 				continue
 			default:
 				return err
@@ -215,30 +379,63 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 	}
 }
 
-// authenticate authenticates the peer.
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(
-			codes.Unknown,
-			"couldn't find peer info",
-		).Err()
-	}
+// anonymousMethod returns whether clients call the method without
+// authenticating: the health service, which load balancers and orchestrators
+// call without credentials, and GetServers and WatchServers, which gRPC
+// resolvers call with only the connection's credentials.
+func anonymousMethod(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.Health/") ||
+		method == "/log.v1.Log/GetServers" ||
+		method == "/log.v1.Log/WatchServers"
+}
 
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+// authenticate returns the function authenticating the peer with the
+// authenticator, from its verified certificate or the bearer token in the
+// authorization metadata, and adding its subject to the context.
+func authenticate(authenticator Authenticator) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		if method, ok := grpc.Method(ctx); ok && anonymousMethod(method) {
+			return ctx, nil
+		}
+		var creds auth.Credentials
+		if peer, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo); ok {
+				creds.TLS = &tlsInfo.State
+			}
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			if token, ok := bearerToken(value); ok {
+				creds.Token = token
+				break
+			}
+		}
+		subject, err := authenticator.Authenticate(creds)
+		if err != nil {
+			return ctx, status.New(
+				codes.Unauthenticated,
+				fmt.Sprintf("failed to authenticate: %v", err),
+			).Err()
+		}
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
 	}
+}
 
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-
-	return ctx, nil
+// bearerToken returns the token of the authorization value, if it has the
+// bearer scheme.
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
 }
 
-// subject returns the subject of the context.
+// subject returns the subject of the context, empty if it has none.
 func subject(ctx context.Context) string {
-	return ctx.Value(subjectContextKey{}).(string)
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
 }
 
 // subjectContextKey is a key for the subject in the context.
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"go.opencensus.io/examples/exporter"
+	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"net"
 	"os"
@@ -45,6 +46,7 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
+		"consume stream of truncated offset fails":           testConsumeStreamTruncated,
 		"unauthorized fails":                                 testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
@@ -115,7 +117,8 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
 
 	var telemetryExporter *exporter.LogExporter
 	if *debug {
@@ -135,6 +138,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		require.NoError(t, err)
 		err = telemetryExporter.Start()
 		require.NoError(t, err)
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 	}
 
 	cfg = &Config{
@@ -218,6 +222,34 @@ func testConsumePastBoundary(
 	}
 }
 
+func testConsumeStreamTruncated(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	clog := config.CommitLog.(*log.Log)
+	require.NoError(t, clog.Truncate(50))
+	lowest, err := clog.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+
+	// the stream waits for the records not appended yet, but not for the
+	// ones retention removed
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+}
+
 func testProduceConsumeStream(
 	t *testing.T,
 	client api.LogClient,
@@ -299,3 +331,47 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func TestMaxServerWatches(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.ServerWatcher = watcher{}
+		c.MaxServerWatches = 1
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := func() (api.Log_WatchServersClient, error) {
+		stream, err := client.WatchServers(ctx, &api.WatchServersRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		return stream, err
+	}
+	_, err := watch()
+	require.NoError(t, err)
+	_, err = watch()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// ending the watches makes room for another
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	require.Eventually(t, func() bool {
+		_, err := watch()
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+// watcher sends the servers once, then waits for the watch to end.
+type watcher struct{}
+
+func (watcher) WatchServers(
+	ctx context.Context,
+	fn func([]*api.Server) error,
+) error {
+	if err := fn([]*api.Server{{Id: "0", IsLeader: true}}); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/quota"
+)
+
+var (
+	// tailPollInterval is how often a tail at the end of the log checks for
+	// new records.
+	tailPollInterval = 100 * time.Millisecond
+	// heartbeatInterval is how long a tail waits for records before it sends
+	// a heartbeat, so proxies keep the connection open and clients can tell
+	// it's alive.
+	heartbeatInterval = 15 * time.Second
+)
+
+// writeWait bounds a write to a WebSocket.
+const writeWait = 10 * time.Second
+
+// maxCloseReasonBytes is the longest reason a WebSocket close frame holds.
+const maxCloseReasonBytes = 123
+
+var upgrader = websocket.Upgrader{}
+
+// handleEvents tails the log as Server-Sent Events. Each record is a record
+// event whose ID is its offset and whose data is its JSON, so an EventSource
+// resumes after the last record it got when it reconnects. Heartbeats are
+// comments, and an error ends the stream with an error event.
+func (s *httpServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	encoding, from, err := s.tailRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, status.Error(codes.Internal, "streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = s.tail(r.Context(), r, encoding, from, func(record httpRecord) error {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(
+			w,
+			"id: %d\nevent: record\ndata: %s\n\n",
+			record.Offset,
+			b,
+		)
+		flusher.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(w, ": heartbeat\n\n")
+		flusher.Flush()
+		return err
+	})
+	if err != nil {
+		_, body := errorBody(err)
+		b, _ := json.Marshal(body)
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+		flusher.Flush()
+	}
+}
+
+// handleSocket tails the log over a WebSocket, sending each record's JSON as
+// a text message and pinging the client as a heartbeat. An error closes the
+// socket with its message as the reason, followed by the log's lowest offset
+// if retention removed the records to tail.
+func (s *httpServer) handleSocket(w http.ResponseWriter, r *http.Request) {
+	encoding, from, err := s.tailRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has responded with the error
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// reading handles the client's control messages and notices it leaving
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = s.tail(ctx, r, encoding, from, func(record httpRecord) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteJSON(record)
+	}, func() error {
+		return conn.WriteControl(
+			websocket.PingMessage,
+			nil,
+			time.Now().Add(writeWait),
+		)
+	})
+	code, reason := websocket.CloseNormalClosure, ""
+	if err != nil {
+		code = websocket.CloseInternalServerErr
+		if status.Code(err) == codes.PermissionDenied {
+			code = websocket.ClosePolicyViolation
+		}
+		reason = status.Convert(err).Message()
+		var outOfRange api.ErrOffsetOutOfRange
+		if errors.As(err, &outOfRange) {
+			reason = fmt.Sprintf("%s, lowest %d", reason, outOfRange.Lowest)
+		}
+		if len(reason) > maxCloseReasonBytes {
+			reason = reason[:maxCloseReasonBytes]
+		}
+	}
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait),
+	)
+}
+
+// tailRequest returns the value encoding and the offset to tail from of the
+// request, and authorizes it to consume. The offset follows the one in the
+// Last-Event-ID header if it's set, as the client resumes after the last
+// record it got, and is the from query parameter otherwise.
+func (s *httpServer) tailRequest(r *http.Request) (string, uint64, error) {
+	encoding, err := valueEncoding(r)
+	if err != nil {
+		return "", 0, err
+	}
+	var from uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return "", 0, status.Errorf(
+				codes.InvalidArgument,
+				"invalid Last-Event-ID: %s",
+				id,
+			)
+		}
+		from = last + 1
+	} else if from, err = uintParam(r.URL.Query().Get("from"), 0); err != nil {
+		return "", 0, err
+	}
+	if _, err = s.authorize(r, consumeAction); err != nil {
+		return "", 0, err
+	}
+	return encoding, from, nil
+}
+
+// tail sends the records of the log from the offset as they're appended
+// until the context is done or sending fails, authorizing each read and
+// delaying records by the subject's consume quota like the gRPC server's
+// ConsumeStream. It sends a heartbeat whenever no record comes for
+// heartbeatInterval, and fails if retention removes the offset's record, as
+// it would never come.
+func (s *httpServer) tail(
+	ctx context.Context,
+	r *http.Request,
+	encoding string,
+	from uint64,
+	send func(httpRecord) error,
+	heartbeat func() error,
+) error {
+	poll := time.NewTicker(tailPollInterval)
+	defer poll.Stop()
+	heartbeats := time.NewTicker(heartbeatInterval)
+	defer heartbeats.Stop()
+	for off := from; ; {
+		subject, err := s.authorize(r, consumeAction)
+		if err != nil {
+			return err
+		}
+		record, err := s.CommitLog.ReadContext(ctx, off)
+		var outOfRange api.ErrOffsetOutOfRange
+		switch {
+		case err == nil:
+			if err = s.waitConsume(ctx, subject, record); err != nil {
+				// the client left while waiting
+				return nil
+			}
+			encoded, err := encodeRecord(encoding, record)
+			if err != nil {
+				return err
+			}
+			if err = send(encoded); err != nil {
+				return err
+			}
+			heartbeats.Reset(heartbeatInterval)
+			off++
+			continue
+		case errors.As(err, &outOfRange) && !outOfRange.Truncated():
+		default:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeats.C:
+			if err = heartbeat(); err != nil {
+				return err
+			}
+		case <-poll.C:
+		}
+	}
+}
+
+// waitConsume waits until the subject's consume quota allows the record, as
+// large as the log stores it, failing only if the context is done first.
+func (s *httpServer) waitConsume(
+	ctx context.Context,
+	subject string,
+	record *api.Record,
+) error {
+	if s.Quotas == nil {
+		return nil
+	}
+	waited, err := quota.Wait(ctx, func() time.Duration {
+		return s.Quotas.Consume(subject, int64(proto.Size(record)))
+	})
+	if waited > 0 {
+		stats.Record(ctx, throttledRequests.M(1))
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/auth"
+	"github.com/pouriaamini/proglog/internal/config"
+	"github.com/pouriaamini/proglog/internal/log"
+)
+
+func TestTail(t *testing.T) {
+	defer func(interval time.Duration) {
+		heartbeatInterval = interval
+	}(heartbeatInterval)
+	heartbeatInterval = 50 * time.Millisecond
+
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		srv *httptest.Server,
+		clog *log.Log,
+		rootTLSConfig, nobodyTLSConfig *tls.Config,
+	){
+		"server-sent events resume after the last event id": testEvents,
+		"websocket tails appended records":                  testSocket,
+		"unauthorized tail fails":                           testTailUnauthorized,
+		"tail from removed records fails":                   testTailTruncated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "tail-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			// segments of three records, so retention can remove
+			// the first
+			c := log.Config{}
+			c.Segment.MaxIndexBytes = 3 * 12
+			clog, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer clog.Close()
+
+			serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+				CertFile: config.ServerCertFile,
+				KeyFile:  config.ServerKeyFile,
+				CAFile:   config.CAFile,
+				Server:   true,
+			})
+			require.NoError(t, err)
+			authorizer, err := auth.New(
+				config.ACLModelFile,
+				config.ACLPolicyFile,
+			)
+			require.NoError(t, err)
+			srv := httptest.NewUnstartedServer(NewHTTPHandler(&Config{
+				CommitLog:  clog,
+				Authorizer: authorizer,
+			}))
+			srv.TLS = serverTLSConfig
+			srv.StartTLS()
+			defer srv.Close()
+
+			clientTLSConfig := func(crtPath, keyPath string) *tls.Config {
+				tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+					CertFile:      crtPath,
+					KeyFile:       keyPath,
+					CAFile:        config.CAFile,
+					ServerAddress: "127.0.0.1",
+				})
+				require.NoError(t, err)
+				return tlsConfig
+			}
+			fn(t, srv, clog,
+				clientTLSConfig(
+					config.RootClientCertFile,
+					config.RootClientKeyFile,
+				),
+				clientTLSConfig(
+					config.NobodyClientCertFile,
+					config.NobodyClientKeyFile,
+				),
+			)
+		})
+	}
+}
+
+func testEvents(
+	t *testing.T,
+	srv *httptest.Server,
+	clog *log.Log,
+	tlsConfig, _ *tls.Config,
+) {
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := clog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		srv.URL+"/records/events?encoding=text",
+		nil,
+	)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(res.Body)
+	next := func() string {
+		require.True(t, lines.Scan())
+		return lines.Text()
+	}
+	for i, value := range []string{"second", "third"} {
+		require.Equal(t, fmt.Sprintf("id: %d", i+1), next())
+		require.Equal(t, "event: record", next())
+		require.Equal(t,
+			fmt.Sprintf(`data: {"offset":%d,"value":"%s"}`, i+1, value),
+			next(),
+		)
+		require.Equal(t, "", next())
+	}
+	// the tail waits at the end of the log, sending heartbeats
+	require.Equal(t, ": heartbeat", next())
+	require.Equal(t, "", next())
+	_, err = clog.Append(&api.Record{Value: []byte("fourth")})
+	require.NoError(t, err)
+	for {
+		if line := next(); line != "" && !strings.HasPrefix(line, ":") {
+			require.Equal(t, "id: 3", line)
+			break
+		}
+	}
+}
+
+func testSocket(
+	t *testing.T,
+	srv *httptest.Server,
+	clog *log.Log,
+	tlsConfig, _ *tls.Config,
+) {
+	_, err := clog.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+	pings := make(chan struct{}, 1)
+	conn, _, err := dialer.Dial(
+		"wss"+strings.TrimPrefix(srv.URL, "https")+
+			"/records/ws?from=0&encoding=text",
+		nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	var record httpRecord
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, uint64(0), record.Offset)
+	require.JSONEq(t, `"first"`, string(record.Value))
+
+	_, err = clog.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, uint64(1), record.Offset)
+	require.JSONEq(t, `"second"`, string(record.Value))
+
+	// reading handles the pings the server sends while the log's idle
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Fatal("didn't get a heartbeat")
+	}
+}
+
+func testTailUnauthorized(
+	t *testing.T,
+	srv *httptest.Server,
+	_ *log.Log,
+	_, tlsConfig *tls.Config,
+) {
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	res, err := client.Get(srv.URL + "/records/events")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+	_, res, err = dialer.Dial(
+		"wss"+strings.TrimPrefix(srv.URL, "https")+"/records/ws",
+		nil,
+	)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func testTailTruncated(
+	t *testing.T,
+	srv *httptest.Server,
+	clog *log.Log,
+	tlsConfig, _ *tls.Config,
+) {
+	for i := 0; i < 4; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Truncate(2))
+
+	// resuming after a removed record ends the stream with an error event,
+	// rather than waiting for the record forever
+	req, err := http.NewRequest(
+		http.MethodGet,
+		srv.URL+"/records/events",
+		nil,
+	)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t,
+		"event: error\n"+
+			`data: {"code":"NotFound","message":"offset out of range: 1",`+
+			`"lowest":3,"next":4}`+"\n\n",
+		string(b),
+	)
+
+	dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+	conn, _, err := dialer.Dial(
+		"wss"+strings.TrimPrefix(srv.URL, "https")+"/records/ws?from=0",
+		nil,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	require.Equal(t, "offset out of range: 0, lowest 3", closeErr.Text)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// defaultMaxRequestBytes bounds the requests of servers whose records fit
+// in it, as gRPC bounds its messages by default.
+const defaultMaxRequestBytes = 4 << 20
+
+// maxRequestBytes returns the size of the largest request a server takes:
+// twice the largest record, which the encodings of values in the HTTP API
+// may grow it to, and at least defaultMaxRequestBytes.
+func maxRequestBytes(maxRecordBytes uint64) int64 {
+	if maxRecordBytes == 0 || 2*maxRecordBytes <= defaultMaxRequestBytes {
+		return defaultMaxRequestBytes
+	}
+	return int64(2 * maxRecordBytes)
+}
+
+// validateRecord checks the record is there and isn't larger than max, when
+// max is set.
+func validateRecord(record *api.Record, max uint64) error {
+	if record == nil {
+		return api.ErrMissingRecord{}
+	}
+	if size := uint64(proto.Size(record)); max != 0 && size > max {
+		return api.ErrRecordTooLarge{Size: size, Max: max}
+	}
+	return nil
+}
+
+// validate checks the request is well formed, so the server rejects it
+// before it reaches the log and Raft.
+func validate(req interface{}, maxRecordBytes uint64) error {
+	switch req := req.(type) {
+	case *api.ProduceRequest:
+		return validateRecord(req.Record, maxRecordBytes)
+	case *api.RemoveServerRequest:
+		if req.Id == "" {
+			return badRequest("id", "The request has no server to remove")
+		}
+	case *api.GossipKeyRequest:
+		key, err := base64.StdEncoding.DecodeString(req.Key)
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			return badRequest(
+				"key",
+				"The key must be a base64 encoded 16, 24 or 32 byte key",
+			)
+		}
+	case *api.RegisterSchemaRequest:
+		if req.Subject == "" {
+			return badRequest(
+				"subject",
+				"The request has no subject to register the schema under",
+			)
+		}
+		if len(req.Definition) == 0 {
+			return badRequest("definition", "The request has no schema")
+		}
+	case *api.SetCompatibilityRequest:
+		if req.Subject == "" {
+			return badRequest(
+				"subject",
+				"The request has no subject to set the compatibility of",
+			)
+		}
+		if _, ok := api.Compatibility_name[int32(req.Compatibility)]; !ok {
+			return badRequest(
+				"compatibility",
+				"The compatibility must be NONE, BACKWARD, FORWARD or FULL",
+			)
+		}
+	}
+	return nil
+}
+
+// badRequest returns an InvalidArgument error detailing the invalid field.
+func badRequest(field, description string) error {
+	st := status.New(codes.InvalidArgument, "invalid "+field)
+	detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       field,
+			Description: description,
+		}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// validateUnaryInterceptor fails the calls with invalid requests with
+// InvalidArgument.
+func validateUnaryInterceptor(maxRecordBytes uint64) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := validate(req, maxRecordBytes); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// validateStreamInterceptor fails the streams receiving invalid requests
+// with InvalidArgument.
+func validateStreamInterceptor(
+	maxRecordBytes uint64,
+) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &validateServerStream{
+			ServerStream:   stream,
+			maxRecordBytes: maxRecordBytes,
+		})
+	}
+}
+
+// validateServerStream validates the requests the stream it wraps receives.
+type validateServerStream struct {
+	grpc.ServerStream
+	maxRecordBytes uint64
+}
+
+func (s *validateServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return validate(m, s.maxRecordBytes)
+}
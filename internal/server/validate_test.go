@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+func TestValidate(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxRecordBytes = 16
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, "missing record", status.Convert(err).Message())
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 32)},
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Equal(t, "record too large: 34 bytes, max 16", st.Message())
+	require.Len(t, st.Details(), 1)
+	badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+	require.True(t, ok)
+	require.Equal(t, "record", badRequest.FieldViolations[0].Field)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+
+	// streams fail on the first invalid record
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 32)},
+	}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	require.Equal(t, int64(defaultMaxRequestBytes), maxRequestBytes(0))
+	require.Equal(t, int64(defaultMaxRequestBytes), maxRequestBytes(1<<20))
+	require.Equal(t, int64(16<<20), maxRequestBytes(8<<20))
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// fileExporter writes spans to a file as lines of JSON.
+type fileExporter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	node string
+}
+
+// newFileExporter opens the config's file for appending, or writes to stderr
+// if it has none.
+func newFileExporter(c Config) (*fileExporter, error) {
+	e := &fileExporter{w: os.Stderr, node: c.NodeName}
+	if c.File != "" {
+		f, err := os.OpenFile(
+			c.File,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+			0644,
+		)
+		if err != nil {
+			return nil, err
+		}
+		e.w, e.file = f, f
+	}
+	return e, nil
+}
+
+// fileSpan is the JSON representation of a span.
+type fileSpan struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Node         string                 `json:"node,omitempty"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	StatusCode   int32                  `json:"status_code,omitempty"`
+	Message      string                 `json:"message,omitempty"`
+	Annotations  []string               `json:"annotations,omitempty"`
+}
+
+// ExportSpan writes the span.
+func (e *fileExporter) ExportSpan(s *trace.SpanData) {
+	span := fileSpan{
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		Name:       s.Name,
+		Node:       e.node,
+		Start:      s.StartTime,
+		End:        s.EndTime,
+		Attributes: s.Attributes,
+		StatusCode: s.Code,
+		Message:    s.Message,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	for _, a := range s.Annotations {
+		span.Annotations = append(span.Annotations, a.Message)
+	}
+	b, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.w.Write(append(b, '\n'))
+}
+
+// Close closes the file, if the exporter opened one.
+func (e *fileExporter) Close() error {
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
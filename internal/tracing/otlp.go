@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	// otlpQueueSize is the number of spans waiting to be exported past which
+	// new spans are dropped rather than slowing down requests.
+	otlpQueueSize = 2048
+	// otlpBatchSize is the number of spans sent in one export.
+	otlpBatchSize = 512
+	// otlpFlushInterval is how long spans wait for a full batch.
+	otlpFlushInterval = 5 * time.Second
+	// otlpExportTimeout bounds an export to the collector.
+	otlpExportTimeout = 10 * time.Second
+)
+
+// otlpExporter sends spans to a collector in batches with OTLP over gRPC.
+type otlpExporter struct {
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+
+	spans    chan *trace.SpanData
+	done     chan struct{}
+	conn     *grpc.ClientConn
+	client   coltracepb.TraceServiceClient
+	resource *resourcepb.Resource
+	logger   *zap.Logger
+}
+
+// newOTLPExporter connects to the config's collector and starts exporting
+// the spans it's given. The connection is made in the background, so spans
+// are dropped rather than the server failing to start if the collector's
+// down.
+func newOTLPExporter(c Config) (*otlpExporter, error) {
+	conn, err := grpc.Dial(c.OTLPEndpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	e := &otlpExporter{
+		spans:  make(chan *trace.SpanData, otlpQueueSize),
+		done:   make(chan struct{}),
+		conn:   conn,
+		client: coltracepb.NewTraceServiceClient(conn),
+		resource: &resourcepb.Resource{
+			Attributes: otlpAttributes(map[string]interface{}{
+				"service.name":        serviceName,
+				"service.instance.id": c.NodeName,
+			}),
+		},
+		logger: zap.L().Named("tracing"),
+	}
+	go e.run()
+	return e, nil
+}
+
+// ExportSpan queues the span to be exported with the next batch.
+func (e *otlpExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+		e.dropped++
+	}
+}
+
+// run exports the queued spans when a batch fills up or the flush interval
+// passes, until the queue's closed.
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []*trace.SpanData
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.export(batch)
+		batch = nil
+	}
+}
+
+// export sends the batch to the collector.
+func (e *otlpExporter) export(batch []*trace.SpanData) {
+	e.mu.Lock()
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped != 0 {
+		e.logger.Warn("dropped spans", zap.Int("spans", dropped))
+	}
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]*tracepb.Span, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, otlpSpan(s))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+	defer cancel()
+	_, err := e.client.Export(ctx, &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: e.resource,
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: serviceName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		e.logger.Error(
+			"failed to export spans",
+			zap.Error(err),
+			zap.Int("spans", len(spans)),
+		)
+	}
+}
+
+// Close exports the queued spans and closes the connection to the collector.
+func (e *otlpExporter) Close() error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mu.Unlock()
+	<-e.done
+	return e.conn.Close()
+}
+
+// otlpSpan converts the OpenCensus span to its OTLP representation.
+func otlpSpan(s *trace.SpanData) *tracepb.Span {
+	span := &tracepb.Span{
+		TraceId:           s.TraceID[:],
+		SpanId:            s.SpanID[:],
+		Name:              s.Name,
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: uint64(s.StartTime.UnixNano()),
+		EndTimeUnixNano:   uint64(s.EndTime.UnixNano()),
+		Attributes:        otlpAttributes(s.Attributes),
+		Status:            &tracepb.Status{},
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanId = s.ParentSpanID[:]
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = tracepb.Span_SPAN_KIND_SERVER
+	case trace.SpanKindClient:
+		span.Kind = tracepb.Span_SPAN_KIND_CLIENT
+	}
+	if s.Code != trace.StatusCodeOK {
+		span.Status.Code = tracepb.Status_STATUS_CODE_ERROR
+		span.Status.Message = s.Message
+	}
+	for _, a := range s.Annotations {
+		span.Events = append(span.Events, &tracepb.Span_Event{
+			TimeUnixNano: uint64(a.Time.UnixNano()),
+			Name:         a.Message,
+			Attributes:   otlpAttributes(a.Attributes),
+		})
+	}
+	return span
+}
+
+// otlpAttributes converts the attributes, sorted by key, to their OTLP
+// representation.
+func otlpAttributes(attributes map[string]interface{}) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kvs []*commonpb.KeyValue
+	for _, k := range keys {
+		value := &commonpb.AnyValue{}
+		switch v := attributes[k].(type) {
+		case string:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: v}
+		case bool:
+			value.Value = &commonpb.AnyValue_BoolValue{BoolValue: v}
+		case int64:
+			value.Value = &commonpb.AnyValue_IntValue{IntValue: v}
+		case float64:
+			value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: v}
+		default:
+			continue
+		}
+		kvs = append(kvs, &commonpb.KeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
@@ -0,0 +1,82 @@
+// Package tracing configures how the OpenCensus spans of the server, the log
+// and Raft are sampled and where they're exported.
+package tracing
+
+import (
+	"fmt"
+	"io"
+
+	"go.opencensus.io/trace"
+)
+
+// Exporters spans can be sent to.
+const (
+	// ExporterNone samples spans but doesn't export them.
+	ExporterNone = "none"
+	// ExporterOTLP sends spans to a collector with OTLP over gRPC.
+	ExporterOTLP = "otlp"
+	// ExporterFile writes spans to a file as lines of JSON.
+	ExporterFile = "file"
+)
+
+// Config describes how spans are sampled and exported.
+type Config struct {
+	// SampleRatio is the fraction of traces that are sampled, from 0 to 1.
+	SampleRatio float64
+	// Exporter is where sampled spans go, ExporterNone if empty.
+	Exporter string
+	// OTLPEndpoint is the address of the collector the OTLP exporter sends
+	// spans to, without TLS as the collector's expected to run locally.
+	OTLPEndpoint string
+	// File is the path of the file the file exporter appends spans to,
+	// stderr if empty.
+	File string
+	// NodeName identifies the server the spans come from.
+	NodeName string
+}
+
+// serviceName is the name of the service in the exported spans.
+const serviceName = "proglog"
+
+// exporter is a trace.Exporter that flushes the spans it holds on Close.
+type exporter interface {
+	trace.Exporter
+	io.Closer
+}
+
+// Setup applies the config's sampler to all new traces and registers its
+// exporter. The returned function unregisters the exporter and flushes the
+// spans it holds.
+func Setup(c Config) (func() error, error) {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return nil, fmt.Errorf(
+			"trace sample ratio %v isn't between 0 and 1",
+			c.SampleRatio,
+		)
+	}
+	var e exporter
+	var err error
+	switch c.Exporter {
+	case "", ExporterNone:
+	case ExporterOTLP:
+		e, err = newOTLPExporter(c)
+	case ExporterFile:
+		e, err = newFileExporter(c)
+	default:
+		err = fmt.Errorf("unknown trace exporter: %s", c.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	trace.ApplyConfig(trace.Config{
+		DefaultSampler: trace.ProbabilitySampler(c.SampleRatio),
+	})
+	if e == nil {
+		return func() error { return nil }, nil
+	}
+	trace.RegisterExporter(e)
+	return func() error {
+		trace.UnregisterExporter(e)
+		return e.Close()
+	}, nil
+}
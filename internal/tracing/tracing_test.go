@@ -0,0 +1,134 @@
+package tracing_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+
+	"github.com/pouriaamini/proglog/internal/tracing"
+)
+
+func TestSetup(t *testing.T) {
+	_, err := tracing.Setup(tracing.Config{SampleRatio: 2})
+	require.Error(t, err)
+	_, err = tracing.Setup(tracing.Config{Exporter: "zipkin"})
+	require.Error(t, err)
+	closeTracing, err := tracing.Setup(tracing.Config{
+		Exporter: tracing.ExporterNone,
+	})
+	require.NoError(t, err)
+	require.NoError(t, closeTracing())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	collector := &collector{}
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, collector)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	defer srv.Stop()
+
+	closeTracing, err := tracing.Setup(tracing.Config{
+		SampleRatio:  1,
+		Exporter:     tracing.ExporterOTLP,
+		OTLPEndpoint: ln.Addr().String(),
+		NodeName:     "0",
+	})
+	require.NoError(t, err)
+	parent, child := spans()
+	require.NoError(t, closeTracing())
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	require.Equal(t, 1, len(collector.requests))
+	resourceSpans := collector.requests[0].ResourceSpans[0]
+	require.Equal(t,
+		"service.instance.id",
+		resourceSpans.Resource.Attributes[0].Key,
+	)
+	require.Equal(t,
+		"0",
+		resourceSpans.Resource.Attributes[0].Value.GetStringValue(),
+	)
+	got := resourceSpans.ScopeSpans[0].Spans
+	require.Equal(t, 2, len(got))
+	// the child ends first
+	require.Equal(t, "child", got[0].Name)
+	require.Equal(t, child.TraceID[:], got[0].TraceId)
+	require.Equal(t, parent.SpanID[:], got[0].ParentSpanId)
+	require.Equal(t, "offset", got[0].Attributes[0].Key)
+	require.Equal(t, int64(1), got[0].Attributes[0].Value.GetIntValue())
+	require.Equal(t, "parent", got[1].Name)
+	require.Equal(t, tracepb.Status_STATUS_CODE_ERROR, got[1].Status.Code)
+	require.Nil(t, got[1].ParentSpanId)
+}
+
+func TestFileExporter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces.json")
+	closeTracing, err := tracing.Setup(tracing.Config{
+		SampleRatio: 1,
+		Exporter:    tracing.ExporterFile,
+		File:        file,
+	})
+	require.NoError(t, err)
+	parent, _ := spans()
+	require.NoError(t, closeTracing())
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	var got []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+		got = append(got, span)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, 2, len(got))
+	require.Equal(t, "child", got[0]["name"])
+	require.Equal(t, parent.SpanID.String(), got[0]["parent_span_id"])
+	require.Equal(t, "parent", got[1]["name"])
+}
+
+// spans records a failed parent span with a child.
+func spans() (parent, child trace.SpanContext) {
+	ctx, parentSpan := trace.StartSpan(context.Background(), "parent")
+	_, childSpan := trace.StartSpan(ctx, "child")
+	childSpan.AddAttributes(trace.Int64Attribute("offset", 1))
+	childSpan.End()
+	parentSpan.SetStatus(trace.Status{Code: trace.StatusCodeInternal})
+	parentSpan.End()
+	return parentSpan.SpanContext(), childSpan.SpanContext()
+}
+
+// collector records the spans exported to it.
+type collector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	mu       sync.Mutex
+	requests []*coltracepb.ExportTraceServiceRequest
+}
+
+func (c *collector) Export(
+	ctx context.Context,
+	req *coltracepb.ExportTraceServiceRequest,
+) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
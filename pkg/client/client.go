@@ -0,0 +1,156 @@
+// Package client provides high-level clients of the log. They discover the
+// cluster's servers through the one they're given, send their requests to
+// the leader or the followers as the loadbalance picker routes them, and
+// retry the requests that fail while the cluster changes.
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+	"github.com/pouriaamini/proglog/internal/loadbalance"
+)
+
+// conn is a client's connection to the cluster of the server at the
+// address, resolving its servers and their roles with the loadbalance
+// resolver.
+type conn struct {
+	addr string
+	opts []grpc.DialOption
+
+	mu   sync.Mutex
+	conn *grpc.ClientConn
+}
+
+// dial connects to the cluster of the server at the address.
+func dial(addr string, opts []grpc.DialOption) (*conn, error) {
+	c := &conn{addr: addr, opts: opts}
+	var err error
+	if c.conn, err = c.dial(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) dial() (*grpc.ClientConn, error) {
+	target := fmt.Sprintf("%s:///%s", loadbalance.Name, c.addr)
+	return grpc.Dial(target, c.opts...)
+}
+
+// client returns a client of the current connection.
+func (c *conn) client() api.LogClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return api.NewLogClient(c.conn)
+}
+
+// reconnect connects to the cluster again, resolving its servers and which
+// of them is the leader.
+func (c *conn) reconnect() {
+	conn, err := c.dial()
+	if err != nil {
+		// the current connection's retried until the next error
+		return
+	}
+	c.mu.Lock()
+	old := c.conn
+	c.conn = conn
+	c.mu.Unlock()
+	_ = old.Close()
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// retriable returns whether a request that failed with the error may succeed
+// if it's retried: the servers were unavailable, including the ones that
+// weren't the leader, throttled it, or it timed out.
+func retriable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable,
+		codes.ResourceExhausted,
+		codes.Aborted,
+		codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// notLeader returns whether the error is of a server that wasn't the leader,
+// so the client has to resolve the cluster again to find it.
+func notLeader(err error) bool {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok &&
+			info.Reason == api.NotLeaderReason {
+			return true
+		}
+	}
+	return false
+}
+
+// offsetOutOfRange returns the ErrOffsetOutOfRange the error is of, from its
+// error info detail.
+func offsetOutOfRange(err error) (api.ErrOffsetOutOfRange, bool) {
+	var e api.ErrOffsetOutOfRange
+	for _, detail := range status.Convert(err).Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != api.OffsetOutOfRangeReason {
+			continue
+		}
+		for key, off := range map[string]*uint64{
+			"offset": &e.Offset,
+			"lowest": &e.Lowest,
+			"next":   &e.Next,
+		} {
+			v, err := strconv.ParseUint(info.Metadata[key], 10, 64)
+			if err != nil {
+				return e, false
+			}
+			*off = v
+		}
+		return e, true
+	}
+	return e, false
+}
+
+// backoff doubles the delays between the retries of a request, from min up
+// to max, waiting at least as long as the servers ask to.
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// delay returns how long to wait before retrying the request that failed
+// with the error.
+func (b *backoff) delay(err error) time.Duration {
+	if b.next == 0 {
+		b.next = b.min
+	}
+	d := b.next
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok &&
+			info.RetryDelay.AsDuration() > d {
+			d = info.RetryDelay.AsDuration()
+		}
+	}
+	return d
+}
+
+// reset restarts the delays from min, once a request succeeded.
+func (b *backoff) reset() {
+	b.next = 0
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// testCluster is a cluster of servers appending the records produced to the
+// leader to a shared log and streaming them to consumers, which may fail the
+// streams as a cluster whose servers are down would.
+type testCluster struct {
+	addrs []string
+
+	mu       sync.Mutex
+	leader   int
+	failures int
+	lowest   uint64
+	records  []*api.Record
+	opened   map[int]int
+	// truncated counts the consume streams from removed offsets
+	truncated int
+}
+
+func newTestCluster(t *testing.T, servers int) *testCluster {
+	t.Helper()
+	c := &testCluster{opened: make(map[int]int)}
+	for i := 0; i < servers; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		c.addrs = append(c.addrs, l.Addr().String())
+		srv := grpc.NewServer()
+		api.RegisterLogServer(srv, &testServer{cluster: c, id: i})
+		go func() {
+			_ = srv.Serve(l)
+		}()
+		t.Cleanup(srv.Stop)
+	}
+	return c
+}
+
+// fail fails the next n produce streams, or the consume streams about to
+// send their next record, as unavailable.
+func (c *testCluster) fail(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = n
+}
+
+// elect makes the server with the ID the leader.
+func (c *testCluster) elect(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = id
+}
+
+// streams returns how many produce streams the server's leader took.
+func (c *testCluster) streams(id int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened[id]
+}
+
+// append appends records of the values to the log.
+func (c *testCluster) append(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range values {
+		c.records = append(c.records, &api.Record{
+			Value:  []byte(value),
+			Offset: uint64(len(c.records)),
+		})
+	}
+}
+
+// truncate removes the records before the lowest offset from the log, as
+// retention would.
+func (c *testCluster) truncate(lowest uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lowest = lowest
+}
+
+// truncatedStreams returns how many consume streams started from removed
+// offsets.
+func (c *testCluster) truncatedStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.truncated
+}
+
+// values returns the values of the records in the log.
+func (c *testCluster) values() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var values []string
+	for _, record := range c.records {
+		values = append(values, string(record.Value))
+	}
+	return values
+}
+
+// testServer is a server of a testCluster.
+type testServer struct {
+	api.UnimplementedLogServer
+	cluster *testCluster
+	id      int
+}
+
+func (s *testServer) GetServers(
+	context.Context,
+	*api.GetServersRequest,
+) (*api.GetServersResponse, error) {
+	c := s.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var servers []*api.Server
+	for i, addr := range c.addrs {
+		servers = append(servers, &api.Server{
+			RpcAddr:  addr,
+			IsLeader: i == c.leader,
+		})
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *testServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	c := s.cluster
+	c.mu.Lock()
+	switch {
+	case c.leader != s.id:
+		c.mu.Unlock()
+		return api.ErrNotLeader{Leader: c.addrs[c.leader]}
+	case c.failures > 0:
+		c.failures--
+		c.mu.Unlock()
+		return status.Error(codes.Unavailable, "server down")
+	}
+	c.opened[s.id]++
+	c.mu.Unlock()
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if string(req.Record.Value) == "invalid" {
+			return status.Error(codes.InvalidArgument, "invalid record")
+		}
+		c.mu.Lock()
+		offset := uint64(len(c.records))
+		c.records = append(c.records, req.Record)
+		c.mu.Unlock()
+		if err = stream.Send(&api.ProduceResponse{Offset: offset}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *testServer) ConsumeStream(
+	req *api.ConsumeRequest,
+	stream api.Log_ConsumeStreamServer,
+) error {
+	c := s.cluster
+	for off := req.Offset; ; {
+		c.mu.Lock()
+		var record *api.Record
+		switch {
+		case off < c.lowest:
+			c.truncated++
+			err := api.ErrOffsetOutOfRange{
+				Offset: off,
+				Lowest: c.lowest,
+				Next:   uint64(len(c.records)),
+			}
+			c.mu.Unlock()
+			return err
+		case off < uint64(len(c.records)) && c.failures > 0:
+			c.failures--
+			c.mu.Unlock()
+			return status.Error(codes.Unavailable, "server down")
+		case off < uint64(len(c.records)):
+			record = c.records[off]
+		}
+		c.mu.Unlock()
+		if record == nil {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-time.After(time.Millisecond):
+			}
+			continue
+		}
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+		off++
+	}
+}
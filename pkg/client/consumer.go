@@ -0,0 +1,300 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// ErrNoOffsetStore is returned when records are committed with a consumer
+// without an offset store.
+var ErrNoOffsetStore = errors.New("client: consumer has no offset store")
+
+// OffsetReset is where a consumer resumes once retention removed the records
+// at its offset.
+type OffsetReset int
+
+const (
+	// OffsetResetNone stops the consumer with the ErrOffsetOutOfRange.
+	OffsetResetNone OffsetReset = iota
+	// OffsetResetEarliest resumes at the log's lowest offset, consuming the
+	// records retention kept.
+	OffsetResetEarliest
+	// OffsetResetLatest resumes at the log's next offset, consuming only the
+	// records appended after.
+	OffsetResetLatest
+)
+
+// OffsetStore checkpoints the offset a consumer resumes from, in a local
+// file like FileOffsetStore or wherever the application keeps its state.
+type OffsetStore interface {
+	// Load returns the checkpointed offset, or false if there's none.
+	Load() (uint64, bool, error)
+	// Store checkpoints the offset.
+	Store(uint64) error
+}
+
+// ConsumerConfig configures a Consumer. Its zero values are replaced with
+// the defaults.
+type ConsumerConfig struct {
+	// Addr is the RPC address of a server of the cluster, which the
+	// consumer discovers the others through.
+	Addr string
+	// DialOptions are the options of the consumer's connection, which must
+	// have its transport credentials.
+	DialOptions []grpc.DialOption
+	// Offset is the offset the consumer starts from, unless its OffsetStore
+	// has one checkpointed.
+	Offset uint64
+	// OffsetStore, if it's not nil, checkpoints the offsets of the records
+	// committed, and the consumer starts from its offset.
+	OffsetStore OffsetStore
+	// OffsetReset is where the consumer resumes once retention removed the
+	// records at its offset, OffsetResetNone by default.
+	OffsetReset OffsetReset
+	// BufferRecords is how many records the consumer reads ahead of the
+	// ones received from Records, 100 by default. It stops reading once
+	// they're buffered.
+	BufferRecords int
+	// MaxRetries is how many times in a row a broken stream is opened again
+	// before the consumer fails, 10 by default. The retries wait from
+	// RetryBackoff, 100ms by default, doubling up to MaxRetryBackoff, 5s by
+	// default, or as long as the servers ask to.
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+func (c *ConsumerConfig) setDefaults() {
+	if c.BufferRecords == 0 {
+		c.BufferRecords = 100
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 10
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = 5 * time.Second
+	}
+}
+
+// Consumer streams the records of the log in order from an offset, tracking
+// the offset of the next record. When its stream breaks, it resolves the
+// cluster again and resumes from that offset on another server.
+type Consumer struct {
+	config ConsumerConfig
+	conn   *conn
+
+	// next is the offset of the next record, only used by run
+	next    uint64
+	records chan *api.Record
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewConsumer connects to the cluster of the config's server and starts
+// consuming from the offset of the config or its offset store.
+func NewConsumer(config ConsumerConfig) (*Consumer, error) {
+	config.setDefaults()
+	next := config.Offset
+	if config.OffsetStore != nil {
+		off, ok, err := config.OffsetStore.Load()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			next = off
+		}
+	}
+	conn, err := dial(config.Addr, config.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Consumer{
+		config:  config,
+		conn:    conn,
+		next:    next,
+		records: make(chan *api.Record, config.BufferRecords),
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	go c.run(ctx)
+	return c, nil
+}
+
+// Records returns the channel of the records consumed, in order. It's closed
+// once the consumer's closed or has failed with the error Err returns.
+func (c *Consumer) Records() <-chan *api.Record {
+	return c.records
+}
+
+// Err returns the error the consumer failed with, such as an
+// ErrOffsetOutOfRange with OffsetResetNone, or nil.
+func (c *Consumer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Commit checkpoints the record as processed with the offset store, so a
+// consumer of the store resumes after it.
+func (c *Consumer) Commit(record *api.Record) error {
+	if c.config.OffsetStore == nil {
+		return ErrNoOffsetStore
+	}
+	return c.config.OffsetStore.Store(record.Offset + 1)
+}
+
+// Close stops consuming, dropping the records buffered but not received,
+// and closes the consumer's connection.
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		<-c.stopped
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+// run consumes the records until the consumer's closed or fails, opening the
+// stream again when it breaks with a retriable error and resetting the
+// offset as configured once retention removed its records.
+func (c *Consumer) run(ctx context.Context) {
+	defer close(c.stopped)
+	defer close(c.records)
+	b := backoff{min: c.config.RetryBackoff, max: c.config.MaxRetryBackoff}
+	retries := 0
+	for {
+		n, err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if n > 0 {
+			retries = 0
+			b.reset()
+		}
+		outOfRange, ok := offsetOutOfRange(err)
+		if ok && outOfRange.Truncated() {
+			switch c.config.OffsetReset {
+			case OffsetResetEarliest:
+				c.next = outOfRange.Lowest
+				continue
+			case OffsetResetLatest:
+				c.next = outOfRange.Next
+				continue
+			}
+			err = outOfRange
+		}
+		// the servers end the streams they stop serving
+		if !errors.Is(err, io.EOF) && !retriable(err) ||
+			retries == c.config.MaxRetries {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			return
+		}
+		retries++
+		c.conn.reconnect()
+		select {
+		case <-time.After(b.delay(err)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// consume streams the records from the next offset into the records channel,
+// waiting for them to be buffered, until the stream breaks, returning how
+// many it received.
+func (c *Consumer) consume(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.conn.client().ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Offset: c.next},
+	)
+	if err != nil {
+		return 0, err
+	}
+	for n := 0; ; n++ {
+		res, err := stream.Recv()
+		if err != nil {
+			return n, err
+		}
+		select {
+		case c.records <- res.Record:
+			c.next = res.Record.Offset + 1
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+}
+
+// FileOffsetStore checkpoints offsets in a local file. It replaces the file
+// with each offset, so a crash while storing one leaves the previous.
+type FileOffsetStore struct {
+	path string
+}
+
+var _ OffsetStore = (*FileOffsetStore)(nil)
+
+// NewFileOffsetStore returns an offset store checkpointing to the file at
+// the path.
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+// Load returns the offset in the file, or false if it doesn't exist yet.
+func (s *FileOffsetStore) Load() (uint64, bool, error) {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	off, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return off, true, nil
+}
+
+// Store writes the offset to a temporary file, syncs it, and renames it to
+// the store's file.
+func (s *FileOffsetStore) Store(off uint64) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatUint(off, 10) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+func TestConsumer(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	cluster.append("a", "b", "c")
+	store := NewFileOffsetStore(filepath.Join(t.TempDir(), "offset"))
+	consumer := newConsumer(t, cluster, ConsumerConfig{OffsetStore: store})
+
+	for i, value := range []string{"a", "b", "c"} {
+		record := receive(t, consumer)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, value, string(record.Value))
+		if value == "b" {
+			require.NoError(t, consumer.Commit(record))
+		}
+	}
+
+	// the consumer resumes from the next offset once its stream breaks
+	cluster.fail(1)
+	cluster.append("d")
+	record := receive(t, consumer)
+	require.Equal(t, uint64(3), record.Offset)
+	require.Equal(t, "d", string(record.Value))
+	require.NoError(t, consumer.Close())
+	require.NoError(t, consumer.Err())
+
+	// a consumer of the store resumes after the committed record
+	off, ok, err := store.Load()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), off)
+	consumer = newConsumer(t, cluster, ConsumerConfig{OffsetStore: store})
+	require.Equal(t, "c", string(receive(t, consumer).Value))
+
+	consumer = newConsumer(t, cluster, ConsumerConfig{Offset: 1})
+	require.ErrorIs(t, consumer.Commit(&api.Record{}), ErrNoOffsetStore)
+}
+
+func TestConsumerOffsetReset(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	cluster.append("a", "b", "c", "d")
+	cluster.truncate(2)
+
+	consumer := newConsumer(t, cluster, ConsumerConfig{})
+	_, ok := <-consumer.Records()
+	require.False(t, ok)
+	var outOfRange api.ErrOffsetOutOfRange
+	require.ErrorAs(t, consumer.Err(), &outOfRange)
+	require.True(t, outOfRange.Truncated())
+	require.Equal(t, uint64(2), outOfRange.Lowest)
+
+	consumer = newConsumer(t, cluster, ConsumerConfig{
+		OffsetReset: OffsetResetEarliest,
+	})
+	require.Equal(t, uint64(2), receive(t, consumer).Offset)
+
+	// the consumer skips to the records appended once it's reset
+	consumer = newConsumer(t, cluster, ConsumerConfig{
+		OffsetReset: OffsetResetLatest,
+	})
+	require.Eventually(t, func() bool {
+		return cluster.truncatedStreams() == 3
+	}, 5*time.Second, time.Millisecond)
+	cluster.append("e")
+	require.Equal(t, uint64(4), receive(t, consumer).Offset)
+}
+
+// newConsumer returns a consumer of the cluster, through its first server,
+// retrying without waiting long.
+func newConsumer(
+	t *testing.T,
+	cluster *testCluster,
+	config ConsumerConfig,
+) *Consumer {
+	t.Helper()
+	config.Addr = cluster.addrs[0]
+	config.DialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	config.RetryBackoff = time.Millisecond
+	consumer, err := NewConsumer(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = consumer.Close() })
+	return consumer
+}
+
+// receive returns the consumer's next record.
+func receive(t *testing.T, consumer *Consumer) *api.Record {
+	t.Helper()
+	select {
+	case record, ok := <-consumer.Records():
+		require.True(t, ok, "consumer failed: %v", consumer.Err())
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record received")
+		return nil
+	}
+}
@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+// ErrClosed is returned when records are produced with a closed producer.
+var ErrClosed = errors.New("client: producer closed")
+
+// ProducerConfig configures a Producer. Its zero values are replaced with
+// the defaults.
+type ProducerConfig struct {
+	// Addr is the RPC address of a server of the cluster, which the
+	// producer discovers the others and the leader through.
+	Addr string
+	// DialOptions are the options of the producer's connection, which must
+	// have its transport credentials.
+	DialOptions []grpc.DialOption
+	// Linger is how long a batch waits for more records before it's sent,
+	// 5ms by default.
+	Linger time.Duration
+	// BatchRecords and BatchBytes send a batch as soon as it has as many
+	// records or bytes, 500 and 1 MiB by default.
+	BatchRecords int
+	BatchBytes   int
+	// BufferRecords is how many records may wait to be sent before Produce
+	// blocks, 10000 by default.
+	BufferRecords int
+	// MaxRetries is how many times in a row the records of a batch are
+	// retried before they fail, 10 by default. The retries wait from
+	// RetryBackoff, 100ms by default, doubling up to MaxRetryBackoff, 5s by
+	// default, or as long as the servers ask to.
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// RequestTimeout bounds each attempt to send a batch, 10s by default.
+	RequestTimeout time.Duration
+}
+
+func (c *ProducerConfig) setDefaults() {
+	if c.Linger == 0 {
+		c.Linger = 5 * time.Millisecond
+	}
+	if c.BatchRecords == 0 {
+		c.BatchRecords = 500
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = 1 << 20
+	}
+	if c.BufferRecords == 0 {
+		c.BufferRecords = 10000
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 10
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = 5 * time.Second
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = 10 * time.Second
+	}
+}
+
+// Producer buffers the records produced with it and sends them to the leader
+// in batches, one at a time so they're appended in the order they were
+// produced. The records of batches that fail with retriable errors are
+// retried, after resolving the cluster again when the server wasn't the
+// leader.
+//
+// The servers don't deduplicate the records they append, so a record whose
+// batch was appended but whose response was lost is appended again when
+// it's retried: records are delivered at least once.
+type Producer struct {
+	config ProducerConfig
+
+	conn *conn
+
+	// closeMu guards closed, so no record is buffered once the producer's
+	// closing
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu      sync.Mutex
+	pending int
+	drained chan struct{}
+
+	records chan *Result
+	flushes chan struct{}
+	stopped chan struct{}
+}
+
+// NewProducer connects to the cluster of the config's server and starts
+// sending the records produced with the returned producer.
+func NewProducer(config ProducerConfig) (*Producer, error) {
+	config.setDefaults()
+	conn, err := dial(config.Addr, config.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+	p := &Producer{
+		config:  config,
+		conn:    conn,
+		drained: make(chan struct{}),
+		records: make(chan *Result, config.BufferRecords),
+		flushes: make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	close(p.drained)
+	go p.run()
+	return p, nil
+}
+
+// Result is the result of a produced record, the offset it was appended at
+// or the error it failed with, once its batch is sent.
+type Result struct {
+	record   *api.Record
+	callback func(uint64, error)
+	done     chan struct{}
+	offset   uint64
+	err      error
+}
+
+// Done is closed once the record is appended or has failed.
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits for the record to be appended and returns its offset, or the
+// error it failed with.
+func (r *Result) Wait(ctx context.Context) (uint64, error) {
+	select {
+	case <-r.done:
+		return r.offset, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Produce buffers the record to be sent in a batch, blocking while the
+// buffer is full. The callback, if it's not nil, is called with the record's
+// offset or error once its batch is sent, from the producer's goroutine, so
+// it mustn't block.
+func (p *Producer) Produce(
+	ctx context.Context,
+	record *api.Record,
+	callback func(offset uint64, err error),
+) (*Result, error) {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+	r := &Result{
+		record:   record,
+		callback: callback,
+		done:     make(chan struct{}),
+	}
+	p.mu.Lock()
+	if p.pending == 0 {
+		p.drained = make(chan struct{})
+	}
+	p.pending++
+	p.mu.Unlock()
+	select {
+	case p.records <- r:
+		return r, nil
+	case <-ctx.Done():
+		p.complete()
+		return nil, ctx.Err()
+	}
+}
+
+// ProduceSync produces the record and waits for it to be appended.
+func (p *Producer) ProduceSync(
+	ctx context.Context,
+	record *api.Record,
+) (uint64, error) {
+	r, err := p.Produce(ctx, record, nil)
+	if err != nil {
+		return 0, err
+	}
+	p.flush()
+	return r.Wait(ctx)
+}
+
+// Flush sends the buffered records without waiting for their batches to
+// fill, and waits for the records produced before it to be appended or to
+// fail.
+func (p *Producer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	drained := p.drained
+	p.mu.Unlock()
+	p.flush()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush stops the batch being filled from waiting for more records.
+func (p *Producer) flush() {
+	select {
+	case p.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// Close sends the buffered records, waits for them to be appended or to
+// fail, and closes the producer's connection.
+func (p *Producer) Close() error {
+	p.closeMu.Lock()
+	if p.closed {
+		p.closeMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.closeMu.Unlock()
+	close(p.records)
+	<-p.stopped
+	return p.conn.Close()
+}
+
+// run sends the batches of buffered records until the producer's closed.
+// Once flushed, it sends the batches without lingering until it has read
+// every record buffered, so the flush covers the records produced before it
+// even if they're read after a batch that was already filling.
+func (p *Producer) run() {
+	defer close(p.stopped)
+	flushing := false
+	for {
+		r, ok := <-p.records
+		if !ok {
+			return
+		}
+		batch := []*Result{r}
+		size := proto.Size(r.record)
+		linger := time.NewTimer(p.config.Linger)
+	fill:
+		for len(batch) < p.config.BatchRecords && size < p.config.BatchBytes {
+			if flushing && len(p.records) == 0 {
+				break
+			}
+			select {
+			case r, ok := <-p.records:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, r)
+				size += proto.Size(r.record)
+			case <-linger.C:
+				break fill
+			case <-p.flushes:
+				flushing = true
+			}
+		}
+		linger.Stop()
+		if len(p.records) == 0 {
+			flushing = false
+		}
+		p.send(batch)
+	}
+}
+
+// send sends the batch, retrying the records that fail with retriable
+// errors, until each of them is appended or has failed.
+func (p *Producer) send(batch []*Result) {
+	b := backoff{min: p.config.RetryBackoff, max: p.config.MaxRetryBackoff}
+	retries := 0
+	for len(batch) > 0 {
+		n, err := p.produce(batch)
+		for _, r := range batch[:n] {
+			p.finish(r, r.offset, nil)
+		}
+		batch = batch[n:]
+		if n > 0 {
+			retries = 0
+			b.reset()
+		}
+		switch {
+		case err == nil:
+		case status.Code(err) == codes.InvalidArgument:
+			// the record's invalid, the ones after it may not be
+			p.finish(batch[0], 0, err)
+			batch = batch[1:]
+		case !retriable(err) || retries == p.config.MaxRetries:
+			for _, r := range batch {
+				p.finish(r, 0, err)
+			}
+			return
+		default:
+			retries++
+			if notLeader(err) {
+				p.conn.reconnect()
+			}
+			time.Sleep(b.delay(err))
+		}
+	}
+}
+
+// produce sends the batch's records on a stream, setting the offsets of the
+// ones appended before it failed and returning how many were.
+func (p *Producer) produce(batch []*Result) (int, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		p.config.RequestTimeout,
+	)
+	defer cancel()
+	stream, err := p.conn.client().ProduceStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// the responses are read as the records are sent, so neither side
+	// waits for the other to read
+	go func() {
+		for _, r := range batch {
+			err := stream.Send(&api.ProduceRequest{Record: r.record})
+			if err != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+	for i, r := range batch {
+		res, err := stream.Recv()
+		if err != nil {
+			return i, err
+		}
+		r.offset = res.Offset
+	}
+	return len(batch), nil
+}
+
+// finish sets the record's result and calls its callback.
+func (p *Producer) finish(r *Result, offset uint64, err error) {
+	r.offset, r.err = offset, err
+	close(r.done)
+	if r.callback != nil {
+		r.callback(offset, err)
+	}
+	p.complete()
+}
+
+// complete counts a record out of the pending ones, and signals the flushes
+// waiting for them once there are none.
+func (p *Producer) complete() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending--; p.pending == 0 {
+		close(p.drained)
+	}
+}
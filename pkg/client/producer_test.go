@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/pouriaamini/proglog/api/v1"
+)
+
+func TestProducer(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	producer := newProducer(t, cluster, ProducerConfig{
+		Linger: time.Hour,
+	})
+	ctx := context.Background()
+
+	// the records wait for their batch until they're flushed, and are
+	// appended in order
+	var results []*Result
+	var offsets []uint64
+	for _, value := range []string{"a", "b", "c"} {
+		r, err := producer.Produce(
+			ctx,
+			&api.Record{Value: []byte(value)},
+			func(offset uint64, err error) {
+				require.NoError(t, err)
+				offsets = append(offsets, offset)
+			},
+		)
+		require.NoError(t, err)
+		results = append(results, r)
+	}
+	select {
+	case <-results[0].Done():
+		t.Fatal("record sent before its batch was full or flushed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, producer.Flush(ctx))
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+	offset, err := results[2].Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	require.Equal(t, 1, cluster.streams(0))
+
+	// an invalid record fails alone
+	_, err = producer.Produce(ctx, &api.Record{Value: []byte("d")}, nil)
+	require.NoError(t, err)
+	invalid, err := producer.Produce(
+		ctx,
+		&api.Record{Value: []byte("invalid")},
+		nil,
+	)
+	require.NoError(t, err)
+	offset, err = producer.ProduceSync(ctx, &api.Record{Value: []byte("e")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), offset)
+	_, err = invalid.Wait(ctx)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, cluster.values())
+
+	require.NoError(t, producer.Close())
+	_, err = producer.Produce(ctx, &api.Record{Value: []byte("f")}, nil)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestProducerRetries(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	producer := newProducer(t, cluster, ProducerConfig{MaxRetries: 2})
+	ctx := context.Background()
+
+	cluster.fail(2)
+	offset, err := producer.ProduceSync(ctx, &api.Record{Value: []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	cluster.fail(3)
+	_, err = producer.ProduceSync(ctx, &api.Record{Value: []byte("b")})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, []string{"a"}, cluster.values())
+}
+
+func TestProducerFailover(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	producer := newProducer(t, cluster, ProducerConfig{})
+	ctx := context.Background()
+
+	_, err := producer.ProduceSync(ctx, &api.Record{Value: []byte("a")})
+	require.NoError(t, err)
+
+	// the old leader turns the records away, and the producer resolves the
+	// cluster again to find the new one
+	cluster.elect(1)
+	offset, err := producer.ProduceSync(ctx, &api.Record{Value: []byte("b")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	require.Equal(t, 1, cluster.streams(1))
+	require.Equal(t, []string{"a", "b"}, cluster.values())
+}
+
+// newProducer returns a producer of the cluster, through its first server,
+// retrying without waiting long.
+func newProducer(
+	t *testing.T,
+	cluster *testCluster,
+	config ProducerConfig,
+) *Producer {
+	t.Helper()
+	config.Addr = cluster.addrs[0]
+	config.DialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	config.RetryBackoff = time.Millisecond
+	producer, err := NewProducer(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = producer.Close() })
+	return producer
+}